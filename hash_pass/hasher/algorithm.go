@@ -0,0 +1,75 @@
+/*********************************************************
+File: algorithm.go
+Contents: Pluggable algorithms producing the plain sha512 output format
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"sync"
+)
+
+const (
+	// Algorithm used for the plain format when none is selected
+	AlgorithmSHA512 = "sha512"
+)
+
+// Produces the encoded hash of a password.  Implementations must be safe
+// for concurrent use.
+type Hasher interface {
+	Hash(password, salt []byte) (string, error)
+}
+
+// Adapts an ordinary function to a Hasher
+type HasherFunc func(password, salt []byte) (string, error)
+
+// SHA-512 of the password followed by the salt, base64 encoded.  With no
+// salt this is the value SHA512 returns.
+type SHA512Hasher struct{}
+
+var (
+	// Algorithms by name, guarded by mtxHashers
+	hashers = map[string]Hasher{
+		AlgorithmSHA512: SHA512Hasher{},
+	}
+	mtxHashers sync.RWMutex
+)
+
+func (f HasherFunc) Hash(password, salt []byte) (string, error) {
+	return f(password, salt)
+}
+
+func (SHA512Hasher) Hash(password, salt []byte) (string, error) {
+	h := sha512.New()
+	h.Write(password)
+	h.Write(salt)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+/* method Register()
+Make `h` selectable as algorithm `name`, replacing any algorithm already
+registered under that name.  Typically called from an init function.
+*/
+func Register(name string, h Hasher) {
+	if h == nil {
+		panic("hasher: Register of nil Hasher for " + name)
+	}
+	mtxHashers.Lock()
+	hashers[name] = h
+	mtxHashers.Unlock()
+}
+
+/* method Lookup()
+Return the algorithm registered as `name`, AlgorithmSHA512 when it is empty
+*/
+func Lookup(name string) (Hasher, bool) {
+	if len(name) == 0 {
+		name = AlgorithmSHA512
+	}
+	mtxHashers.RLock()
+	defer mtxHashers.RUnlock()
+	h, ok := hashers[name]
+	return h, ok
+}
@@ -0,0 +1,120 @@
+/*********************************************************
+File: argon2.go
+Contents: Argon2id as an algorithm for the plain output format, as PHC strings
+*********************************************************/
+
+package hasher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+
+	argon2Prefix = "$argon2id$"
+	// Bytes of random salt and of derived key
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+
+	// OWASP's minimum recommendation: 19 MiB, 2 passes, 1 lane
+	DefaultArgon2Memory      = 19 * 1024
+	DefaultArgon2Iterations  = 2
+	DefaultArgon2Parallelism = 1
+
+	// Most memory in KiB and passes accepted, so a single hash can't
+	// exhaust the host
+	MaxArgon2Memory     = 4 * 1024 * 1024
+	MaxArgon2Iterations = 100
+)
+
+// Argon2id with the given cost, the defaults for fields left at 0.  A fresh
+// random salt is used when Hash is passed none.
+type Argon2idHasher struct {
+	// Memory in KiB
+	Memory uint32
+	// Passes over the memory
+	Iterations uint32
+	// Lanes, and threads computing them
+	Parallelism uint8
+}
+
+func init() {
+	Register(AlgorithmArgon2id, Argon2idHasher{})
+}
+
+/* method Valid()
+Report whether the parameters, after defaults are applied, are in range
+*/
+func (a Argon2idHasher) Valid() bool {
+	a = a.withDefaults()
+	return a.Iterations <= MaxArgon2Iterations && a.Memory <= MaxArgon2Memory &&
+		a.Memory >= 8*uint32(a.Parallelism)
+}
+
+func (a Argon2idHasher) withDefaults() Argon2idHasher {
+	if a.Memory == 0 {
+		a.Memory = DefaultArgon2Memory
+	}
+	if a.Iterations == 0 {
+		a.Iterations = DefaultArgon2Iterations
+	}
+	if a.Parallelism == 0 {
+		a.Parallelism = DefaultArgon2Parallelism
+	}
+	return a
+}
+
+/* method Hash()
+Return the PHC string
+$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+*/
+func (a Argon2idHasher) Hash(password, salt []byte) (string, error) {
+	if !a.Valid() {
+		return "", ErrRounds
+	}
+	a = a.withDefaults()
+	if len(salt) == 0 {
+		var err error
+		if salt, err = RandomSalt(argon2SaltSize); err != nil {
+			return "", err
+		}
+	}
+	return a.encode(password, salt, argon2KeySize), nil
+}
+
+func (a Argon2idHasher) encode(password, salt []byte, keySize uint32) string {
+	key := argon2.IDKey(password, salt, a.Iterations, a.Memory, a.Parallelism, keySize)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		a.Memory, a.Iterations, a.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+/* method verifyArgon2id()
+Recompute a PHC string for `pword` with the parameters and salt of `encoded`
+*/
+func verifyArgon2id(pword string, encoded string) (string, error) {
+	parts := strings.Split(encoded[len(argon2Prefix):], "$")
+	if len(parts) != 4 || parts[0] != fmt.Sprintf("v=%d", argon2.Version) {
+		return "", ErrUnrecognized
+	}
+	var a Argon2idHasher
+	_, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &a.Memory, &a.Iterations, &a.Parallelism)
+	if err != nil || a.Memory == 0 || a.Iterations == 0 || a.Parallelism == 0 || !a.Valid() {
+		return "", ErrUnrecognized
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrUnrecognized
+	}
+	key, err := b64.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return "", ErrUnrecognized
+	}
+	return a.encode([]byte(pword), salt, uint32(len(key))), nil
+}
@@ -0,0 +1,43 @@
+/*********************************************************
+File: bcrypt.go
+Contents: bcrypt as an algorithm for the plain output format
+*********************************************************/
+
+package hasher
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmBcrypt = "bcrypt"
+
+	// Range of bcrypt costs, each step doubling the work
+	MinBcryptCost     = bcrypt.MinCost
+	MaxBcryptCost     = bcrypt.MaxCost
+	DefaultBcryptCost = bcrypt.DefaultCost
+)
+
+// bcrypt at cost Cost, DefaultBcryptCost when 0.  bcrypt makes its own
+// salt, so the one passed to Hash is not used.
+type BcryptHasher struct {
+	Cost int
+}
+
+func init() {
+	Register(AlgorithmBcrypt, BcryptHasher{})
+}
+
+func (b BcryptHasher) Hash(password, salt []byte) (string, error) {
+	cost := b.Cost
+	if cost == 0 {
+		cost = DefaultBcryptCost
+	}
+	sum, err := bcrypt.GenerateFromPassword(password, cost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", ErrPassword
+	}
+	return string(sum), err
+}
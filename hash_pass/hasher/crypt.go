@@ -0,0 +1,262 @@
+/*********************************************************
+File: crypt.go
+Contents: crypt(3) formats, glibc SHA-512 crypt and Apache APR1
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha512"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Alphabet used by crypt(3) for salts and encoded hashes
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// Rounds of glibc SHA-512 crypt without an explicit rounds= parameter
+	sha512CryptRounds = 5000
+	// Longest salt used by SHA-512 crypt and APR1, longer salts are truncated
+	sha512CryptSaltSize = 16
+	apr1SaltSize        = 8
+
+	apr1Magic = "$apr1$"
+)
+
+// Order in which SHA-512 crypt encodes the bytes of the final digest, three at a time
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+/* method RandomSalt()
+Return `n` random bytes
+*/
+func RandomSalt(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/* method CryptSalt()
+Return a random salt of `n` characters from the crypt(3) alphabet
+*/
+func CryptSalt(n int) (string, error) {
+	b, err := RandomSalt(n)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b), nil
+}
+
+/* method cryptEncode()
+Append the crypt(3) encoding of the 24 bits in b2, b1, b0, `n` characters
+least significant first
+*/
+func cryptEncode(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+/* method SHA512Crypt()
+glibc SHA-512 crypt ($6$), as specified by Ulrich Drepper's "Unix crypt
+using SHA-256 and SHA-512".  A non-zero `rounds` is written into the
+result as rounds=N, as glibc does when it is given one.
+*/
+func SHA512Crypt(pword string, salt string, rounds int) string {
+	if len(salt) > sha512CryptSaltSize {
+		salt = salt[:sha512CryptSaltSize]
+	}
+	pw, s := []byte(pword), []byte(salt)
+
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(s)
+	b.Write(pw)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(s)
+	cryptRepeat(a, sumB, len(pw))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(pw) {
+		dp.Write(pw)
+	}
+	p := cryptFill(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write(s)
+	}
+	sp := cryptFill(ds.Sum(nil), len(s))
+
+	n := rounds
+	if n == 0 {
+		n = sha512CryptRounds
+	}
+	for i := range n {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sumA)
+		}
+		if i%3 != 0 {
+			c.Write(sp)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sumA)
+		} else {
+			c.Write(p)
+		}
+		sumA = c.Sum(nil)
+	}
+
+	out := []byte("$6$")
+	if rounds != 0 {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt+"$"...)
+	for _, t := range sha512CryptOrder {
+		out = cryptEncode(out, sumA[t[0]], sumA[t[1]], sumA[t[2]], 4)
+	}
+	out = cryptEncode(out, 0, 0, sumA[63], 2)
+	return string(out)
+}
+
+/* method verifySHA512Crypt()
+Recompute a $6$ value for `pword` with the salt and rounds of `encoded`
+*/
+func verifySHA512Crypt(pword string, encoded string) (string, error) {
+	fields := strings.Split(encoded[len("$6$"):], "$")
+	rounds := 0
+	if len(fields) == 3 && strings.HasPrefix(fields[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil || n < MinCryptRounds || n > MaxCryptRounds {
+			return "", ErrRounds
+		}
+		rounds, fields = n, fields[1:]
+	}
+	if len(fields) != 2 {
+		return "", ErrUnrecognized
+	}
+	return SHA512Crypt(pword, fields[0], rounds), nil
+}
+
+/* method APR1()
+Apache's variant of MD5 crypt ($apr1$), used by `htpasswd -m`
+*/
+func APR1(pword string, salt string) string {
+	if len(salt) > apr1SaltSize {
+		salt = salt[:apr1SaltSize]
+	}
+	pw, s := []byte(pword), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	sumAlt := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write(s)
+	cryptRepeat(ctx, sumAlt, len(pw))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := range 1000 {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pw)
+		}
+		sum = c.Sum(nil)
+	}
+
+	out := []byte(apr1Magic + salt + "$")
+	out = cryptEncode(out, sum[0], sum[6], sum[12], 4)
+	out = cryptEncode(out, sum[1], sum[7], sum[13], 4)
+	out = cryptEncode(out, sum[2], sum[8], sum[14], 4)
+	out = cryptEncode(out, sum[3], sum[9], sum[15], 4)
+	out = cryptEncode(out, sum[4], sum[10], sum[5], 4)
+	out = cryptEncode(out, 0, 0, sum[11], 2)
+	return string(out)
+}
+
+/* method verifyAPR1()
+Recompute an $apr1$ value for `pword` with the salt of `encoded`
+*/
+func verifyAPR1(pword string, encoded string) (string, error) {
+	salt, _, ok := strings.Cut(encoded[len(apr1Magic):], "$")
+	if !ok {
+		return "", ErrUnrecognized
+	}
+	return APR1(pword, salt), nil
+}
+
+/* method cryptRepeat()
+Write `n` bytes of `sum` to `h`, repeating it as often as needed
+*/
+func cryptRepeat(h hash.Hash, sum []byte, n int) {
+	for ; n > len(sum); n -= len(sum) {
+		h.Write(sum)
+	}
+	h.Write(sum[:n])
+}
+
+/* method cryptFill()
+Return `n` bytes made of `sum` repeated
+*/
+func cryptFill(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, sum[:min(len(sum), n-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+/*********************************************************
+File: digest.go
+Contents: Plain digests as algorithms for the plain output format
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// Fast digests, for checksums and keys rather than passwords
+	AlgorithmSHA256  = "sha256"
+	AlgorithmSHA384  = "sha384"
+	AlgorithmSHA3512 = "sha3-512"
+	AlgorithmBLAKE2b = "blake2b"
+)
+
+// A plain digest of the password followed by the salt, base64 encoded like
+// SHA512Hasher
+type DigestHasher struct {
+	New func() hash.Hash
+}
+
+func init() {
+	Register(AlgorithmSHA256, DigestHasher{New: sha256.New})
+	Register(AlgorithmSHA384, DigestHasher{New: sha512.New384})
+	Register(AlgorithmSHA3512, DigestHasher{New: func() hash.Hash { return sha3.New512() }})
+	Register(AlgorithmBLAKE2b, DigestHasher{New: func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	}})
+}
+
+func (d DigestHasher) Hash(password, salt []byte) (string, error) {
+	h := d.New()
+	h.Write(password)
+	h.Write(salt)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
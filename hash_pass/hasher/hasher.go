@@ -0,0 +1,244 @@
+/*********************************************************
+File: hasher.go
+Contents: Password hashing in every supported format, and verification
+*********************************************************/
+
+// Package hasher hashes and verifies passwords in the formats served by
+// hash_pass, with no dependency on the server, so other services can
+// produce and check the same values.
+package hasher
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Output formats
+	FormatSHA512         = "sha512"
+	FormatCrypt          = "crypt"
+	FormatShadow         = "shadow"
+	FormatHtpasswdBcrypt = "htpasswd-bcrypt"
+	FormatHtpasswdAPR1   = "htpasswd-apr1"
+	FormatSSHA512        = "ssha512"
+	FormatSCRAMSHA256    = "scram-sha-256"
+
+	// Range of rounds accepted for SHA-512 crypt.  glibc allows up to
+	// 999999999, the upper bound here keeps a single hash from tying up a
+	// CPU for minutes.
+	MinCryptRounds = 1000
+	MaxCryptRounds = 10000000
+
+	// Longest password bcrypt will hash
+	bcryptMaxPassword = 72
+)
+
+// How a password is to be hashed
+type Options struct {
+	// Output format, FormatSHA512 when empty
+	Format string
+	// User name on the htpasswd line, htpasswd formats only
+	User string
+	// Rounds for SHA-512 crypt, 0 for the default
+	Rounds int
+	// Cost of FormatHtpasswdBcrypt values, DefaultBcryptCost when 0
+	BcryptCost int
+	// Registered algorithm producing the FormatSHA512 value, AlgorithmSHA512
+	// when empty.  The other formats have an algorithm of their own.
+	Algorithm string
+	// Used in place of the algorithm named by Algorithm when set
+	Hasher Hasher
+	// Salt passed to the algorithm for FormatSHA512, none when nil
+	Salt []byte
+	// Secret mixed into the password with Pepper before a FormatSHA512 value
+	// is computed, none when nil.  The other formats are read by systems
+	// that don't know the pepper.
+	Pepper []byte
+}
+
+var (
+	ErrFormat       = errors.New("unsupported output format")
+	ErrAlgorithm    = errors.New("unsupported algorithm for output format")
+	ErrUser         = errors.New("missing or invalid user for htpasswd format")
+	ErrPassword     = errors.New("password too long for format")
+	ErrRounds       = errors.New("invalid number of rounds")
+	ErrUnrecognized = errors.New("unrecognized hash")
+)
+
+/* method Check()
+Report why a password can't be hashed with `opts`, nil if it can
+*/
+func Check(pword string, opts Options) error {
+	plain := opts.Format == "" || opts.Format == FormatSHA512
+	if !plain && len(opts.Algorithm) > 0 {
+		return ErrAlgorithm
+	}
+	switch opts.Format {
+	case "", FormatSHA512:
+		if _, ok := Lookup(opts.Algorithm); !ok && opts.Hasher == nil {
+			return ErrAlgorithm
+		}
+		if opts.Algorithm == AlgorithmBcrypt && len(opts.Pepper) == 0 && len(pword) > bcryptMaxPassword {
+			return ErrPassword
+		}
+	case FormatSSHA512, FormatSCRAMSHA256:
+	case FormatCrypt, FormatShadow:
+		if opts.Rounds != 0 && (opts.Rounds < MinCryptRounds || opts.Rounds > MaxCryptRounds) {
+			return ErrRounds
+		}
+	case FormatHtpasswdBcrypt, FormatHtpasswdAPR1:
+		if len(opts.User) == 0 || strings.ContainsAny(opts.User, ":\r\n") {
+			return ErrUser
+		}
+		if opts.Format == FormatHtpasswdBcrypt && len(pword) > bcryptMaxPassword {
+			return ErrPassword
+		}
+	default:
+		return ErrFormat
+	}
+	return nil
+}
+
+/* method Hash()
+Hash `pword` in the format selected by `opts`, with a fresh random salt
+for the salted formats.  FormatSHA512 values come from the selected
+algorithm.
+*/
+func Hash(pword string, opts Options) (string, error) {
+	if err := Check(pword, opts); err != nil {
+		return "", err
+	}
+	switch opts.Format {
+	case FormatCrypt, FormatShadow:
+		salt, err := CryptSalt(sha512CryptSaltSize)
+		if err != nil {
+			return "", err
+		}
+		return SHA512Crypt(pword, salt, opts.Rounds), nil
+	case FormatHtpasswdBcrypt:
+		sum, err := BcryptHasher{Cost: opts.BcryptCost}.Hash([]byte(pword), nil)
+		if err != nil {
+			return "", err
+		}
+		// Apache writes the identical $2y$ variant
+		return opts.User + ":$2y$" + strings.TrimPrefix(sum, "$2a$"), nil
+	case FormatHtpasswdAPR1:
+		salt, err := CryptSalt(apr1SaltSize)
+		if err != nil {
+			return "", err
+		}
+		return opts.User + ":" + APR1(pword, salt), nil
+	case FormatSSHA512:
+		salt, err := RandomSalt(sshaSaltSize)
+		if err != nil {
+			return "", err
+		}
+		return SSHA512(pword, salt), nil
+	case FormatSCRAMSHA256:
+		salt, err := RandomSalt(scramSaltSize)
+		if err != nil {
+			return "", err
+		}
+		return SCRAMSHA256(pword, salt, scramIterations)
+	}
+	h := opts.Hasher
+	if h == nil {
+		h, _ = Lookup(opts.Algorithm)
+	}
+	if len(opts.Pepper) > 0 {
+		pword = Pepper(pword, opts.Pepper)
+	}
+	return h.Hash([]byte(pword), opts.Salt)
+}
+
+/* method SHA512()
+- Calculate SHA512 of `pword`
+- Return it Base64 encoded
+*/
+func SHA512(pword string) string {
+	// Hash the password
+	sum := sha512.Sum512([]byte(pword))
+
+	// Convert to Base64
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+/* method Verify()
+Report whether `pword` matches `encoded`, a value in any of the supported
+formats.  htpasswd lines are accepted with their user name.
+*/
+func Verify(pword string, encoded string) (bool, error) {
+	var computed string
+	var err error
+	switch {
+	case strings.HasPrefix(encoded, "$6$"):
+		computed, err = verifySHA512Crypt(pword, encoded)
+	case strings.HasPrefix(encoded, apr1Magic):
+		computed, err = verifyAPR1(pword, encoded)
+	case strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pword))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encoded, sshaPrefix):
+		computed, err = verifySSHA512(pword, encoded)
+	case strings.HasPrefix(encoded, scramPrefix):
+		computed, err = verifySCRAMSHA256(pword, encoded)
+	case strings.HasPrefix(encoded, argon2Prefix):
+		computed, err = verifyArgon2id(pword, encoded)
+	case strings.HasPrefix(encoded, scryptPrefix):
+		computed, err = verifyScrypt(pword, encoded)
+	case strings.HasPrefix(encoded, "$pbkdf2-"):
+		computed, err = verifyPBKDF2(pword, encoded)
+	case strings.Contains(encoded, ":"):
+		// htpasswd line, check the hash after the user name
+		_, sum, _ := strings.Cut(encoded, ":")
+		return Verify(pword, sum)
+	case len(encoded) == base64.URLEncoding.EncodedLen(sha512.Size):
+		computed = SHA512(pword)
+	default:
+		err = ErrUnrecognized
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
+
+/* method VerifySalted()
+Report whether `pword` matches `encoded`, a FormatSHA512 value hashed with
+`opts`: the Algorithm or Hasher, Salt and Pepper it was produced with.
+Values carrying their own salt and parameters, such as bcrypt or argon2id,
+are checked as Verify checks them; the others, sha512, the plain digests
+and hmac-sha512, are computed again with the salt.  Other formats are
+passed to Verify.
+*/
+func VerifySalted(pword string, encoded string, opts Options) (bool, error) {
+	if opts.Format != "" && opts.Format != FormatSHA512 {
+		return Verify(pword, encoded)
+	}
+	if len(opts.Pepper) > 0 {
+		pword = Pepper(pword, opts.Pepper)
+	}
+	if strings.HasPrefix(encoded, "$") {
+		return Verify(pword, encoded)
+	}
+	h := opts.Hasher
+	if h == nil {
+		var ok bool
+		if h, ok = Lookup(opts.Algorithm); !ok {
+			return false, ErrAlgorithm
+		}
+	}
+	computed, err := h.Hash([]byte(pword), opts.Salt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
@@ -0,0 +1,174 @@
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSHA512(t *testing.T) {
+	// From the assignment
+	want := "ZEHhWB65gUlzdVwtDQArEyx-KVLzp_aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A-gf7Q=="
+	if got := SHA512("angryMonkey"); got != want {
+		t.Errorf("SHA512(angryMonkey) = %s, want %s", got, want)
+	}
+	got, err := Hash("angryMonkey", Options{})
+	if err != nil || got != want {
+		t.Errorf("Hash(angryMonkey) = %s, %v, want %s", got, err, want)
+	}
+}
+
+func TestSHA512Crypt(t *testing.T) {
+	// From Ulrich Drepper's "Unix crypt using SHA-256 and SHA-512"
+	for _, tc := range []struct {
+		pword, salt string
+		rounds      int
+		want        string
+	}{
+		{"Hello world!", "saltstring", 0,
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "saltstringsaltstring", 10000,
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"This is just a test", "toolongsaltstring", 5000,
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"we have a short salt string but not a short password", "short", 77777,
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	} {
+		if got := SHA512Crypt(tc.pword, tc.salt, tc.rounds); got != tc.want {
+			t.Errorf("SHA512Crypt(%q, %q, %d) = %s, want %s", tc.pword, tc.salt, tc.rounds, got, tc.want)
+		}
+	}
+}
+
+func TestAPR1(t *testing.T) {
+	// From the Apache htpasswd documentation
+	want := "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"
+	if got := APR1("myPassword", "r31....."); got != want {
+		t.Errorf("APR1(myPassword) = %s, want %s", got, want)
+	}
+}
+
+func TestSCRAMSHA256(t *testing.T) {
+	// The verifier for the RFC 7677 exchange, checked against the proofs in
+	// its example below
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	want := "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="
+	got, err := SCRAMSHA256("pencil", salt, 4096)
+	if err != nil || got != want {
+		t.Fatalf("SCRAMSHA256(pencil) = %s, %v, want %s", got, err, want)
+	}
+
+	keys := strings.Split(got[strings.LastIndex(got, "$")+1:], ":")
+	storedKey, _ := base64.StdEncoding.DecodeString(keys[0])
+	serverKey, _ := base64.StdEncoding.DecodeString(keys[1])
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	mac := func(key []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(authMessage))
+		return h.Sum(nil)
+	}
+
+	if sig := base64.StdEncoding.EncodeToString(mac(serverKey)); sig != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Errorf("server signature %s doesn't match RFC 7677", sig)
+	}
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	clientKey := mac(storedKey)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	if sum := sha256.Sum256(clientKey); !hmac.Equal(sum[:], storedKey) {
+		t.Error("RFC 7677 client proof doesn't match the stored key")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name, pword, encoded string
+	}{
+		{"sha512", "angryMonkey", "ZEHhWB65gUlzdVwtDQArEyx-KVLzp_aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A-gf7Q=="},
+		{"sha512 crypt", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"sha512 crypt rounds", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"apr1", "myPassword", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{"htpasswd line", "myPassword", "bob:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		// From the OpenBSD bcrypt tests
+		{"bcrypt", "U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"scram-sha-256", "pencil", "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="},
+		// RFC 7914 scrypt and PBKDF2-HMAC-SHA256 vectors
+		{"scrypt", "password", "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA"},
+		{"pbkdf2-sha256", "password", "$pbkdf2-sha256$i=4096$c2FsdA$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if ok, err := Verify(tc.pword, tc.encoded); !ok || err != nil {
+				t.Errorf("Verify(%q) = %v, %v, want true", tc.pword, ok, err)
+			}
+			if ok, err := Verify(tc.pword+"x", tc.encoded); ok || err != nil {
+				t.Errorf("Verify of a wrong password = %v, %v, want false", ok, err)
+			}
+		})
+	}
+
+	if _, err := Verify("pw", "$unknown$value"); !errors.Is(err, ErrUnrecognized) {
+		t.Errorf("Verify of an unknown value returned %v, want ErrUnrecognized", err)
+	}
+}
+
+func TestHashVerify(t *testing.T) {
+	for _, opts := range []Options{
+		{Format: FormatCrypt},
+		{Format: FormatShadow, Rounds: 1000},
+		{Format: FormatHtpasswdBcrypt, User: "bob", BcryptCost: MinBcryptCost},
+		{Format: FormatHtpasswdAPR1, User: "bob"},
+		{Format: FormatSSHA512},
+		{Format: FormatSCRAMSHA256},
+	} {
+		t.Run(opts.Format, func(t *testing.T) {
+			encoded, err := Hash("angryMonkey", opts)
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if ok, err := Verify("angryMonkey", encoded); !ok || err != nil {
+				t.Errorf("Verify(%s) = %v, %v, want true", encoded, ok, err)
+			}
+			if ok, _ := Verify("angryMonkeys", encoded); ok {
+				t.Errorf("Verify(%s) accepted a wrong password", encoded)
+			}
+		})
+	}
+}
+
+func TestHtpasswdBcryptCost(t *testing.T) {
+	encoded, err := Hash("angryMonkey", Options{Format: FormatHtpasswdBcrypt, User: "bob", BcryptCost: 5})
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "bob:$2y$05$") {
+		t.Errorf("htpasswd-bcrypt line %s not at cost 5", encoded)
+	}
+}
+
+func TestVerifySalted(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	for _, opts := range []Options{
+		{Salt: salt},
+		{Algorithm: AlgorithmSHA256, Salt: salt},
+		{Hasher: BcryptHasher{Cost: MinBcryptCost}},
+		{Hasher: PBKDF2Hasher{Digest: "sha256", Iterations: MinPBKDF2Iterations}, Salt: salt},
+		{Salt: salt, Pepper: []byte("a pepper of at least thirty-two bytes")},
+	} {
+		encoded, err := Hash("angryMonkey", opts)
+		if err != nil {
+			t.Fatalf("Hash(%+v): %v", opts, err)
+		}
+		if ok, err := VerifySalted("angryMonkey", encoded, opts); !ok || err != nil {
+			t.Errorf("VerifySalted(%s) = %v, %v, want true", encoded, ok, err)
+		}
+		if ok, _ := VerifySalted("angryMonkeys", encoded, opts); ok {
+			t.Errorf("VerifySalted(%s) accepted a wrong password", encoded)
+		}
+	}
+}
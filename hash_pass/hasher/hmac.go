@@ -0,0 +1,42 @@
+/*********************************************************
+File: hmac.go
+Contents: HMAC-SHA512 keyed with a server secret, for the plain output format
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+)
+
+const (
+	AlgorithmHMACSHA512 = "hmac-sha512"
+
+	// Shortest secret accepted, so the key is no easier to guess than the
+	// digest is to invert
+	MinHMACKeySize = 32
+)
+
+var (
+	ErrHMACKey = errors.New("HMAC secret shorter than 32 bytes")
+)
+
+// HMAC-SHA512 of the password followed by the salt, keyed with Key and
+// base64 encoded.  Values can't be brute-forced offline without the key.
+// It needs a key, so unlike the other algorithms it isn't registered.
+type HMACHasher struct {
+	Key []byte
+}
+
+func (h HMACHasher) Hash(password, salt []byte) (string, error) {
+	if len(h.Key) < MinHMACKeySize {
+		return "", ErrHMACKey
+	}
+	mac := hmac.New(sha512.New, h.Key)
+	mac.Write(password)
+	mac.Write(salt)
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,39 @@
+/*********************************************************
+File: ldap.go
+Contents: LDAP {SSHA512} values for OpenLDAP userPassword attributes
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+)
+
+const (
+	sshaPrefix = "{SSHA512}"
+	// Bytes of random salt appended to the password
+	sshaSaltSize = 8
+)
+
+/* method SSHA512()
+The SHA-512 digest of the password followed by the salt, then the salt
+itself, base64 encoded
+*/
+func SSHA512(pword string, salt []byte) string {
+	h := sha512.New()
+	h.Write([]byte(pword))
+	h.Write(salt)
+	return sshaPrefix + base64.StdEncoding.EncodeToString(append(h.Sum(nil), salt...))
+}
+
+/* method verifySSHA512()
+Recompute an {SSHA512} value for `pword` with the salt of `encoded`
+*/
+func verifySSHA512(pword string, encoded string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded[len(sshaPrefix):])
+	if err != nil || len(raw) < sha512.Size {
+		return "", ErrUnrecognized
+	}
+	return SSHA512(pword, raw[sha512.Size:]), nil
+}
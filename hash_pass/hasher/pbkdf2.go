@@ -0,0 +1,147 @@
+/*********************************************************
+File: pbkdf2.go
+Contents: PBKDF2-HMAC-SHA256 and -SHA512 algorithms and iteration calibration
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgorithmPBKDF2SHA256 = "pbkdf2-sha256"
+	AlgorithmPBKDF2SHA512 = "pbkdf2-sha512"
+
+	// Bytes of random salt
+	pbkdf2SaltSize = 16
+
+	// OWASP's recommended iteration counts
+	DefaultPBKDF2SHA256Iterations = 600000
+	DefaultPBKDF2SHA512Iterations = 210000
+
+	// Range of iteration counts accepted
+	MinPBKDF2Iterations = 1000
+	MaxPBKDF2Iterations = 100000000
+
+	// Iterations timed to calibrate the count, and how many timings are
+	// taken with the fastest one used
+	pbkdf2CalibrationIterations = 20000
+	pbkdf2CalibrationRuns       = 3
+)
+
+// PBKDF2 with HMAC of the named digest, "sha256" or "sha512", at the given
+// iteration count, the digest's default when 0.  A fresh random salt is used
+// when Hash is passed none.
+type PBKDF2Hasher struct {
+	Digest     string
+	Iterations int
+}
+
+func init() {
+	Register(AlgorithmPBKDF2SHA256, PBKDF2Hasher{Digest: "sha256"})
+	Register(AlgorithmPBKDF2SHA512, PBKDF2Hasher{Digest: "sha512"})
+}
+
+/* method newHash()
+Return the digest constructor, its output size and default iterations,
+nil for an unknown digest
+*/
+func (p PBKDF2Hasher) newHash() (func() hash.Hash, int, int) {
+	switch p.Digest {
+	case "sha256":
+		return sha256.New, sha256.Size, DefaultPBKDF2SHA256Iterations
+	case "sha512":
+		return sha512.New, sha512.Size, DefaultPBKDF2SHA512Iterations
+	}
+	return nil, 0, 0
+}
+
+/* method Valid()
+Report whether the digest is known and the iteration count in range
+*/
+func (p PBKDF2Hasher) Valid() bool {
+	newHash, _, _ := p.newHash()
+	return newHash != nil && (p.Iterations == 0 ||
+		(p.Iterations >= MinPBKDF2Iterations && p.Iterations <= MaxPBKDF2Iterations))
+}
+
+/* method Hash()
+Return $pbkdf2-<digest>$i=<iterations>$<salt>$<key>, with a key as long as
+the digest
+*/
+func (p PBKDF2Hasher) Hash(password, salt []byte) (string, error) {
+	if !p.Valid() {
+		return "", ErrRounds
+	}
+	newHash, size, iterations := p.newHash()
+	if p.Iterations != 0 {
+		iterations = p.Iterations
+	}
+	if len(salt) == 0 {
+		var err error
+		if salt, err = RandomSalt(pbkdf2SaltSize); err != nil {
+			return "", err
+		}
+	}
+	key, err := pbkdf2.Key(newHash, string(password), salt, iterations, size)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawStdEncoding
+	return "$pbkdf2-" + p.Digest + "$i=" + strconv.Itoa(iterations) + "$" +
+		b64.EncodeToString(salt) + "$" + b64.EncodeToString(key), nil
+}
+
+/* method CalibratePBKDF2()
+Return the iteration count that makes one hash with `digest` take about
+`target` on this host, within the accepted range
+*/
+func CalibratePBKDF2(digest string, target time.Duration) int {
+	newHash, size, _ := PBKDF2Hasher{Digest: digest}.newHash()
+	if newHash == nil {
+		return 0
+	}
+	salt := make([]byte, pbkdf2SaltSize)
+	var fastest time.Duration
+	for i := 0; i < pbkdf2CalibrationRuns; i++ {
+		start := time.Now()
+		pbkdf2.Key(newHash, "calibration", salt, pbkdf2CalibrationIterations, size)
+		if elapsed := time.Since(start); i == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	iterations := int(float64(pbkdf2CalibrationIterations) * float64(target) / float64(max(fastest, 1)))
+	return min(max(iterations, MinPBKDF2Iterations), MaxPBKDF2Iterations)
+}
+
+/* method verifyPBKDF2()
+Recompute a value for `pword` with the digest, iterations and salt of
+`encoded`
+*/
+func verifyPBKDF2(pword string, encoded string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(encoded, "$pbkdf2-"), "$")
+	if len(parts) != 4 || !strings.HasPrefix(parts[1], "i=") {
+		return "", ErrUnrecognized
+	}
+	iterations, err := strconv.Atoi(parts[1][len("i="):])
+	if err != nil {
+		return "", ErrUnrecognized
+	}
+	p := PBKDF2Hasher{Digest: parts[0], Iterations: iterations}
+	if iterations == 0 || !p.Valid() {
+		return "", ErrUnrecognized
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrUnrecognized
+	}
+	return p.Hash([]byte(pword), salt)
+}
@@ -0,0 +1,29 @@
+/*********************************************************
+File: pepper.go
+Contents: Mixing a secret pepper into passwords before they are hashed
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+const (
+	// Shortest pepper accepted
+	MinPepperSize = 16
+)
+
+/* method Pepper()
+Return the password to hash in place of `pword` with `pepper` mixed in: the
+base64 HMAC-SHA256 of the password keyed with the pepper.  At 44 bytes it
+fits every algorithm, bcrypt included.  To verify a peppered value, pass
+Verify the peppered password.
+*/
+func Pepper(pword string, pepper []byte) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(pword))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
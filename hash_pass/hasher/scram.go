@@ -0,0 +1,142 @@
+/*********************************************************
+File: scram.go
+Contents: SCRAM-SHA-256 verifiers as stored by PostgreSQL
+*********************************************************/
+
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	scramPrefix = "SCRAM-SHA-256$"
+	// PostgreSQL's defaults for scram_iterations and the salt length
+	scramIterations = 4096
+	scramSaltSize   = 16
+	// Most iterations accepted when verifying
+	maxScramIterations = 10000000
+)
+
+/* method SCRAMSHA256()
+Return the verifier PostgreSQL keeps in pg_authid.rolpassword for a role
+with this password, in the form
+SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+*/
+func SCRAMSHA256(pword string, salt []byte, iterations int) (string, error) {
+	salted, err := pbkdf2.Key(sha256.New, saslPrep(pword), salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(salted, "Server Key")
+
+	b64 := base64.StdEncoding
+	return scramPrefix + strconv.Itoa(iterations) + ":" + b64.EncodeToString(salt) +
+		"$" + b64.EncodeToString(storedKey[:]) + ":" + b64.EncodeToString(serverKey), nil
+}
+
+/* method verifySCRAMSHA256()
+Recompute a verifier for `pword` with the iterations and salt of `encoded`
+*/
+func verifySCRAMSHA256(pword string, encoded string) (string, error) {
+	params, _, ok := strings.Cut(encoded[len(scramPrefix):], "$")
+	iter, salt, ok2 := strings.Cut(params, ":")
+	if !ok || !ok2 {
+		return "", ErrUnrecognized
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < 1 || iterations > maxScramIterations {
+		return "", ErrUnrecognized
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", ErrUnrecognized
+	}
+	return SCRAMSHA256(pword, rawSalt, iterations)
+}
+
+/* method scramHMAC()
+HMAC-SHA-256 of `msg` keyed by the salted password
+*/
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+/* method saslPrep()
+Normalize a password the way PostgreSQL does before hashing it (RFC 4013
+SASLprep): non-ASCII spaces become spaces, characters commonly mapped to
+nothing are dropped, and the result is NFKC normalized.  As in PostgreSQL,
+a password that is ASCII or that contains prohibited characters is used
+as is.  The bidirectional text rules are not checked.
+*/
+func saslPrep(pword string) string {
+	ascii := true
+	for i := 0; i < len(pword); i++ {
+		if pword[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return pword
+	}
+
+	var b strings.Builder
+	for _, c := range pword {
+		switch {
+		case c == 0x00A0 || c == 0x1680 || (c >= 0x2000 && c <= 0x200B) || c == 0x202F || c == 0x205F || c == 0x3000:
+			b.WriteRune(' ')
+		case c == 0x00AD || c == 0x034F || c == 0x1806 || (c >= 0x180B && c <= 0x180D) ||
+			(c >= 0x200C && c <= 0x200D) || c == 0x2060 || (c >= 0xFE00 && c <= 0xFE0F) || c == 0xFEFF:
+			// Commonly mapped to nothing
+		default:
+			b.WriteRune(c)
+		}
+	}
+	prepared := norm.NFKC.String(b.String())
+
+	for _, c := range prepared {
+		if saslProhibited(c) {
+			return pword
+		}
+	}
+	return prepared
+}
+
+/* method saslProhibited()
+Report whether SASLprep prohibits `c` in its output
+*/
+func saslProhibited(c rune) bool {
+	switch {
+	case c > 0x7F && unicode.IsSpace(c):
+		return true
+	case unicode.Is(unicode.Cc, c) || unicode.Is(unicode.Co, c) || unicode.Is(unicode.Cs, c):
+		return true
+	case c&0xFFFE == 0xFFFE || (c >= 0xFDD0 && c <= 0xFDEF):
+		// Non-characters
+		return true
+	case (c >= 0xFFF9 && c <= 0xFFFD) || (c >= 0x2FF0 && c <= 0x2FFB):
+		// Inappropriate for plain text or canonical representation
+		return true
+	case c == 0x0340 || c == 0x0341 || c == 0x200E || c == 0x200F || (c >= 0x202A && c <= 0x202E) || (c >= 0x206A && c <= 0x206F):
+		// Change display properties or are deprecated
+		return true
+	case c == 0xE0001 || (c >= 0xE0020 && c <= 0xE007F):
+		// Tagging characters
+		return true
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+/*********************************************************
+File: scrypt.go
+Contents: scrypt as an algorithm for the plain output format
+*********************************************************/
+
+package hasher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	AlgorithmScrypt = "scrypt"
+
+	scryptPrefix = "$scrypt$"
+	// Bytes of random salt and of derived key
+	scryptSaltSize = 16
+	scryptKeySize  = 32
+
+	// The parameters recommended for interactive logins
+	DefaultScryptN = 1 << 15
+	DefaultScryptR = 8
+	DefaultScryptP = 1
+
+	// Largest N accepted, and most memory a single hash may use
+	MaxScryptN      = 1 << 20
+	MaxScryptMemory = 1 << 30
+)
+
+// scrypt with CPU/memory cost N, block size R and parallelism P, the
+// defaults for fields left at 0.  A fresh random salt is used when Hash is
+// passed none.
+type ScryptHasher struct {
+	N int
+	R int
+	P int
+}
+
+func init() {
+	Register(AlgorithmScrypt, ScryptHasher{})
+}
+
+func (s ScryptHasher) withDefaults() ScryptHasher {
+	if s.N == 0 {
+		s.N = DefaultScryptN
+	}
+	if s.R == 0 {
+		s.R = DefaultScryptR
+	}
+	if s.P == 0 {
+		s.P = DefaultScryptP
+	}
+	return s
+}
+
+/* method Valid()
+Report whether the parameters, after defaults are applied, are in range:
+N a power of 2 from 2 to MaxScryptN, R and P positive with R*P below 2^30,
+and at most MaxScryptMemory used
+*/
+func (s ScryptHasher) Valid() bool {
+	s = s.withDefaults()
+	switch {
+	case s.N < 2 || s.N > MaxScryptN || s.N&(s.N-1) != 0:
+		return false
+	case s.R < 1 || s.P < 1 || s.R*s.P >= 1<<30:
+		return false
+	}
+	return 128*s.N*s.R+128*s.R*s.P <= MaxScryptMemory
+}
+
+/* method Hash()
+Return $scrypt$ln=<log2 N>,r=<R>,p=<P>$<salt>$<key>, the layout passlib
+reads
+*/
+func (s ScryptHasher) Hash(password, salt []byte) (string, error) {
+	if !s.Valid() {
+		return "", ErrRounds
+	}
+	s = s.withDefaults()
+	if len(salt) == 0 {
+		var err error
+		if salt, err = RandomSalt(scryptSaltSize); err != nil {
+			return "", err
+		}
+	}
+	return s.encode(password, salt, scryptKeySize)
+}
+
+func (s ScryptHasher) encode(password, salt []byte, keySize int) (string, error) {
+	key, err := scrypt.Key(password, salt, s.N, s.R, s.P, keySize)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, bits.TrailingZeros(uint(s.N)),
+		s.R, s.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+/* method verifyScrypt()
+Recompute a value for `pword` with the parameters and salt of `encoded`
+*/
+func verifyScrypt(pword string, encoded string) (string, error) {
+	parts := strings.Split(encoded[len(scryptPrefix):], "$")
+	if len(parts) != 3 {
+		return "", ErrUnrecognized
+	}
+	var s ScryptHasher
+	var ln int
+	_, err := fmt.Sscanf(parts[0], "ln=%d,r=%d,p=%d", &ln, &s.R, &s.P)
+	if err != nil || ln < 1 || ln > bits.TrailingZeros(MaxScryptN) || s.R == 0 || s.P == 0 {
+		return "", ErrUnrecognized
+	}
+	s.N = 1 << ln
+	if !s.Valid() {
+		return "", ErrUnrecognized
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrUnrecognized
+	}
+	key, err := b64.DecodeString(parts[2])
+	if err != nil || len(key) == 0 {
+		return "", ErrUnrecognized
+	}
+	return s.encode([]byte(pword), salt, len(key))
+}
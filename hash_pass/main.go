@@ -1,35 +1,735 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash_pass/hasher"
 	JCServer "hash_pass/server"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+
+	// Registers the "postgres" database/sql driver -postgres-dsn opens
+	_ "github.com/lib/pq"
 )
 
 const (
 	minPort = 1024
 	maxPort = 65535
+
+	// Environment variables holding the hmac-sha512 secret, the pepper and
+	// the callback signing secret
+	hmacSecretEnv     = "HASH_PASS_HMAC_SECRET"
+	pepperEnv         = "HASH_PASS_PEPPER"
+	callbackSecretEnv = "HASH_PASS_CALLBACK_SECRET"
+	// Environment variable holding the base64 key shared by the cluster nodes
+	clusterKeyEnv = "HASH_PASS_CLUSTER_KEY"
+	// Environment variable holding the keys results are encrypted at rest
+	// with, as <id> <base64 key> separated by semicolons
+	encryptionKeysEnv = "HASH_PASS_ENCRYPTION_KEYS"
+	// Environment variable holding the processing delay, used when -delay
+	// isn't given on the command line
+	delayEnv = "HASH_PASS_DELAY"
+	// Standard OpenTelemetry environment variables naming the collector
+	// and the headers, such as an API key, sent to it
+	otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpHeadersEnv  = "OTEL_EXPORTER_OTLP_HEADERS"
+
+	// Standard AWS environment variables holding the archive credentials
+	awsAccessKeyEnv    = "AWS_ACCESS_KEY_ID"
+	awsSecretKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnv = "AWS_SESSION_TOKEN"
 )
+
+// Flags whose values must not be reported by the admin config endpoint
+var secretFlags = map[string]bool{
+	"sentry-dsn":   true,
+	"consul-token": true,
+	"admin-token":  true,
+	"redis-url":    true,
+	"postgres-dsn": true,
+	"otlp-headers": true,
+}
+
+/* method parseCIDR()
+Parse a network in CIDR notation, a bare IP is taken as a single host
+*/
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+/* method countryList()
+Split a comma separated list of country codes, normalized to upper case
+*/
+func countryList(s string) []string {
+	var codes []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); len(c) > 0 {
+			codes = append(codes, c)
+		}
+	}
+	return codes
+}
+
+/* method validOrigin()
+Report whether `s` is "*" or an origin a browser sends, scheme://host[:port]
+*/
+func validOrigin(s string) bool {
+	if s == "*" {
+		return true
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0 && len(u.Path) == 0 && len(u.RawQuery) == 0
+}
+
+/* method loadFeatures()
+Read the initial feature flag states from a JSON object of name to boolean
+*/
+func loadFeatures(path string, cfg *JCServer.Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &cfg.Features)
+}
+
+/* method parseHeaders()
+Parse a comma separated list of name=value headers, the values
+percent-encoded as in OTEL_EXPORTER_OTLP_HEADERS
+*/
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if name = strings.TrimSpace(name); !ok || len(name) == 0 {
+			return nil, fmt.Errorf("invalid header '%s'", pair)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header '%s': %v", name, err)
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+/* method readSecret()
+Return a secret from `path`, less a trailing newline, or from environment
+variable `env` when no file is given.  Empty when neither is set.
+*/
+func readSecret(path string, env string) ([]byte, error) {
+	if len(path) == 0 {
+		return []byte(os.Getenv(env)), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+/* method importResults()
+Import the export at `path` into the store `cfg` configures, then shut the
+server down so everything imported is written out
+*/
+func importResults(cfg JCServer.Config, opts []JCServer.Option, path string, conflict string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	format := JCServer.ExportJSONL
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = JCServer.ExportCSV
+	}
+	s, err := JCServer.NewServer(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	summary, err := s.Import(f, format, conflict)
+	if shutdownErr := s.Shutdown(context.Background()); err == nil {
+		err = shutdownErr
+	}
+	if err != nil {
+		return err
+	}
+	jtext, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Printf("%s\n", jtext)
+	return nil
+}
+
+/* method applySettings()
+Set the flags not given on the command line from the environment, for
+-delay, and then from the JSON object of flag name to value in the config
+file at `path`, if any.  Return where each flag set came from.
+*/
+func applySettings(path string) (map[string]string, error) {
+	sources := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		sources[f.Name] = JCServer.SourceFlag
+	})
+	if v, ok := os.LookupEnv(delayEnv); ok && len(sources["delay"]) == 0 {
+		if err := flag.Set("delay", v); err != nil {
+			return nil, fmt.Errorf("invalid %s '%s'", delayEnv, v)
+		}
+		sources["delay"] = JCServer.SourceEnv
+	}
+	if len(path) == 0 {
+		return sources, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config-file" {
+			return nil, fmt.Errorf("unknown setting '%s'", name)
+		}
+		if len(sources[name]) > 0 {
+			continue
+		}
+		// Strings are unquoted, numbers and booleans taken as written
+		v := string(values[name])
+		var text string
+		if json.Unmarshal(values[name], &text) == nil {
+			v = text
+		}
+		if err := flag.Set(name, v); err != nil {
+			return nil, fmt.Errorf("invalid value '%s' for %s", v, name)
+		}
+		sources[name] = JCServer.SourceFile
+	}
+	return sources, nil
+}
+
+/* method shutdownOnSignal()
+Drain and shut down the server on SIGINT or SIGTERM, as the shutdown
+endpoint does, so in-flight jobs complete.  A second signal exits at once.
+*/
+func shutdownOnSignal(srv *JCServer.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+	go func() {
+		sig := <-signals
+		log.Fatalf("Received %v again, exiting without waiting for pending tasks", sig)
+	}()
+	// The drain logs any jobs it abandons, and Start returns what went
+	// wrong stopping the server
+	srv.Shutdown(context.Background())
+}
+
+/* method settings()
+Describe every flag and the port with the value in effect and whether it
+was given on the command line, the environment or the config file, or was
+left at its default
+*/
+func settings(port int, sources map[string]string) []JCServer.Setting {
+	var list []JCServer.Setting
+	portSource := JCServer.SourceDefault
+	if flag.NArg() > 0 {
+		portSource = JCServer.SourceFlag
+	}
+	list = append(list, JCServer.Setting{Name: "port", Value: strconv.Itoa(port), Source: portSource})
+	flag.VisitAll(func(f *flag.Flag) {
+		s := JCServer.Setting{Name: f.Name, Value: f.Value.String(), Source: JCServer.SourceDefault, Secret: secretFlags[f.Name]}
+		if source, ok := sources[f.Name]; ok {
+			s.Source = source
+		}
+		list = append(list, s)
+	})
+	return list
+}
+
 func main() {
-	listenPort := JCServer.ListenPort
+	cfg := JCServer.Config{Port: JCServer.DefaultPort, Delay: JCServer.DefaultDelay}
 
-	if len(os.Args) > 1{
-		port, err := strconv.Atoi(os.Args[1])
+	flag.Float64Var(&cfg.SLOObjective, "slo-objective", JCServer.DefaultSLOObjective, "fraction of POST requests that must meet the latency objective")
+	flag.DurationVar(&cfg.SLOLatency, "slo-latency", JCServer.DefaultSLOLatency, "maximum enqueue time for a POST request to count as good")
+	flag.StringVar(&cfg.SentryDSN, "sentry-dsn", "", "Sentry DSN to report panics and server errors to")
+	flag.StringVar(&cfg.SentryEnvironment, "sentry-environment", "", "environment name attached to Sentry events")
+	flag.Float64Var(&cfg.SentryTraceRate, "sentry-trace-rate", 0, "fraction of requests and jobs to send performance traces to Sentry for")
+	flag.StringVar(&cfg.HeartbeatURL, "heartbeat-url", "", "URL to ping periodically while the service is healthy")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", JCServer.DefaultHeartbeatInterval, "time between heartbeat pings")
+	flag.StringVar(&cfg.ConsulAddr, "consul-addr", "", "Consul agent address to register with, e.g. http://127.0.0.1:8500")
+	flag.StringVar(&cfg.ConsulToken, "consul-token", "", "ACL token for the Consul agent")
+	flag.StringVar(&cfg.ConsulService, "consul-service", JCServer.DefaultConsulService, "service name to register with Consul")
+	flag.StringVar(&cfg.ConsulServiceAddr, "consul-service-addr", "", "address to advertise to Consul, defaults to the agent's address")
+	flag.StringVar(&cfg.ClusterBind, "cluster-bind", "", "host:port to gossip with other instances on, e.g. 0.0.0.0:7946")
+	flag.StringVar(&cfg.ClusterAdvertise, "cluster-advertise", "", "address advertised to other cluster nodes")
+	clusterJoin := flag.String("cluster-join", "", "comma separated gossip addresses of existing cluster nodes")
+	clusterKeyFile := flag.String("cluster-key-file", "", "file holding the base64 16, 24 or 32 byte key every cluster node shares, read from "+clusterKeyEnv+" when not given")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate file to serve HTTPS with, required with -distribute so passwords forwarded between nodes are encrypted")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key file of -tls-cert")
+	flag.StringVar(&cfg.ClusterCA, "cluster-ca", "", "PEM file of the CAs issuing the cluster nodes' certificates, the system roots when not given")
+	flag.StringVar(&cfg.NodeName, "node-name", "", "unique cluster node name, defaults to hostname-port")
+	flag.StringVar(&cfg.RaftBind, "raft-bind", "", "host:port for raft replication of results, e.g. 10.0.0.1:7000")
+	flag.StringVar(&cfg.RaftAdvertise, "raft-advertise", "", "raft address advertised to other nodes, defaults to -raft-bind")
+	flag.StringVar(&cfg.RaftDir, "raft-dir", "", "directory holding the raft log and snapshots")
+	flag.StringVar(&cfg.DataDir, "data-dir", "", "directory holding results and the request counter across restarts, in memory only when not given")
+	flag.StringVar(&cfg.RedisURL, "redis-url", "", "redis[s]://[user:password@]host[:port][/db] of a Redis server sharing results and the request counter between instances")
+	flag.StringVar(&cfg.RedisPrefix, "redis-prefix", JCServer.DefaultRedisPrefix, "prefix of the keys kept in Redis")
+	flag.DurationVar(&cfg.RedisTTL, "redis-ttl", 0, "expiry of results kept in Redis, kept until deleted when 0")
+	flag.StringVar(&cfg.PostgresDSN, "postgres-dsn", "", "data source name of a PostgreSQL database sharing results and the request counter between instances")
+	flag.StringVar(&cfg.PostgresDriver, "postgres-driver", JCServer.DefaultPostgresDriver, "database/sql driver the binary was built with to open -postgres-dsn")
+	flag.IntVar(&cfg.PostgresMaxConns, "postgres-max-conns", JCServer.DefaultPostgresMaxConns, "open connections to PostgreSQL")
+	flag.StringVar(&cfg.WALPath, "wal", "", "file logging accepted jobs and results, replayed on start so acknowledged jobs survive a crash")
+	flag.BoolVar(&cfg.WALPlaintext, "wal-plaintext", false, "allow -wal without encryption keys, keeping the passwords of pending jobs in it in the clear")
+	flag.IntVar(&cfg.WALCompactRecords, "wal-compact-records", JCServer.DefaultWALCompactRecords, "records appended to -wal between compactions")
+	flag.StringVar(&cfg.SnapshotPath, "snapshot-file", "", "file the results and counters are periodically snapshotted to and loaded from on start")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", JCServer.DefaultSnapshotInterval, "time between snapshots")
+	flag.StringVar(&cfg.ArchiveURL, "archive-url", "", "S3-compatible bucket old results are moved to, e.g. https://s3.us-east-1.amazonaws.com/bucket/prefix/, with credentials from "+awsAccessKeyEnv+" and "+awsSecretKeyEnv)
+	flag.StringVar(&cfg.ArchiveRegion, "archive-region", JCServer.DefaultArchiveRegion, "region archive requests are signed for")
+	flag.DurationVar(&cfg.ArchiveAfter, "archive-after", JCServer.DefaultArchiveAfter, "age after completion at which results are archived")
+	flag.BoolVar(&cfg.RaftBootstrap, "raft-bootstrap", false, "start a new raft cluster with this node as its first member")
+	flag.StringVar(&cfg.RaftJoin, "raft-join", "", "HTTP address of an existing raft node to join through, e.g. http://10.0.0.1:8080")
+	flag.BoolVar(&cfg.Sharded, "sharded", false, "prefix request Ids with the node name and forward GETs to the owning node")
+	flag.BoolVar(&cfg.Distributed, "distribute", false, "spread jobs across cluster nodes by consistent hashing of their Id")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated CIDRs or IPs of reverse proxies allowed to set X-Forwarded-For/Forwarded")
+	flag.StringVar(&cfg.GeoIPDB, "geoip-db", "", "MaxMind-format country database used to resolve client countries")
+	wsOrigins := flag.String("ws-allowed-origins", "", "comma separated origins, as scheme://host[:port] or * for any, whose pages may open a WebSocket besides the server's own")
+	geoAllow := flag.String("geoip-allow", "", "comma separated ISO country codes allowed to use the hash API, ZZ for unknown")
+	geoDeny := flag.String("geoip-deny", "", "comma separated ISO country codes refused access to the hash API, ZZ for unknown")
+	flag.DurationVar(&cfg.AbuseWindow, "abuse-window", JCServer.DefaultAbuseWindow, "period over which client activity is counted for abuse detection")
+	flag.DurationVar(&cfg.AbuseThrottle, "abuse-throttle", JCServer.DefaultAbuseThrottle, "how long an abusive client is refused service")
+	flag.IntVar(&cfg.AbusePostLimit, "abuse-post-limit", 0, "POSTs per client per window before it is throttled, 0 disables")
+	flag.IntVar(&cfg.AbuseMissLimit, "abuse-miss-limit", 0, "GETs of unknown task Ids per client per window before it is throttled, 0 disables")
+	flag.IntVar(&cfg.AbuseAuthLimit, "abuse-auth-limit", 0, "authorization failures per client per window before it is throttled, 0 disables")
+	flag.IntVar(&cfg.Workers, "workers", 0, "workers hashing jobs once their delay has passed, 0 for one per CPU")
+	flag.IntVar(&cfg.MaxWorkers, "max-workers", JCServer.DefaultMaxWorkers, "largest pool /admin/workers may resize to")
+	flag.DurationVar(&cfg.PriorityAging, "priority-aging", JCServer.DefaultPriorityAging, "time a job waits for a worker before its priority is raised a level")
+	flag.IntVar(&cfg.AutoscaleMin, "autoscale-min", 1, "fewest workers the autoscaler leaves")
+	flag.IntVar(&cfg.AutoscaleMax, "autoscale-max", 0, "most workers the autoscaler may start, 0 to keep the pool at -workers")
+	flag.DurationVar(&cfg.AutoscaleWait, "autoscale-wait", JCServer.DefaultAutoscaleWait, "time jobs may queue for a worker before the autoscaler grows the pool")
+	flag.IntVar(&cfg.MaxQueueDepth, "max-queue-depth", 0, "jobs that may be waiting to complete before POSTs are refused with 429, 0 for no limit")
+	flag.IntVar(&cfg.MaxInFlightPerClient, "max-inflight-per-client", 0, "jobs a single client may have in flight at once, 0 for no limit")
+	flag.DurationVar(&cfg.JobTimeout, "job-timeout", 0, "deadline for a job to complete, 0 for none")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", JCServer.DefaultDrainTimeout, "longest a shutdown waits for pending jobs before abandoning them, 0 to wait for all of them")
+	flag.BoolVar(&cfg.Dedup, "dedup", false, "answer a client repeating a submission with the same password and options with the job it already created")
+	flag.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", JCServer.DefaultIdempotencyWindow, "time an Idempotency-Key is remembered, replays within it returning the original task Id")
+	flag.StringVar(&cfg.Algorithm, "algorithm", hasher.AlgorithmSHA512, "hash algorithm for sha512 format results when a request names none")
+	flag.IntVar(&cfg.BcryptCost, "bcrypt-cost", hasher.DefaultBcryptCost, "cost of the bcrypt algorithm and htpasswd-bcrypt format, each step doubling the work")
+	flag.IntVar(&cfg.Argon2Memory, "argon2-memory", hasher.DefaultArgon2Memory, "memory used by the argon2id algorithm in KiB")
+	flag.IntVar(&cfg.Argon2Iterations, "argon2-iterations", hasher.DefaultArgon2Iterations, "passes over memory made by the argon2id algorithm")
+	flag.IntVar(&cfg.Argon2Parallelism, "argon2-parallelism", hasher.DefaultArgon2Parallelism, "lanes, and threads computing them, used by the argon2id algorithm")
+	flag.IntVar(&cfg.ScryptN, "scrypt-n", hasher.DefaultScryptN, "CPU/memory cost of the scrypt algorithm, a power of 2")
+	flag.IntVar(&cfg.ScryptR, "scrypt-r", hasher.DefaultScryptR, "block size of the scrypt algorithm")
+	flag.IntVar(&cfg.ScryptP, "scrypt-p", hasher.DefaultScryptP, "parallelism of the scrypt algorithm")
+	hmacSecretFile := flag.String("hmac-secret-file", "", "file holding the hmac-sha512 secret, read from "+hmacSecretEnv+" when not given")
+	pepperFile := flag.String("pepper-file", "", "file holding the pepper mixed into sha512 format results, read from "+pepperEnv+" when not given")
+	callbackSecretFile := flag.String("callback-secret-file", "", "file holding the secret signing callbacks, read from "+callbackSecretEnv+" when not given")
+	flag.IntVar(&cfg.JobRetries, "job-retries", JCServer.DefaultJobRetries, "times a job that couldn't be hashed or stored is retried before it is dead-lettered")
+	flag.IntVar(&cfg.CallbackRetries, "callback-retries", JCServer.DefaultCallbackRetries, "times a failed callback delivery is retried")
+	flag.BoolVar(&cfg.CallbackAllowPrivate, "callback-allow-private", false, "deliver callbacks to loopback, private and link-local addresses too")
+	keysFile := flag.String("encryption-keys-file", "", "file of <id> <base64 AES key> lines encrypting stored results, the first encrypting new ones, read from "+encryptionKeysEnv+" when not given")
+	flag.DurationVar(&cfg.PepperRefresh, "pepper-refresh", 0, "time between re-reads of the pepper to pick up rotations, 0 to read it at startup only")
+	flag.IntVar(&cfg.PBKDF2Iterations, "pbkdf2-iterations", 0, "iterations of the pbkdf2 algorithms, 0 for 600000 with SHA-256 and 210000 with SHA-512")
+	flag.DurationVar(&cfg.PBKDF2Calibrate, "pbkdf2-calibrate", 0, "pick the pbkdf2 iterations at startup so a hash takes this long on this host, e.g. 250ms")
+	flag.DurationVar(&cfg.StatsInterval, "stats-interval", 0, "time between lines of statistics written to the log, 0 for none")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "base URL of an OpenTelemetry collector to push metrics to over OTLP/HTTP, such as http://localhost:4318, read from "+otlpEndpointEnv+" when not given")
+	otlpHeaders := flag.String("otlp-headers", "", "comma separated name=value headers sent with each metrics push, read from "+otlpHeadersEnv+" when not given")
+	flag.DurationVar(&cfg.OTLPInterval, "otlp-interval", JCServer.DefaultOTLPInterval, "time between metrics pushes")
+	flag.IntVar(&cfg.MaxResults, "max-results", 0, "most results kept, evicting the least recently used beyond it, 0 for no limit")
+	flag.DurationVar(&cfg.ResultTTL, "result-ttl", 0, "time a result is kept after its job completes, 0 to keep it until deleted")
+	flag.DurationVar(&cfg.DeleteRecovery, "delete-recovery", JCServer.DefaultDeleteRecovery, "time a deleted result can still be restored, 0 to remove it at once")
+	flag.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", JCServer.DefaultReadHeaderTimeout, "time allowed to read a request's headers")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", JCServer.DefaultReadTimeout, "time allowed to read an entire request including its body")
+	flag.DurationVar(&cfg.Delay, "delay", JCServer.DefaultDelay, "time each job waits before it is processed, 0 for none, read from "+delayEnv+" when not given")
+	flag.DurationVar(&cfg.MaxDelay, "max-delay", JCServer.DefaultMaxDelay, "longest delay a POST may ask for with its delay field, longer ones being cut to it")
+	flag.Float64Var(&cfg.DelayJitter, "delay-jitter", 0, "fraction the processing delay varies by either way, e.g. 0.2 for 5s ±20%")
+	flag.DurationVar(&cfg.DelayJitterRange, "delay-jitter-range", 0, "time the processing delay varies by either way, e.g. 1s for 5s ±1s, in place of -delay-jitter")
+	flag.IntVar(&cfg.WarmupHashes, "warmup-hashes", 0, "calibration hashes to run at startup before /readyz reports ready")
+	flag.IntVar(&cfg.PreallocResults, "prealloc-results", 0, "number of results to size the result map for up front")
+	flag.Int64Var(&cfg.MaxDigestBytes, "digest-max-bytes", JCServer.DefaultMaxDigestBytes, "largest payload accepted by /digest in bytes, 0 for no limit")
+	flag.BoolVar(&cfg.JumpCloudAuth, "jumpcloud-auth", false, "require API keys on the hash API, validated against the JumpCloud directory")
+	flag.StringVar(&cfg.JumpCloudURL, "jumpcloud-url", JCServer.DefaultJumpCloudURL, "base URL of the JumpCloud API")
+	flag.StringVar(&cfg.JumpCloudOrgID, "jumpcloud-org", "", "JumpCloud organization Id API keys must belong to, any when empty")
+	flag.DurationVar(&cfg.AuthCacheTTL, "auth-cache-ttl", JCServer.DefaultAuthCacheTTL, "how long an API key validation is cached")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "bearer token required by the /admin endpoints and /shutdown, which without one are only served on a loopback -admin-addr")
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", "", "address of a second listener serving the admin endpoints, /shutdown, /stats and pprof, such as localhost:9090, instead of the public one")
+	featuresFile := flag.String("features-file", "", "JSON file mapping feature flag names to true or false")
+	importFile := flag.String("import", "", "export file whose results are imported into the configured store, after which the program exits; .csv files are read as CSV, others as JSON Lines")
+	importConflict := flag.String("import-conflict", JCServer.ConflictSkip, "how -import resolves Ids already in use: skip, overwrite, renumber or fail")
+	validate := flag.Bool("validate", false, "check the configuration and that its store and archive can be reached, print the effective settings and exit")
+	flag.BoolVar(validate, "dry-run", false, "same as -validate")
+	configFile := flag.String("config-file", "", "JSON file mapping flag names to values, for the settings not given on the command line")
+	// `serve` may name what is run, as in `hash_pass serve --validate`
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	// Collect every problem rather than stopping at the first, so a single
+	// validation run reports everything that needs fixing
+	var problems []string
+
+	sources, err := applySettings(*configFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid settings: %v", err))
+	}
+
+	for _, origin := range strings.Split(*wsOrigins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) == 0 {
+			continue
+		}
+		if !validOrigin(origin) {
+			problems = append(problems, fmt.Sprintf("Invalid WebSocket origin %q, use scheme://host[:port]", origin))
+			continue
+		}
+		cfg.WSAllowedOrigins = append(cfg.WSAllowedOrigins, origin)
+	}
+	cfg.GeoAllow = countryList(*geoAllow)
+	cfg.GeoDeny = countryList(*geoDeny)
+	if (len(cfg.GeoAllow) > 0 || len(cfg.GeoDeny) > 0) && len(cfg.GeoIPDB) == 0 {
+		problems = append(problems, "GeoIP rules require a database (-geoip-db)")
+	}
+	if len(cfg.GeoIPDB) > 0 {
+		if _, err := os.Stat(cfg.GeoIPDB); err != nil {
+			problems = append(problems, fmt.Sprintf("GeoIP database is not readable: %v", err))
+		}
+	}
+	if len(*featuresFile) > 0 {
+		if err := loadFeatures(*featuresFile, &cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid feature flags file: %v", err))
+		}
+	}
+	if len(*clusterJoin) > 0 {
+		cfg.ClusterJoin = strings.Split(*clusterJoin, ",")
+	}
+	if len(*trustedProxies) > 0 {
+		for _, cidr := range strings.Split(*trustedProxies, ",") {
+			proxy, err := parseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid trusted proxy '%s'", cidr))
+				continue
+			}
+			cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		port, err := strconv.Atoi(flag.Arg(0))
 		if err != nil {
-			fmt.Printf("Invalid port value '%s'\n",os.Args[1])
-			syscall.Exit(-1)
+			problems = append(problems, fmt.Sprintf("Invalid port value '%s'", flag.Arg(0)))
+		} else if port <= minPort || port > maxPort {
+			problems = append(problems, "Port must be in range of 1024 < port < 65536")
+		} else {
+			cfg.Port = port
+		}
+	}
+	if cfg.SLOObjective <= 0 || cfg.SLOObjective >= 1 {
+		problems = append(problems, "SLO objective must be in range of 0 < objective < 1")
+	}
+	if cfg.SentryTraceRate < 0 || cfg.SentryTraceRate > 1 {
+		problems = append(problems, "Sentry trace rate must be in range of 0 <= rate <= 1")
+	}
+	if cfg.Delay < 0 || cfg.MaxDelay < 0 {
+		problems = append(problems, "Processing delays must not be negative")
+	}
+	if cfg.DelayJitter < 0 || cfg.DelayJitter >= 1 {
+		problems = append(problems, "Delay jitter must be in range of 0 <= jitter < 1")
+	}
+	if cfg.DelayJitterRange < 0 || (cfg.DelayJitterRange > 0 && cfg.DelayJitter > 0) {
+		problems = append(problems, "Delay jitter range must not be negative, nor set with -delay-jitter")
+	}
+	if cfg.PriorityAging <= 0 {
+		problems = append(problems, "Priority aging must be positive")
+	}
+	if cfg.Workers < 0 || cfg.MaxQueueDepth < 0 {
+		problems = append(problems, "Workers and queue depth must not be negative")
+	}
+	if cfg.MaxWorkers < 1 || cfg.Workers > cfg.MaxWorkers || cfg.AutoscaleMax > cfg.MaxWorkers {
+		problems = append(problems, "Maximum workers must be at least 1, -workers and -autoscale-max")
+	}
+	if cfg.AutoscaleMax > 0 && (cfg.AutoscaleMin < 1 || cfg.AutoscaleMin > cfg.AutoscaleMax || cfg.AutoscaleWait <= 0) {
+		problems = append(problems, "Autoscaling needs 1 <= min <= max and a positive wait")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		problems = append(problems, "Heartbeat interval must be positive")
+	}
+	if len(cfg.OTLPEndpoint) == 0 {
+		cfg.OTLPEndpoint = os.Getenv(otlpEndpointEnv)
+	}
+	if len(cfg.OTLPEndpoint) > 0 {
+		if u, err := url.Parse(cfg.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			problems = append(problems, fmt.Sprintf("Invalid OTLP endpoint '%s', expected an http or https URL", cfg.OTLPEndpoint))
+		}
+	}
+	headers := *otlpHeaders
+	if len(headers) == 0 {
+		headers = os.Getenv(otlpHeadersEnv)
+	}
+	if parsed, err := parseHeaders(headers); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid OTLP headers: %v", err))
+	} else {
+		cfg.OTLPHeaders = parsed
+	}
+	if cfg.OTLPInterval <= 0 {
+		problems = append(problems, "Metrics push interval must be positive")
+	}
+	if cfg.JobTimeout < 0 || cfg.DrainTimeout < 0 || cfg.ReadHeaderTimeout < 0 || cfg.ReadTimeout < 0 || cfg.ResultTTL < 0 || cfg.StatsInterval < 0 || cfg.DeleteRecovery < 0 {
+		problems = append(problems, "Timeouts must not be negative")
+	}
+	if secret, err := readSecret(*hmacSecretFile, hmacSecretEnv); err != nil {
+		problems = append(problems, fmt.Sprintf("Unable to read HMAC secret: %v", err))
+	} else {
+		cfg.HMACSecret = secret
+	}
+	if len(cfg.ClusterBind) > 0 {
+		if secret, err := readSecret(*clusterKeyFile, clusterKeyEnv); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read cluster key: %v", err))
+		} else if key, err := base64.StdEncoding.DecodeString(string(secret)); err != nil || len(secret) == 0 {
+			problems = append(problems, "Clustering requires a base64 cluster key with -cluster-key-file or "+clusterKeyEnv)
+		} else if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			problems = append(problems, "Cluster key must be 16, 24 or 32 bytes")
+		} else {
+			cfg.ClusterKey = key
+		}
+	}
+	if secret, err := readSecret(*callbackSecretFile, callbackSecretEnv); err != nil {
+		problems = append(problems, fmt.Sprintf("Unable to read callback secret: %v", err))
+	} else {
+		cfg.CallbackSecret = secret
+	}
+	if len(cfg.ArchiveURL) > 0 {
+		cfg.ArchiveCredentials = JCServer.ArchiveCredentials{
+			AccessKey:    os.Getenv(awsAccessKeyEnv),
+			SecretKey:    os.Getenv(awsSecretKeyEnv),
+			SessionToken: os.Getenv(awsSessionTokenEnv),
 		}
-		if port <= minPort || port > maxPort {
-			fmt.Printf("Port must be in range of 1024 < port < 65536\n")
-			syscall.Exit(-1)
+		if len(cfg.ArchiveCredentials.AccessKey) == 0 || len(cfg.ArchiveCredentials.SecretKey) == 0 {
+			problems = append(problems, fmt.Sprintf("Archive requires credentials in %s and %s", awsAccessKeyEnv, awsSecretKeyEnv))
 		}
-		listenPort = port
+		if cfg.ArchiveAfter <= 0 {
+			problems = append(problems, "Archive age must be positive")
+		} else if cfg.ResultTTL > 0 && cfg.ResultTTL <= cfg.ArchiveAfter {
+			problems = append(problems, "Results would expire before they are archived, the result TTL must be longer than the archive age")
+		}
+	}
+	if cfg.CallbackRetries < 0 || cfg.JobRetries < 0 {
+		problems = append(problems, "Callback and job retries must not be negative")
+	}
+	if len(cfg.HMACSecret) > 0 && len(cfg.HMACSecret) < hasher.MinHMACKeySize {
+		problems = append(problems, fmt.Sprintf("HMAC secret must be at least %d bytes", hasher.MinHMACKeySize))
+	}
+	if cfg.Algorithm == hasher.AlgorithmHMACSHA512 {
+		if len(cfg.HMACSecret) == 0 {
+			problems = append(problems, "HMAC secret is missing, set "+hmacSecretEnv+" or -hmac-secret-file")
+		}
+	} else if _, ok := hasher.Lookup(cfg.Algorithm); !ok {
+		problems = append(problems, fmt.Sprintf("Unknown hash algorithm '%s'", cfg.Algorithm))
+	}
+	if cfg.BcryptCost < hasher.MinBcryptCost || cfg.BcryptCost > hasher.MaxBcryptCost {
+		problems = append(problems, fmt.Sprintf("bcrypt cost must be in range of %d <= cost <= %d", hasher.MinBcryptCost, hasher.MaxBcryptCost))
+	}
+	if cfg.Argon2Iterations < 1 || cfg.Argon2Iterations > hasher.MaxArgon2Iterations {
+		problems = append(problems, fmt.Sprintf("argon2id iterations must be in range of 1 <= iterations <= %d", hasher.MaxArgon2Iterations))
+	}
+	if cfg.Argon2Parallelism < 1 || cfg.Argon2Parallelism > 255 {
+		problems = append(problems, "argon2id parallelism must be in range of 1 <= parallelism <= 255")
+	}
+	if cfg.Argon2Memory < 8*cfg.Argon2Parallelism || cfg.Argon2Memory > hasher.MaxArgon2Memory {
+		problems = append(problems, fmt.Sprintf("argon2id memory must be in range of 8 x parallelism <= memory <= %d KiB", hasher.MaxArgon2Memory))
+	}
+	if sc := (hasher.ScryptHasher{N: cfg.ScryptN, R: cfg.ScryptR, P: cfg.ScryptP}); cfg.ScryptN <= 0 || cfg.ScryptR <= 0 || cfg.ScryptP <= 0 || !sc.Valid() {
+		problems = append(problems, fmt.Sprintf("scrypt N must be a power of 2 up to %d, and r and p positive, using at most %d MiB", hasher.MaxScryptN, hasher.MaxScryptMemory>>20))
+	}
+	if cfg.PBKDF2Iterations != 0 && (cfg.PBKDF2Iterations < hasher.MinPBKDF2Iterations || cfg.PBKDF2Iterations > hasher.MaxPBKDF2Iterations) {
+		problems = append(problems, fmt.Sprintf("pbkdf2 iterations must be 0 or in range of %d <= iterations <= %d", hasher.MinPBKDF2Iterations, hasher.MaxPBKDF2Iterations))
+	}
+	if cfg.PBKDF2Calibrate < 0 {
+		problems = append(problems, "pbkdf2 calibration target must not be negative")
+	}
+	var opts []JCServer.Option
+	var pepper JCServer.PepperSource
+	if len(*pepperFile) > 0 {
+		pepper = JCServer.FilePepper(*pepperFile)
+	} else if len(os.Getenv(pepperEnv)) > 0 {
+		pepper = JCServer.EnvPepper(pepperEnv)
+	}
+	if pepper != nil {
+		if p, err := pepper.Pepper(); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read pepper: %v", err))
+		} else if len(p.Secret) < hasher.MinPepperSize {
+			problems = append(problems, fmt.Sprintf("Pepper must be at least %d bytes", hasher.MinPepperSize))
+		}
+		opts = append(opts, JCServer.WithPepperSource(pepper))
+	}
+	var keys JCServer.KeySource
+	if len(*keysFile) > 0 {
+		keys = JCServer.FileKeys(*keysFile)
+	} else if len(os.Getenv(encryptionKeysEnv)) > 0 {
+		keys = JCServer.EnvKeys(encryptionKeysEnv)
+	}
+	if keys != nil {
+		if kr, err := keys.Keys(); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read encryption keys: %v", err))
+		} else if err := kr.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid encryption keys: %v", err))
+		}
+		opts = append(opts, JCServer.WithKeySource(keys))
+	}
+	if len(cfg.WALPath) > 0 && keys == nil && !cfg.WALPlaintext {
+		problems = append(problems, "Write-ahead log needs encryption keys to protect the passwords in it, or -wal-plaintext to keep them in the clear")
+	}
+	if cfg.WALCompactRecords < 0 {
+		problems = append(problems, "Write-ahead log compaction interval must not be negative")
 	}
+	if cfg.PepperRefresh < 0 {
+		problems = append(problems, "Pepper refresh interval must not be negative")
+	}
+	if cfg.MaxDigestBytes < 0 {
+		problems = append(problems, "Digest payload limit must not be negative")
+	}
+	if cfg.WarmupHashes < 0 || cfg.PreallocResults < 0 {
+		problems = append(problems, "Warm-up hashes and preallocated results must not be negative")
+	}
+	if cfg.MaxResults < 0 {
+		problems = append(problems, "Maximum results must not be negative")
+	}
+	if cfg.JumpCloudAuth && cfg.AuthCacheTTL <= 0 {
+		problems = append(problems, "Auth cache TTL must be positive")
+	}
+	if cfg.AbuseWindow <= 0 || cfg.AbuseThrottle <= 0 {
+		problems = append(problems, "Abuse window and throttle must be positive")
+	}
+	if len(cfg.RaftBind) > 0 && len(cfg.DataDir) > 0 {
+		problems = append(problems, "Data directory can't be used with raft, which keeps its state in the raft directory")
+	}
+	stores := 0
+	for _, v := range []string{cfg.DataDir, cfg.RedisURL, cfg.PostgresDSN} {
+		if len(v) > 0 {
+			stores++
+		}
+	}
+	if stores > 1 {
+		problems = append(problems, "Only one of a data directory, Redis and PostgreSQL can keep results")
+	}
+	if len(cfg.RaftBind) > 0 && (len(cfg.RedisURL) > 0 || len(cfg.PostgresDSN) > 0) {
+		problems = append(problems, "Redis and PostgreSQL can't be used with raft, which replicates results itself")
+	}
+	if len(cfg.RaftBind) > 0 && len(cfg.WALPath) > 0 {
+		problems = append(problems, "Write-ahead log can't be used with raft, which keeps its own log")
+	}
+	if len(cfg.RaftBind) > 0 && len(cfg.SnapshotPath) > 0 {
+		problems = append(problems, "Snapshot file can't be used with raft, which takes its own snapshots")
+	}
+	if cfg.IdempotencyWindow <= 0 {
+		problems = append(problems, "Idempotency window must be positive")
+	}
+	if cfg.SnapshotInterval <= 0 {
+		problems = append(problems, "Snapshot interval must be positive")
+	}
+	if len(cfg.PostgresDSN) > 0 && !slices.Contains(sql.Drivers(), cfg.PostgresDriver) {
+		problems = append(problems, fmt.Sprintf("PostgreSQL driver %q isn't built into this binary", cfg.PostgresDriver))
+	}
+	if cfg.PostgresMaxConns < 1 {
+		problems = append(problems, "PostgreSQL connections must be at least 1")
+	}
+	if cfg.RedisTTL < 0 {
+		problems = append(problems, "Redis TTL must not be negative")
+	}
+	if len(*importFile) > 0 {
+		if _, err := os.Stat(*importFile); err != nil {
+			problems = append(problems, fmt.Sprintf("Import file is not readable: %v", err))
+		}
+		if !slices.Contains([]string{JCServer.ConflictSkip, JCServer.ConflictOverwrite, JCServer.ConflictRenumber, JCServer.ConflictFail}, *importConflict) {
+			problems = append(problems, fmt.Sprintf("Unknown import conflict resolution '%s'", *importConflict))
+		}
+		if len(cfg.RaftBind) > 0 {
+			problems = append(problems, "Import can't be used with raft, load the results into a node before it joins")
+		}
+		if len(cfg.DataDir) == 0 && len(cfg.RedisURL) == 0 && len(cfg.PostgresDSN) == 0 && len(cfg.SnapshotPath) == 0 && len(cfg.WALPath) == 0 {
+			problems = append(problems, "Import needs a data directory, Redis, PostgreSQL, a snapshot file or a write-ahead log to keep the results in")
+		}
+	}
+	if len(cfg.RaftBind) > 0 && len(cfg.RaftDir) == 0 {
+		problems = append(problems, "Raft replication requires a data directory (-raft-dir)")
+	}
+	if (len(cfg.TLSCert) > 0) != (len(cfg.TLSKey) > 0) {
+		problems = append(problems, "-tls-cert and -tls-key must be given together")
+	}
+	if cfg.Distributed && len(cfg.TLSCert) == 0 {
+		problems = append(problems, "Distributed mode forwards passwords between nodes and requires -tls-cert and -tls-key")
+	}
+	if (cfg.Sharded || cfg.Distributed) && (len(cfg.ClusterBind) == 0 || len(cfg.RaftBind) > 0) {
+		problems = append(problems, "Sharded and distributed modes require -cluster-bind and cannot be combined with raft replication")
+	}
+
+	cfg.Settings = settings(cfg.Port, sources)
 
-	log.Printf("Starting server on port %d",listenPort)
-	JCServer.StartServer(listenPort)
+	if *validate {
+		// Show what the server would run with, then try its backends and
+		// report the verdict
+		for _, s := range JCServer.ReportedSettings(cfg) {
+			fmt.Printf("%s=%s (%s)\n", s.Name, s.Value, s.Source)
+		}
+		problems = append(problems, JCServer.CheckBackends(cfg, opts...)...)
+	}
+	for _, p := range problems {
+		fmt.Printf("%s\n", p)
+	}
+	if len(problems) > 0 {
+		syscall.Exit(-1)
+	}
+	if *validate {
+		fmt.Printf("Configuration is valid\n")
+		return
+	}
+
+	if len(*importFile) > 0 {
+		if err := importResults(cfg, opts, *importFile, *importConflict); err != nil {
+			log.Fatalf("Error importing %s: %v", *importFile, err)
+		}
+		return
+	}
+
+	log.Printf("Starting server on port %d",cfg.Port)
+	srv, err := JCServer.NewServer(cfg, opts...)
+	if err != nil {
+		log.Fatalf("Error creating server: %v", err)
+	}
+	go shutdownOnSignal(srv)
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Error running server: %v", err)
+	}
 	log.Printf("Service has shutdown")
 }
@@ -0,0 +1,179 @@
+/*********************************************************
+File: abuse.go
+Contents: Detection and throttling of abusive clients
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// What a single client has done in the current window
+type clientActivity struct {
+	windowStart    time.Time
+	posts          int
+	misses         int
+	authFailures   int
+	throttledUntil time.Time
+}
+
+// Context key for the client abuseGuard records a request against, its IP
+// until authenticate resolves a principal
+type abuseClientKey struct{}
+
+/* method abuseEnabled()
+Detection is on as soon as any threshold is configured
+*/
+func (s *Server) abuseEnabled() bool {
+	return s.config.AbusePostLimit > 0 || s.config.AbuseMissLimit > 0 || s.config.AbuseAuthLimit > 0
+}
+
+/* method auditAbuse()
+Record that a client has been throttled, in the log and in Sentry if enabled
+*/
+func (s *Server) auditAbuse(client string, reason string, count int) {
+	msg := fmt.Sprintf("Client %s throttled for %v: %s (%d in %v)", client, s.config.AbuseThrottle, reason, count, s.config.AbuseWindow)
+	log.Printf("AUDIT: %s", msg)
+	if s.bSentry {
+		sentry.CaptureMessage(msg)
+	}
+}
+
+/* method recordActivity()
+- Count the outcome of a request against the client's current window
+- Throttle the client if any threshold has been exceeded
+*/
+func (s *Server) recordActivity(client string, r *http.Request, status int) {
+	now := s.clock.Now()
+
+	s.mtxAbuse.Lock()
+	defer s.mtxAbuse.Unlock()
+
+	// Drop clients that have gone quiet so the map doesn't grow forever
+	if now.Sub(s.lastAbuseSweep) > s.config.AbuseWindow {
+		for k, a := range s.clientActivities {
+			if now.Sub(a.windowStart) > s.config.AbuseWindow && now.After(a.throttledUntil) {
+				delete(s.clientActivities, k)
+			}
+		}
+		s.lastAbuseSweep = now
+	}
+
+	a := s.clientActivities[client]
+	if a == nil {
+		a = &clientActivity{windowStart: now}
+		s.clientActivities[client] = a
+	}
+	if now.Sub(a.windowStart) > s.config.AbuseWindow {
+		a.windowStart = now
+		a.posts, a.misses, a.authFailures = 0, 0, 0
+	}
+
+	isHash := r.URL.Path == HashPath || strings.HasPrefix(r.URL.Path, HashPath+"/")
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		a.authFailures++
+	case isHash && r.Method == http.MethodPost:
+		a.posts++
+	case isHash && r.Method == http.MethodGet && (status == http.StatusBadRequest || status == http.StatusNotFound):
+		// Lookups of Ids that don't exist, typical of someone walking the Id space
+		a.misses++
+	}
+
+	var reason string
+	var count int
+	switch {
+	case s.config.AbuseAuthLimit > 0 && a.authFailures > s.config.AbuseAuthLimit:
+		reason, count = "repeated authorization failures", a.authFailures
+	case s.config.AbusePostLimit > 0 && a.posts > s.config.AbusePostLimit:
+		reason, count = "submission spike", a.posts
+	case s.config.AbuseMissLimit > 0 && a.misses > s.config.AbuseMissLimit:
+		reason, count = "task Id scanning", a.misses
+	default:
+		return
+	}
+	a.throttledUntil = now.Add(s.config.AbuseThrottle)
+	a.windowStart = now
+	a.posts, a.misses, a.authFailures = 0, 0, 0
+	s.auditAbuse(client, reason, count)
+}
+
+/* method throttledFor()
+Return how much longer the client is throttled for, zero if it isn't
+*/
+func (s *Server) throttledFor(client string) time.Duration {
+	s.mtxAbuse.Lock()
+	defer s.mtxAbuse.Unlock()
+	if a := s.clientActivities[client]; a != nil {
+		if left := a.throttledUntil.Sub(s.clock.Now()); left > 0 {
+			return left
+		}
+	}
+	return 0
+}
+
+/* method renderThrottled()
+Answer a throttled client with Too Many Requests, telling it to retry
+after `left`
+*/
+func renderThrottled(w http.ResponseWriter, r *http.Request, left time.Duration) {
+	// Round up so clients don't retry a moment too early
+	w.Header().Set("Retry-After", strconv.Itoa(int((left+time.Second-1)/time.Second)))
+	renderError(w, r, http.StatusTooManyRequests, ErrThrottled)
+}
+
+/* method throttlePrincipal()
+Record the request against the principal authenticate resolved for it
+rather than its IP, so clients sharing an address are told apart like
+clientKey does, and throttle it if the principal is.  Returns true when the
+request has been answered.
+*/
+func (s *Server) throttlePrincipal(w http.ResponseWriter, r *http.Request, principal string) bool {
+	client, ok := r.Context().Value(abuseClientKey{}).(*string)
+	if !ok || len(principal) == 0 {
+		// Abuse detection is off, or the request came from a peer
+		return false
+	}
+	*client = principal
+	if left := s.throttledFor(principal); left > 0 {
+		renderThrottled(w, r, left)
+		return true
+	}
+	return false
+}
+
+/* method abuseGuard()
+Reject requests from throttled clients with Too Many Requests, and watch
+everyone else's requests for abuse.  Requests are counted against the
+client's principal once it has authenticated and against its IP until
+then, so failed authorizations always count against the IP.  Cluster peers
+are never throttled.
+*/
+func (s *Server) abuseGuard(next http.Handler) http.Handler {
+	if !s.abuseEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.memberList != nil && s.isPeerRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := s.clientIP(r)
+		if left := s.throttledFor(client); left > 0 {
+			renderThrottled(w, r, left)
+			return
+		}
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), abuseClientKey{}, &client)))
+		s.recordActivity(client, r, sr.status)
+	})
+}
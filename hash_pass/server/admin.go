@@ -0,0 +1,85 @@
+/*********************************************************
+File: admin.go
+Contents: Authentication and listener of the admin endpoints
+*********************************************************/
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+/* method adminOnly()
+Require the configured admin token as a bearer token.  Without a token the
+admin endpoints are only served on an admin listener bound to a loopback
+address, and refused everywhere else.
+*/
+func (s *Server) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.AdminToken) == 0 {
+			if !s.adminLoopback {
+				renderError(w, r, http.StatusForbidden, ErrAdminClosed)
+				return
+			}
+		} else {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				renderError(w, r, http.StatusUnauthorized, ErrAdminToken)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* method routeProfiling()
+Register the pprof endpoints, only ever on the admin listener
+*/
+func (s *Server) routeProfiling() {
+	s.adminRoute(http.MethodGet, ProfilePath+"/", s.adminOnly(http.HandlerFunc(pprof.Index)))
+	s.adminRoute(http.MethodGet, ProfilePath+"/cmdline", s.adminOnly(http.HandlerFunc(pprof.Cmdline)))
+	s.adminRoute(http.MethodGet, ProfilePath+"/profile", s.adminOnly(http.HandlerFunc(pprof.Profile)))
+	s.adminRoute(http.MethodGet, ProfilePath+"/symbol", s.adminOnly(http.HandlerFunc(pprof.Symbol)))
+	s.adminRoute(http.MethodGet, ProfilePath+"/trace", s.adminOnly(http.HandlerFunc(pprof.Trace)))
+}
+
+/* method AdminHandler()
+Return the admin endpoints as an http.Handler for mounting in another
+server, nil without AdminAddr as they're served by Handler then
+*/
+func (s *Server) AdminHandler() http.Handler {
+	return s.adminHandler
+}
+
+/* method startAdmin()
+Listen on AdminAddr and serve the admin endpoints until the server stops
+*/
+func (s *Server) startAdmin() error {
+	s.adminServer = http.Server{
+		Addr:              s.config.AdminAddr,
+		Handler:           s.adminHandler,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+	}
+	ln, err := net.Listen("tcp", s.adminServer.Addr)
+	if err != nil {
+		return err
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		s.adminLoopback = addr.IP.IsLoopback()
+	}
+	log.Printf("Serving admin endpoints on %s", ln.Addr())
+	go func() {
+		if err := s.adminServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving admin endpoints: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,283 @@
+/*********************************************************
+File: archive.go
+Contents: Archival of old results to S3-compatible object storage
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Region signed for unless another is configured
+	DefaultArchiveRegion = "us-east-1"
+	// Age after completion at which results are archived unless another
+	// is configured
+	DefaultArchiveAfter = 24 * time.Hour
+
+	// Time allowed for each object request
+	archiveTimeout = 30 * time.Second
+	// Largest archived object read back
+	maxArchiveObject = 64 << 10
+)
+
+// Credentials signing requests to the bucket
+type ArchiveCredentials struct {
+	AccessKey string
+	SecretKey string
+	// Session token of temporary credentials, if any
+	SessionToken string
+}
+
+// Client of an S3-compatible bucket, addressed path-style as
+// <endpoint>/<bucket>/<prefix><task id> and signed with AWS Signature V4
+type objectArchive struct {
+	// Base of the object URLs, including the bucket and key prefix
+	base   *url.URL
+	region string
+	creds  ArchiveCredentials
+	client http.Client
+}
+
+/* method newObjectArchive()
+Create a client of the bucket at `rawURL`,
+http[s]://host[:port]/bucket[/prefix], e.g. https://s3.us-east-1.amazonaws.com/results/hash_pass/
+*/
+func newObjectArchive(rawURL string, region string, creds ArchiveCredentials) (*objectArchive, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || len(strings.Trim(u.Path, "/")) == 0 {
+		return nil, fmt.Errorf("archive URL must look like https://host/bucket[/prefix]")
+	}
+	if len(creds.AccessKey) == 0 || len(creds.SecretKey) == 0 {
+		return nil, fmt.Errorf("archive credentials are missing")
+	}
+	if !strings.Contains(strings.Trim(u.Path, "/"), "/") {
+		// Just a bucket, keys go directly in it
+		u.Path = "/" + strings.Trim(u.Path, "/") + "/"
+	}
+	return &objectArchive{base: u, region: region, creds: creds, client: http.Client{Timeout: archiveTimeout}}, nil
+}
+
+/* method s3Escape()
+Escape an object path as Signature V4 expects, everything but unreserved
+characters and slashes percent-encoded
+*/
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/* method signV4()
+Sign `req`, whose body hashes to `payloadHash`, at `now` with AWS Signature
+V4, covering the host and every header already set
+*/
+func signV4(req *http.Request, payloadHash string, region string, creds ArchiveCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(creds.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKey, scope, signedHeaders, signature))
+}
+
+/* method do()
+Make a signed request for object `id`, returning the response status and
+body
+*/
+func (a *objectArchive) do(method string, id string, body []byte) (int, []byte, error) {
+	u := *a.base
+	u.Path += id
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	payloadHash := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(payloadHash[:]), a.region, a.creds, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxArchiveObject))
+	return resp.StatusCode, data, err
+}
+
+/* method put()
+Archive `result` as `id`
+*/
+func (a *objectArchive) put(id string, result StoredResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	status, _, err := a.do(http.MethodPut, id, data)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d", status)
+	}
+	return err
+}
+
+/* method get()
+Return the result archived as `id`, false if there is none
+*/
+func (a *objectArchive) get(id string) (StoredResult, bool, error) {
+	var result StoredResult
+	status, data, err := a.do(http.MethodGet, id, nil)
+	switch {
+	case err != nil:
+		return result, false, err
+	case status == http.StatusNotFound:
+		return result, false, nil
+	case status != http.StatusOK:
+		return result, false, fmt.Errorf("status %d", status)
+	}
+	return result, true, json.Unmarshal(data, &result)
+}
+
+/* method openArchive()
+Set up the configured archive bucket, filling in the default region and
+age
+*/
+func (s *Server) openArchive() error {
+	region := s.config.ArchiveRegion
+	if len(region) == 0 {
+		region = DefaultArchiveRegion
+	}
+	if s.config.ArchiveAfter <= 0 {
+		s.config.ArchiveAfter = DefaultArchiveAfter
+	}
+	a, err := newObjectArchive(s.config.ArchiveURL, region, s.config.ArchiveCredentials)
+	if err != nil {
+		return err
+	}
+	s.archive = a
+	log.Printf("Archiving results older than %v to %s", s.config.ArchiveAfter, a.base.Redacted())
+	return nil
+}
+
+/* method archiveInterval()
+Return the time between archival sweeps, a tenth of the archive age
+between a second and a minute
+*/
+func (s *Server) archiveInterval() time.Duration {
+	return min(max(s.config.ArchiveAfter/10, time.Second), time.Minute)
+}
+
+/* method archiveResults()
+Move results that completed more than Config.ArchiveAfter before `now` to
+the archive.  Results under legal hold stay in the store.  Uploads are made
+without holding mtxMap, and a result that changed meanwhile is left for
+the next sweep.
+*/
+func (s *Server) archiveResults(now time.Time) {
+	cutoff := now.Add(-s.config.ArchiveAfter).UnixNano()
+	old := make(map[string]StoredResult)
+	s.mtxMap.Lock()
+	for id, result := range s.allResults() {
+		if result.Completed != 0 && result.Completed < cutoff && !s.onHold(id) {
+			old[id] = result
+		}
+	}
+	s.mtxMap.Unlock()
+
+	archived := 0
+	for id, result := range old {
+		if err := s.archive.put(id, s.sealer.sealResult(result)); err != nil {
+			log.Printf("Error archiving result %s, retrying next sweep: %v", id, err)
+			break
+		}
+		s.mtxMap.Lock()
+		if current, ok := s.getResult(id); ok && current == result && !s.onHold(id) {
+			s.lockedDeleteResult(id)
+			archived++
+		}
+		s.mtxMap.Unlock()
+	}
+	if archived > 0 {
+		log.Printf("Archived %d results", archived)
+	}
+}
+
+/* method archivedResult()
+Fetch result `id` from the archive, if one is configured
+*/
+func (s *Server) archivedResult(id string) (StoredResult, bool, error) {
+	if s.archive == nil {
+		return StoredResult{}, false, nil
+	}
+	result, ok, err := s.archive.get(id)
+	if !ok || err != nil {
+		return result, ok, err
+	}
+	result, err = s.sealer.openResult(result)
+	return result, err == nil, err
+}
@@ -0,0 +1,73 @@
+/*********************************************************
+File: auth.go
+Contents: Pluggable authentication of API clients
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Checks the credentials on a request and returns who made it
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal string, err error)
+}
+
+// Context key for the principal resolved by authenticate
+type principalKey struct{}
+
+// Returned by authenticators when the credentials can't be checked right
+// now, as opposed to being wrong
+var ErrAuthUnavailable = errors.New("credential validation unavailable")
+
+/* method requestPrincipal()
+Return the principal authenticate resolved for the request, "" if none
+*/
+func requestPrincipal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	return principal
+}
+
+/* method clientKey()
+Identify the client for per-client limits: its principal when it has
+authenticated, otherwise its IP
+*/
+func (s *Server) clientKey(r *http.Request) string {
+	if principal := requestPrincipal(r); len(principal) > 0 {
+		return principal
+	}
+	return s.clientIP(r)
+}
+
+/* method authenticate()
+Reject requests the authenticator doesn't accept, and make the principal
+available to `next`.  Jobs handed over by cluster peers were authenticated
+where they arrived.
+*/
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticator == nil || (s.memberList != nil && s.isPeerRequest(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, err := s.authenticator.Authenticate(r)
+		if errors.Is(err, ErrAuthUnavailable) {
+			log.Printf("Error authenticating %s: %v", s.clientLabel(r), err)
+			renderError(w, r, http.StatusServiceUnavailable, ErrAuthBackend)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "ApiKey")
+			renderError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if s.throttlePrincipal(w, r, principal) {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
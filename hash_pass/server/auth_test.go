@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Authenticator returning a fixed principal or error
+type stubAuthenticator struct {
+	principal string
+	err       error
+}
+
+func (a stubAuthenticator) Authenticate(r *http.Request) (string, error) {
+	return a.principal, a.err
+}
+
+// serveGuarded sends `r` through `guard` wrapping a handler that records
+// the principal it was called with, returning the status, that principal
+// and whether the handler ran
+func serveGuarded(guard func(http.Handler) http.Handler, r *http.Request) (int, string, bool) {
+	reached, principal := false, ""
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached, principal = true, requestPrincipal(r)
+	})
+	rec := httptest.NewRecorder()
+	guard(next).ServeHTTP(rec, r)
+	return rec.Code, principal, reached
+}
+
+func TestAdminOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		token    string
+		loopback bool
+		header   string
+		want     int
+	}{
+		{"no token off loopback", "", false, "", http.StatusForbidden},
+		{"no token off loopback ignores a bearer", "", false, "Bearer anything", http.StatusForbidden},
+		{"no token on loopback", "", true, "", http.StatusOK},
+		{"missing token", "secret", false, "", http.StatusUnauthorized},
+		{"missing token on loopback", "secret", true, "", http.StatusUnauthorized},
+		{"wrong token", "secret", false, "Bearer wrong", http.StatusUnauthorized},
+		{"token without scheme", "secret", false, "secret", http.StatusUnauthorized},
+		{"empty bearer", "secret", false, "Bearer ", http.StatusUnauthorized},
+		{"right token", "secret", false, "Bearer secret", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{config: Config{AdminToken: tc.token}, adminLoopback: tc.loopback}
+			r := httptest.NewRequest(http.MethodGet, AdminConfigPath, nil)
+			if len(tc.header) > 0 {
+				r.Header.Set("Authorization", tc.header)
+			}
+			status, _, reached := serveGuarded(s.adminOnly, r)
+			if tc.want == http.StatusOK {
+				if !reached {
+					t.Fatal("handler not reached")
+				}
+			} else if reached {
+				t.Fatal("handler reached despite being refused")
+			}
+			if status != tc.want {
+				t.Errorf("status %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesFailClosed(t *testing.T) {
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusForbidden},
+		{"secret", http.StatusUnauthorized},
+	} {
+		s, err := NewServer(Config{Workers: 1, AdminToken: tc.token})
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		for _, path := range []string{AdminConfigPath, FeaturesPath, RuntimePath, HashPath} {
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != tc.want {
+				t.Errorf("GET %s with admin token %q and no credentials got %d, want %d", path, tc.token, rec.Code, tc.want)
+			}
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		auth Authenticator
+		peer bool
+		want int
+	}{
+		{"no authenticator", nil, false, http.StatusOK},
+		{"accepted", stubAuthenticator{principal: "client-1"}, false, http.StatusOK},
+		{"refused", stubAuthenticator{err: errors.New("unknown key")}, false, http.StatusUnauthorized},
+		{"backend unavailable", stubAuthenticator{err: ErrAuthUnavailable}, false, http.StatusServiceUnavailable},
+		{"wrapped unavailable", stubAuthenticator{err: errors.Join(errors.New("timeout"), ErrAuthUnavailable)}, false, http.StatusServiceUnavailable},
+		// Without a cluster nothing is trusted as coming from a peer
+		{"claims to be a peer", stubAuthenticator{err: errors.New("no key")}, true, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{authenticator: tc.auth}
+			r := httptest.NewRequest(http.MethodPost, HashPath, nil)
+			if tc.peer {
+				r.Header.Set(peerSignatureHeader, "t=0,sig=00")
+				r.Header.Set(forwardedHeader, "node-2")
+			}
+			status, principal, reached := serveGuarded(s.authenticate, r)
+			if tc.want == http.StatusOK {
+				if !reached {
+					t.Fatal("handler not reached")
+				}
+				if want, _ := tc.auth.(stubAuthenticator); principal != want.principal {
+					t.Errorf("principal %q, want %q", principal, want.principal)
+				}
+				return
+			}
+			if reached {
+				t.Fatal("handler reached despite being refused")
+			}
+			if status != tc.want {
+				t.Errorf("status %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
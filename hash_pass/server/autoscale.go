@@ -0,0 +1,114 @@
+/*********************************************************
+File: autoscale.go
+Contents: Optional autoscaling of the worker pool on queue depth and wait
+*********************************************************/
+
+package server
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Queue wait the autoscaler aims for unless another is configured
+	DefaultAutoscaleWait = 100 * time.Millisecond
+
+	// Time between scaling decisions
+	autoscaleInterval = 5 * time.Second
+)
+
+// Bounds the autoscaler keeps the pool within, and the decisions it made
+type AutoscaleStat struct {
+	Min        int   `json:"min"`
+	Max        int   `json:"max"`
+	ScaleUps   int64 `json:"scale_ups"`
+	ScaleDowns int64 `json:"scale_downs"`
+}
+
+/* method autoscaleBounds()
+Return the fewest and most workers the autoscaler may leave, and false
+when it is off
+*/
+func (s *Server) autoscaleBounds() (int, int, bool) {
+	if s.config.AutoscaleMax <= 0 {
+		return 0, 0, false
+	}
+	return max(s.config.AutoscaleMin, 1), s.config.AutoscaleMax, true
+}
+
+/* method autoscaleWait()
+Return the queue wait the autoscaler aims for
+*/
+func (s *Server) autoscaleWait() time.Duration {
+	if s.config.AutoscaleWait > 0 {
+		return s.config.AutoscaleWait
+	}
+	return DefaultAutoscaleWait
+}
+
+/* method autoscaleWorkers()
+- Double the pool when jobs have waited longer than the target for a
+  worker since the last decision, or the oldest one queued has
+- Shrink it by a quarter when nothing is queued, fewer than half the
+  workers are busy and jobs were taken well within the target
+- Keep it within the bounds and log every change
+- Leave it alone while processing is paused
+*/
+func (s *Server) autoscaleWorkers(now time.Time) {
+	lo, hi, _ := s.autoscaleBounds()
+	goal := s.autoscaleWait()
+	p := &s.workers
+	p.mtx.Lock()
+	if p.paused {
+		// The queue grows for as long as the pool is paused
+		p.scaledStarted, p.scaledWaited = p.started, p.waited
+		p.mtx.Unlock()
+		return
+	}
+	size, busy, queued := p.size, p.busy, p.ready.len()
+	var wait time.Duration
+	if n := p.started - p.scaledStarted; n > 0 {
+		wait = time.Duration((p.waited - p.scaledWaited) / n)
+	}
+	if queued > 0 {
+		wait = max(wait, time.Duration(now.UnixNano()-p.ready.oldest()))
+	}
+	p.scaledStarted, p.scaledWaited = p.started, p.waited
+
+	target := size
+	switch {
+	case wait > goal:
+		target = size * 2
+	case queued == 0 && busy*2 < size && wait < goal/2:
+		target = size - max(size/4, 1)
+	}
+	target = min(max(target, lo), hi)
+	switch {
+	case target > size:
+		p.scaleUps++
+	case target < size:
+		p.scaleDowns++
+	}
+	p.mtx.Unlock()
+
+	if target == size {
+		return
+	}
+	s.resizeWorkers(target)
+	log.Printf("Autoscaler resized worker pool from %d to %d, %d busy, %d queued, waiting %v", size, target, busy, queued, wait)
+}
+
+/* method autoscaleStats()
+Return the autoscaler's bounds and decisions, nil when it is off
+*/
+func (s *Server) autoscaleStats() *AutoscaleStat {
+	lo, hi, ok := s.autoscaleBounds()
+	if !ok {
+		return nil
+	}
+	p := &s.workers
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return &AutoscaleStat{Min: lo, Max: hi, ScaleUps: p.scaleUps, ScaleDowns: p.scaleDowns}
+}
@@ -0,0 +1,71 @@
+/*********************************************************
+File: backlog.go
+Contents: At a glance summary of the jobs waiting and in progress
+*********************************************************/
+
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Payload returned by the queue endpoint.  Pending jobs are waiting out
+// their delay or for a worker, replicated ones included, and in-flight jobs
+// are being hashed.  OldestPending is the age of the longest waiting job in
+// microseconds, 0 when none is.
+type QueueStatus struct {
+	Pending       int64 `json:"pending"`
+	InFlight      int64 `json:"in_flight"`
+	Completed     int64 `json:"completed"`
+	OldestPending int64 `json:"oldest_pending"`
+}
+
+/* method queueStatus()
+Count the jobs on this node by state at `now`, and the jobs completed since
+it started
+*/
+func (s *Server) queueStatus(now time.Time) QueueStatus {
+	var status QueueStatus
+	oldest := int64(0)
+	pending := func(submitted int64) {
+		status.Pending++
+		if submitted > 0 && (oldest == 0 || submitted < oldest) {
+			oldest = submitted
+		}
+	}
+
+	s.mtxMap.Lock()
+	for _, state := range s.jobStates {
+		if state.Status == StatusProcessing {
+			status.InFlight++
+		} else {
+			pending(state.Submitted)
+		}
+	}
+	for _, job := range s.pendingJobs {
+		pending(job.Submitted)
+	}
+	s.mtxMap.Unlock()
+
+	s.mtxId.Lock()
+	status.Completed = s.outcomeCounts[OutcomeCompleted]
+	s.mtxId.Unlock()
+	if oldest > 0 {
+		status.OldestPending = max(now.UnixNano()-oldest, 0) / int64(time.Microsecond)
+	}
+	return status
+}
+
+/*
+	method getQueue()
+	Handle GET request for URL path `/queue`, returning a JSON object with
+	this node's backlog
+*/
+func (s *Server) getQueue(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.queueStatus(s.clock.Now()))
+}
@@ -0,0 +1,166 @@
+/*********************************************************
+File: backup.go
+Contents: Admin backup of the result store and its restore elsewhere
+*********************************************************/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Format of the backups written by this version
+	backupVersion = 1
+	// Prefix of a backup checksum, followed by the hex SHA-256 of the
+	// contents exactly as they appear in the file
+	checksumPrefix = "sha256:"
+)
+
+// A backup file.  Checksum covers Contents byte for byte, so a file altered
+// or cut short in transit is refused.
+type backupFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+// What a backup holds
+type backupContents struct {
+	Created   time.Time               `json:"created"`
+	Node      string                  `json:"node,omitempty"`
+	RequestID int64                   `json:"request_id"`
+	Results   map[string]StoredResult `json:"results"`
+	Holds     map[string]bool         `json:"holds,omitempty"`
+}
+
+// Body of a successful restore
+type RestoreSummary struct {
+	Results   int   `json:"results"`
+	Holds     int   `json:"holds"`
+	RequestID int64 `json:"request_id"`
+}
+
+func backupChecksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+/*
+	method getBackup()
+	Handle GET request for URL path `/admin/backup`, downloading every
+	stored result, the legal holds and the request counter.  The backup is
+	kept for a while so an interrupted download can resume with a Range
+	request.
+*/
+func (s *Server) getBackup(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	created := s.clock.Now().UTC()
+	name := "hash_pass-backup-" + created.Format("20060102T150405Z") + ".json"
+	s.serveDownload(w, r, BackupPath, name, "application/json", func(out io.Writer) (string, error) {
+		contents := backupContents{Created: created, Node: s.config.NodeName}
+		s.mtxId.Lock()
+		contents.RequestID = s.requestID
+		s.mtxId.Unlock()
+		s.mtxMap.Lock()
+		contents.Results = s.allResults()
+		for id, result := range contents.Results {
+			contents.Results[id] = s.sealer.sealResult(result)
+		}
+		contents.Holds = s.lockedHolds()
+		s.mtxMap.Unlock()
+
+		jtext, err := json.Marshal(contents)
+		if err == nil {
+			err = json.NewEncoder(out).Encode(backupFile{Version: backupVersion, Checksum: backupChecksum(jtext), Contents: jtext})
+		}
+		return fmt.Sprintf("Backup of %d results", len(contents.Results)), err
+	})
+}
+
+/*
+	method postRestore()
+	Handle POST request for URL path `/admin/restore`, loading a backup
+	into an instance that holds no results or jobs yet
+*/
+func (s *Server) postRestore(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	if _, shared := s.store.(SequenceStore); shared || s.raftNode != nil {
+		// Restoring one node would put it out of step with the others, and
+		// the counter of a shared store can't be moved on
+		renderError(w, r, http.StatusConflict, ErrRestore)
+		return
+	}
+
+	var file backupFile
+	if err := json.NewDecoder(r.Body).Decode(&file); err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrBackup)
+		return
+	}
+	if file.Version < 1 || file.Version > backupVersion || !strings.HasPrefix(file.Checksum, checksumPrefix) || backupChecksum(file.Contents) != file.Checksum {
+		renderError(w, r, http.StatusBadRequest, ErrBackup)
+		return
+	}
+	var contents backupContents
+	if err := json.Unmarshal(file.Contents, &contents); err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrBackup)
+		return
+	}
+	results := make(map[string]StoredResult, len(contents.Results))
+	for id, result := range contents.Results {
+		opened, err := s.sealer.openResult(result)
+		if err != nil {
+			log.Printf("Error decrypting result %s in backup: %v", id, err)
+			renderError(w, r, http.StatusBadRequest, ErrBackup)
+			return
+		}
+		results[id] = opened
+	}
+
+	s.mtxMap.Lock()
+	if s.countResults() > 0 || len(s.jobStates) > 0 || len(s.pendingJobs) > 0 {
+		s.mtxMap.Unlock()
+		renderError(w, r, http.StatusConflict, ErrRestore)
+		return
+	}
+	// Holds first, so eviction passes over the held results
+	for k, v := range contents.Holds {
+		if err := s.lockedPutHold(k, v); err != nil {
+			s.mtxMap.Unlock()
+			log.Printf("Error restoring legal hold on request Id %s: %v", k, err)
+			renderError(w, r, http.StatusServiceUnavailable, ErrStorage)
+			return
+		}
+	}
+	for id, result := range results {
+		s.lockedPutResult(id, result)
+	}
+	s.mtxMap.Unlock()
+	s.mtxId.Lock()
+	s.requestID = max(s.requestID, contents.RequestID)
+	n := s.requestID
+	s.mtxId.Unlock()
+	if cs, ok := s.store.(CounterStore); ok {
+		if err := cs.SaveCounter(n); err != nil {
+			log.Printf("Error saving request counter: %v", err)
+		}
+	}
+
+	log.Printf("AUDIT: Backup of %d results taken %s restored by %s", len(results), contents.Created.Format(time.RFC3339), s.clientLabel(r))
+	writeJSON(w, r, http.StatusOK, RestoreSummary{Results: len(results), Holds: len(contents.Holds), RequestID: n})
+}
@@ -0,0 +1,317 @@
+/*********************************************************
+File: boltstore.go
+Contents: bbolt-backed Store keeping results and the counter across restarts
+*********************************************************/
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// Layout of the buckets written by this version
+	boltStoreVersion = 1
+)
+
+var (
+	// Bucket names, results by task Id, dead letters by sequence number,
+	// deleted results and legal holds by task Id and the store's own
+	// settings
+	bucketResults     = []byte("results")
+	bucketDeadLetters = []byte("dead_letters")
+	bucketDeleted     = []byte("deleted")
+	bucketHolds       = []byte("holds")
+	bucketMeta        = []byte("meta")
+
+	// Keys in bucketMeta, both 8 byte big endian
+	keyVersion   = []byte("version")
+	keyRequestID = []byte("request_id")
+)
+
+// Implements CounterStore, DeadLetterStore and RetentionStore on a single
+// bbolt file
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func uint64Bytes(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+/* method OpenBoltStore()
+Open (or create) the store at `path`, creating its buckets and migrating a
+file written before the request counter was kept
+*/
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		results, err := tx.CreateBucketIfNotExists(bucketResults)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketDeadLetters, bucketDeleted, bucketHolds} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if v := meta.Get(keyVersion); v != nil && binary.BigEndian.Uint64(v) > boltStoreVersion {
+			return fmt.Errorf("store version %d is newer than this build supports", binary.BigEndian.Uint64(v))
+		}
+		if meta.Get(keyRequestID) == nil {
+			// Carry on from the highest Id stored so none is handed out twice
+			var highest uint64
+			results.ForEach(func(k, _ []byte) error {
+				id := string(k)
+				if n, err := strconv.ParseUint(id[strings.LastIndex(id, shardSeparator)+1:], 10, 64); err == nil {
+					highest = max(highest, n)
+				}
+				return nil
+			})
+			if err := meta.Put(keyRequestID, uint64Bytes(highest)); err != nil {
+				return err
+			}
+			if highest > 0 {
+				log.Printf("Migrated request counter of %s to %d", path, highest)
+			}
+		}
+		return meta.Put(keyVersion, uint64Bytes(boltStoreVersion))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) Put(id string, result StoredResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketResults).Put([]byte(id), data)
+	})
+}
+
+func (b *BoltStore) Get(id string) (StoredResult, bool, error) {
+	var result StoredResult
+	var found bool
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucketResults).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &result)
+	})
+	return result, found, err
+}
+
+func (b *BoltStore) Delete(id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketResults).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStore) List(fn func(id string, result StoredResult) bool) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketResults).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var result StoredResult
+			if err := json.Unmarshal(v, &result); err != nil {
+				return fmt.Errorf("result %s: %w", k, err)
+			}
+			if !fn(string(k), result) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Count() (int, error) {
+	var n int
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(bucketResults).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+/* method SaveCounter()
+Record the counter unless a higher value already is, so concurrent saves
+can land in any order.  Saves are batched into shared transactions.
+*/
+func (b *BoltStore) SaveCounter(n int64) error {
+	return b.db.Batch(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if v := meta.Get(keyRequestID); v != nil && int64(binary.BigEndian.Uint64(v)) >= n {
+			return nil
+		}
+		return meta.Put(keyRequestID, uint64Bytes(uint64(n)))
+	})
+}
+
+func (b *BoltStore) LoadCounter() (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(bucketMeta).Get(keyRequestID); v != nil {
+			n = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return n, err
+}
+
+/* method PutDeadLetter()
+Append `d` under the bucket's next sequence number, so the keys sort
+oldest first, and drop the oldest beyond `keep`
+*/
+func (b *BoltStore) PutDeadLetter(d DeadLetter, keep int) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		letters := tx.Bucket(bucketDeadLetters)
+		seq, err := letters.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := letters.Put(uint64Bytes(seq), data); err != nil {
+			return err
+		}
+		c := letters.Cursor()
+		n := 0
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		for ; n > keep; n-- {
+			c.First()
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) ListDeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketDeadLetters).ForEach(func(k, v []byte) error {
+			var d DeadLetter
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("dead letter %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			letters = append(letters, d)
+			return nil
+		})
+	})
+	return letters, err
+}
+
+func (b *BoltStore) ClearDeadLetters() error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(bucketDeadLetters); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(bucketDeadLetters)
+		return err
+	})
+}
+
+func (b *BoltStore) PutDeleted(id string, result StoredResult, at int64) error {
+	data, err := json.Marshal(newDeletedResult(result, at))
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketDeleted).Put([]byte(id), data)
+	})
+}
+
+func (b *BoltStore) GetDeleted(id string) (StoredResult, int64, bool, error) {
+	var d deletedResult
+	var found bool
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucketDeleted).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &d)
+	})
+	return d.result(), d.At, found, err
+}
+
+func (b *BoltStore) ForgetDeleted(id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketDeleted).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStore) ListDeleted(fn func(id string, result StoredResult, at int64) bool) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketDeleted).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var d deletedResult
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("deleted result %s: %w", k, err)
+			}
+			if !fn(string(k), d.result(), d.At) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) SetHold(id string, held bool) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if held {
+			return tx.Bucket(bucketHolds).Put([]byte(id), []byte{1})
+		}
+		return tx.Bucket(bucketHolds).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStore) Held(id string) (bool, error) {
+	var held bool
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		held = tx.Bucket(bucketHolds).Get([]byte(id)) != nil
+		return nil
+	})
+	return held, err
+}
+
+func (b *BoltStore) ListHolds() ([]string, error) {
+	var ids []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketHolds).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
@@ -0,0 +1,192 @@
+/*********************************************************
+File: callback.go
+Contents: Signed webhook delivery of results to a job's callback URL
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// Headers of a callback, the time it was signed in Unix seconds and
+	// sha256=<hex HMAC-SHA256 of the timestamp, a dot and the body>
+	CallbackTimestampHeader = "X-Hash-Timestamp"
+	CallbackSignatureHeader = "X-Hash-Signature"
+
+	// Time allowed for each delivery attempt, and the wait before the first
+	// retry, doubling for each one after up to maxCallbackBackoff
+	callbackTimeout    = 10 * time.Second
+	callbackBackoff    = time.Second
+	maxCallbackBackoff = 5 * time.Minute
+)
+
+var (
+	// Networks a callback is never delivered to unless
+	// Config.CallbackAllowPrivate is set, on top of the loopback, private,
+	// link-local, multicast and unspecified addresses: "this network" and
+	// carrier-grade NAT
+	reservedNetworks = []*net.IPNet{
+		mustParseCIDR("0.0.0.0/8"),
+		mustParseCIDR("100.64.0.0/10"),
+	}
+
+	// Returned when a callback URL resolves to an address we don't deliver to
+	errCallbackTarget = errors.New("callback address is not publicly routable")
+)
+
+/* method mustParseCIDR()
+Parse a network that is known to be valid
+*/
+func mustParseCIDR(v string) *net.IPNet {
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+/* method publicIP()
+Report whether `ip` is a publicly routable unicast address
+*/
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+/* method newCallbackClient()
+Create the client delivering callbacks.  The address is checked as each
+connection is made, after DNS resolution, so a name can't point a callback
+at this host or its network, and redirects are never followed since they
+could lead anywhere.
+*/
+func (s *Server) newCallbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: callbackTimeout}
+	if !s.config.CallbackAllowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicIP(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", errCallbackTarget, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialled instead of the target, bypassing the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   callbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/* method validCallback()
+Report whether `v` is an absolute http or https URL a result can be sent to
+*/
+func validCallback(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0 && u.User == nil
+}
+
+/* method signCallback()
+Return the signature header value of a callback body sent at `ts`
+*/
+func signCallback(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/* method postCallback()
+Make one delivery attempt.  Returns whether a failure is worth retrying:
+network errors, 429 and 5xx are, other refusals, redirects and addresses
+we don't deliver to are not.
+*/
+func (s *Server) postCallback(target string, body []byte, c correlation) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.RequestID) > 0 {
+		req.Header.Set(RequestIDHeader, c.RequestID)
+	}
+	if len(s.config.CallbackSecret) > 0 {
+		ts := strconv.FormatInt(s.clock.Now().Unix(), 10)
+		req.Header.Set(CallbackTimestampHeader, ts)
+		req.Header.Set(CallbackSignatureHeader, signCallback(s.config.CallbackSecret, ts, body))
+	}
+
+	resp, err := s.callbackClient.Do(req)
+	if errors.Is(err, errCallbackTarget) {
+		return false, err
+	} else if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+/* method sendCallback()
+POST the result of job `requestId` to `target` in the background, retrying
+with exponential backoff up to Config.CallbackRetries times
+*/
+func (s *Server) sendCallback(target string, requestId string, result StoredResult, c correlation) {
+	body, _ := json.Marshal(hashResult(requestId, StatusComplete, result))
+	go func() {
+		backoff := callbackBackoff
+		for attempt := 0; ; attempt++ {
+			retry, err := s.postCallback(target, body, c)
+			if err == nil {
+				log.Printf("Callback for request Id %s delivered%s", requestId, c.logSuffix())
+				return
+			}
+			if !retry || attempt >= s.config.CallbackRetries {
+				log.Printf("Callback for request Id %s failed after %d attempts: %v%s", requestId, attempt+1, err, c.logSuffix())
+				s.recordDeadLetter(requestId, DeadLetterCallback, err, attempt+1, c)
+				return
+			}
+			log.Printf("Callback for request Id %s failed, retrying in %v: %v%s", requestId, backoff, err, c.logSuffix())
+			s.clock.Sleep(backoff)
+			backoff = min(2*backoff, maxCallbackBackoff)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+/*********************************************************
+File: cancel.go
+Contents: Cancellation of jobs still waiting for a worker
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Time a cancelled task Id is remembered, so its GETs can say so
+	cancelledRetention = 24 * time.Hour
+	// Time between sweeps of the cancelled task Ids
+	cancelledSweepInterval = time.Minute
+)
+
+var (
+	// Wraps context.Canceled so the job's trace span is marked cancelled
+	errJobCancelled = fmt.Errorf("cancelled by request: %w", context.Canceled)
+)
+
+/* method cancelJob()
+Remove job `id` from the queue if no worker has taken it yet, waiting out
+its delay or queued for a worker, and remember it was cancelled
+*/
+func (s *Server) cancelJob(id string, now time.Time) bool {
+	p := &s.workers
+	p.mtx.Lock()
+	job, ok := p.byID[id]
+	if ok {
+		delete(p.byID, id)
+		job.cancelled = true
+		if !job.timer.Stop() && job.readyAt > 0 {
+			p.ready.remove(job)
+		}
+	}
+	p.mtx.Unlock()
+	if !ok {
+		return false
+	}
+
+	// Recorded before the job's watchers are told it has gone
+	s.mtxMap.Lock()
+	s.cancelledJobs[id] = now.UnixNano()
+	s.mtxMap.Unlock()
+	s.endJob(job, errJobCancelled)
+	return true
+}
+
+/* method jobCancelled()
+Report whether job `id` was cancelled
+*/
+func (s *Server) jobCancelled(id string) bool {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	_, ok := s.cancelledJobs[id]
+	return ok
+}
+
+/* method expireCancelled()
+Forget the cancelled task Ids older than cancelledRetention
+*/
+func (s *Server) expireCancelled(now time.Time) {
+	cutoff := now.Add(-cancelledRetention).UnixNano()
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	for id, at := range s.cancelledJobs {
+		if at <= cutoff {
+			delete(s.cancelledJobs, id)
+		}
+	}
+}
+
+/*
+	method cancelHash()
+	Handle POST request for URL path `/hash/{id}/cancel`, removing a job
+	no worker has taken yet.  Cancelling a cancelled job again succeeds.
+*/
+func (s *Server) cancelHash(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	id := r.PathValue("id")
+	if s.forwardToOwner(w, r, id) {
+		return
+	}
+	if s.cancelJob(id, s.clock.Now()) {
+		log.Printf("AUDIT: Request Id %s cancelled by %s", id, s.clientLabel(r))
+	} else if !s.jobCancelled(id) {
+		if _, status := s.jobStatus(id); len(status) == 0 {
+			renderError(w, r, http.StatusNotFound, ErrInvalidId)
+		} else {
+			// Being hashed, complete, or replicated and so hashed already
+			renderError(w, r, http.StatusConflict, ErrNotPending)
+		}
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, r, http.StatusOK, HashResult{ID: TaskID(id), Status: StatusCancelled})
+		return
+	}
+	if _, err := fmt.Fprint(w, StatusCancelled); err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+/*********************************************************
+File: clock.go
+Contents: Source of the time and timers jobs are scheduled by
+*********************************************************/
+
+package server
+
+import (
+	"time"
+)
+
+// Tells the time and runs timers for everything the server schedules or
+// stamps: processing delays, retry and callback backoffs, result
+// timestamps and expiry, cancellation, deletion recovery, throttling, the
+// SLO windows, long-poll waits and the maintenance loop.  Tests can
+// substitute a FakeClock with WithClock and advance it rather than wait out
+// real delays.  Network deadlines, request signing for S3 and warm-up
+// timings stay on the wall clock, as they measure real time.
+type Clock interface {
+	Now() time.Time
+	// Call f in its own goroutine once `d` has passed
+	AfterFunc(d time.Duration, f func()) Timer
+	Sleep(d time.Duration)
+}
+
+// A call scheduled by Clock.AfterFunc.  Stop reports whether it prevented
+// the call, false once it has run or been stopped.
+type Timer interface {
+	Stop() bool
+}
+
+// The wall clock, used unless another is given
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
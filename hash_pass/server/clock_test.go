@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls `cond` until it holds, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockAdvance(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	fired := make(chan time.Duration, 2)
+	c.AfterFunc(2*time.Second, func() { fired <- 2 * time.Second })
+	c.AfterFunc(5*time.Second, func() { fired <- 5 * time.Second })
+	stopped := c.AfterFunc(3*time.Second, func() { fired <- 3 * time.Second })
+	if !stopped.Stop() {
+		t.Fatal("Stop of a waiting timer reported false")
+	}
+
+	c.Advance(time.Second)
+	if got := c.Now(); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("Now() = %v, want %v", got, start.Add(time.Second))
+	}
+	if n := c.Pending(); n != 2 {
+		t.Fatalf("Pending() = %d, want 2", n)
+	}
+
+	c.Advance(time.Second)
+	if d := <-fired; d != 2*time.Second {
+		t.Fatalf("fired %v timer, want 2s", d)
+	}
+	c.Advance(10 * time.Second)
+	if d := <-fired; d != 5*time.Second {
+		t.Fatalf("fired %v timer, want 5s", d)
+	}
+	if c.Pending() != 0 {
+		t.Fatal("timers still pending after every one came due")
+	}
+	select {
+	case d := <-fired:
+		t.Fatalf("stopped %v timer fired", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFakeClockSleep(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	woke := make(chan struct{})
+	go func() {
+		c.Sleep(time.Minute)
+		close(woke)
+	}()
+	waitFor(t, "Sleep to start waiting", func() bool { return c.Pending() == 1 })
+
+	c.Advance(59 * time.Second)
+	select {
+	case <-woke:
+		t.Fatal("Sleep returned before its duration passed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	<-woke
+}
+
+func TestJobDelayFollowsClock(t *testing.T) {
+	c := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := NewServer(Config{Workers: 1}, WithClock(c), WithDelay(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	h := s.Handler()
+
+	req := httptest.NewRequest(http.MethodPost, HashPath, strings.NewReader(url.Values{"password": {"angryMonkey"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST status %d: %s", rec.Code, rec.Body)
+	}
+	id := strings.TrimSpace(rec.Body.String())
+
+	status := func() string {
+		_, st := s.jobStatus(id)
+		return st
+	}
+	if st := status(); st != StatusPending {
+		t.Fatalf("status before the delay = %q, want %q", st, StatusPending)
+	}
+	c.Advance(4 * time.Second)
+	if st := status(); st != StatusPending {
+		t.Fatalf("status a second before the delay ends = %q, want %q", st, StatusPending)
+	}
+	c.Advance(time.Second)
+	waitFor(t, "the job to complete", func() bool { return status() == StatusComplete })
+
+	result, _ := s.getResult(id)
+	if want := c.Now().Add(-5 * time.Second).UnixNano(); result.Submitted != want {
+		t.Errorf("result submitted at %d, want the fake clock's %d", result.Submitted, want)
+	}
+}
@@ -0,0 +1,209 @@
+/*********************************************************
+File: cluster.go
+Contents: Gossip-based peer discovery between service instances
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// Time allowed to tell the other nodes we are leaving
+	clusterLeaveTimeout = 5 * time.Second
+)
+
+// A service instance discovered through gossip
+type Peer struct {
+	Name string `json:"name"`
+	// Base URL of the instance's HTTP API
+	Addr string `json:"addr"`
+	Self bool   `json:"self"`
+}
+
+// Metadata each node gossips about itself
+type nodeMeta struct {
+	Port int `json:"port"`
+	// Set when the API is served over HTTPS
+	TLS bool `json:"tls,omitempty"`
+}
+
+// memberlist.Delegate that only publishes our metadata
+type clusterDelegate struct {
+	meta []byte
+}
+
+func (d *clusterDelegate) NodeMeta(limit int) []byte                  { return d.meta }
+func (d *clusterDelegate) NotifyMsg([]byte)                           {}
+func (d *clusterDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *clusterDelegate) LocalState(join bool) []byte                { return nil }
+func (d *clusterDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// memberlist.EventDelegate that logs membership changes
+type clusterEvents struct {
+	s *Server
+}
+
+// memberlist holds its member lock while notifying, so anything that reads
+// the member list has to run on its own goroutine
+func (e *clusterEvents) NotifyJoin(n *memberlist.Node) {
+	log.Printf("Cluster node %s joined", n.Name)
+	go e.s.rebuildRing()
+}
+
+func (e *clusterEvents) NotifyLeave(n *memberlist.Node) {
+	log.Printf("Cluster node %s left", n.Name)
+	go e.s.rebuildRing()
+}
+
+func (e *clusterEvents) NotifyUpdate(n *memberlist.Node) {}
+
+/* method nodeName()
+Name identifying this instance to its peers, defaults to hostname-port
+*/
+func (s *Server) nodeName() string {
+	if len(s.config.NodeName) > 0 {
+		return s.config.NodeName
+	}
+	hostname, _ := os.Hostname()
+	return hostname + "-" + strconv.Itoa(s.config.Port)
+}
+
+/* method startCluster()
+- Start gossiping on the configured bind address, advertising the port the
+  API listener is bound to, with gossip encrypted and authenticated by the
+  cluster key
+- Join any seed nodes we were given, it is not an error if none of them
+  answer since they may join us later
+*/
+func (s *Server) startCluster() error {
+	host, portStr, err := net.SplitHostPort(s.config.ClusterBind)
+	if err != nil {
+		return fmt.Errorf("invalid cluster bind address '%s': %v", s.config.ClusterBind, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid cluster bind port '%s'", portStr)
+	}
+	if !validClusterKey(s.config.ClusterKey) {
+		return ErrClusterKey
+	}
+	meta, _ := json.Marshal(nodeMeta{Port: s.listenPort(), TLS: s.tlsCert != nil})
+
+	mlConfig := memberlist.DefaultLANConfig()
+	mlConfig.Name = s.nodeName()
+	mlConfig.BindAddr = host
+	mlConfig.BindPort = port
+	mlConfig.AdvertiseAddr = s.config.ClusterAdvertise
+	mlConfig.Delegate = &clusterDelegate{meta: meta}
+	mlConfig.Events = &clusterEvents{s: s}
+	mlConfig.SecretKey = s.config.ClusterKey
+	s.peerKey = derivePeerKey(s.config.ClusterKey)
+
+	s.memberList, err = memberlist.Create(mlConfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("Cluster node %s gossiping on %s", mlConfig.Name, s.config.ClusterBind)
+	s.rebuildRing()
+
+	if len(s.config.ClusterJoin) > 0 {
+		n, err := s.memberList.Join(s.config.ClusterJoin)
+		if err != nil {
+			log.Printf("Unable to join cluster: %v", err)
+		} else {
+			log.Printf("Joined cluster through %d seed node(s)", n)
+		}
+	}
+	return nil
+}
+
+/* method leaveCluster()
+Tell the other nodes we are going away and stop gossiping
+*/
+func (s *Server) leaveCluster() {
+	if s.memberList == nil {
+		return
+	}
+	if err := s.memberList.Leave(clusterLeaveTimeout); err != nil {
+		log.Printf("Error leaving cluster: %v", err)
+	}
+	if err := s.memberList.Shutdown(); err != nil {
+		log.Printf("Error stopping cluster membership: %v", err)
+	}
+}
+
+/* method clusterPeers()
+Return the live members of the cluster including this node.  This is the
+hook cross-node features use to find the other instances.
+*/
+func (s *Server) clusterPeers() []Peer {
+	if s.memberList == nil {
+		return nil
+	}
+	self := s.memberList.LocalNode().Name
+	var peers []Peer
+	for _, n := range s.memberList.Members() {
+		var meta nodeMeta
+		if err := json.Unmarshal(n.Meta, &meta); err != nil {
+			// Not one of ours
+			continue
+		}
+		scheme := "http://"
+		if meta.TLS {
+			scheme = "https://"
+		}
+		peers = append(peers, Peer{
+			Name: n.Name,
+			Addr: scheme + net.JoinHostPort(n.Addr.String(), strconv.Itoa(meta.Port)),
+			Self: n.Name == self,
+		})
+	}
+	return peers
+}
+
+/* method peersOnly()
+Serve only requests from cluster members, answering others as if the route
+didn't exist
+*/
+func (s *Server) peersOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.memberList == nil || !s.isPeerRequest(r) {
+			notFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	method getCluster()
+	Return a JSON list of the known cluster members
+*/
+func (s *Server) getCluster(w http.ResponseWriter, r *http.Request) {
+	// If we're shutting down we will not accept requests
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	peers := s.clusterPeers()
+	if peers == nil {
+		peers = []Peer{}
+	}
+	jtext, _ := json.Marshal(peers)
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning cluster members: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*********************************************************
+File: clusterstats.go
+Contents: Aggregation of statistics across all cluster members
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Peers that don't answer within this time are left out of the totals
+	peerStatsTimeout = 2 * time.Second
+)
+
+// Statistics summed over every reachable node
+type ClusterStat struct {
+	RequestStat
+	// Number of nodes included in the totals
+	Nodes int `json:"nodes"`
+	// Names of peers whose statistics could not be fetched
+	Unreachable []string `json:"unreachable"`
+}
+
+/* method fetchPeerStats()
+Get the local statistics of a single peer, in nanoseconds
+*/
+func (s *Server) fetchPeerStats(client *http.Client, peer Peer) (RequestStat, error) {
+	var stats RequestStat
+	req, err := http.NewRequest(http.MethodGet, peer.Addr+StatsPath+"?"+ScopeKey+"="+ScopeLocal+"&"+UnitKey+"="+UnitNanoseconds, nil)
+	if err != nil {
+		return stats, err
+	}
+	req.Header.Set(forwardedHeader, s.nodeName())
+	s.signPeerRequest(req, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	// Peers that predate units ignore the parameter and answer in microseconds
+	return stats.inUnit(UnitNanoseconds), err
+}
+
+/* method sameBounds()
+Report whether two histograms were collected with the same buckets
+*/
+func sameBounds(a, b LatencyHistogram) bool {
+	if len(a.Bounds) != len(b.Bounds) || len(a.Counts) != len(b.Counts) {
+		return false
+	}
+	for i := range a.Bounds {
+		if a.Bounds[i] != b.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* method squareSum()
+Recover the sum of squared times from a node's mean and standard deviation
+*/
+func squareSum(s RequestStat) float64 {
+	n := float64(s.Total)
+	return n * (s.StdDev*s.StdDev + s.Average*s.Average)
+}
+
+/* method clusterStats()
+- Query every known peer for its local statistics in parallel
+- Sum the counts, outcomes, country breakdowns and latency histograms,
+  weight the averages by count and combine the spreads
+*/
+func (s *Server) clusterStats() ClusterStat {
+	local := s.localStats()
+	agg := ClusterStat{
+		RequestStat: local,
+		Nodes:       1,
+		Unreachable: []string{},
+	}
+	elapsed := local.Average * float64(local.Total)
+	squares := squareSum(local)
+
+	var peers []Peer
+	for _, p := range s.clusterPeers() {
+		if !p.Self {
+			peers = append(peers, p)
+		}
+	}
+	results := make([]RequestStat, len(peers))
+	errs := make([]error, len(peers))
+
+	client := s.peerClient(peerStatsTimeout)
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p Peer) {
+			defer wg.Done()
+			results[i], errs[i] = s.fetchPeerStats(client, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for i, p := range peers {
+		if errs[i] != nil {
+			log.Printf("Error fetching statistics from %s: %v", p.Name, errs[i])
+			agg.Unreachable = append(agg.Unreachable, p.Name)
+			continue
+		}
+		stats := results[i]
+		agg.Nodes++
+		if stats.Total > 0 {
+			if agg.Total == 0 || stats.Min < agg.Min {
+				agg.Min = stats.Min
+			}
+			agg.Max = max(agg.Max, stats.Max)
+		}
+		agg.Total += stats.Total
+		agg.Timeouts += stats.Timeouts
+		agg.Evictions += stats.Evictions
+		agg.QueueDepth += stats.QueueDepth
+		agg.QueueRejections += stats.QueueRejections
+		agg.Goroutines += stats.Goroutines
+		if stats.Workers != nil {
+			if agg.Workers == nil {
+				agg.Workers = &WorkerStat{}
+			}
+			agg.Workers.Size += stats.Workers.Size
+			agg.Workers.Running += stats.Workers.Running
+			agg.Workers.Busy += stats.Workers.Busy
+			agg.Workers.Queued += stats.Workers.Queued
+			agg.Workers.Clients += stats.Workers.Clients
+			agg.Workers.Paused = agg.Workers.Paused || stats.Workers.Paused
+			if a := stats.Workers.Autoscale; a != nil {
+				if agg.Workers.Autoscale == nil {
+					agg.Workers.Autoscale = &AutoscaleStat{}
+				}
+				agg.Workers.Autoscale.Min += a.Min
+				agg.Workers.Autoscale.Max += a.Max
+				agg.Workers.Autoscale.ScaleUps += a.ScaleUps
+				agg.Workers.Autoscale.ScaleDowns += a.ScaleDowns
+			}
+			if started := agg.Workers.Started + stats.Workers.Started; started > 0 {
+				agg.Workers.QueueWait = (agg.Workers.QueueWait*float64(agg.Workers.Started) + stats.Workers.QueueWait*float64(stats.Workers.Started)) / float64(started)
+				agg.Workers.Started = started
+			}
+			if agg.Workers.Priorities == nil {
+				agg.Workers.Priorities = make(map[string]PriorityStat)
+			}
+			for name, ps := range stats.Workers.Priorities {
+				sum := agg.Workers.Priorities[name]
+				sum.Queued += ps.Queued
+				if started := sum.Started + ps.Started; started > 0 {
+					sum.QueueWait = (sum.QueueWait*float64(sum.Started) + ps.QueueWait*float64(ps.Started)) / float64(started)
+					sum.Started = started
+				}
+				agg.Workers.Priorities[name] = sum
+			}
+		}
+		elapsed += stats.Average * float64(stats.Total)
+		squares += squareSum(stats)
+		for o, n := range stats.Outcomes {
+			agg.Outcomes[o] += n
+		}
+		for c, n := range stats.Countries {
+			if agg.Countries == nil {
+				agg.Countries = make(map[string]int64)
+			}
+			agg.Countries[c] += n
+		}
+		// Histograms can only be summed if the peer uses the same buckets
+		if !sameBounds(stats.Latency, agg.Latency) {
+			log.Printf("Latency buckets from %s don't match ours, histogram skipped", p.Name)
+			continue
+		}
+		for j, c := range stats.Latency.Counts {
+			agg.Latency.Counts[j] += c
+		}
+	}
+
+	if agg.Total != 0 {
+		agg.Average = elapsed / float64(agg.Total)
+	}
+	agg.StdDev = stdDev(agg.Total, elapsed, squares)
+	return agg
+}
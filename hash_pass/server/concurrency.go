@@ -0,0 +1,56 @@
+/*********************************************************
+File: concurrency.go
+Contents: Per-client caps on the number of jobs in flight
+*********************************************************/
+
+package server
+
+import (
+)
+
+/* method acquireSlot()
+Reserve an in-flight slot for `client`, false if it is at its cap
+*/
+func (s *Server) acquireSlot(client string) bool {
+	s.mtxInFlight.Lock()
+	defer s.mtxInFlight.Unlock()
+	if s.config.MaxInFlightPerClient > 0 && s.inFlight[client] >= s.config.MaxInFlightPerClient {
+		return false
+	}
+	s.inFlight[client]++
+	return true
+}
+
+/* method releaseSlot()
+Give back a slot that didn't turn into a job processed on this node
+*/
+func (s *Server) releaseSlot(client string) {
+	s.mtxInFlight.Lock()
+	defer s.mtxInFlight.Unlock()
+	if s.inFlight[client]--; s.inFlight[client] <= 0 {
+		delete(s.inFlight, client)
+	}
+}
+
+/* method bindSlot()
+Tie a reserved slot to the job it was used for, so completing the job frees it
+*/
+func (s *Server) bindSlot(requestId string, client string) {
+	s.mtxInFlight.Lock()
+	s.jobClients[requestId] = client
+	s.mtxInFlight.Unlock()
+}
+
+/* method releaseJob()
+Free the slot held by a job that has completed.  Jobs accepted by another
+node hold no slot here.
+*/
+func (s *Server) releaseJob(requestId string) {
+	s.mtxInFlight.Lock()
+	client, ok := s.jobClients[requestId]
+	delete(s.jobClients, requestId)
+	s.mtxInFlight.Unlock()
+	if ok {
+		s.releaseSlot(client)
+	}
+}
@@ -0,0 +1,135 @@
+/*********************************************************
+File: consul.go
+Contents: Registration of the service with a Consul agent
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Consul agent API paths
+	consulRegisterPath   = "/v1/agent/service/register"
+	consulDeregisterPath = "/v1/agent/service/deregister/"
+
+	// Health check settings sent with the registration
+	consulCheckInterval   = "10s"
+	consulCheckTimeout    = "2s"
+	consulDeregisterAfter = "1m"
+
+	// Give up on an agent call that takes longer than this
+	consulTimeout = 5 * time.Second
+)
+
+// Service definition understood by the Consul agent API
+type consulService struct {
+	ID      string      `json:"ID"`
+	Name    string      `json:"Name"`
+	Address string      `json:"Address,omitempty"`
+	Port    int         `json:"Port"`
+	Check   consulCheck `json:"Check"`
+}
+
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Method                         string `json:"Method"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+/* method consulRequest()
+Send a PUT to the Consul agent with an optional JSON body
+*/
+func (s *Server) consulRequest(path string, body interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(s.config.ConsulAddr, "/")+path, &buf)
+	if err != nil {
+		return err
+	}
+	if len(s.config.ConsulToken) > 0 {
+		req.Header.Set("X-Consul-Token", s.config.ConsulToken)
+	}
+	client := http.Client{Timeout: consulTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul agent returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/* method registerConsul()
+Register this instance and an HTTP health check against HealthPath, on the
+address and port the listener is bound to unless ConsulServiceAddr says
+otherwise
+*/
+func (s *Server) registerConsul() {
+	port := s.listenPort()
+	host, _ := os.Hostname()
+	id := s.config.ConsulService + "-" + host + "-" + strconv.Itoa(port)
+
+	// The agent runs the check, so it has to be able to reach us on this address
+	address := s.config.ConsulServiceAddr
+	if len(address) == 0 && s.boundAddr != nil && !s.boundAddr.IP.IsUnspecified() {
+		address = s.boundAddr.IP.String()
+	}
+	checkHost := address
+	if len(checkHost) == 0 {
+		checkHost = "127.0.0.1"
+	}
+
+	svc := consulService{
+		ID:      id,
+		Name:    s.config.ConsulService,
+		Address: address,
+		Port:    port,
+		Check: consulCheck{
+			HTTP:                           "http://" + net.JoinHostPort(checkHost, strconv.Itoa(port)) + HealthPath,
+			Method:                         http.MethodGet,
+			Interval:                       consulCheckInterval,
+			Timeout:                        consulCheckTimeout,
+			DeregisterCriticalServiceAfter: consulDeregisterAfter,
+		},
+	}
+	if err := s.consulRequest(consulRegisterPath, svc); err != nil {
+		log.Printf("Error registering with Consul: %v", err)
+		return
+	}
+	s.consulServiceID = id
+	log.Printf("Registered with Consul as %s", id)
+}
+
+/* method deregisterConsul()
+Remove our registration so no more traffic is routed here
+*/
+func (s *Server) deregisterConsul() {
+	if len(s.consulServiceID) == 0 {
+		return
+	}
+	if err := s.consulRequest(consulDeregisterPath+s.consulServiceID, nil); err != nil {
+		log.Printf("Error deregistering from Consul: %v", err)
+		return
+	}
+	log.Printf("Deregistered %s from Consul", s.consulServiceID)
+	s.consulServiceID = ""
+}
@@ -0,0 +1,140 @@
+/*********************************************************
+File: correlation.go
+Contents: Request Ids and trace context that follow a job to completion
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Header carrying the request Id, taken from the client when it sends one
+	RequestIDHeader = "X-Request-Id"
+	// W3C trace context header, https://www.w3.org/TR/trace-context/
+	TraceparentHeader = "traceparent"
+
+	// Longest client supplied request Id we accept
+	maxRequestIDLength = 128
+)
+
+// Identifiers shared by a request and the job it submits
+type correlation struct {
+	RequestID string
+	// W3C trace Id, 32 hex digits
+	TraceID string
+	// Span Id of this hop, 16 hex digits
+	SpanID string
+}
+
+// Context key for the correlation resolved by correlate
+type correlationKey struct{}
+
+/* method randomHex()
+Return `n` random bytes as hex
+*/
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/* method validRequestID()
+Client supplied Ids end up in log lines, so only allow short printable ones
+*/
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/* method parseTraceparent()
+Return the trace Id from a version 00 traceparent header, "" if it isn't one
+*/
+func parseTraceparent(header string) string {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if _, err := hex.DecodeString(p); err != nil {
+			return ""
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		// All-zero Ids are invalid
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+/* method newCorrelation()
+Resolve the identifiers for `r`, continuing the caller's request Id and
+trace when it sent them and starting new ones otherwise
+*/
+func newCorrelation(r *http.Request) correlation {
+	c := correlation{
+		RequestID: r.Header.Get(RequestIDHeader),
+		TraceID:   parseTraceparent(r.Header.Get(TraceparentHeader)),
+		SpanID:    randomHex(8),
+	}
+	if !validRequestID(c.RequestID) {
+		c.RequestID = randomHex(16)
+	}
+	if len(c.TraceID) == 0 {
+		c.TraceID = randomHex(16)
+	}
+	return c
+}
+
+/* method traceparent()
+Header value naming this hop as the parent of the next one
+*/
+func (c correlation) traceparent() string {
+	return "00-" + c.TraceID + "-" + c.SpanID + "-01"
+}
+
+/* method logSuffix()
+Identifiers to append to a log line, "" when there are none
+*/
+func (c correlation) logSuffix() string {
+	if len(c.RequestID) == 0 && len(c.TraceID) == 0 {
+		return ""
+	}
+	return " [request_id=" + c.RequestID + " trace_id=" + c.TraceID + "]"
+}
+
+/* method requestCorrelation()
+Return the correlation correlate stored in `ctx`.  Jobs keep the values of
+the request that submitted them, so this works for them too.
+*/
+func requestCorrelation(ctx context.Context) correlation {
+	c, _ := ctx.Value(correlationKey{}).(correlation)
+	return c
+}
+
+/* method correlate()
+Give every request a request Id and trace context, echo the request Id to
+the client, and set both on the request so they travel with it when it is
+forwarded or proxied to another node
+*/
+func correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := newCorrelation(r)
+		w.Header().Set(RequestIDHeader, c.RequestID)
+		r.Header.Set(RequestIDHeader, c.RequestID)
+		r.Header.Set(TraceparentHeader, c.traceparent())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), correlationKey{}, c)))
+	})
+}
@@ -0,0 +1,95 @@
+/*********************************************************
+File: dedup.go
+Contents: Opt-in sharing of one job between identical submissions
+*********************************************************/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	// Time between sweeps of the jobs whose Id is no longer known
+	dedupSweepInterval = time.Minute
+)
+
+/* method newDedupSecret()
+Return a random key for the submission digests, so the table of them can't
+be used to test guesses at passwords
+*/
+func newDedupSecret() []byte {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	return secret
+}
+
+/* method dedupKey()
+Digest what decides a job's result, the client, password, format,
+algorithm and its parameters, but not the salt, so a repeat of a
+submission can be matched to the first.  "" for jobs that don't keep their
+result or send it to a callback, which always run.
+*/
+func (s *Server) dedupKey(client string, pw string, opts jobOptions) string {
+	if !opts.store || len(opts.callbackURL) > 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.dedupSecret)
+	for _, field := range []string{
+		client, pw, opts.Format, opts.Algorithm, opts.User, opts.pepperID,
+		strconv.Itoa(opts.Rounds), strconv.Itoa(opts.scrypt.N), strconv.Itoa(opts.scrypt.R), strconv.Itoa(opts.scrypt.P),
+	} {
+		// Length prefixes keep the fields from running into each other
+		mac.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* method dedupedJob()
+Return the Id of the job an identical submission created, if it is still
+pending or its result is still held
+*/
+func (s *Server) dedupedJob(key string) (string, bool) {
+	if len(key) == 0 {
+		return "", false
+	}
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	id, ok := s.dedupJobs[key]
+	if !ok {
+		return "", false
+	}
+	if _, status := s.lockedJobStatus(id); len(status) == 0 {
+		delete(s.dedupJobs, key)
+		return "", false
+	}
+	return id, true
+}
+
+/* method recordDedup()
+Remember that the submission digested as `key` created job `id`
+*/
+func (s *Server) recordDedup(key string, id string) {
+	s.mtxMap.Lock()
+	s.dedupJobs[key] = id
+	s.mtxMap.Unlock()
+}
+
+/* method sweepDedup()
+Forget the submissions whose job has gone, abandoned, deleted, evicted or
+expired
+*/
+func (s *Server) sweepDedup(time.Time) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	for key, id := range s.dedupJobs {
+		if _, status := s.lockedJobStatus(id); len(status) == 0 {
+			delete(s.dedupJobs, key)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*********************************************************
+File: digest.go
+Contents: Checksums of arbitrary binary payloads and file uploads
+*********************************************************/
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Payload returned by the digest endpoint
+type DigestResult struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Buffer used to stream a payload into the hash, so memory stays bounded
+// however large the payload is
+const digestBufferSize = 64 << 10
+
+// Reader that pushes the connection's read deadline forward as data arrives,
+// so the read timeout limits how long the client may stall rather than how
+// long a large upload may take
+type deadlineReader struct {
+	io.ReadCloser
+	rc *http.ResponseController
+	// Time allowed between reads, 0 for no limit
+	timeout time.Duration
+}
+
+var (
+	// Supported digest algorithms by name
+	digestAlgorithms = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+		"blake2b": func() hash.Hash {
+			h, _ := blake2b.New512(nil)
+			return h
+		},
+	}
+)
+
+/* method digestPayload()
+Return the body to checksum: the first file part of a multipart upload,
+otherwise the raw request body
+*/
+func digestPayload(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if len(part.FileName()) > 0 {
+			return part, nil
+		}
+	}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.timeout > 0 {
+		d.rc.SetReadDeadline(time.Now().Add(d.timeout))
+	}
+	return d.ReadCloser.Read(p)
+}
+
+/*
+	method doDigest()
+	Return the digest of the posted payload using the algorithm in the
+	`algorithm` query parameter, SHA-256 by default.  The payload is hashed
+	as it is read, chunked or not, and never held in memory.
+*/
+func (s *Server) doDigest(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	name := strings.ToLower(r.URL.Query().Get(AlgorithmKey))
+	if len(name) == 0 {
+		name = DefaultDigestAlgorithm
+	}
+	newHash, ok := digestAlgorithms[name]
+	if !ok {
+		renderError(w, r, http.StatusBadRequest, ErrAlgorithm)
+		return
+	}
+
+	if s.config.MaxDigestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxDigestBytes)
+	}
+	r.Body = &deadlineReader{ReadCloser: r.Body, rc: http.NewResponseController(w), timeout: s.config.ReadTimeout}
+	payload, err := digestPayload(r)
+	var size int64
+	h := newHash()
+	if err == nil {
+		size, err = io.CopyBuffer(h, payload, make([]byte, digestBufferSize))
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			renderError(w, r, http.StatusRequestEntityTooLarge, ErrPayloadSize)
+			return
+		}
+		renderError(w, r, http.StatusBadRequest, ErrPayload)
+		return
+	}
+
+	result := DigestResult{Algorithm: name, Digest: hex.EncodeToString(h.Sum(nil)), Size: size}
+	jtext, _ := json.Marshal(result)
+	_, err = w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning digest: %v", err)
+	}
+}
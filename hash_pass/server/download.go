@@ -0,0 +1,163 @@
+/*********************************************************
+File: download.go
+Contents: Resumable downloads of exports and backups
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// How long a download is kept for clients to resume it with a Range
+	// request
+	downloadTTL = time.Hour
+)
+
+// A generated export or backup kept on disk so interrupted downloads can
+// resume where they stopped
+type download struct {
+	path        string
+	etag        string
+	name        string
+	contentType string
+	created     time.Time
+}
+
+/* method serveDownload()
+Serve the download `key`.  A Range request resumes the download generated
+last, if it is still kept, with If-Range and its ETag making sure the rest
+belongs to the same one.  Any other request generates it afresh with
+`generate`, which returns a summary of what it wrote for the audit log.
+*/
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, key string, name string, contentType string, generate func(io.Writer) (string, error)) {
+	if len(r.Header.Get("Range")) > 0 {
+		if f, d := s.openDownload(key); f != nil {
+			defer f.Close()
+			s.sendDownload(w, r, d, f)
+			log.Printf("AUDIT: Download %s resumed by %s", d.name, s.clientLabel(r))
+			return
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "hash_pass-download-*")
+	if err != nil {
+		log.Printf("Error creating download: %v", err)
+		renderError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tmp.Close()
+	sum := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(tmp, sum))
+	summary, err := generate(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error generating download %s: %v", name, err)
+		renderError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	d := &download{
+		path:        tmp.Name(),
+		etag:        `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`,
+		name:        name,
+		contentType: contentType,
+		created:     s.clock.Now(),
+	}
+	s.keepDownload(key, d)
+	s.sendDownload(w, r, d, tmp)
+	log.Printf("AUDIT: %s taken by %s", summary, s.clientLabel(r))
+}
+
+/* method sendDownload()
+Send `f`, the file of download `d`, honouring Range and If-Range
+*/
+func (s *Server) sendDownload(w http.ResponseWriter, r *http.Request, d *download, f *os.File) {
+	// ReadTimeout would otherwise cut a long download short
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.name))
+	w.Header().Set("Content-Type", d.contentType)
+	w.Header().Set("ETag", d.etag)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, d.name, d.created, f)
+}
+
+/* method keepDownload()
+Keep `d` as the download to resume for `key`, removing the one it replaces
+and any that have expired
+*/
+func (s *Server) keepDownload(key string, d *download) {
+	s.mtxDownloads.Lock()
+	defer s.mtxDownloads.Unlock()
+	if old, ok := s.downloads[key]; ok {
+		os.Remove(old.path)
+	}
+	s.downloads[key] = d
+	s.lockedExpireDownloads(s.clock.Now())
+}
+
+/* method openDownload()
+Open the download kept for `key`, nil if there is none or it has expired
+*/
+func (s *Server) openDownload(key string) (*os.File, *download) {
+	s.mtxDownloads.Lock()
+	defer s.mtxDownloads.Unlock()
+	s.lockedExpireDownloads(s.clock.Now())
+	d, ok := s.downloads[key]
+	if !ok {
+		return nil, nil
+	}
+	// Opened under the lock, so it can't be removed before we have it
+	f, err := os.Open(d.path)
+	if err != nil {
+		log.Printf("Error opening download %s: %v", d.name, err)
+		return nil, nil
+	}
+	return f, d
+}
+
+/* method expireDownloads()
+Remove the downloads kept longer than downloadTTL
+*/
+func (s *Server) expireDownloads(now time.Time) {
+	s.mtxDownloads.Lock()
+	s.lockedExpireDownloads(now)
+	s.mtxDownloads.Unlock()
+}
+
+/* method lockedExpireDownloads()
+Remove the downloads kept longer than downloadTTL.  The caller must hold
+mtxDownloads.
+*/
+func (s *Server) lockedExpireDownloads(now time.Time) {
+	for key, d := range s.downloads {
+		if now.Sub(d.created) >= downloadTTL {
+			os.Remove(d.path)
+			delete(s.downloads, key)
+		}
+	}
+}
+
+/* method removeDownloads()
+Remove every download kept, as the server stops
+*/
+func (s *Server) removeDownloads() {
+	s.mtxDownloads.Lock()
+	defer s.mtxDownloads.Unlock()
+	for key, d := range s.downloads {
+		os.Remove(d.path)
+		delete(s.downloads, key)
+	}
+}
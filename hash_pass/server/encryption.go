@@ -0,0 +1,340 @@
+/*********************************************************
+File: encryption.go
+Contents: AES-GCM encryption of results written to durable backends
+*********************************************************/
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// Prefix of an encrypted value, enc:<key id>:<base64 nonce and
+	// ciphertext>.  Values without it were written before encryption was
+	// enabled and are read as they are.
+	sealedPrefix = "enc:"
+)
+
+// Keys results are encrypted with, by Id.  New values are encrypted with
+// Current; the others are kept to read values written before a rotation.
+type Keyring struct {
+	Current string
+	// AES-128, AES-192 or AES-256 keys, 16, 24 or 32 bytes
+	Keys map[string][]byte
+}
+
+/* method Validate()
+Check there is a current key and every key is a valid AES key with an Id
+that can tag encrypted values
+*/
+func (kr Keyring) Validate() error {
+	if _, ok := kr.Keys[kr.Current]; !ok {
+		return errors.New("no current encryption key")
+	}
+	for id, key := range kr.Keys {
+		if len(id) == 0 || strings.Contains(id, ":") {
+			return fmt.Errorf("invalid encryption key Id %q", id)
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("encryption key %s is %d bytes, AES keys are 16, 24 or 32", id, n)
+		}
+	}
+	return nil
+}
+
+// Supplies the encryption keys, from a file, the environment or a key
+// management service
+type KeySource interface {
+	Keys() (Keyring, error)
+}
+
+// Adapts an ordinary function to a KeySource
+type KeyFunc func() (Keyring, error)
+
+func (f KeyFunc) Keys() (Keyring, error) {
+	return f()
+}
+
+/* method ParseKeyring()
+Parse keys given one per line as `<id> <base64 key>`, the first being the
+current one.  Blank lines and lines starting with # are skipped.
+*/
+func ParseKeyring(text string) (Keyring, error) {
+	kr := Keyring{Keys: make(map[string][]byte)}
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, " ")
+		if !ok {
+			return Keyring{}, fmt.Errorf("line %d: expected <id> <base64 key>", n+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return Keyring{}, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if _, dup := kr.Keys[id]; dup {
+			return Keyring{}, fmt.Errorf("line %d: key %s given twice", n+1, id)
+		}
+		kr.Keys[id] = key
+		if len(kr.Current) == 0 {
+			kr.Current = id
+		}
+	}
+	return kr, nil
+}
+
+/* method FileKeys()
+Read the keys from the file at `path` in ParseKeyring's format
+*/
+func FileKeys(path string) KeySource {
+	return KeyFunc(func() (Keyring, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Keyring{}, err
+		}
+		return ParseKeyring(string(data))
+	})
+}
+
+/* method EnvKeys()
+Read the keys from the environment variable `name` in ParseKeyring's
+format, with lines or semicolons separating the keys
+*/
+func EnvKeys(name string) KeySource {
+	return KeyFunc(func() (Keyring, error) {
+		return ParseKeyring(strings.ReplaceAll(os.Getenv(name), ";", "\n"))
+	})
+}
+
+// AES-GCM ciphers of a Keyring.  A nil *sealer leaves values in the clear.
+type sealer struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+/* method newSealer()
+Set up the ciphers of `kr`
+*/
+func newSealer(kr Keyring) (*sealer, error) {
+	if err := kr.Validate(); err != nil {
+		return nil, err
+	}
+	sl := &sealer{current: kr.Current, aeads: make(map[string]cipher.AEAD)}
+	for id, key := range kr.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if sl.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return sl, nil
+}
+
+/* method seal()
+Encrypt `v` with the current key, "" staying ""
+*/
+func (sl *sealer) seal(v string) string {
+	if sl == nil || len(v) == 0 {
+		return v
+	}
+	aead := sl.aeads[sl.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(v)+aead.Overhead())
+	io.ReadFull(rand.Reader, nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(v), nil)
+	return sealedPrefix + sl.current + ":" + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+/* method open()
+Decrypt a value sealed with any key in the keyring, passing values that
+aren't encrypted through as they are
+*/
+func (sl *sealer) open(v string) (string, error) {
+	if !strings.HasPrefix(v, sealedPrefix) {
+		return v, nil
+	}
+	id, encoded, ok := strings.Cut(v[len(sealedPrefix):], ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+	if sl == nil {
+		return "", fmt.Errorf("value encrypted with key %s but no keys are configured", id)
+	}
+	aead, ok := sl.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("value encrypted with unknown key %s", id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting with key %s: %w", id, err)
+	}
+	return string(plain), nil
+}
+
+/* method sealResult()
+Encrypt the hash and salt of `r`, leaving the times and Ids readable
+*/
+func (sl *sealer) sealResult(r StoredResult) StoredResult {
+	r.Hash, r.Salt = sl.seal(r.Hash), sl.seal(r.Salt)
+	return r
+}
+
+func (sl *sealer) openResult(r StoredResult) (StoredResult, error) {
+	var err error
+	if r.Hash, err = sl.open(r.Hash); err != nil {
+		return StoredResult{}, err
+	}
+	if r.Salt, err = sl.open(r.Salt); err != nil {
+		return StoredResult{}, err
+	}
+	return r, nil
+}
+
+/* method sealJob()
+Encrypt the hash and salt of a pending job, which replicas, the
+write-ahead log and snapshots keep until it is due
+*/
+func (sl *sealer) sealJob(j pendingJob) pendingJob {
+	j.Hash, j.Salt = sl.seal(j.Hash), sl.seal(j.Salt)
+	return j
+}
+
+func (sl *sealer) openJob(j pendingJob) (pendingJob, error) {
+	var err error
+	if j.Hash, err = sl.open(j.Hash); err != nil {
+		return pendingJob{}, err
+	}
+	if j.Salt, err = sl.open(j.Salt); err != nil {
+		return pendingJob{}, err
+	}
+	return j, nil
+}
+
+/* method loadKeys()
+Fetch the keys from the source and start encrypting with them
+*/
+func (s *Server) loadKeys() error {
+	kr, err := s.keySource.Keys()
+	if err != nil {
+		return err
+	}
+	if s.sealer, err = newSealer(kr); err != nil {
+		return err
+	}
+	log.Printf("Encrypting stored results with key %s", kr.Current)
+	return nil
+}
+
+// Encrypts the results of a durable Store
+type encryptedStore struct {
+	inner  Store
+	sealer *sealer
+}
+
+// encryptedStore of a CounterStore
+type encryptedCounterStore struct {
+	encryptedStore
+	counter CounterStore
+}
+
+// encryptedStore of a SequenceStore
+type encryptedSequenceStore struct {
+	encryptedStore
+	sequence SequenceStore
+}
+
+/* method encryptStore()
+Wrap `st` so the results it holds are encrypted, keeping any counter it
+keeps
+*/
+func encryptStore(st Store, sl *sealer) Store {
+	e := encryptedStore{inner: st, sealer: sl}
+	switch inner := st.(type) {
+	case SequenceStore:
+		return encryptedSequenceStore{encryptedStore: e, sequence: inner}
+	case CounterStore:
+		return encryptedCounterStore{encryptedStore: e, counter: inner}
+	}
+	return e
+}
+
+/* method Unwrap()
+Return the store whose results are encrypted.  Job states, dead letters
+and legal holds hold no secrets, so they are kept there as they are, and
+deleted results are sealed before they are handed to it.
+*/
+func (e encryptedStore) Unwrap() Store {
+	return e.inner
+}
+
+func (e encryptedStore) Put(id string, result StoredResult) error {
+	return e.inner.Put(id, e.sealer.sealResult(result))
+}
+
+func (e encryptedStore) Get(id string) (StoredResult, bool, error) {
+	result, ok, err := e.inner.Get(id)
+	if !ok || err != nil {
+		return result, ok, err
+	}
+	result, err = e.sealer.openResult(result)
+	return result, err == nil, err
+}
+
+func (e encryptedStore) Delete(id string) error {
+	return e.inner.Delete(id)
+}
+
+func (e encryptedStore) List(fn func(id string, result StoredResult) bool) error {
+	var openErr error
+	err := e.inner.List(func(id string, result StoredResult) bool {
+		if result, openErr = e.sealer.openResult(result); openErr != nil {
+			openErr = fmt.Errorf("result %s: %w", id, openErr)
+			return false
+		}
+		return fn(id, result)
+	})
+	if err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (e encryptedStore) Count() (int, error) {
+	return e.inner.Count()
+}
+
+func (e encryptedStore) Close() error {
+	if c, ok := e.inner.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (e encryptedCounterStore) SaveCounter(n int64) error {
+	return e.counter.SaveCounter(n)
+}
+
+func (e encryptedCounterStore) LoadCounter() (int64, error) {
+	return e.counter.LoadCounter()
+}
+
+func (e encryptedSequenceStore) NextID() (int64, error) {
+	return e.sequence.NextID()
+}
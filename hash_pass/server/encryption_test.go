@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testSealer(t *testing.T, current string, ids ...string) *sealer {
+	t.Helper()
+	kr := Keyring{Current: current, Keys: make(map[string][]byte)}
+	for i, id := range ids {
+		kr.Keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	sl, err := newSealer(kr)
+	if err != nil {
+		t.Fatalf("newSealer: %v", err)
+	}
+	return sl
+}
+
+func TestSealOpen(t *testing.T) {
+	sl := testSealer(t, "k1", "k1")
+	for _, v := range []string{"hash", "a much longer value holding : and enc:k1: itself", "\x00\xff"} {
+		sealed := sl.seal(v)
+		if !strings.HasPrefix(sealed, "enc:k1:") || strings.Contains(sealed, v) {
+			t.Errorf("seal(%q) = %s", v, sealed)
+		}
+		if sealed == sl.seal(v) {
+			t.Errorf("sealing %q twice gave the same value", v)
+		}
+		if got, err := sl.open(sealed); err != nil || got != v {
+			t.Errorf("open(seal(%q)) = %q, %v", v, got, err)
+		}
+	}
+	if sl.seal("") != "" {
+		t.Error("empty value sealed")
+	}
+
+	// Values written before encryption was enabled read as they are, with
+	// or without keys
+	var none *sealer
+	for _, s := range []*sealer{sl, none} {
+		if got, err := s.open("plain hash"); err != nil || got != "plain hash" {
+			t.Errorf("open of a plain value = %q, %v", got, err)
+		}
+	}
+	if none.seal("hash") != "hash" {
+		t.Error("nil sealer encrypted a value")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := testSealer(t, "k1", "k1")
+	sealed := old.seal("hash")
+
+	// After a rotation new values take the new key's prefix, the values
+	// sealed before still open and each opens with its own key
+	rotated := testSealer(t, "k2", "k1", "k2")
+	resealed := rotated.seal("hash")
+	if !strings.HasPrefix(resealed, "enc:k2:") {
+		t.Errorf("value sealed after rotation = %s, want the k2 prefix", resealed)
+	}
+	for _, v := range []string{sealed, resealed} {
+		if got, err := rotated.open(v); err != nil || got != "hash" {
+			t.Errorf("open(%s) after rotation = %q, %v", v, got, err)
+		}
+	}
+
+	// The key is chosen by the prefix, so relabelling a value fails
+	relabelled := "enc:k2:" + strings.TrimPrefix(sealed, "enc:k1:")
+	if _, err := rotated.open(relabelled); err == nil {
+		t.Error("value opened with a key it wasn't sealed with")
+	}
+}
+
+func TestOpenFailures(t *testing.T) {
+	sl := testSealer(t, "k1", "k1")
+	sealed := sl.seal("hash")
+	// Same Id, different key material
+	other := testSealer(t, "k1", "k0", "k1")
+	// Change the first character of the nonce
+	n := len("enc:k1:")
+	tampered := sealed[:n] + "A" + sealed[n+1:]
+	if tampered == sealed {
+		tampered = sealed[:n] + "B" + sealed[n+1:]
+	}
+	for _, tc := range []struct {
+		name, value string
+		sl          *sealer
+		err         string
+	}{
+		{"wrong key", sealed, other, "decrypting with key k1"},
+		{"unknown key", sealed, testSealer(t, "k2", "k2"), "unknown key k1"},
+		{"no keys", sealed, nil, "no keys are configured"},
+		{"tampered", tampered, sl, "decrypting with key k1"},
+		{"no key Id", "enc:abc", sl, "malformed"},
+		{"bad base64", "enc:k1:!!!", sl, "malformed"},
+		{"short", "enc:k1:AAAA", sl, "malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.sl.open(tc.value)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("open(%s) = %q, %v, want an error containing %q", tc.value, got, err, tc.err)
+			}
+		})
+	}
+
+	if _, err := newSealer(Keyring{Current: "k1", Keys: map[string][]byte{"k1": []byte("short")}}); err == nil {
+		t.Error("newSealer accepted a 5 byte key")
+	}
+	if _, err := newSealer(Keyring{Current: "k2", Keys: map[string][]byte{"k1": make([]byte, 16)}}); err == nil {
+		t.Error("newSealer accepted a keyring without its current key")
+	}
+	if _, err := newSealer(Keyring{Current: "a:b", Keys: map[string][]byte{"a:b": make([]byte, 16)}}); err == nil {
+		t.Error("newSealer accepted a key Id holding a colon")
+	}
+}
+
+// counterMemoryStore is a MemoryStore that also keeps the request counter
+type counterMemoryStore struct {
+	*MemoryStore
+	counter int64
+}
+
+func (m *counterMemoryStore) SaveCounter(n int64) error {
+	m.counter = n
+	return nil
+}
+
+func (m *counterMemoryStore) LoadCounter() (int64, error) {
+	return m.counter, nil
+}
+
+func TestEncryptStore(t *testing.T) {
+	sl := testSealer(t, "k1", "k1")
+	inner := &counterMemoryStore{MemoryStore: NewMemoryStore(0)}
+	st := encryptStore(inner, sl)
+	if unwrapStore(st) != Store(inner) {
+		t.Error("encrypting store doesn't unwrap to the store it wraps")
+	}
+
+	// Hash and salt are sealed in the inner store, the rest left readable
+	want := StoredResult{Hash: "hash", Salt: "salt", Algorithm: "sha512", Submitted: 1, Completed: 2}
+	if err := st.Put("a", want); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	raw, _, _ := inner.Get("a")
+	if !strings.HasPrefix(raw.Hash, "enc:k1:") || !strings.HasPrefix(raw.Salt, "enc:k1:") {
+		t.Errorf("stored hash %s and salt %s aren't sealed", raw.Hash, raw.Salt)
+	}
+	if raw.Algorithm != want.Algorithm || raw.Submitted != want.Submitted || raw.Completed != want.Completed {
+		t.Errorf("stored fields besides the hash and salt changed: %+v", raw)
+	}
+	if got, ok, err := st.Get("a"); !ok || err != nil || got != want {
+		t.Errorf("Get = %+v, %v, %v, want %+v", got, ok, err, want)
+	}
+
+	// Results stored before encryption read as they are
+	inner.Put("plain", StoredResult{Hash: "plain hash"})
+	listed := make(map[string]StoredResult)
+	if err := st.List(func(id string, r StoredResult) bool { listed[id] = r; return true }); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(listed) != 2 || listed["a"] != want || listed["plain"].Hash != "plain hash" {
+		t.Errorf("List = %+v", listed)
+	}
+
+	// The counter goes through to the inner store
+	cs, ok := st.(CounterStore)
+	if !ok {
+		t.Fatal("encrypting a CounterStore lost the counter")
+	}
+	if err := cs.SaveCounter(7); err != nil || inner.counter != 7 {
+		t.Errorf("SaveCounter = %v, inner counter %d", err, inner.counter)
+	}
+	if _, ok := encryptStore(NewMemoryStore(0), sl).(CounterStore); ok {
+		t.Error("encrypting a plain Store added a counter")
+	}
+
+	// A result sealed with a key no longer configured is an error, not a
+	// miss, and stops a listing
+	inner.Put("lost", StoredResult{Hash: testSealer(t, "gone", "gone").seal("hash")})
+	if _, ok, err := st.Get("lost"); ok || err == nil {
+		t.Errorf("Get of a result sealed with an unknown key = %v, %v", ok, err)
+	}
+	if err := st.List(func(string, StoredResult) bool { return true }); err == nil || !strings.Contains(err.Error(), "result lost") {
+		t.Errorf("List over a result sealed with an unknown key returned %v", err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	kr, err := ParseKeyring("# rotated 2024\nk2 AAAAAAAAAAAAAAAAAAAAAA==\n\nk1 AQEBAQEBAQEBAQEBAQEBAQ==\n")
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if kr.Current != "k2" || len(kr.Keys) != 2 || len(kr.Keys["k1"]) != 16 {
+		t.Errorf("ParseKeyring = %+v", kr)
+	}
+	for _, text := range []string{"k1", "k1 not-base64!", "k1 AAAAAAAAAAAAAAAAAAAAAA==\nk1 AAAAAAAAAAAAAAAAAAAAAA=="} {
+		if _, err := ParseKeyring(text); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded", text)
+		}
+	}
+}
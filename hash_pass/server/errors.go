@@ -0,0 +1,199 @@
+/*********************************************************
+File: errors.go
+Contents: Rendering of error responses and the hooks for customizing it
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Media type of RFC 7807 problem details
+	ProblemContentType = "application/problem+json"
+)
+
+// Writes an error response for `status` with the message `msg`
+type ErrorRenderer func(w http.ResponseWriter, r *http.Request, status int, msg string)
+
+// RFC 7807 problem details, with a stable code clients can branch on
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// Context key for the server whose renderers handle a request's errors
+type renderersKey struct{}
+
+var (
+	// Stable codes of the error messages, errors with other messages are
+	// coded by their status
+	errorCodes = map[string]string{
+		ErrInvalidId:       "invalid_task_id",
+		ErrPassword:        "invalid_password",
+		ErrShutdown:        "shutting_down",
+		ErrReplication:     "replication_failed",
+		ErrStorage:         "storage_unavailable",
+		ErrArchive:         "archive_unavailable",
+		ErrBackup:          "invalid_backup",
+		ErrRestore:         "restore_conflict",
+		ErrExportFormat:    "invalid_export_format",
+		ErrImport:          "invalid_import",
+		ErrImportConflict:  "import_conflict",
+		ErrConflictMode:    "invalid_conflict_mode",
+		ErrImportRaft:      "import_unavailable",
+		ErrIdempotencyKey:  "invalid_idempotency_key",
+		ErrIdempotentReuse: "idempotency_key_reused",
+		ErrIdempotentBusy:  "idempotency_key_in_progress",
+		ErrRaftJoin:        "invalid_join",
+		ErrScope:           "invalid_scope",
+		ErrUnit:            "invalid_unit",
+		ErrNodeUnavailable: "node_unavailable",
+		ErrHandoff:         "invalid_handoff",
+		ErrGeoDenied:       "region_denied",
+		ErrThrottled:       "throttled",
+		ErrConcurrency:     "too_many_in_flight",
+		ErrPriority:        "invalid_priority",
+		ErrDelay:           "invalid_delay",
+		ErrQueueFull:       "queue_full",
+		ErrFeature:         "unknown_feature",
+		ErrFeatureValue:    "invalid_feature_value",
+		ErrAdminToken:      "invalid_admin_token",
+		ErrAdminClosed:     "admin_not_configured",
+		ErrRuntimeValue:    "invalid_runtime_setting",
+		ErrWorkers:         "invalid_worker_count",
+		ErrWorkersMax:      "worker_count_too_large",
+		ErrNotReady:        "not_ready",
+		ErrStore:           "invalid_store",
+		ErrFormat:          "unsupported_format",
+		ErrUser:            "invalid_user",
+		ErrRounds:          "invalid_rounds",
+		ErrUnauthorized:    "unauthorized",
+		ErrAuthBackend:     "auth_unavailable",
+		ErrAlgorithm:       "unsupported_digest_algorithm",
+		ErrHashAlgorithm:   "unsupported_hash_algorithm",
+		ErrAlgorithmOff:    "algorithm_disabled",
+		ErrPayload:         "invalid_payload",
+		ErrPayloadSize:     "payload_too_large",
+		ErrLegalHold:       "legal_hold",
+		ErrNotDeleted:      "not_deleted",
+		ErrHoldValue:       "invalid_hold",
+		ErrScrypt:          "invalid_scrypt_parameters",
+		ErrSalt:            "salt_unavailable",
+		ErrContentType:     "unsupported_content_type",
+		ErrJSON:            "malformed_json",
+		ErrWait:            "invalid_wait",
+		ErrWebSocket:       "invalid_websocket_handshake",
+		ErrWSOrigin:        "websocket_origin_denied",
+		ErrSubscribe:       "invalid_subscribe_message",
+		ErrCallback:        "invalid_callback_url",
+		ErrCallbacksOff:    "callbacks_disabled",
+		ErrStatusFilter:    "invalid_status_filter",
+		ErrLimit:           "invalid_limit",
+		ErrCursor:          "invalid_cursor",
+		ErrExpired:         "result_expired",
+		ErrDeadLetterKind:  "invalid_dead_letter_kind",
+		ErrCancelled:       "task_cancelled",
+		ErrNotPending:      "task_not_pending",
+	}
+)
+
+/* method ProblemError()
+Render an error as RFC 7807 problem details.  The code is looked up from
+the message, so it stays the same if the wording changes.
+*/
+func ProblemError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	code, ok := errorCodes[msg]
+	if !ok {
+		code = strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+	p := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: strings.TrimPrefix(msg, "Error: "),
+		Code:   code,
+	}
+	if p.Detail == p.Title {
+		p.Detail = ""
+	}
+	if r != nil {
+		p.Instance = r.URL.Path
+	}
+	jtext, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(jtext); err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
+
+/* method PlainTextError()
+Render an error as the bare message, as the service did before problem
+details
+*/
+func PlainTextError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	http.Error(w, msg, status)
+}
+
+/* method withRenderers()
+Make the server's error renderer and handlers available to the requests it
+serves
+*/
+func (s *Server) withRenderers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), renderersKey{}, s)))
+	})
+}
+
+/* method requestServer()
+Return the server handling the request, nil outside its handler
+*/
+func requestServer(r *http.Request) *Server {
+	s, _ := r.Context().Value(renderersKey{}).(*Server)
+	return s
+}
+
+/* method renderError()
+Send an error response through the server's renderer, problem details by
+default
+*/
+func renderError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if s := requestServer(r); s != nil && s.errorRenderer != nil {
+		s.errorRenderer(w, r, status, msg)
+		return
+	}
+	ProblemError(w, r, status, msg)
+}
+
+/* method notFound()
+Respond to a request for an unknown path
+*/
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if s := requestServer(r); s != nil && s.notFoundHandler != nil {
+		s.notFoundHandler.ServeHTTP(w, r)
+		return
+	}
+	renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
+
+/* method methodNotAllowed()
+Respond to a request using a method the endpoint doesn't support
+*/
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if s := requestServer(r); s != nil && s.methodNotAllowedHandler != nil {
+		s.methodNotAllowedHandler.ServeHTTP(w, r)
+		return
+	}
+	renderError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+}
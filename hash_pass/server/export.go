@@ -0,0 +1,175 @@
+/*********************************************************
+File: export.go
+Contents: Bulk export of the stored results as JSON Lines or CSV
+*********************************************************/
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Export formats, chosen with the format query parameter or the Accept
+	// header
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+
+	// Results read from the store per lock
+	exportBatch = 500
+)
+
+var (
+	// Column order of a CSV export, the JSON names of ExportRecord
+	exportColumns = []string{"id", "hash", "algorithm", "salt", "pepper_id", "submitted", "started", "completed", "delay"}
+)
+
+// One result in an export
+type ExportRecord struct {
+	ID        TaskID    `json:"id"`
+	Hash      string    `json:"hash"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Salt      string    `json:"salt,omitempty"`
+	PepperID  string    `json:"pepper_id,omitempty"`
+	Submitted time.Time `json:"submitted,omitzero"`
+	Started   time.Time `json:"started,omitzero"`
+	Completed time.Time `json:"completed,omitzero"`
+	// Processing delay in microseconds
+	Delay int64 `json:"delay,omitempty"`
+}
+
+/* method exportFormat()
+Return the format a request asks for, JSON Lines unless it names CSV in
+the format parameter or prefers text/csv, and false for an unknown one
+*/
+func exportFormat(r *http.Request) (string, bool) {
+	switch r.URL.Query().Get(FormatKey) {
+	case ExportJSONL:
+		return ExportJSONL, true
+	case ExportCSV:
+		return ExportCSV, true
+	case "":
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			return ExportCSV, true
+		}
+		return ExportJSONL, true
+	}
+	return "", false
+}
+
+/* method csvTime()
+Format a time for a CSV export, empty for the zero time
+*/
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+/* method csvDelay()
+Format a delay for a CSV export, empty for none
+*/
+func csvDelay(us int64) string {
+	if us == 0 {
+		return ""
+	}
+	return strconv.FormatInt(us, 10)
+}
+
+/*
+	method getExport()
+	Handle GET request for URL path `/admin/export`, downloading every
+	stored result in Id order.  Results are read a batch at a time so a
+	slow reader never holds up the server, and the export is kept for a
+	while so an interrupted download can resume with a Range request.
+*/
+func (s *Server) getExport(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	format, ok := exportFormat(r)
+	if !ok {
+		renderError(w, r, http.StatusBadRequest, ErrExportFormat)
+		return
+	}
+
+	name := "hash_pass-export-" + s.clock.Now().UTC().Format("20060102T150405Z") + "." + format
+	contentType := "application/x-ndjson"
+	if format == ExportCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	s.serveDownload(w, r, ExportPath+"?"+format, name, contentType, func(out io.Writer) (string, error) {
+		exported, err := s.writeExport(out, format)
+		return fmt.Sprintf("Export of %d results as %s", exported, format), err
+	})
+}
+
+/* method writeExport()
+Write every stored result in Id order to `out` in `format`, returning how
+many were written
+*/
+func (s *Server) writeExport(out io.Writer, format string) (int, error) {
+	s.mtxMap.Lock()
+	ids := make([]string, 0, s.countResults())
+	for id := range s.allResults() {
+		ids = append(ids, id)
+	}
+	s.mtxMap.Unlock()
+	slices.SortFunc(ids, compareIDs)
+
+	cw := csv.NewWriter(out)
+	enc := json.NewEncoder(out)
+	if format == ExportCSV {
+		cw.Write(exportColumns)
+	}
+	exported := 0
+	for len(ids) > 0 {
+		batch := ids[:min(exportBatch, len(ids))]
+		ids = ids[len(batch):]
+		records := make([]ExportRecord, 0, len(batch))
+		s.mtxMap.Lock()
+		for _, id := range batch {
+			// Skip results deleted or expired since the listing
+			if result, ok := s.getResult(id); ok {
+				records = append(records, ExportRecord{
+					ID:        TaskID(id),
+					Hash:      result.Hash,
+					Algorithm: result.Algorithm,
+					Salt:      result.Salt,
+					PepperID:  result.PepperID,
+					Submitted: unixTime(result.Submitted),
+					Started:   unixTime(result.Started),
+					Completed: unixTime(result.Completed),
+					Delay:     result.Delay / int64(time.Microsecond),
+				})
+			}
+		}
+		s.mtxMap.Unlock()
+
+		for _, rec := range records {
+			if format == ExportCSV {
+				cw.Write([]string{string(rec.ID), rec.Hash, rec.Algorithm, rec.Salt, rec.PepperID, csvTime(rec.Submitted), csvTime(rec.Started), csvTime(rec.Completed), csvDelay(rec.Delay)})
+			} else if err := enc.Encode(rec); err != nil {
+				return exported, err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return exported, err
+		}
+		exported += len(records)
+	}
+	// A CSV export of no results still has its header
+	cw.Flush()
+	return exported, cw.Error()
+}
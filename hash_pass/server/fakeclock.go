@@ -0,0 +1,114 @@
+/*********************************************************
+File: fakeclock.go
+Contents: A Clock that only moves when told to, for tests
+*********************************************************/
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock standing still until Advance moves it, running the timers that
+// come due as it does.  Safe for concurrent use.
+type FakeClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// A call waiting for a FakeClock to reach `at`
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	f     func()
+}
+
+/* method NewFakeClock()
+Create a fake clock reading `start`
+*/
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+/* method AfterFunc()
+Call `f` in its own goroutine once the clock has been advanced by `d`, at
+once if `d` isn't positive
+*/
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+/* method Sleep()
+Block until the clock has been advanced by `d`
+*/
+func (c *FakeClock) Sleep(d time.Duration) {
+	woken := make(chan struct{})
+	c.AfterFunc(d, func() { close(woken) })
+	<-woken
+}
+
+/* method Advance()
+Move the clock on by `d` and start the timers due by then, earliest first
+*/
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.now = c.now.Add(d)
+	var due, waiting []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			waiting = append(waiting, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = waiting
+	c.mtx.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+/* method Pending()
+Return the number of timers, sleeps included, waiting for the clock to
+move, so a test can tell a goroutine has started waiting before advancing
+*/
+func (c *FakeClock) Pending() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.timers)
+}
+
+/* method Stop()
+Cancel the call.  Reports false if it has already been started or stopped.
+*/
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, waiting := range c.timers {
+		if waiting == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+/*********************************************************
+File: features.go
+Contents: Runtime feature flags gating risky features
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"hash_pass/hasher"
+)
+
+const (
+	// Built-in feature flags
+	// Deliver results to the callback URL a POST names, off by default
+	FeatureCallbacks = "callbacks"
+	// Prefix of the flags, on by default, letting POSTs select each
+	// algorithm besides sha512, e.g. algorithm-bcrypt
+	FeatureAlgorithmPrefix = "algorithm-"
+)
+
+var (
+	// Algorithms gated by a flag of their own
+	gatedAlgorithms = []string{
+		hasher.AlgorithmBcrypt,
+		hasher.AlgorithmArgon2id,
+		hasher.AlgorithmScrypt,
+		hasher.AlgorithmPBKDF2SHA256,
+		hasher.AlgorithmPBKDF2SHA512,
+		hasher.AlgorithmSHA256,
+		hasher.AlgorithmSHA384,
+		hasher.AlgorithmSHA3512,
+		hasher.AlgorithmBLAKE2b,
+		hasher.AlgorithmHMACSHA512,
+	}
+)
+
+/* method builtinFeatures()
+Return the flags the server itself checks, with their defaults
+*/
+func builtinFeatures() map[string]bool {
+	features := map[string]bool{FeatureCallbacks: false}
+	for _, name := range gatedAlgorithms {
+		features[FeatureAlgorithmPrefix+name] = true
+	}
+	return features
+}
+
+/* method algorithmEnabled()
+Report whether POSTs may select `name`, true for algorithms without a flag
+*/
+func (s *Server) algorithmEnabled(name string) bool {
+	s.mtxFeatures.Lock()
+	defer s.mtxFeatures.Unlock()
+	enabled, ok := s.features[FeatureAlgorithmPrefix+name]
+	return enabled || !ok
+}
+
+/* method FeatureEnabled()
+Report whether a feature is currently on, false for unknown features
+*/
+func (s *Server) FeatureEnabled(name string) bool {
+	s.mtxFeatures.Lock()
+	defer s.mtxFeatures.Unlock()
+	return s.features[name]
+}
+
+/* method applyFeatures()
+Start from the defaults declared with WithFeature and override them with
+the configured state, ignoring unknown names
+*/
+func (s *Server) applyFeatures(initial map[string]bool) {
+	s.mtxFeatures.Lock()
+	defer s.mtxFeatures.Unlock()
+	for name, enabled := range s.featureDefaults {
+		s.features[name] = enabled
+	}
+	for name, enabled := range initial {
+		if _, ok := s.features[name]; !ok {
+			log.Printf("Ignoring unknown feature flag %s", name)
+			continue
+		}
+		s.features[name] = enabled
+	}
+}
+
+/*
+	method getFeatures()
+	Return a JSON object with the state of every feature flag
+*/
+func (s *Server) getFeatures(w http.ResponseWriter, r *http.Request) {
+	// If we're shutting down we will not accept requests
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	s.mtxFeatures.Lock()
+	jtext, _ := json.Marshal(s.features)
+	s.mtxFeatures.Unlock()
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning feature flags: %v", err)
+	}
+}
+
+/*
+	method setFeature()
+	Turn the feature named in the path on or off according to the
+	`enabled` form field
+*/
+func (s *Server) setFeature(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.FormValue(EnabledKey))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrFeatureValue)
+		return
+	}
+	name := r.PathValue("name")
+	s.mtxFeatures.Lock()
+	_, ok := s.features[name]
+	if ok {
+		s.features[name] = enabled
+	}
+	s.mtxFeatures.Unlock()
+	if !ok {
+		renderError(w, r, http.StatusNotFound, ErrFeature)
+		return
+	}
+	log.Printf("AUDIT: Feature %s set to %t by %s", name, enabled, s.clientLabel(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+/*********************************************************
+File: geoip.go
+Contents: Country lookup and allow/deny policy using a local MMDB file
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+const (
+	// ISO 3166 user-assigned code reported for addresses the database doesn't know,
+	// such as private networks.  It can be used in the allow and deny lists.
+	UnknownCountry = "ZZ"
+)
+
+// Context key for the country resolved by geoPolicy
+type countryKey struct{}
+
+/* method openGeoIP()
+Open the configured MaxMind-format country or city database
+*/
+func (s *Server) openGeoIP() error {
+	db, err := maxminddb.Open(s.config.GeoIPDB)
+	if err != nil {
+		return err
+	}
+	s.geoDB = db
+	log.Printf("Loaded GeoIP database %s", s.config.GeoIPDB)
+	return nil
+}
+
+/* method lookupCountry()
+Return the ISO country code for `ip`, or UnknownCountry
+*/
+func (s *Server) lookupCountry(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return UnknownCountry
+	}
+	var iso string
+	err = s.geoDB.Lookup(addr.Unmap()).DecodePath(&iso, "country", "iso_code")
+	if err != nil || len(iso) == 0 {
+		return UnknownCountry
+	}
+	return iso
+}
+
+/* method countryAllowed()
+Deny rules win, then if there is an allow list the country must be on it
+*/
+func (s *Server) countryAllowed(country string) bool {
+	for _, c := range s.config.GeoDeny {
+		if c == country {
+			return false
+		}
+	}
+	if len(s.config.GeoAllow) == 0 {
+		return true
+	}
+	for _, c := range s.config.GeoAllow {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+/* method requestCountry()
+Return the country geoPolicy resolved for the request, "" if GeoIP is disabled
+*/
+func requestCountry(r *http.Request) string {
+	country, _ := r.Context().Value(countryKey{}).(string)
+	return country
+}
+
+/* method clientLabel()
+Describe the client for log lines, with its country and principal when known
+*/
+func (s *Server) clientLabel(r *http.Request) string {
+	label := s.clientIP(r)
+	if country := requestCountry(r); len(country) > 0 {
+		label += " [" + country + "]"
+	}
+	if principal := requestPrincipal(r); len(principal) > 0 {
+		label += " (" + principal + ")"
+	}
+	return label
+}
+
+/* method geoPolicy()
+Resolve the client's country, reject it if the policy doesn't allow it,
+and make it available to `next` for statistics and logging
+*/
+func (s *Server) geoPolicy(next http.Handler) http.Handler {
+	if s.geoDB == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country := s.lookupCountry(s.clientIP(r))
+		r = r.WithContext(context.WithValue(r.Context(), countryKey{}, country))
+		if !s.countryAllowed(country) {
+			log.Printf("Request from %s denied by GeoIP policy", s.clientLabel(r))
+			renderError(w, r, http.StatusForbidden, ErrGeoDenied)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
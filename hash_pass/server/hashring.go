@@ -0,0 +1,288 @@
+/*********************************************************
+File: hashring.go
+Contents: Consistent-hash distribution of jobs across cluster nodes
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Points each node gets on the ring, more points spread keys more evenly
+	ringReplicas = 100
+	// Tries at an Id that lands on our own part of the ring
+	ownedIDAttempts = 256
+	// Give up handing work to a peer that takes longer than this
+	handoffTimeout = 5 * time.Second
+)
+
+// Consistent-hash ring mapping keys to node names
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+/* method ringHash()
+Position of `key` on the ring.  Ids differ only in their last few digits so
+this needs a hash that spreads similar keys well, which CRC32 does not.
+*/
+func ringHash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+/* method newHashRing()
+Place `ringReplicas` points on the ring for every node
+*/
+func newHashRing(nodes []string) *hashRing {
+	h := &hashRing{owners: make(map[uint32]string)}
+	for _, n := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			p := ringHash(n + "#" + strconv.Itoa(i))
+			h.points = append(h.points, p)
+			h.owners[p] = n
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+	return h
+}
+
+/* method owner()
+Return the node owning `key`, the first point clockwise from its hash
+*/
+func (h *hashRing) owner(key string) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+	k := ringHash(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= k })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+/* method rebuildRing()
+- Recompute the ring from the current cluster members
+- Hand off any results that now belong to another node.  Only the keys on
+  the arcs gained or lost by the changed node move.
+*/
+func (s *Server) rebuildRing() {
+	if !s.config.Distributed || s.memberList == nil {
+		return
+	}
+	peers := s.clusterPeers()
+	var names []string
+	addrs := make(map[string]string)
+	for _, p := range peers {
+		names = append(names, p.Name)
+		addrs[p.Name] = p.Addr
+	}
+
+	s.mtxRing.Lock()
+	s.ring = newHashRing(names)
+	s.ringAddrs = addrs
+	s.mtxRing.Unlock()
+
+	s.rebalance()
+}
+
+/* method ringOwner()
+Return the name and base URL of the node owning job `id`
+*/
+func (s *Server) ringOwner(id string) (string, string) {
+	s.mtxRing.Lock()
+	defer s.mtxRing.Unlock()
+	if s.ring == nil {
+		return "", ""
+	}
+	name := s.ring.owner(id)
+	return name, s.ringAddrs[name]
+}
+
+/* method handedOver()
+Report whether this POST is a job a peer handed us because we own it on
+the ring, rather than one straight from a client
+*/
+func (s *Server) handedOver(r *http.Request) bool {
+	return s.config.Distributed && s.isPeerRequest(r) && len(r.Header.Get(forwardedHeader)) > 0
+}
+
+/* method ownedID()
+Give a job handed to us an Id of our own that the ring places on this node,
+so GETs arriving anywhere in the cluster are sent here.  The peer only
+chose this node, never the Id.
+*/
+func (s *Server) ownedID() string {
+	id := s.shardID(newTaskID())
+	for i := 1; i < ownedIDAttempts; i++ {
+		if owner, _ := s.ringOwner(id); len(owner) == 0 || owner == s.nodeName() {
+			break
+		}
+		id = s.shardID(newTaskID())
+	}
+	return id
+}
+
+/* method dispatchJob()
+Hand job `id` to the node owning it on the ring, which gives the job an Id
+of its own.  Returns that Id, or false if the job should run here,
+including when the owner can't be reached.
+*/
+func (s *Server) dispatchJob(r *http.Request, id string, pword string, opts jobOptions) (string, bool) {
+	if !s.config.Distributed || len(r.Header.Get(forwardedHeader)) > 0 {
+		return "", false
+	}
+	owner, addr := s.ringOwner(id)
+	if len(owner) == 0 || owner == s.nodeName() {
+		return "", false
+	}
+
+	form := url.Values{
+		PasswordKey:  {pword},
+		StoreKey:     {strconv.FormatBool(opts.store)},
+		FormatKey:    {opts.Format},
+		UserKey:      {opts.User},
+		RoundsKey:    {strconv.Itoa(opts.Rounds)},
+		AlgorithmKey: {opts.Algorithm},
+		PriorityKey:  {priorities[opts.priority]},
+	}
+	if len(opts.callbackURL) > 0 {
+		form.Set(CallbackKey, opts.callbackURL)
+	}
+	if opts.delaySet {
+		form.Set(DelayKey, opts.delay.String())
+	}
+	for key, v := range map[string]int{ScryptNKey: opts.scrypt.N, ScryptRKey: opts.scrypt.R, ScryptPKey: opts.scrypt.P} {
+		if v != 0 {
+			form.Set(key, strconv.Itoa(v))
+		}
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest(http.MethodPost, addr+HashPath, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error forwarding request %s to %s: %v", id, owner, err)
+		return "", false
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(forwardedHeader, s.nodeName())
+	// Let the owner log and trace the job under the same identifiers
+	req.Header.Set(RequestIDHeader, r.Header.Get(RequestIDHeader))
+	req.Header.Set(TraceparentHeader, r.Header.Get(TraceparentHeader))
+	s.signPeerRequest(req, body)
+
+	assigned := ""
+	resp, err := s.peerClient(handoffTimeout).Do(req)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		} else if escaped, ok := strings.CutPrefix(resp.Header.Get("Location"), HashPath+"/"); !ok {
+			err = errors.New("no job Id in response")
+		} else {
+			assigned, err = url.PathUnescape(escaped)
+		}
+	}
+	if err != nil {
+		log.Printf("Error forwarding request %s to %s, processing locally: %v", id, owner, err)
+		return "", false
+	}
+	log.Printf("Request %s forwarded to %s as %s%s", id, owner, assigned, requestCorrelation(r.Context()).logSuffix())
+	return assigned, true
+}
+
+/* method rebalance()
+Move completed results owned by other nodes to their owners
+*/
+func (s *Server) rebalance() {
+	self := s.nodeName()
+	moves := make(map[string]map[string]StoredResult)
+
+	s.mtxMap.Lock()
+	for id, result := range s.allResults() {
+		owner, addr := s.ringOwner(id)
+		if len(owner) == 0 || owner == self {
+			continue
+		}
+		if moves[addr] == nil {
+			moves[addr] = make(map[string]StoredResult)
+		}
+		moves[addr][id] = result
+	}
+	s.mtxMap.Unlock()
+
+	client := s.peerClient(handoffTimeout)
+	for addr, results := range moves {
+		body, _ := json.Marshal(results)
+		req, err := http.NewRequest(http.MethodPost, addr+HandoffPath, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(forwardedHeader, self)
+		s.signPeerRequest(req, body)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			// Keep serving them from here, the next membership change retries
+			log.Printf("Error handing off %d results to %s: %v", len(results), addr, err)
+			continue
+		}
+
+		s.mtxMap.Lock()
+		for id := range results {
+			s.lockedDeleteResult(id)
+		}
+		s.mtxMap.Unlock()
+		log.Printf("Handed off %d results to %s", len(results), addr)
+	}
+}
+
+/*
+	method doHandoff()
+	Accept results handed to us by a peer after a membership change
+*/
+func (s *Server) doHandoff(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Distributed || !s.isPeerRequest(r) {
+		renderError(w, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	var results map[string]StoredResult
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrHandoff)
+		return
+	}
+	s.mtxMap.Lock()
+	for id, result := range results {
+		s.lockedPutResult(id, result)
+	}
+	s.mtxMap.Unlock()
+
+	log.Printf("Received %d results from %s", len(results), r.Header.Get(forwardedHeader))
+	_, err := fmt.Fprint(w, MsgHealthy)
+	if err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+/*********************************************************
+File: heartbeat.go
+Contents: Periodic pings to an external heartbeat monitor
+*********************************************************/
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Give up on a ping that takes longer than this
+	heartbeatTimeout = 10 * time.Second
+)
+
+/* method sendHeartbeats()
+- Ping the configured heartbeat URL once per interval while the node is
+  healthy, so a monitor such as healthchecks.io alerts on the missing pings
+  when it isn't
+- Stop as soon as the server starts shutting down
+*/
+func (s *Server) sendHeartbeats() {
+	client := http.Client{Timeout: heartbeatTimeout}
+	var started int64
+	backlogged := false
+
+	for ; ; s.clock.Sleep(s.config.HeartbeatInterval) {
+		if s.bShutdown.Load() {
+			return
+		}
+		var why string
+		why, started, backlogged = s.heartbeatWithheld(started, backlogged)
+		if len(why) > 0 {
+			log.Printf("Heartbeat ping withheld: %s", why)
+			continue
+		}
+		resp, err := client.Get(s.config.HeartbeatURL)
+		if err != nil {
+			log.Printf("Heartbeat ping failed: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("Heartbeat ping returned status %d", resp.StatusCode)
+			}
+		}
+	}
+}
+
+/* method heartbeatWithheld()
+Return why the node shouldn't ping, "" if it should: it is still warming
+up, processing is paused, or the workers are hung, with jobs ready for
+them at the last ping and none taken from the queue since.  `started` and
+`backlogged` are the jobs taken and whether any were ready at the last
+ping, and are returned for the next.
+*/
+func (s *Server) heartbeatWithheld(started int64, backlogged bool) (string, int64, bool) {
+	p := &s.workers
+	p.mtx.Lock()
+	nowStarted, queued, paused := p.started, p.ready.len(), p.paused
+	p.mtx.Unlock()
+
+	switch {
+	case !s.bReady.Load():
+		return "not ready", nowStarted, false
+	case paused:
+		return "processing paused", nowStarted, false
+	case backlogged && nowStarted == started:
+		return fmt.Sprintf("workers hung, %d jobs waiting", queued), nowStarted, queued > 0
+	}
+	return "", nowStarted, queued > 0
+}
@@ -0,0 +1,143 @@
+/*********************************************************
+File: idempotency.go
+Contents: Idempotency-Key handling so retried POSTs don't create duplicate jobs
+*********************************************************/
+
+package server
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"time"
+)
+
+const (
+	// Request header naming a key the client attaches to a POST, so a retry
+	// of it returns the original job
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// Response header set on a replayed POST
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// Time a key is remembered unless another is configured
+	DefaultIdempotencyWindow = 24 * time.Hour
+
+	// Longest key accepted
+	maxIdempotencyKey = 255
+)
+
+// A POST an Idempotency-Key was given with
+type idempotentRequest struct {
+	// Digest of the request's fields, so a key reused for a different
+	// request is caught
+	fingerprint [sha256.Size]byte
+	// Id of the job created, "" while the request is still being handled
+	id string
+	// When the key is forgotten, in Unix nanoseconds
+	expires int64
+}
+
+/* method validIdempotencyKey()
+Check a key is no longer than maxIdempotencyKey and printable ASCII
+*/
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > maxIdempotencyKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/* method idempotencyKey()
+Return the key given with a POST, scoped to the client so two clients can't
+collide, and false if it isn't a valid key.  "" when none was given.
+*/
+func (s *Server) idempotencyKey(r *http.Request) (string, bool) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) == 0 {
+		return "", true
+	}
+	if !validIdempotencyKey(key) {
+		return "", false
+	}
+	return s.clientKey(r) + "\x00" + key, true
+}
+
+/* method requestFingerprint()
+Digest the fields of a parsed POST, in a fixed order, so a replay can be
+told from a different request sent with the same key
+*/
+func requestFingerprint(r *http.Request) [sha256.Size]byte {
+	return sha256.Sum256([]byte(r.Form.Encode()))
+}
+
+/* method idempotencyWindow()
+Return the time a key is remembered
+*/
+func (s *Server) idempotencyWindow() time.Duration {
+	if s.config.IdempotencyWindow > 0 {
+		return s.config.IdempotencyWindow
+	}
+	return DefaultIdempotencyWindow
+}
+
+/* method claimIdempotencyKey()
+Claim `key` for a request with `fingerprint`.  Returns the Id of the job an
+earlier request with the key created, or the error message to reject it
+with if the key belongs to a different request or one still being handled.
+*/
+func (s *Server) claimIdempotencyKey(key string, fingerprint [sha256.Size]byte, now time.Time) (string, int, string) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	if req, ok := s.idempotencyKeys[key]; ok && req.expires > now.UnixNano() {
+		switch {
+		case req.fingerprint != fingerprint:
+			return "", http.StatusUnprocessableEntity, ErrIdempotentReuse
+		case len(req.id) == 0:
+			return "", http.StatusConflict, ErrIdempotentBusy
+		}
+		return req.id, 0, ""
+	}
+	s.idempotencyKeys[key] = idempotentRequest{fingerprint: fingerprint, expires: now.Add(s.idempotencyWindow()).UnixNano()}
+	return "", 0, ""
+}
+
+/* method settleIdempotencyKey()
+Record the job a claimed key created, or release the key if the request
+was rejected, "" for `id`, so it can be retried
+*/
+func (s *Server) settleIdempotencyKey(key string, id string) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	if len(id) == 0 {
+		delete(s.idempotencyKeys, key)
+		return
+	}
+	req := s.idempotencyKeys[key]
+	req.id = id
+	s.idempotencyKeys[key] = req
+}
+
+/* method idempotencySweepInterval()
+Return the time between sweeps of expired keys, a tenth of the window
+between a second and a minute
+*/
+func (s *Server) idempotencySweepInterval() time.Duration {
+	return min(max(s.idempotencyWindow()/10, time.Second), time.Minute)
+}
+
+/* method expireIdempotencyKeys()
+Forget the keys whose window has passed
+*/
+func (s *Server) expireIdempotencyKeys(now time.Time) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	for key, req := range s.idempotencyKeys {
+		if req.expires <= now.UnixNano() && len(req.id) > 0 {
+			delete(s.idempotencyKeys, key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postHash sends a form POST of `password` with Idempotency-Key `key` from
+// `remote`
+func postHash(s *Server, remote, key, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, HashPath, strings.NewReader(url.Values{"password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = remote
+	if len(key) > 0 {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, r)
+	return rec
+}
+
+func TestIdempotentPost(t *testing.T) {
+	s, err := NewServer(Config{Workers: 1})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer s.closeBackends()
+
+	first := postHash(s, "198.51.100.1:1000", "key-1", "angryMonkey")
+	if first.Code != http.StatusAccepted || len(first.Body.String()) == 0 {
+		t.Fatalf("first POST got %d %q", first.Code, first.Body)
+	}
+	if first.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Error("first POST marked as replayed")
+	}
+	id := first.Body.String()
+
+	// The same key with the same body gets the same job back
+	replay := postHash(s, "198.51.100.1:1000", "key-1", "angryMonkey")
+	if replay.Code != http.StatusAccepted || replay.Body.String() != id {
+		t.Errorf("replay got %d %q, want %d %q", replay.Code, replay.Body, http.StatusAccepted, id)
+	}
+	if replay.Header().Get(IdempotentReplayedHeader) != "true" || replay.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("replay headers %v", replay.Header())
+	}
+
+	// The same key with a different body is refused and leaves the job the
+	// key created
+	reused := postHash(s, "198.51.100.1:1000", "key-1", "calmMonkey")
+	if reused.Code != http.StatusUnprocessableEntity || !strings.Contains(reused.Body.String(), errorCodes[ErrIdempotentReuse]) {
+		t.Errorf("reused key got %d %q, want %d", reused.Code, reused.Body, http.StatusUnprocessableEntity)
+	}
+	if again := postHash(s, "198.51.100.1:1000", "key-1", "angryMonkey"); again.Body.String() != id {
+		t.Errorf("replay after a refused reuse got %q, want %q", again.Body, id)
+	}
+
+	// Keys are the client's own, and without one every POST is a new job
+	if other := postHash(s, "198.51.100.2:1000", "key-1", "calmMonkey"); other.Code != http.StatusAccepted || other.Body.String() == id {
+		t.Errorf("another client's POST with the key got %d %q", other.Code, other.Body)
+	}
+	if plain := postHash(s, "198.51.100.1:1000", "", "angryMonkey"); plain.Body.String() == id {
+		t.Error("POST without a key got the keyed job")
+	}
+	if bad := postHash(s, "198.51.100.1:1000", "bad\x01key", "angryMonkey"); bad.Code != http.StatusBadRequest {
+		t.Errorf("invalid key got %d, want %d", bad.Code, http.StatusBadRequest)
+	}
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	s := &Server{idempotencyKeys: make(map[string]idempotentRequest), config: Config{IdempotencyWindow: time.Minute}}
+	now := time.Unix(1000, 0)
+	same, different := [32]byte{1}, [32]byte{2}
+
+	if id, _, msg := s.claimIdempotencyKey("k", same, now); id != "" || msg != "" {
+		t.Fatalf("first claim = %q, %q", id, msg)
+	}
+	// A retry while the first request is still being handled waits for it
+	if _, status, msg := s.claimIdempotencyKey("k", same, now); status != http.StatusConflict || msg != ErrIdempotentBusy {
+		t.Errorf("claim in progress = %d %q", status, msg)
+	}
+	s.settleIdempotencyKey("k", "job")
+	if id, _, msg := s.claimIdempotencyKey("k", same, now); id != "job" || msg != "" {
+		t.Errorf("replayed claim = %q, %q, want job", id, msg)
+	}
+	if _, status, msg := s.claimIdempotencyKey("k", different, now); status != http.StatusUnprocessableEntity || msg != ErrIdempotentReuse {
+		t.Errorf("claim for a different request = %d %q", status, msg)
+	}
+
+	// Once the window passes the key is free for any request
+	later := now.Add(time.Minute)
+	s.expireIdempotencyKeys(later)
+	if id, _, msg := s.claimIdempotencyKey("k", different, later); id != "" || msg != "" {
+		t.Errorf("claim after the window = %q, %q", id, msg)
+	}
+
+	// A rejected request releases its key for a retry
+	s.settleIdempotencyKey("k", "")
+	if id, _, msg := s.claimIdempotencyKey("k", same, later); id != "" || msg != "" {
+		t.Errorf("claim after release = %q, %q", id, msg)
+	}
+}
@@ -0,0 +1,328 @@
+/*********************************************************
+File: import.go
+Contents: Bulk import of exported results, for moving them between instances
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Ways of resolving an imported Id that is already in use, given in
+	// the on_conflict parameter.  Skip keeps the result already held,
+	// overwrite replaces it, renumber imports the record under a new Id
+	// and fail refuses the whole import.
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictRenumber  = "renumber"
+	ConflictFail      = "fail"
+
+	// Longest line of a JSON Lines import
+	maxImportLine = 1 << 20
+)
+
+var (
+	errImportFile     = errors.New("invalid import file")
+	errImportConflict = errors.New("imported Ids are already in use")
+	errConflictMode   = errors.New("unknown conflict resolution")
+	errImportRaft     = errors.New("import is unavailable with raft replication")
+)
+
+// Outcome of an import
+type ImportSummary struct {
+	// Records stored, including those replacing a result
+	Imported int `json:"imported"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"`
+	// New Ids of the renumbered records, by the Id in the file
+	Renumbered map[string]TaskID `json:"renumbered,omitempty"`
+}
+
+/* method checkImportRecord()
+Check a record has an Id that can be fetched through /hash/{id} and a hash
+*/
+func checkImportRecord(rec ExportRecord) error {
+	if len(rec.ID) == 0 || strings.ContainsFunc(string(rec.ID), func(c rune) bool {
+		return c == '/' || unicode.IsSpace(c) || unicode.IsControl(c)
+	}) {
+		return fmt.Errorf("invalid task Id %q", rec.ID)
+	}
+	if len(rec.Hash) == 0 {
+		return fmt.Errorf("task %s has no hash", rec.ID)
+	}
+	return nil
+}
+
+/* method parseImport()
+Read the records of an export in `format`, ExportJSONL or ExportCSV.  The
+whole file is checked before anything is imported, so a bad line, or an Id
+given twice, refuses it with the line number.
+*/
+func parseImport(r io.Reader, format string) ([]ExportRecord, error) {
+	var records []ExportRecord
+	lines := make(map[TaskID]int)
+	add := func(line int, rec ExportRecord) error {
+		if err := checkImportRecord(rec); err != nil {
+			return fmt.Errorf("%w: line %d: %v", errImportFile, line, err)
+		}
+		if first, dup := lines[rec.ID]; dup {
+			return fmt.Errorf("%w: line %d: task %s already given on line %d", errImportFile, line, rec.ID, first)
+		}
+		lines[rec.ID] = line
+		records = append(records, rec)
+		return nil
+	}
+
+	switch format {
+	case ExportJSONL:
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, maxImportLine)
+		for n := 1; sc.Scan(); n++ {
+			if len(strings.TrimSpace(sc.Text())) == 0 {
+				continue
+			}
+			var rec ExportRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", errImportFile, n, err)
+			}
+			if err := add(n, rec); err != nil {
+				return nil, err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %v", errImportFile, err)
+		}
+	case ExportCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("%w: header: %v", errImportFile, err)
+		}
+		// Columns may come in any order, but only those an export has
+		cols := make(map[string]int)
+		for i, name := range header {
+			if !slices.Contains(exportColumns, name) {
+				return nil, fmt.Errorf("%w: unknown column %q", errImportFile, name)
+			}
+			cols[name] = i
+		}
+		for _, name := range []string{"id", "hash"} {
+			if _, ok := cols[name]; !ok {
+				return nil, fmt.Errorf("%w: no %s column", errImportFile, name)
+			}
+		}
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%w: %v", errImportFile, err)
+			}
+			n, _ := cr.FieldPos(0)
+			field := func(name string) string {
+				if i, ok := cols[name]; ok {
+					return row[i]
+				}
+				return ""
+			}
+			rec := ExportRecord{
+				ID:        TaskID(field("id")),
+				Hash:      field("hash"),
+				Algorithm: field("algorithm"),
+				Salt:      field("salt"),
+				PepperID:  field("pepper_id"),
+			}
+			for _, t := range []struct {
+				name string
+				into *time.Time
+			}{{"submitted", &rec.Submitted}, {"started", &rec.Started}, {"completed", &rec.Completed}} {
+				if v := field(t.name); len(v) > 0 {
+					if *t.into, err = time.Parse(time.RFC3339Nano, v); err != nil {
+						return nil, fmt.Errorf("%w: line %d: invalid %s time %q", errImportFile, n, t.name, v)
+					}
+				}
+			}
+			if v := field("delay"); len(v) > 0 {
+				if rec.Delay, err = strconv.ParseInt(v, 10, 64); err != nil || rec.Delay < 0 {
+					return nil, fmt.Errorf("%w: line %d: invalid delay %q", errImportFile, n, v)
+				}
+			}
+			if err := add(n, rec); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", errImportFile, format)
+	}
+	return records, nil
+}
+
+/* method lockedIDInUse()
+Report whether `id` is taken by a result, a job or a deleted result that
+can still be restored.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedIDInUse(id string) bool {
+	if _, ok := s.getResult(id); ok {
+		return true
+	}
+	_, running := s.jobStates[id]
+	_, pending := s.pendingJobs[id]
+	_, deleted, err := s.lockedGetDeleted(id)
+	if err != nil {
+		// Taken, rather than risk overwriting a result still restorable
+		log.Printf("Error reading deleted result %s from store: %v", id, err)
+		return true
+	}
+	return running || pending || deleted
+}
+
+/* method Import()
+Import the results of an export read from `r` in `format`, ExportJSONL or
+ExportCSV, resolving Ids already in use as `conflict` says, ConflictSkip
+when empty
+*/
+func (s *Server) Import(r io.Reader, format string, conflict string) (ImportSummary, error) {
+	if len(conflict) == 0 {
+		conflict = ConflictSkip
+	}
+	switch conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictRenumber, ConflictFail:
+	default:
+		return ImportSummary{}, fmt.Errorf("%w %q", errConflictMode, conflict)
+	}
+	if s.raftNode != nil {
+		// Results written here would never reach the other nodes
+		return ImportSummary{}, errImportRaft
+	}
+	records, err := parseImport(r, format)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+
+	s.mtxMap.Lock()
+	var conflicts []string
+	for _, rec := range records {
+		if s.lockedIDInUse(string(rec.ID)) {
+			conflicts = append(conflicts, string(rec.ID))
+		}
+	}
+	s.mtxMap.Unlock()
+	if conflict == ConflictFail && len(conflicts) > 0 {
+		return ImportSummary{}, fmt.Errorf("%w: %d of %d, including %s", errImportConflict, len(conflicts), len(records), conflicts[0])
+	}
+	summary := ImportSummary{}
+	if conflict == ConflictRenumber && len(conflicts) > 0 {
+		summary.Renumbered = make(map[string]TaskID, len(conflicts))
+		for _, id := range conflicts {
+			summary.Renumbered[id] = TaskID(s.shardID(newTaskID()))
+		}
+	}
+
+	s.mtxMap.Lock()
+	for _, rec := range records {
+		id := string(rec.ID)
+		if newID, ok := summary.Renumbered[id]; ok {
+			id = string(newID)
+		} else if s.lockedIDInUse(id) {
+			// Also catches Ids taken since the check above, which every
+			// mode but overwrite now skips
+			if _, stored := s.getResult(id); conflict == ConflictOverwrite && stored && !s.onHold(id) {
+				summary.Replaced++
+			} else {
+				summary.Skipped++
+				continue
+			}
+		}
+		delete(s.expiredResults, id)
+		s.lockedPutResult(id, StoredResult{
+			Hash:      rec.Hash,
+			Algorithm: rec.Algorithm,
+			Salt:      rec.Salt,
+			PepperID:  rec.PepperID,
+			Submitted: unixNano(rec.Submitted),
+			Started:   unixNano(rec.Started),
+			Completed: unixNano(rec.Completed),
+			Delay:     rec.Delay * int64(time.Microsecond),
+		})
+		summary.Imported++
+	}
+	s.mtxMap.Unlock()
+	return summary, nil
+}
+
+/* method unixNano()
+Convert a time to Unix nanoseconds, 0 for the zero time
+*/
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+/* method importFormat()
+Return the format of an import body, JSON Lines unless the format
+parameter or the content type names CSV
+*/
+func importFormat(r *http.Request) string {
+	if v := r.URL.Query().Get(FormatKey); len(v) > 0 {
+		return v
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return ExportCSV
+	}
+	return ExportJSONL
+}
+
+/*
+	method postImport()
+	Handle POST request for URL path `/admin/import`, loading the results
+	of an export from another instance, as in a blue/green migration
+*/
+func (s *Server) postImport(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	// ReadTimeout would otherwise cut a large import short
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	summary, err := s.Import(r.Body, importFormat(r), r.URL.Query().Get(ConflictKey))
+	switch {
+	case errors.Is(err, errConflictMode):
+		renderError(w, r, http.StatusBadRequest, ErrConflictMode)
+		return
+	case errors.Is(err, errImportFile):
+		log.Printf("Import by %s refused: %v", s.clientLabel(r), err)
+		renderError(w, r, http.StatusBadRequest, ErrImport)
+		return
+	case errors.Is(err, errImportConflict):
+		log.Printf("Import by %s refused: %v", s.clientLabel(r), err)
+		renderError(w, r, http.StatusConflict, ErrImportConflict)
+		return
+	case errors.Is(err, errImportRaft):
+		renderError(w, r, http.StatusConflict, ErrImportRaft)
+		return
+	case err != nil:
+		log.Printf("Error importing results: %v", err)
+		renderError(w, r, http.StatusServiceUnavailable, ErrStorage)
+		return
+	}
+	log.Printf("AUDIT: Import of %d results, %d replaced, %d skipped and %d renumbered, by %s",
+		summary.Imported, summary.Replaced, summary.Skipped, len(summary.Renumbered), s.clientLabel(r))
+	writeJSON(w, r, http.StatusOK, summary)
+}
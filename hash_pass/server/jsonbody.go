@@ -0,0 +1,106 @@
+/*********************************************************
+File: jsonbody.go
+Contents: Content type checks and JSON bodies for POST /hash
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Largest JSON body accepted by POST /hash
+	maxJSONBody = 64 << 10
+)
+
+// JSON body of POST /hash, with the same fields as the form
+type hashRequest struct {
+	Password  string `json:"password"`
+	Store     *bool  `json:"store"`
+	Format    string `json:"format"`
+	User      string `json:"user"`
+	Rounds    int    `json:"rounds"`
+	Algorithm string `json:"algorithm"`
+	ScryptN   int    `json:"scrypt-n"`
+	ScryptR   int    `json:"scrypt-r"`
+	ScryptP   int    `json:"scrypt-p"`
+	Callback  string `json:"callback_url"`
+	Priority  string `json:"priority"`
+	// A duration such as "2s", or a number of seconds as a string
+	Delay string `json:"delay"`
+}
+
+/* method readHashRequest()
+Make the fields of a POST /hash body available through FormValue whatever
+its encoding.  A JSON object is decoded strictly, rejecting unknown fields,
+fields of the wrong type and trailing data.  Returns the status and error
+message for a body that can't be used, 0 and "" when it can.
+*/
+func readHashRequest(w http.ResponseWriter, r *http.Request) (int, string) {
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		return 0, ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return http.StatusUnsupportedMediaType, ErrContentType
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		return 0, ""
+	case "application/json":
+	default:
+		return http.StatusUnsupportedMediaType, ErrContentType
+	}
+
+	var req hashRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&req)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("data after JSON object")
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, ErrPayloadSize
+		}
+		return http.StatusBadRequest, ErrJSON
+	}
+
+	// Query parameters still apply, the body wins over them
+	form := r.URL.Query()
+	set := func(key string, v string) {
+		if len(v) > 0 {
+			form.Set(key, v)
+		}
+	}
+	setInt := func(key string, v int) {
+		if v != 0 {
+			form.Set(key, strconv.Itoa(v))
+		}
+	}
+	set(PasswordKey, req.Password)
+	set(FormatKey, req.Format)
+	set(UserKey, req.User)
+	set(AlgorithmKey, req.Algorithm)
+	set(CallbackKey, req.Callback)
+	set(PriorityKey, req.Priority)
+	set(DelayKey, req.Delay)
+	setInt(RoundsKey, req.Rounds)
+	setInt(ScryptNKey, req.ScryptN)
+	setInt(ScryptRKey, req.ScryptR)
+	setInt(ScryptPKey, req.ScryptP)
+	if req.Store != nil {
+		form.Set(StoreKey, strconv.FormatBool(*req.Store))
+	}
+	r.Form = form
+	r.PostForm = form
+	return 0, ""
+}
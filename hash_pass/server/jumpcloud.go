@@ -0,0 +1,145 @@
+/*********************************************************
+File: jumpcloud.go
+Contents: Validation of API keys against the JumpCloud directory
+*********************************************************/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Header clients send their API key in
+	APIKeyHeader = "X-Api-Key"
+
+	// Time allowed for a call to the JumpCloud API
+	jumpCloudTimeout = 5 * time.Second
+	// Cached validations kept before expired entries are swept
+	jumpCloudCacheSweep = 10000
+)
+
+// Outcome of validating a key, cached until `expires`
+type cachedKey struct {
+	principal string
+	err       error
+	expires   time.Time
+}
+
+// Authenticator accepting API keys that the JumpCloud Admin API accepts,
+// optionally only those of a single organization
+type JumpCloudAuthenticator struct {
+	url      string
+	orgID    string
+	cacheTTL time.Duration
+	client   http.Client
+	// Validations by SHA-256 of the key, so keys aren't kept in memory
+	cache map[[sha256.Size]byte]cachedKey
+	// Mutex to protect cache
+	mtxCache sync.Mutex
+}
+
+var errInvalidKey = errors.New("invalid API key")
+
+/* method NewJumpCloudAuthenticator()
+Create an authenticator validating keys against the JumpCloud API at `url`.
+With `orgID` set only keys for that organization are accepted.  Results,
+good or bad, are cached for `cacheTTL`.
+*/
+func NewJumpCloudAuthenticator(url string, orgID string, cacheTTL time.Duration) *JumpCloudAuthenticator {
+	return &JumpCloudAuthenticator{
+		url:      url,
+		orgID:    orgID,
+		cacheTTL: cacheTTL,
+		client:   http.Client{Timeout: jumpCloudTimeout},
+		cache:    make(map[[sha256.Size]byte]cachedKey),
+	}
+}
+
+/* method Authenticate()
+Accept the request if JumpCloud accepts its API key.  The principal names
+the key by a prefix of its digest so it can appear in logs.
+*/
+func (j *JumpCloudAuthenticator) Authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if len(key) == 0 {
+		return "", errInvalidKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	now := time.Now()
+
+	j.mtxCache.Lock()
+	cached, ok := j.cache[sum]
+	j.mtxCache.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.principal, cached.err
+	}
+
+	principal := "key-" + hex.EncodeToString(sum[:6])
+	err := j.validate(key)
+	if errors.Is(err, ErrAuthUnavailable) {
+		// Don't remember outages, try again on the next request
+		return "", err
+	}
+
+	j.mtxCache.Lock()
+	if len(j.cache) >= jumpCloudCacheSweep {
+		for k, c := range j.cache {
+			if now.After(c.expires) {
+				delete(j.cache, k)
+			}
+		}
+	}
+	j.cache[sum] = cachedKey{principal: principal, err: err, expires: now.Add(j.cacheTTL)}
+	j.mtxCache.Unlock()
+	return principal, err
+}
+
+/* method validate()
+Ask JumpCloud which organizations the key can access
+*/
+func (j *JumpCloudAuthenticator) validate(key string) error {
+	req, err := http.NewRequest(http.MethodGet, j.url+"/api/organizations", nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
+	req.Header.Set("x-api-key", key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return errInvalidKey
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%w: JumpCloud returned status %d", ErrAuthUnavailable, resp.StatusCode)
+	}
+
+	var orgs struct {
+		Results []struct {
+			ID string `json:"_id"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&orgs); err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
+	if len(j.orgID) == 0 {
+		return nil
+	}
+	for _, org := range orgs.Results {
+		if org.ID == j.orgID {
+			return nil
+		}
+	}
+	return errInvalidKey
+}
@@ -0,0 +1,57 @@
+/*********************************************************
+File: lifecycle.go
+Contents: Hooks that let embedders follow the server lifecycle
+*********************************************************/
+
+package server
+
+/* method OnStart()
+Register a hook run as Start begins, before the listener is bound
+*/
+func (s *Server) OnStart(hook func()) {
+	s.mtxHooks.Lock()
+	s.startHooks = append(s.startHooks, hook)
+	s.mtxHooks.Unlock()
+}
+
+/* method OnReady()
+Register a hook run once the listener is bound and warm-up has completed
+*/
+func (s *Server) OnReady(hook func()) {
+	s.mtxHooks.Lock()
+	s.readyHooks = append(s.readyHooks, hook)
+	s.mtxHooks.Unlock()
+}
+
+/* method OnDrainStart()
+Register a hook run when shutdown begins, after new requests start being
+rejected but before waiting for pending jobs.  This is the place to
+deregister from a load balancer.
+*/
+func (s *Server) OnDrainStart(hook func()) {
+	s.mtxHooks.Lock()
+	s.drainHooks = append(s.drainHooks, hook)
+	s.mtxHooks.Unlock()
+}
+
+/* method OnShutdown()
+Register a hook run once all pending jobs have completed, just before the
+HTTP server is stopped.  This is the place to flush caches.
+*/
+func (s *Server) OnShutdown(hook func()) {
+	s.mtxHooks.Lock()
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+	s.mtxHooks.Unlock()
+}
+
+/* method runHooks()
+Run the hooks for a stage in the order they were registered
+*/
+func (s *Server) runHooks(hooks *[]func()) {
+	s.mtxHooks.Lock()
+	run := append([]func(){}, *hooks...)
+	s.mtxHooks.Unlock()
+	for _, hook := range run {
+		hook()
+	}
+}
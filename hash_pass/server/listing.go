@@ -0,0 +1,164 @@
+/*********************************************************
+File: listing.go
+Contents: Paginated listing of the jobs a node holds, for operators
+*********************************************************/
+
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Jobs listed per page unless the request asks for fewer, and the most
+	// it may ask for
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// One job in a listing
+type JobSummary struct {
+	ID        TaskID    `json:"id"`
+	Status    string    `json:"status"`
+	Submitted time.Time `json:"submitted,omitzero"`
+	Completed time.Time `json:"completed,omitzero"`
+}
+
+// Body of GET /hash.  NextCursor fetches the following page and is omitted
+// on the last one.
+type JobList struct {
+	Jobs       []JobSummary `json:"jobs"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+/* method unixTime()
+Convert Unix nanoseconds to a time, the zero time for 0
+*/
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+/* method compareIDs()
+Order task Ids by node prefix and then numerically, so 9 comes before 10
+*/
+func compareIDs(a, b string) int {
+	i, j := strings.LastIndex(a, shardSeparator), strings.LastIndex(b, shardSeparator)
+	if c := strings.Compare(a[:max(i, 0)], b[:max(j, 0)]); c != 0 {
+		return c
+	}
+	na, errA := strconv.ParseInt(a[i+1:], 10, 64)
+	nb, errB := strconv.ParseInt(b[j+1:], 10, 64)
+	if errA != nil || errB != nil || na == nb {
+		return strings.Compare(a, b)
+	}
+	if na < nb {
+		return -1
+	}
+	return 1
+}
+
+/* method parseStatusFilter()
+Parse a comma separated list of statuses, nil for all of them.  Returns
+false if it names one that isn't a status.
+*/
+func parseStatusFilter(v string) (map[string]bool, bool) {
+	if len(v) == 0 {
+		return nil, true
+	}
+	filter := make(map[string]bool)
+	for _, status := range strings.Split(v, ",") {
+		switch status {
+		case StatusPending, StatusProcessing, StatusComplete:
+			filter[status] = true
+		default:
+			return nil, false
+		}
+	}
+	return filter, true
+}
+
+/* method listJobs()
+Return up to `limit` jobs with Ids after `after`, in Id order, with a
+status in `filter` unless it is nil, and the cursor of the next page
+*/
+func (s *Server) listJobs(after string, limit int, filter map[string]bool) JobList {
+	s.mtxMap.Lock()
+	ids := make([]string, 0, s.countResults()+len(s.jobStates)+len(s.pendingJobs))
+	for id := range s.allResults() {
+		ids = append(ids, id)
+	}
+	for id := range s.jobStates {
+		ids = append(ids, id)
+	}
+	for id := range s.pendingJobs {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareIDs)
+	ids = slices.Compact(ids)
+
+	list := JobList{Jobs: []JobSummary{}}
+	for _, id := range ids {
+		if len(after) > 0 && compareIDs(id, after) <= 0 {
+			continue
+		}
+		result, status := s.lockedJobStatus(id)
+		if filter != nil && !filter[status] {
+			continue
+		}
+		if len(list.Jobs) == limit {
+			list.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(list.Jobs[limit-1].ID))
+			break
+		}
+		list.Jobs = append(list.Jobs, JobSummary{
+			ID:        TaskID(id),
+			Status:    status,
+			Submitted: unixTime(result.Submitted),
+			Completed: unixTime(result.Completed),
+		})
+	}
+	s.mtxMap.Unlock()
+	return list
+}
+
+/*
+	method listHashes()
+	Handle GET request for URL path `/hash`, listing the jobs this node
+	holds a page at a time
+*/
+func (s *Server) listHashes(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, ok := parseStatusFilter(query.Get(StatusKey))
+	if !ok {
+		renderError(w, r, http.StatusBadRequest, ErrStatusFilter)
+		return
+	}
+	limit := DefaultListLimit
+	if v := query.Get(LimitKey); len(v) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			renderError(w, r, http.StatusBadRequest, ErrLimit)
+			return
+		}
+		limit = min(limit, MaxListLimit)
+	}
+	after, err := base64.RawURLEncoding.DecodeString(query.Get(CursorKey))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrCursor)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, s.listJobs(string(after), limit, filter))
+}
@@ -0,0 +1,93 @@
+/*********************************************************
+File: lru.go
+Contents: Least recently used eviction capping the number of results kept
+*********************************************************/
+
+package server
+
+import (
+	"container/list"
+	"log"
+)
+
+/* method lockedTouch()
+Mark result `id` as the most recently used.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedTouch(id string) {
+	if s.config.MaxResults <= 0 {
+		return
+	}
+	if e, ok := s.resultElems[id]; ok {
+		s.resultOrder.MoveToFront(e)
+		return
+	}
+	s.resultElems[id] = s.resultOrder.PushFront(id)
+}
+
+/* method lockedPutResult()
+Store `result` as `id`, evicting the least recently used results beyond
+Config.MaxResults.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedPutResult(id string, result StoredResult) error {
+	if err := s.store.Put(id, result); err != nil {
+		log.Printf("Error storing result %s: %v", id, err)
+		return err
+	}
+	sealed := s.sealer.sealResult(result)
+	s.walAppend(walRecord{Op: walPut, ID: id, Result: &sealed})
+	s.lockedTouch(id)
+	s.lockedEvict()
+	return nil
+}
+
+/* method lockedDeleteResult()
+Remove result `id`.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedDeleteResult(id string) {
+	if err := s.store.Delete(id); err != nil {
+		log.Printf("Error deleting result %s from store: %v", id, err)
+	}
+	s.walAppend(walRecord{Op: walDelete, ID: id})
+	if e, ok := s.resultElems[id]; ok {
+		s.resultOrder.Remove(e)
+		delete(s.resultElems, id)
+	}
+}
+
+/* method lockedEvict()
+Evict least recently used results until no more than Config.MaxResults
+remain.  Every result kept is tracked from the moment the server is
+created, so the tracking list gives the count without asking the store.
+Results under legal hold are never evicted, so they may keep the count
+above the cap.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedEvict() {
+	if s.config.MaxResults <= 0 {
+		return
+	}
+	count := s.resultOrder.Len()
+	e := s.resultOrder.Back()
+	for count > s.config.MaxResults && e != nil {
+		prev := e.Prev()
+		if id := e.Value.(string); !s.onHold(id) {
+			s.lockedDeleteResult(id)
+			s.evictionCount++
+			count--
+		}
+		e = prev
+	}
+}
+
+/* method lockedResetOrder()
+Start tracking use afresh after the results have been replaced wholesale,
+as by a raft snapshot restore, or loaded from a store, snapshot or log when
+the server is created.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedResetOrder() {
+	s.resultOrder = list.New()
+	s.resultElems = make(map[string]*list.Element)
+	for id := range s.allResults() {
+		s.lockedTouch(id)
+	}
+	s.lockedEvict()
+}
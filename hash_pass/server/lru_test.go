@@ -0,0 +1,67 @@
+package server
+
+import "testing"
+
+// openLRUServer opens a server keeping at most `maxResults` results in `dir`
+func openLRUServer(t *testing.T, dir string, maxResults int) *Server {
+	t.Helper()
+	s, err := NewServer(Config{Workers: 1, DataDir: dir, MaxResults: maxResults})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s
+}
+
+func putResults(t *testing.T, s *Server, ids ...string) {
+	t.Helper()
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	for _, id := range ids {
+		if err := s.lockedPutResult(id, StoredResult{Hash: "hash of " + id}); err != nil {
+			t.Fatalf("putting %s: %v", id, err)
+		}
+	}
+}
+
+func storedIDs(t *testing.T, s *Server) map[string]bool {
+	t.Helper()
+	ids := make(map[string]bool)
+	for id := range s.allResults() {
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestLRUEvictionAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openLRUServer(t, dir, 3)
+	putResults(t, s, "a", "b", "c")
+	if err := s.closeBackends(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+
+	// The results kept from before count towards the cap, and a use after
+	// the reopen protects a result from eviction
+	s = openLRUServer(t, dir, 3)
+	if _, status := s.jobStatus("a"); status != StatusComplete {
+		t.Fatalf("status of a after reopen = %q, want %q", status, StatusComplete)
+	}
+	putResults(t, s, "d")
+	ids := storedIDs(t, s)
+	if len(ids) != 3 || !ids["a"] || !ids["d"] {
+		t.Fatalf("results after reopen and one more = %v, want 3 with a and d", ids)
+	}
+	if s.evictionCount != 1 {
+		t.Errorf("%d evictions, want 1", s.evictionCount)
+	}
+	if err := s.closeBackends(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+
+	// Lowering the cap evicts down to it as the store is opened
+	s = openLRUServer(t, dir, 2)
+	defer s.closeBackends()
+	if ids := storedIDs(t, s); len(ids) != 2 {
+		t.Errorf("results after reopening with a cap of 2 = %v", ids)
+	}
+}
@@ -0,0 +1,143 @@
+/*********************************************************
+File: maintenance.go
+Contents: Housekeeping loop run in the background for the server's lifetime
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// A housekeeping job the maintenance loop runs every `every`
+type maintenanceTask struct {
+	name  string
+	every time.Duration
+	run   func(now time.Time)
+	// When the task is next due
+	next time.Time
+}
+
+/* method maintenanceTasks()
+Return the housekeeping the configuration calls for
+*/
+func (s *Server) maintenanceTasks() []*maintenanceTask {
+	var tasks []*maintenanceTask
+	add := func(name string, every time.Duration, run func(time.Time)) {
+		tasks = append(tasks, &maintenanceTask{name: name, every: every, run: run, next: s.clock.Now().Add(every)})
+	}
+	if s.config.ResultTTL > 0 {
+		add("expiry sweep", s.reapInterval(), s.expireResults)
+	}
+	if s.pepperSource != nil && s.config.PepperRefresh > 0 {
+		add("pepper refresh", s.config.PepperRefresh, func(time.Time) {
+			if err := s.loadPepper(); err != nil {
+				log.Printf("Error refreshing pepper, keeping pepper %s: %v", s.currentPepper().ID, err)
+			}
+		})
+	}
+	add("idempotency key expiry", s.idempotencySweepInterval(), s.expireIdempotencyKeys)
+	add("cancelled job expiry", cancelledSweepInterval, s.expireCancelled)
+	add("download expiry", downloadTTL, s.expireDownloads)
+	if _, _, ok := s.autoscaleBounds(); ok {
+		add("worker autoscaling", autoscaleInterval, s.autoscaleWorkers)
+	}
+	if s.config.Dedup {
+		add("dedup sweep", dedupSweepInterval, s.sweepDedup)
+	}
+	if s.archive != nil {
+		add("archival", s.archiveInterval(), s.archiveResults)
+	}
+	if len(s.config.SnapshotPath) > 0 {
+		add("snapshot", s.snapshotInterval(), s.takeSnapshot)
+	}
+	if s.config.StatsInterval > 0 {
+		add("stats flush", s.config.StatsInterval, s.flushStats)
+	}
+	if len(s.config.OTLPEndpoint) > 0 {
+		add("metrics export", s.otlpInterval(), s.exportMetrics)
+	}
+	return tasks
+}
+
+/* method flushStats()
+Write this node's statistics to the log as one JSON line
+*/
+func (s *Server) flushStats(time.Time) {
+	jtext, err := json.Marshal(s.localStats().inUnit(UnitMicroseconds))
+	if err != nil {
+		log.Printf("Error encoding stats: %v", err)
+		return
+	}
+	log.Printf("STATS: %s", jtext)
+}
+
+/* method runTask()
+Run one task, logging rather than dying if it panics so the rest of the
+housekeeping carries on
+*/
+func runTask(task *maintenanceTask, now time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Maintenance task %s panicked: %v", task.name, err)
+		}
+	}()
+	task.run(now)
+}
+
+/* method maintain()
+Run each task whenever it is due until `ctx` ends
+*/
+func (s *Server) maintain(ctx context.Context, tasks []*maintenanceTask) {
+	defer close(s.maintenanceDone)
+	for {
+		next := tasks[0].next
+		for _, task := range tasks[1:] {
+			if task.next.Before(next) {
+				next = task.next
+			}
+		}
+		due := make(chan time.Time, 1)
+		timer := s.clock.AfterFunc(next.Sub(s.clock.Now()), func() { due <- s.clock.Now() })
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case now := <-due:
+			for _, task := range tasks {
+				if !now.Before(task.next) {
+					runTask(task, now)
+					task.next = now.Add(task.every)
+				}
+			}
+		}
+	}
+}
+
+/* method startMaintenance()
+Start the maintenance loop, if there is any housekeeping to do
+*/
+func (s *Server) startMaintenance() {
+	tasks := s.maintenanceTasks()
+	if len(tasks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopMaintenance = cancel
+	s.maintenanceDone = make(chan struct{})
+	go s.maintain(ctx, tasks)
+}
+
+/* method endMaintenance()
+Stop the maintenance loop and wait for the task it is running to finish
+*/
+func (s *Server) endMaintenance() {
+	if s.stopMaintenance == nil {
+		return
+	}
+	s.stopMaintenance()
+	<-s.maintenanceDone
+}
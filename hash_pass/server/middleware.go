@@ -0,0 +1,77 @@
+/*********************************************************
+File: middleware.go
+Contents: Middleware applied to every route and the hook for adding more
+*********************************************************/
+
+package server
+
+import (
+	"net/http"
+)
+
+// Wraps a handler with additional behaviour such as auth, logging or tracing
+type Middleware func(http.Handler) http.Handler
+
+// ResponseWriter wrapper that remembers the status code sent to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach the connection, to flush streams,
+// extend deadlines and take over the connection for WebSockets
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+/* method Use()
+Add middleware applied to all of this server's routes, the admin listener's
+included.  Middleware runs in the order it was added, inside the built-in
+error reporting and abuse protection so panics are still reported and
+throttled clients never reach it.  Must be called before Start or Handler.
+*/
+func (s *Server) Use(mw ...func(http.Handler) http.Handler) {
+	for _, m := range mw {
+		s.middlewares = append(s.middlewares, m)
+	}
+	if s.handler != nil {
+		// Added after NewServer built the handlers
+		s.buildHandlers()
+	}
+}
+
+/* method buildHandlers()
+Build the handlers serving the routes, and those of the admin listener if
+there is one
+*/
+func (s *Server) buildHandlers() {
+	s.handler = s.buildHandler(dispatch(s.router))
+	if s.adminRouter != nil {
+		s.adminHandler = s.buildHandler(dispatch(s.adminRouter))
+	}
+}
+
+/* method buildHandler()
+Wrap `h` in the middleware added with Use or WithMiddleware and then the built-in
+layers.  Request Ids are resolved first so everything below can log and
+report them, and the server is made known to the error renderers.  Peer
+signatures are checked before anything relies on them.
+*/
+func (s *Server) buildHandler(h http.Handler) http.Handler {
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return s.withRenderers(correlate(s.peerAuth(s.reportErrors(s.abuseGuard(h)))))
+}
@@ -0,0 +1,188 @@
+/*********************************************************
+File: notify.go
+Contents: Notification of job state changes, for long polls and streams
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Longest a GET may wait for a job to complete
+	MaxWait = time.Minute
+
+	// Status streamed when a job ends without a result to fetch, because it
+	// was abandoned or its result wasn't kept
+	StatusGone = "gone"
+
+	// Time between comments keeping an idle event stream open through proxies
+	eventKeepAlive = 15 * time.Second
+)
+
+/* method jobChanged()
+Wake everything waiting for job `requestId` to change state.  The caller
+must hold mtxMap.
+*/
+func (s *Server) jobChanged(requestId string) {
+	if ch, ok := s.jobWatchers[requestId]; ok {
+		close(ch)
+		delete(s.jobWatchers, requestId)
+	}
+}
+
+/* method watchJob()
+Return the job's current result and status, and a channel closed on its
+next change of state.  The channel is nil once there is nothing more to
+wait for, when the job is complete or unknown, or when it runs on another
+instance sharing the store, whose changes this node doesn't see.
+*/
+func (s *Server) watchJob(requestId string) (StoredResult, string, <-chan struct{}) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	result, status := s.lockedJobStatus(requestId)
+	if status == StatusComplete || len(status) == 0 {
+		return result, status, nil
+	}
+	_, running := s.jobStates[requestId]
+	if _, replicated := s.pendingJobs[requestId]; !running && !replicated {
+		return result, status, nil
+	}
+	ch, ok := s.jobWatchers[requestId]
+	if !ok {
+		ch = make(chan struct{})
+		s.jobWatchers[requestId] = ch
+	}
+	return result, status, ch
+}
+
+/* method awaitJob()
+Block until job `requestId` is complete or unknown, `wait` has passed, or
+`ctx` ends, whichever comes first
+*/
+func (s *Server) awaitJob(ctx context.Context, requestId string, wait time.Duration) {
+	expired := make(chan struct{})
+	timer := s.clock.AfterFunc(wait, func() { close(expired) })
+	defer timer.Stop()
+	for {
+		_, _, changed := s.watchJob(requestId)
+		if changed == nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/* method parseDuration()
+Parse a duration such as 5s or a number of seconds.  Returns false if it is
+neither or negative.
+*/
+func parseDuration(v string) (time.Duration, bool) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d < 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+/* method parseWait()
+Parse a wait parameter and cap it at MaxWait
+*/
+func parseWait(v string) (time.Duration, bool) {
+	wait, ok := parseDuration(v)
+	return min(wait, MaxWait), ok
+}
+
+/* method sendEvent()
+Write one server-sent event and flush it to the client
+*/
+func sendEvent(w http.ResponseWriter, rc *http.ResponseController, event string, v interface{}) error {
+	jtext, _ := json.Marshal(v)
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, jtext); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+/*
+	method jobEvents()
+	Handle GET request for URL path `/hash/{id}/events`, streaming a
+	`status` event with the job's state now and on every change until it
+	completes
+*/
+func (s *Server) jobEvents(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	id := r.PathValue("id")
+	if s.forwardToOwner(w, r, id) {
+		return
+	}
+	result, status, changed := s.watchJob(id)
+	if len(status) == 0 {
+		renderError(w, r, http.StatusNotFound, ErrInvalidId)
+		return
+	}
+
+	// ReadTimeout would otherwise end the stream by cancelling the request
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		event := hashResult(id, status, result)
+		if len(status) == 0 {
+			event.Status = StatusGone
+		}
+		if err := sendEvent(w, rc, "status", event); err != nil {
+			log.Printf("Error streaming events for request Id %s: %v", id, err)
+			return
+		}
+		if changed == nil {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-keepAlive.C:
+				if s.bShutdown.Load() {
+					return
+				}
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+		result, status, changed = s.watchJob(id)
+	}
+}
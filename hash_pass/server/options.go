@@ -0,0 +1,172 @@
+/*********************************************************
+File: options.go
+Contents: Functional options for tuning a Server when it is created
+*********************************************************/
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"hash_pass/hasher"
+)
+
+// Adjusts a server as it is created, applied after the Config passed to
+// NewServer so options win over it
+type Option func(*Server)
+
+/* method WithPort()
+Listen on `port` on every interface
+*/
+func WithPort(port int) Option {
+	return func(s *Server) {
+		s.config.Port = port
+		s.config.ListenAddr = ""
+	}
+}
+
+/* method WithListenAddr()
+Listen on `addr`, e.g. 127.0.0.1:8080 to accept local connections only
+*/
+func WithListenAddr(addr string) Option {
+	return func(s *Server) {
+		s.config.ListenAddr = addr
+	}
+}
+
+/* method WithDelay()
+Wait `d` before each job's result is available, 0 to complete jobs at once
+*/
+func WithDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.config.Delay = d
+	}
+}
+
+/* method WithJobTimeout()
+Abandon jobs that haven't completed within `d`, 0 for no deadline
+*/
+func WithJobTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.config.JobTimeout = d
+	}
+}
+
+/* method WithAuthenticator()
+Require clients of the hash API to pass `a`, taking precedence over
+authentication configured in Config
+*/
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.authenticator = a
+	}
+}
+
+/* method WithMiddleware()
+Add middleware applied to all of this server's routes, as Use does
+*/
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(s *Server) {
+		s.Use(mw...)
+	}
+}
+
+/* method WithHasher()
+Make `h` available to this server's requests as algorithm `name`, taking
+precedence over an algorithm registered with hasher.Register under the
+same name.  Every node of a cluster needs it, as jobs may be hashed on any
+of them.
+*/
+func WithHasher(name string, h hasher.Hasher) Option {
+	return func(s *Server) {
+		s.hashers[name] = h
+	}
+}
+
+/* method WithPepperSource()
+Mix the pepper from `src` into every sha512 format result, fetching it at
+startup and, with Config.PepperRefresh, periodically to pick up rotations
+*/
+func WithPepperSource(src PepperSource) Option {
+	return func(s *Server) {
+		s.pepperSource = src
+	}
+}
+
+/* method WithKeySource()
+Encrypt results written to durable backends, the store, write-ahead log,
+snapshots, archive and raft, with the keys from `src`, fetched at startup
+*/
+func WithKeySource(src KeySource) Option {
+	return func(s *Server) {
+		s.keySource = src
+	}
+}
+
+/* method WithStore()
+Keep results in `st` rather than in memory, e.g. to share or persist them.
+The server wipes and refills it when a raft node restores a snapshot.
+*/
+func WithStore(st Store) Option {
+	return func(s *Server) {
+		s.store = st
+	}
+}
+
+/* method WithClock()
+Schedule jobs and stamp their results with `c` rather than the wall clock,
+so tests can advance time instead of waiting out processing delays
+*/
+func WithClock(c Clock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+/* method WithErrorRenderer()
+Replace the function used to render every error response, so embedders can
+keep response shapes consistent with the rest of their platform
+*/
+func WithErrorRenderer(renderer ErrorRenderer) Option {
+	return func(s *Server) {
+		s.errorRenderer = renderer
+	}
+}
+
+/* method WithNotFoundHandler()
+Replace the handler for requests to unknown paths
+*/
+func WithNotFoundHandler(h http.Handler) Option {
+	return func(s *Server) {
+		s.notFoundHandler = h
+	}
+}
+
+/* method WithMethodNotAllowedHandler()
+Replace the handler for requests using a method the endpoint doesn't support
+*/
+func WithMethodNotAllowedHandler(h http.Handler) Option {
+	return func(s *Server) {
+		s.methodNotAllowedHandler = h
+	}
+}
+
+/* method WithFeature()
+Declare a feature flag and whether it is on by default, so the state in
+Config.Features can be applied to it and FeatureEnabled can check it
+*/
+func WithFeature(name string, enabled bool) Option {
+	return func(s *Server) {
+		s.featureDefaults[name] = enabled
+	}
+}
+
+/* method WithStartHook()
+Register a hook run as Start begins, as OnStart does
+*/
+func WithStartHook(hook func()) Option {
+	return func(s *Server) {
+		s.OnStart(hook)
+	}
+}
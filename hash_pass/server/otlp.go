@@ -0,0 +1,224 @@
+/*********************************************************
+File: otlp.go
+Contents: Pushes of this node's statistics to an OpenTelemetry collector
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Give up on a push that takes longer than this
+	otlpTimeout = 10 * time.Second
+	// Path of the metrics service under the collector's base URL
+	otlpMetricsPath = "/v1/metrics"
+	// Aggregation temporality of the sums and histogram, every point
+	// counting from when the server started
+	otlpCumulative = 2
+	// Name and resource attributes identifying the metrics as ours
+	otlpScopeName = "hash_pass"
+)
+
+// The parts of an OTLP ExportMetricsServiceRequest used, in the JSON
+// encoding of OTLP over HTTP.  64-bit integers are strings in it.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// A metric holds one of Sum, Gauge or Histogram
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano int64           `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      int64           `json:"timeUnixNano,string"`
+	AsInt             int64           `json:"asInt,string"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type otlpHistogramPoint struct {
+	StartTimeUnixNano int64     `json:"startTimeUnixNano,string"`
+	TimeUnixNano      int64     `json:"timeUnixNano,string"`
+	Count             int64     `json:"count,string"`
+	Sum               float64   `json:"sum"`
+	BucketCounts      []string  `json:"bucketCounts"`
+	ExplicitBounds    []float64 `json:"explicitBounds"`
+}
+
+/* method otlpInterval()
+Return the time between pushes of the metrics
+*/
+func (s *Server) otlpInterval() time.Duration {
+	if s.config.OTLPInterval > 0 {
+		return s.config.OTLPInterval
+	}
+	return DefaultOTLPInterval
+}
+
+/* method otlpMetrics()
+Describe `stats`, this node's statistics in nanoseconds, as OTLP metrics
+taken at `now`: the counters as cumulative sums since the server started,
+the processing times as a histogram in seconds and the rest as gauges
+*/
+func (s *Server) otlpMetrics(stats RequestStat, now time.Time) otlpRequest {
+	start, at := s.startTime.UnixNano(), now.UnixNano()
+	var metrics []otlpMetric
+	sum := func(name string, description string, unit string, points ...otlpNumberPoint) {
+		for i := range points {
+			points[i].StartTimeUnixNano, points[i].TimeUnixNano = start, at
+		}
+		metrics = append(metrics, otlpMetric{Name: name, Description: description, Unit: unit,
+			Sum: &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}})
+	}
+	gauge := func(name string, description string, unit string, value int64) {
+		metrics = append(metrics, otlpMetric{Name: name, Description: description, Unit: unit,
+			Gauge: &otlpGauge{DataPoints: []otlpNumberPoint{{TimeUnixNano: at, AsInt: value}}}})
+	}
+
+	sum("hash_pass.posts", "POST requests handled", "{request}", otlpNumberPoint{AsInt: stats.Total})
+	outcomes := make([]otlpNumberPoint, 0, len(stats.Outcomes))
+	for outcome, n := range stats.Outcomes {
+		outcomes = append(outcomes, otlpNumberPoint{
+			Attributes: []otlpAttribute{{Key: "outcome", Value: otlpValue{StringValue: outcome}}},
+			AsInt:      n,
+		})
+	}
+	sum("hash_pass.outcomes", "POST requests and jobs by how they ended", "{request}", outcomes...)
+	sum("hash_pass.timeouts", "Jobs that ran past their deadline", "{job}", otlpNumberPoint{AsInt: stats.Timeouts})
+	sum("hash_pass.evictions", "Results evicted to stay within the maximum", "{result}", otlpNumberPoint{AsInt: stats.Evictions})
+	sum("hash_pass.queue.rejections", "POST requests refused with the queue full", "{request}", otlpNumberPoint{AsInt: stats.QueueRejections})
+
+	// Seconds, as OpenTelemetry durations are
+	seconds := float64(time.Second)
+	point := otlpHistogramPoint{
+		StartTimeUnixNano: start,
+		TimeUnixNano:      at,
+		Count:             stats.Total,
+		Sum:               stats.Average * float64(stats.Total) / seconds,
+		BucketCounts:      make([]string, len(stats.Latency.Counts)),
+		ExplicitBounds:    make([]float64, len(stats.Latency.Bounds)),
+	}
+	for i, n := range stats.Latency.Counts {
+		point.BucketCounts[i] = strconv.FormatInt(n, 10)
+	}
+	for i, b := range stats.Latency.Bounds {
+		point.ExplicitBounds[i] = b / seconds
+	}
+	metrics = append(metrics, otlpMetric{Name: "hash_pass.post.duration", Description: "Processing time of POST requests", Unit: "s",
+		Histogram: &otlpHistogram{DataPoints: []otlpHistogramPoint{point}, AggregationTemporality: otlpCumulative}})
+
+	gauge("hash_pass.queue.depth", "Jobs waiting to complete", "{job}", stats.QueueDepth)
+	if stats.Workers != nil {
+		gauge("hash_pass.workers.size", "Workers in the pool", "{worker}", int64(stats.Workers.Size))
+		gauge("hash_pass.workers.busy", "Workers hashing a job", "{worker}", int64(stats.Workers.Busy))
+	}
+	gauge("hash_pass.goroutines", "Goroutines running", "{goroutine}", int64(stats.Goroutines))
+	gauge("hash_pass.uptime", "Time since the server started", "s", int64(stats.Uptime))
+
+	attr := func(key string, value string) otlpAttribute {
+		return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+	}
+	version := versionInfo().Version
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			attr("service.name", otlpScopeName),
+			attr("service.instance.id", s.nodeName()),
+			attr("service.version", version),
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: otlpScopeName, Version: version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+/* method exportMetrics()
+Push this node's statistics to the configured collector
+*/
+func (s *Server) exportMetrics(now time.Time) {
+	body, err := json.Marshal(s.otlpMetrics(s.localStats(), now))
+	if err != nil {
+		log.Printf("Error encoding metrics: %v", err)
+		return
+	}
+	endpoint := strings.TrimSuffix(s.config.OTLPEndpoint, "/") + otlpMetricsPath
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error pushing metrics: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.config.OTLPHeaders {
+		req.Header.Set(name, value)
+	}
+
+	client := http.Client{Timeout: otlpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error pushing metrics: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		log.Printf("Metrics push returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+}
@@ -0,0 +1,178 @@
+/*********************************************************
+File: peerauth.go
+Contents: Securing the requests cluster nodes send each other
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Carries a node's signature of a request it sends a peer, as
+	// t=<unix seconds>,sig=<hex HMAC-SHA256>
+	peerSignatureHeader = "X-Hash-Pass-Peer-Signature"
+	// Signatures further than this from our clock are refused, so a
+	// captured request can't be replayed later
+	peerSignatureSkew = 30 * time.Second
+	// Largest body a signed peer request may carry
+	maxPeerBody = 32 << 20
+)
+
+// Context key marking requests signed by a cluster member
+type peerRequestKey struct{}
+
+var (
+	// Returned for cluster keys memberlist can't use
+	ErrClusterKey = errors.New("cluster key must be 16, 24 or 32 bytes")
+	// Returned for a cluster CA file without any certificates
+	ErrClusterCA = errors.New("no certificates in cluster CA file")
+)
+
+/* method validClusterKey()
+Report whether `key` can encrypt gossip, AES-128, 192 or 256
+*/
+func validClusterKey(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+/* method derivePeerKey()
+Derive the key signing peer requests from the cluster key, so the gossip
+encryption key is never used for anything else
+*/
+func derivePeerKey(clusterKey []byte) []byte {
+	mac := hmac.New(sha256.New, clusterKey)
+	mac.Write([]byte("hash_pass peer requests"))
+	return mac.Sum(nil)
+}
+
+/* method peerSignature()
+Sign the parts of a request a peer acts on: the method, path and query, the
+sending node, the time and the body
+*/
+func (s *Server) peerSignature(method string, uri string, node string, ts string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, s.peerKey)
+	mac.Write([]byte(method + "\n" + uri + "\n" + node + "\n" + ts + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* method signPeerRequest()
+Sign `req`, whose body is `body`, so the peer receiving it accepts it as
+coming from a cluster member
+*/
+func (s *Server) signPeerRequest(req *http.Request, body []byte) {
+	ts := strconv.FormatInt(s.clock.Now().Unix(), 10)
+	sig := s.peerSignature(req.Method, req.URL.RequestURI(), req.Header.Get(forwardedHeader), ts, body)
+	req.Header.Set(peerSignatureHeader, "t="+ts+",sig="+sig)
+}
+
+/* method verifyPeerRequest()
+Report whether the request carries a valid, current signature by a
+cluster member.  The body is read to check it and put back for the handler.
+*/
+func (s *Server) verifyPeerRequest(r *http.Request) bool {
+	var ts, sig string
+	for _, part := range strings.Split(r.Header.Get(peerSignatureHeader), ",") {
+		if v, ok := strings.CutPrefix(part, "t="); ok {
+			ts = v
+		} else if v, ok := strings.CutPrefix(part, "sig="); ok {
+			sig = v
+		}
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	if skew := s.clock.Now().Sub(time.Unix(secs, 0)); skew > peerSignatureSkew || skew < -peerSignatureSkew {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeerBody+1))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) > maxPeerBody {
+		return false
+	}
+	want := s.peerSignature(r.Method, r.URL.RequestURI(), r.Header.Get(forwardedHeader), ts, body)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+/* method peerAuth()
+Mark requests signed by a cluster member, and drop the forwarding header
+from any other request so clients can't pass themselves off as a peer
+*/
+func (s *Server) peerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.memberList != nil && len(r.Header.Get(peerSignatureHeader)) > 0 && s.verifyPeerRequest(r) {
+			r = r.WithContext(context.WithValue(r.Context(), peerRequestKey{}, true))
+		} else {
+			r.Header.Del(forwardedHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* method isPeerRequest()
+Report whether the request was signed by a cluster member
+*/
+func (s *Server) isPeerRequest(r *http.Request) bool {
+	peer, _ := r.Context().Value(peerRequestKey{}).(bool)
+	return peer
+}
+
+/* method loadTLS()
+Load the certificate to serve HTTPS with and the CAs to check the other
+cluster nodes' certificates against, when configured
+*/
+func (s *Server) loadTLS() error {
+	if len(s.config.TLSCert) > 0 || len(s.config.TLSKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return err
+		}
+		s.tlsCert = &cert
+	}
+	if len(s.config.ClusterCA) > 0 {
+		pem, err := os.ReadFile(s.config.ClusterCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrClusterCA
+		}
+		s.peerTransport = http.DefaultTransport.(*http.Transport).Clone()
+		s.peerTransport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return nil
+}
+
+/* method peerClient()
+Return a client for requests to other cluster nodes giving up after
+`timeout`
+*/
+func (s *Server) peerClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if s.peerTransport != nil {
+		client.Transport = s.peerTransport
+	}
+	return client
+}
@@ -0,0 +1,108 @@
+/*********************************************************
+File: pepper.go
+Contents: The secret pepper mixed into sha512 format results, and its rotation
+*********************************************************/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"hash_pass/hasher"
+)
+
+// A pepper and the Id recorded with the results hashed with it, so old
+// results can still be verified after a rotation
+type Pepper struct {
+	ID     string
+	Secret []byte
+}
+
+// Supplies the current pepper, from a file, the environment or a secret
+// manager.  Returning a pepper with a new Id rotates it.
+type PepperSource interface {
+	Pepper() (Pepper, error)
+}
+
+// Adapts an ordinary function to a PepperSource
+type PepperFunc func() (Pepper, error)
+
+var (
+	errPepperMissing = errors.New("pepper is empty")
+	errPepperShort   = errors.New("pepper is shorter than 16 bytes")
+)
+
+func (f PepperFunc) Pepper() (Pepper, error) {
+	return f()
+}
+
+/* method pepperID()
+Identify a pepper by a fingerprint of it, so a rotated secret gets a new Id
+without revealing anything about it
+*/
+func pepperID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:4])
+}
+
+/* method FilePepper()
+Read the pepper from the file at `path`, less a trailing newline, each time
+it is asked for, so replacing the file rotates it
+*/
+func FilePepper(path string) PepperSource {
+	return PepperFunc(func() (Pepper, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Pepper{}, err
+		}
+		secret := []byte(strings.TrimRight(string(data), "\r\n"))
+		return Pepper{ID: pepperID(secret), Secret: secret}, nil
+	})
+}
+
+/* method EnvPepper()
+Read the pepper from the environment variable `name`
+*/
+func EnvPepper(name string) PepperSource {
+	return PepperFunc(func() (Pepper, error) {
+		secret := []byte(os.Getenv(name))
+		return Pepper{ID: pepperID(secret), Secret: secret}, nil
+	})
+}
+
+/* method loadPepper()
+Fetch the current pepper from the source and start using it
+*/
+func (s *Server) loadPepper() error {
+	p, err := s.pepperSource.Pepper()
+	switch {
+	case err != nil:
+		return err
+	case len(p.Secret) == 0:
+		return errPepperMissing
+	case len(p.Secret) < hasher.MinPepperSize:
+		return errPepperShort
+	}
+	s.mtxPepper.Lock()
+	previous := s.pepper.ID
+	s.pepper = p
+	s.mtxPepper.Unlock()
+	if p.ID != previous {
+		log.Printf("Using pepper %s", p.ID)
+	}
+	return nil
+}
+
+/* method currentPepper()
+Return the pepper new jobs are hashed with, a zero Pepper when there is none
+*/
+func (s *Server) currentPepper() Pepper {
+	s.mtxPepper.Lock()
+	defer s.mtxPepper.Unlock()
+	return s.pepper
+}
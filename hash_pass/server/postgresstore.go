@@ -0,0 +1,345 @@
+/*********************************************************
+File: postgresstore.go
+Contents: PostgreSQL-backed Store with versioned schema migrations
+*********************************************************/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// database/sql driver used unless another is configured, the binary or
+	// embedding program must import one registered under this name
+	DefaultPostgresDriver = "postgres"
+	// Open connections allowed unless another limit is configured
+	DefaultPostgresMaxConns = 10
+
+	// Idle connections are closed after this long
+	postgresIdleTime = 5 * time.Minute
+	// Key of the advisory lock serializing migrations between instances
+	postgresMigrationLock = 0x68617368
+)
+
+// Schema changes applied in order, each once, version i+1 being
+// postgresMigrations[i].  Append to the list; never edit an entry that has
+// shipped.
+var postgresMigrations = []string{
+	`CREATE TABLE hash_pass_results (
+		id        text PRIMARY KEY,
+		hash      text NOT NULL,
+		algorithm text NOT NULL DEFAULT '',
+		salt      text NOT NULL DEFAULT '',
+		pepper_id text NOT NULL DEFAULT '',
+		submitted bigint NOT NULL DEFAULT 0,
+		completed bigint NOT NULL DEFAULT 0
+	)`,
+	`CREATE SEQUENCE hash_pass_request_id`,
+	`ALTER TABLE hash_pass_results ADD COLUMN started bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE hash_pass_results ADD COLUMN delay bigint NOT NULL DEFAULT 0`,
+	`CREATE TABLE hash_pass_dead_letters (
+		seq    bigserial PRIMARY KEY,
+		letter text NOT NULL
+	)`,
+	`CREATE TABLE hash_pass_deleted (
+		id     text PRIMARY KEY,
+		result text NOT NULL,
+		at     bigint NOT NULL
+	)`,
+	`CREATE TABLE hash_pass_holds (
+		id text PRIMARY KEY
+	)`,
+}
+
+// Statements prepared once per store
+const (
+	pgPut = `INSERT INTO hash_pass_results (id, hash, algorithm, salt, pepper_id, submitted, started, completed, delay)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET hash = $2, algorithm = $3, salt = $4, pepper_id = $5, submitted = $6, started = $7, completed = $8, delay = $9`
+	pgGet    = `SELECT hash, algorithm, salt, pepper_id, submitted, started, completed, delay FROM hash_pass_results WHERE id = $1`
+	pgDelete = `DELETE FROM hash_pass_results WHERE id = $1`
+	pgList   = `SELECT id, hash, algorithm, salt, pepper_id, submitted, started, completed, delay FROM hash_pass_results`
+	pgCount  = `SELECT count(*) FROM hash_pass_results`
+	pgNextID = `SELECT nextval('hash_pass_request_id')`
+
+	pgPutDeadLetter    = `INSERT INTO hash_pass_dead_letters (letter) VALUES ($1)`
+	pgTrimDeadLetters  = `DELETE FROM hash_pass_dead_letters WHERE seq <= (SELECT max(seq) FROM hash_pass_dead_letters) - $1`
+	pgListDeadLetters  = `SELECT letter FROM hash_pass_dead_letters ORDER BY seq`
+	pgClearDeadLetters = `DELETE FROM hash_pass_dead_letters`
+
+	pgPutDeleted = `INSERT INTO hash_pass_deleted (id, result, at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET result = $2, at = $3`
+	pgGetDeleted    = `SELECT result, at FROM hash_pass_deleted WHERE id = $1`
+	pgForgetDeleted = `DELETE FROM hash_pass_deleted WHERE id = $1`
+	pgListDeleted   = `SELECT id, result, at FROM hash_pass_deleted`
+	pgPutHold       = `INSERT INTO hash_pass_holds (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`
+	pgDeleteHold    = `DELETE FROM hash_pass_holds WHERE id = $1`
+	pgHeld          = `SELECT count(*) FROM hash_pass_holds WHERE id = $1`
+	pgListHolds     = `SELECT id FROM hash_pass_holds`
+)
+
+// Implements SequenceStore, DeadLetterStore and RetentionStore on a
+// PostgreSQL database,
+// requests being counted with a sequence shared by the instances using the
+// database
+type PostgresStore struct {
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+/* method OpenPostgresStore()
+Connect through the database/sql `driver` to `dsn` with a pool of up to
+`maxConns` connections, bring the schema up to date and prepare the
+statements the store runs
+*/
+func OpenPostgresStore(driver string, dsn string, maxConns int) (*PostgresStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	db.SetConnMaxIdleTime(postgresIdleTime)
+	p := &PostgresStore{db: db, stmts: make(map[string]*sql.Stmt)}
+	if err := p.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+	for _, query := range []string{pgPut, pgGet, pgDelete, pgList, pgCount, pgNextID, pgPutDeadLetter, pgTrimDeadLetters, pgListDeadLetters, pgClearDeadLetters,
+		pgPutDeleted, pgGetDeleted, pgForgetDeleted, pgListDeleted, pgPutHold, pgDeleteHold, pgHeld, pgListHolds} {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.stmts[query] = stmt
+	}
+	return p, nil
+}
+
+/* method migrate()
+Apply the migrations the database hasn't had, each in its own transaction
+holding an advisory lock so instances starting together take turns
+*/
+func (p *PostgresStore) migrate() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS hash_pass_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	for i, migration := range postgresMigrations {
+		version := i + 1
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		applied := false
+		if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err == nil {
+			err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM hash_pass_migrations WHERE version = $1)`, version).Scan(&applied)
+		}
+		if err == nil && !applied {
+			if _, err = tx.Exec(migration); err == nil {
+				_, err = tx.Exec(`INSERT INTO hash_pass_migrations (version) VALUES ($1)`, version)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		if !applied {
+			log.Printf("Applied schema migration %d", version)
+		}
+	}
+	return nil
+}
+
+func (p *PostgresStore) Close() error {
+	for _, stmt := range p.stmts {
+		stmt.Close()
+	}
+	return p.db.Close()
+}
+
+func (p *PostgresStore) Put(id string, result StoredResult) error {
+	_, err := p.stmts[pgPut].Exec(id, result.Hash, result.Algorithm, result.Salt, result.PepperID, result.Submitted, result.Started, result.Completed, result.Delay)
+	return err
+}
+
+func (p *PostgresStore) Get(id string) (StoredResult, bool, error) {
+	var r StoredResult
+	err := p.stmts[pgGet].QueryRow(id).Scan(&r.Hash, &r.Algorithm, &r.Salt, &r.PepperID, &r.Submitted, &r.Started, &r.Completed, &r.Delay)
+	if err == sql.ErrNoRows {
+		return StoredResult{}, false, nil
+	}
+	return r, err == nil, err
+}
+
+func (p *PostgresStore) Delete(id string) error {
+	_, err := p.stmts[pgDelete].Exec(id)
+	return err
+}
+
+func (p *PostgresStore) List(fn func(id string, result StoredResult) bool) error {
+	rows, err := p.stmts[pgList].Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var r StoredResult
+		if err := rows.Scan(&id, &r.Hash, &r.Algorithm, &r.Salt, &r.PepperID, &r.Submitted, &r.Started, &r.Completed, &r.Delay); err != nil {
+			return err
+		}
+		if !fn(id, r) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (p *PostgresStore) Count() (int, error) {
+	var n int
+	err := p.stmts[pgCount].QueryRow().Scan(&n)
+	return n, err
+}
+
+func (p *PostgresStore) NextID() (int64, error) {
+	var n int64
+	err := p.stmts[pgNextID].QueryRow().Scan(&n)
+	return n, err
+}
+
+/* method PutDeadLetter()
+Append `d` and drop the letters more than `keep` behind the newest.  Gaps
+left in the sequence by failed inserts can leave fewer kept.
+*/
+func (p *PostgresStore) PutDeadLetter(d DeadLetter, keep int) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := p.stmts[pgPutDeadLetter].Exec(string(data)); err != nil {
+		return err
+	}
+	_, err = p.stmts[pgTrimDeadLetters].Exec(keep)
+	return err
+}
+
+func (p *PostgresStore) ListDeadLetters() ([]DeadLetter, error) {
+	rows, err := p.stmts[pgListDeadLetters].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var letters []DeadLetter
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var d DeadLetter
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return nil, fmt.Errorf("dead letter: %w", err)
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+func (p *PostgresStore) ClearDeadLetters() error {
+	_, err := p.stmts[pgClearDeadLetters].Exec()
+	return err
+}
+
+func (p *PostgresStore) PutDeleted(id string, result StoredResult, at int64) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = p.stmts[pgPutDeleted].Exec(id, string(data), at)
+	return err
+}
+
+func (p *PostgresStore) GetDeleted(id string) (StoredResult, int64, bool, error) {
+	var result StoredResult
+	var data string
+	var at int64
+	err := p.stmts[pgGetDeleted].QueryRow(id).Scan(&data, &at)
+	if err == sql.ErrNoRows {
+		return result, 0, false, nil
+	} else if err != nil {
+		return result, 0, false, err
+	}
+	return result, at, true, json.Unmarshal([]byte(data), &result)
+}
+
+func (p *PostgresStore) ForgetDeleted(id string) error {
+	_, err := p.stmts[pgForgetDeleted].Exec(id)
+	return err
+}
+
+func (p *PostgresStore) ListDeleted(fn func(id string, result StoredResult, at int64) bool) error {
+	rows, err := p.stmts[pgListDeleted].Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, data string
+		var at int64
+		if err := rows.Scan(&id, &data, &at); err != nil {
+			return err
+		}
+		var result StoredResult
+		if err := json.Unmarshal([]byte(data), &result); err != nil {
+			return fmt.Errorf("deleted result %s: %w", id, err)
+		}
+		if !fn(id, result, at) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+func (p *PostgresStore) SetHold(id string, held bool) error {
+	query := pgDeleteHold
+	if held {
+		query = pgPutHold
+	}
+	_, err := p.stmts[query].Exec(id)
+	return err
+}
+
+func (p *PostgresStore) Held(id string) (bool, error) {
+	var n int
+	err := p.stmts[pgHeld].QueryRow(id).Scan(&n)
+	return n > 0, err
+}
+
+func (p *PostgresStore) ListHolds() ([]string, error) {
+	rows, err := p.stmts[pgListHolds].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
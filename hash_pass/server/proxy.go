@@ -0,0 +1,94 @@
+/*********************************************************
+File: proxy.go
+Contents: Client address resolution behind trusted reverse proxies
+*********************************************************/
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+/* method isTrustedProxy()
+Report whether `ip` falls within one of the trusted proxy networks
+*/
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.config.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* method parseHop()
+Extract the IP from a forwarding header entry, which may be quoted and may
+carry a port, e.g. `"[2001:db8::1]:4711"` or `192.0.2.60:80`.  Obfuscated
+identifiers such as `unknown` yield nil.
+*/
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+/* method forwardedHops()
+Return the client and proxy addresses recorded by proxies, nearest client
+first.  The standard Forwarded header (RFC 7239) wins over X-Forwarded-For.
+*/
+func forwardedHops(r *http.Request) []string {
+	var hops []string
+	for _, line := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, line := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(line, ",")...)
+	}
+	return hops
+}
+
+/* method clientIP()
+Return the address of the client that made the request.  Forwarding headers
+are only believed when the connection comes from a trusted proxy, and are
+walked from the nearest hop outwards so a client can't spoof its address by
+sending its own header.
+*/
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !s.isTrustedProxy(peer) {
+		return host
+	}
+
+	client := peer
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			// Can't see past a hop we don't understand, settle for the last good one
+			break
+		}
+		client = ip
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestForwardedHops(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		want    []string
+	}{
+		{"none", nil, nil},
+		{"x-forwarded-for", map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.1", "10.0.0.2"}},
+			[]string{"198.51.100.1", " 10.0.0.1", "10.0.0.2"}},
+		{"forwarded", map[string][]string{"Forwarded": {`for=198.51.100.1;proto=https, For="[2001:db8::1]:4711"`}},
+			[]string{"198.51.100.1", `"[2001:db8::1]:4711"`}},
+		{"forwarded wins", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}},
+			[]string{"198.51.100.1"}},
+		{"forwarded without for", map[string][]string{"Forwarded": {"proto=https"}, "X-Forwarded-For": {"203.0.113.9"}},
+			[]string{"203.0.113.9"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for name, values := range tc.headers {
+				for _, v := range values {
+					r.Header.Add(name, v)
+				}
+			}
+			if got := forwardedHops(r); !slices.Equal(got, tc.want) {
+				t.Errorf("forwardedHops() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	s := &Server{config: Config{TrustedProxies: []*net.IPNet{proxies}}}
+
+	for _, tc := range []struct {
+		name, remote, xff, forwarded, want string
+	}{
+		{"direct", "198.51.100.7:1234", "", "", "198.51.100.7"},
+		{"untrusted peer's header ignored", "198.51.100.7:1234", "203.0.113.9", "", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.1:1234", "203.0.113.9", "", "203.0.113.9"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "203.0.113.9, 10.0.0.3, 10.0.0.2", "", "203.0.113.9"},
+		{"spoofed hop before the client", "10.0.0.1:1234", "192.0.2.66, 203.0.113.9", "", "203.0.113.9"},
+		{"unparsable hop", "10.0.0.1:1234", "203.0.113.9, unknown, 10.0.0.2", "", "10.0.0.2"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.3", "", "10.0.0.3"},
+		{"forwarded with port", "10.0.0.1:1234", "", `for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"remote without port", "198.51.100.7", "", "", "198.51.100.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			if len(tc.xff) > 0 {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if len(tc.forwarded) > 0 {
+				r.Header.Set("Forwarded", tc.forwarded)
+			}
+			if got := s.clientIP(r); got != tc.want {
+				t.Errorf("clientIP() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*********************************************************
+File: queue.go
+Contents: Queue of jobs waiting for a worker, served by priority with aging
+and round-robin across clients
+*********************************************************/
+
+package server
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	// Priorities a POST may give its job in the priority field
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+
+	// Time waiting for a worker that raises a job's priority by a level
+	// unless another is configured
+	DefaultPriorityAging = 10 * time.Second
+)
+
+var (
+	// Priorities by level, highest first
+	priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+)
+
+// Jobs whose delay has passed, one lane per priority
+type readyQueue struct {
+	lanes []queueLane
+	// Waiting time that counts as a level of priority
+	aging time.Duration
+}
+
+// Jobs of one priority.  Clients take turns, so one submitting in bulk
+// can't hold up everyone else, and each client's jobs run oldest first.
+type queueLane struct {
+	jobs map[string][]*queuedJob
+	// Clients with jobs queued, the one served next first
+	turn []string
+	n    int
+}
+
+/* method newReadyQueue()
+Return an empty queue with a lane for each priority
+*/
+func newReadyQueue(aging time.Duration) readyQueue {
+	q := readyQueue{lanes: make([]queueLane, len(priorities)), aging: aging}
+	for i := range q.lanes {
+		q.lanes[i].jobs = make(map[string][]*queuedJob)
+	}
+	return q
+}
+
+/* method push()
+Add a job behind its client's others, giving the client a turn if it had
+none queued
+*/
+func (l *queueLane) push(job *queuedJob) {
+	if len(l.jobs[job.client]) == 0 {
+		l.turn = append(l.turn, job.client)
+	}
+	l.jobs[job.client] = append(l.jobs[job.client], job)
+	l.n++
+}
+
+/* method pop()
+Take the oldest job of the client whose turn it is and move it to the back
+of the turns
+*/
+func (l *queueLane) pop() *queuedJob {
+	client := l.turn[0]
+	jobs := l.jobs[client]
+	job := jobs[0]
+	jobs[0] = nil
+	l.turn = l.turn[1:]
+	if len(jobs) > 1 {
+		l.jobs[client] = jobs[1:]
+		l.turn = append(l.turn, client)
+	} else {
+		delete(l.jobs, client)
+	}
+	l.n--
+	return job
+}
+
+/* method remove()
+Take a job out of the lane, wherever it is in its client's turn
+*/
+func (l *queueLane) remove(job *queuedJob) bool {
+	jobs := l.jobs[job.client]
+	i := slices.Index(jobs, job)
+	if i < 0 {
+		return false
+	}
+	if jobs = slices.Delete(jobs, i, i+1); len(jobs) > 0 {
+		l.jobs[job.client] = jobs
+	} else {
+		delete(l.jobs, job.client)
+		l.turn = slices.DeleteFunc(l.turn, func(c string) bool { return c == job.client })
+	}
+	l.n--
+	return true
+}
+
+/* method oldest()
+Return when the job that has waited longest in the lane was queued, 0 if
+none is
+*/
+func (l *queueLane) oldest() int64 {
+	var at int64
+	for _, client := range l.turn {
+		if first := l.jobs[client][0].readyAt; at == 0 || first < at {
+			at = first
+		}
+	}
+	return at
+}
+
+/* method priorityLevel()
+Return the level of a named priority, normal when empty, and false for an
+unknown name
+*/
+func priorityLevel(name string) (int, bool) {
+	if len(name) == 0 {
+		name = PriorityNormal
+	}
+	for level, p := range priorities {
+		if p == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+/* method priorityAging()
+Return the time waiting for a worker that raises a job by a level
+*/
+func (s *Server) priorityAging() time.Duration {
+	if s.config.PriorityAging > 0 {
+		return s.config.PriorityAging
+	}
+	return DefaultPriorityAging
+}
+
+/* method push()
+Add a job to its priority's lane
+*/
+func (q *readyQueue) push(job *queuedJob) {
+	q.lanes[job.opts.priority].push(job)
+}
+
+/* method pop()
+Take the job to run next from the lane of the highest priority, once each
+lane has been raised a level for every `aging` its oldest job has waited,
+so low priority jobs are never starved.  Ties go to the higher priority.
+*/
+func (q *readyQueue) pop(now time.Time) *queuedJob {
+	best, bestRank := -1, 0
+	for level := range q.lanes {
+		if q.lanes[level].n == 0 {
+			continue
+		}
+		rank := level - int((now.UnixNano()-q.lanes[level].oldest())/int64(q.aging))
+		if best < 0 || rank < bestRank {
+			best, bestRank = level, rank
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return q.lanes[best].pop()
+}
+
+/* method remove()
+Take a job out of the queue, false if it isn't queued
+*/
+func (q *readyQueue) remove(job *queuedJob) bool {
+	return q.lanes[job.opts.priority].remove(job)
+}
+
+/* method len()
+Return the number of jobs queued across every priority
+*/
+func (q *readyQueue) len() int {
+	n := 0
+	for _, lane := range q.lanes {
+		n += lane.n
+	}
+	return n
+}
+
+/* method clients()
+Return the number of clients with jobs queued
+*/
+func (q *readyQueue) clients() int {
+	seen := make(map[string]bool)
+	for _, lane := range q.lanes {
+		for _, client := range lane.turn {
+			seen[client] = true
+		}
+	}
+	return len(seen)
+}
+
+/* method oldest()
+Return when the job that has waited longest was queued, 0 if none is
+*/
+func (q *readyQueue) oldest() int64 {
+	var at int64
+	for i := range q.lanes {
+		if first := q.lanes[i].oldest(); first > 0 && (at == 0 || first < at) {
+			at = first
+		}
+	}
+	return at
+}
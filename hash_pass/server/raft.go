@@ -0,0 +1,560 @@
+/*********************************************************
+File: raft.go
+Contents: Raft replication of the request counter and results
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash_pass/hasher"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// Replicated commands
+	opSubmit  = "submit"
+	opNode    = "node"
+	opDelete  = "delete"
+	opRestore = "restore"
+	opHold    = "hold"
+
+	// Raft tuning
+	raftApplyTimeout     = 5 * time.Second
+	raftSnapshotRetain   = 2
+	raftTransportPool    = 3
+	raftTransportTimeout = 10 * time.Second
+	raftJoinRetry        = 2 * time.Second
+	raftJoinAttempts     = 30
+)
+
+// A change to the replicated state
+type raftCommand struct {
+	Op string `json:"op"`
+	// Job to accept, for opSubmit
+	Job pendingJob `json:"job"`
+	// Raft server Id and HTTP API address, for opNode
+	Node string `json:"node,omitempty"`
+	API  string `json:"api,omitempty"`
+	// Task Id, for opSubmit, and result Id, deletion time and hold flag,
+	// for opDelete, opRestore and opHold
+	ID   string `json:"id,omitempty"`
+	At   int64  `json:"at,omitempty"`
+	Hold bool   `json:"hold,omitempty"`
+}
+
+// A replicated job waiting out its processing delay
+type pendingJob struct {
+	Hash string `json:"hash"`
+	// Algorithm or format that produced Hash, and the salt and pepper of
+	// sha512 format results
+	Algorithm string `json:"algorithm,omitempty"`
+	Salt      string `json:"salt,omitempty"`
+	PepperID  string `json:"pepper_id,omitempty"`
+	// Submission, hashing and completion times in Unix nanoseconds
+	Submitted int64 `json:"submitted,omitempty"`
+	Started   int64 `json:"started,omitempty"`
+	Due       int64 `json:"due"`
+	// Processing delay in nanoseconds, jitter included
+	Delay int64 `json:"delay,omitempty"`
+	// Set for fire-and-forget jobs whose result isn't kept
+	Discard bool `json:"discard,omitempty"`
+	// URL the leader POSTs the result to on completion
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Identifiers of the submitting request, so every node logs them on completion
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+// Body of a join request
+type raftJoin struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+	API  string `json:"api"`
+}
+
+// Payload returned by the raft status endpoint
+type RaftStatus struct {
+	ID      string   `json:"id"`
+	State   string   `json:"state"`
+	Leader  string   `json:"leader"`
+	Servers []string `json:"servers"`
+}
+
+// Full replicated state, used for snapshots
+type raftState struct {
+	RequestID int64                    `json:"request_id"`
+	Results   map[string]StoredResult  `json:"results"`
+	Pending   map[string]pendingJob    `json:"pending"`
+	APIs      map[string]string        `json:"apis"`
+	Deleted   map[string]deletedResult `json:"deleted,omitempty"`
+	Holds     map[string]bool          `json:"holds,omitempty"`
+}
+
+// Implements raft.FSM over requestID, the results and the retention state
+type raftFSM struct {
+	s *Server
+}
+
+// Implements raft.FSMSnapshot
+type raftSnapshot struct {
+	state []byte
+}
+
+var (
+	errNoLeader = errors.New("no raft leader available")
+)
+
+/* method Apply()
+Apply a committed log entry.  This runs on every node in the same order, so
+the jobs and the request count stay the same on every node.
+*/
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		log.Printf("Error decoding raft command: %v", err)
+		return nil
+	}
+	switch cmd.Op {
+	case opSubmit:
+		f.s.mtxId.Lock()
+		f.s.requestID++
+		id := cmd.ID
+		if len(id) == 0 {
+			// Logged before Ids were random, when the count was the Id
+			id = strconv.FormatInt(f.s.requestID, 10)
+		}
+		f.s.mtxId.Unlock()
+
+		f.s.mtxMap.Lock()
+		f.s.pendingJobs[id] = cmd.Job
+		f.s.mtxMap.Unlock()
+		f.s.schedulePending(id, cmd.Job)
+		return id
+	case opNode:
+		f.s.mtxMap.Lock()
+		f.s.raftAPIs[cmd.Node] = cmd.API
+		f.s.mtxMap.Unlock()
+	case opDelete, opRestore, opHold:
+		return f.s.retentionCommand(cmd)
+	}
+	return nil
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	state := raftState{
+		Pending: make(map[string]pendingJob),
+		APIs:    make(map[string]string),
+		Deleted: make(map[string]deletedResult),
+		Holds:   make(map[string]bool),
+	}
+	f.s.mtxId.Lock()
+	state.RequestID = f.s.requestID
+	f.s.mtxId.Unlock()
+
+	f.s.mtxMap.Lock()
+	state.Results = f.s.allResults()
+	for id, result := range state.Results {
+		state.Results[id] = f.s.sealer.sealResult(result)
+	}
+	for k, v := range f.s.pendingJobs {
+		state.Pending[k] = v
+	}
+	for k, v := range f.s.raftAPIs {
+		state.APIs[k] = v
+	}
+	for k, v := range f.s.deletedResults {
+		state.Deleted[k] = v
+	}
+	for k, v := range f.s.legalHolds {
+		state.Holds[k] = v
+	}
+	f.s.mtxMap.Unlock()
+
+	jtext, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return &raftSnapshot{state: jtext}, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var state raftState
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return err
+	}
+
+	f.s.mtxId.Lock()
+	f.s.requestID = state.RequestID
+	f.s.mtxId.Unlock()
+
+	f.s.mtxMap.Lock()
+	for id := range f.s.allResults() {
+		f.s.store.Delete(id)
+	}
+	for id, result := range state.Results {
+		result, err := f.s.sealer.openResult(result)
+		if err != nil {
+			f.s.mtxMap.Unlock()
+			return fmt.Errorf("result %s: %w", id, err)
+		}
+		f.s.store.Put(id, result)
+	}
+	f.s.lockedResetOrder()
+	f.s.pendingJobs = state.Pending
+	f.s.lockedCheckDrained()
+	f.s.raftAPIs = state.APIs
+	f.s.deletedResults = make(map[string]deletedResult)
+	f.s.legalHolds = make(map[string]bool)
+	for k, v := range state.Deleted {
+		f.s.deletedResults[k] = v
+	}
+	for k, v := range state.Holds {
+		f.s.legalHolds[k] = v
+	}
+	f.s.mtxMap.Unlock()
+
+	for id, job := range state.Pending {
+		f.s.schedulePending(id, job)
+	}
+	for id, d := range state.Deleted {
+		f.s.schedulePurge(id, d.At)
+	}
+	return nil
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {}
+
+/* method schedulePending()
+Move a pending job into the store once its delay has elapsed.  Every node
+does this on its own so a replicated result becomes visible everywhere at
+once.
+*/
+func (s *Server) schedulePending(id string, job pendingJob) {
+	s.clock.AfterFunc(time.Unix(0, job.Due).Sub(s.clock.Now()), func() {
+		s.mtxMap.Lock()
+		_, ok := s.pendingJobs[id]
+		if ok {
+			delete(s.pendingJobs, id)
+			s.lockedCheckDrained()
+		}
+		s.mtxMap.Unlock()
+		// A job replaced by a snapshot restore is no longer ours to complete
+		if ok {
+			job, err := s.sealer.openJob(job)
+			if err != nil {
+				log.Printf("Error decrypting request Id %s, dropping it: %v", id, err)
+				s.releaseJob(id)
+				return
+			}
+			stored := StoredResult{Hash: job.Hash, Algorithm: job.Algorithm, Salt: job.Salt, PepperID: job.PepperID, Submitted: job.Submitted, Started: job.Started, Completed: job.Due, Delay: job.Delay}
+			c := correlation{RequestID: job.RequestID, TraceID: job.TraceID}
+			if err := s.storeResult(id, stored, !job.Discard, c); err != nil {
+				s.failJob(id, err, 1, c)
+				return
+			}
+			// Every node completes a replicated job, only the leader counts
+			// it and calls back
+			if s.raftNode == nil || s.raftNode.State() == raft.Leader {
+				s.countOutcome(OutcomeCompleted)
+				if len(job.CallbackURL) > 0 {
+					s.sendCallback(job.CallbackURL, id, stored, c)
+				}
+			}
+		}
+	})
+}
+
+/* method raftApply()
+Replicate a command through the leader and return the FSM's response
+*/
+func (s *Server) raftApply(cmd raftCommand) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	f := s.raftNode.Apply(data, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+/* method submitRaft()
+Accept a job in replicated mode.  The digest is computed here and replicated
+with its due time, so the job survives the loss of the node that accepted it
+without the password ever leaving this node.
+*/
+func (s *Server) submitRaft(c correlation, pword string, opts jobOptions) (string, error) {
+	job, err := s.newPendingJob(c, pword, opts)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.raftApply(raftCommand{Op: opSubmit, Job: job, ID: newTaskID()})
+	if err != nil {
+		return "", err
+	}
+	return resp.(string), nil
+}
+
+/* method newPendingJob()
+Hash a job up front, so it only has to wait out its delay
+*/
+func (s *Server) newPendingJob(c correlation, pword string, opts jobOptions) (pendingJob, error) {
+	opts.delay, opts.delaySet = s.jobDelay(opts), true
+	opts.started = s.clock.Now().UnixNano()
+	result, err := hasher.Hash(pword, opts.Options)
+	if err != nil {
+		return pendingJob{}, err
+	}
+	stored := opts.result(result)
+	return s.sealer.sealJob(pendingJob{
+		Hash:        result,
+		Algorithm:   stored.Algorithm,
+		Salt:        stored.Salt,
+		PepperID:    stored.PepperID,
+		Submitted:   opts.submitted,
+		Started:     stored.Started,
+		Due:         s.clock.Now().Add(opts.delay).UnixNano(),
+		Delay:       stored.Delay,
+		Discard:     !opts.store,
+		CallbackURL: opts.callbackURL,
+		RequestID:   c.RequestID,
+		TraceID:     c.TraceID,
+	}), nil
+}
+
+/* method raftIsFollower()
+Report whether requests that change state must go to another node
+*/
+func (s *Server) raftIsFollower() bool {
+	return s.raftNode != nil && s.raftNode.State() != raft.Leader
+}
+
+/* method proxyToLeader()
+Hand a request that must be served by the leader over to it
+*/
+func (s *Server) proxyToLeader(w http.ResponseWriter, r *http.Request) {
+	_, leader := s.raftNode.LeaderWithID()
+	s.mtxMap.Lock()
+	api := s.raftAPIs[string(leader)]
+	s.mtxMap.Unlock()
+
+	if len(leader) == 0 || len(api) == 0 {
+		renderError(w, r, http.StatusServiceUnavailable, errNoLeader.Error())
+		return
+	}
+	s.proxyRequest(w, r, api)
+}
+
+/* method startRaft()
+- Open the on-disk log and snapshot stores
+- Start the raft node, bootstrapping a new cluster if asked to
+- Join an existing cluster in the background if given a node to join through
+*/
+func (s *Server) startRaft() error {
+	id := s.nodeName()
+	if err := os.MkdirAll(s.config.RaftDir, 0700); err != nil {
+		return err
+	}
+	store, err := newBoltRaftStore(filepath.Join(s.config.RaftDir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	snaps, err := raft.NewFileSnapshotStore(s.config.RaftDir, raftSnapshotRetain, os.Stderr)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	advertise := s.config.RaftAdvertise
+	if len(advertise) == 0 {
+		advertise = s.config.RaftBind
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("invalid raft address '%s': %v", advertise, err)
+	}
+	trans, err := raft.NewTCPTransport(s.config.RaftBind, addr, raftTransportPool, raftTransportTimeout, os.Stderr)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	s.raftAPI = "http://" + net.JoinHostPort(addr.IP.String(), strconv.Itoa(s.listenPort()))
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(id)
+	s.raftNode, err = raft.NewRaft(rc, &raftFSM{s: s}, store, store, snaps, trans)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	s.raftStore = store
+
+	if s.config.RaftBootstrap {
+		f := s.raftNode.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: rc.LocalID, Address: trans.LocalAddr()}},
+		})
+		// Restarting a node that already has state is not an error
+		if err := f.Error(); err != nil && err != raft.ErrCantBootstrap {
+			return err
+		}
+	}
+
+	go s.announceLeader(id)
+	if len(s.config.RaftJoin) > 0 {
+		go s.joinRaft(raftJoin{ID: id, Addr: string(trans.LocalAddr()), API: s.raftAPI})
+	}
+	log.Printf("Raft node %s listening on %s", id, s.config.RaftBind)
+	return nil
+}
+
+/* method announceLeader()
+Publish our HTTP address whenever we win an election so that followers can
+forward writes to us
+*/
+func (s *Server) announceLeader(id string) {
+	for isLeader := range s.raftNode.LeaderCh() {
+		if !isLeader {
+			continue
+		}
+		log.Printf("Raft node %s is now the leader", id)
+		if _, err := s.raftApply(raftCommand{Op: opNode, Node: id, API: s.raftAPI}); err != nil {
+			log.Printf("Error publishing leader address: %v", err)
+		}
+	}
+}
+
+/* method joinRaft()
+Ask an existing node to add us as a voter, retrying while the cluster forms
+*/
+func (s *Server) joinRaft(req raftJoin) {
+	body, _ := json.Marshal(req)
+	target := strings.TrimSuffix(s.config.RaftJoin, "/") + RaftJoinPath
+	client := http.Client{Timeout: raftApplyTimeout}
+
+	for attempt := 1; attempt <= raftJoinAttempts; attempt++ {
+		resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("Joined raft cluster through %s", s.config.RaftJoin)
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Raft join attempt %d failed: %v", attempt, err)
+		s.clock.Sleep(raftJoinRetry)
+	}
+	log.Printf("Giving up joining raft cluster through %s", s.config.RaftJoin)
+}
+
+/*
+	method doRaftJoin()
+	Add the requesting node as a voter.  Followers forward this to the leader.
+*/
+func (s *Server) doRaftJoin(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	if s.raftIsFollower() {
+		s.proxyToLeader(w, r)
+		return
+	}
+
+	var req raftJoin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.ID) == 0 || len(req.Addr) == 0 {
+		renderError(w, r, http.StatusBadRequest, ErrRaftJoin)
+		return
+	}
+	f := s.raftNode.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.Addr), 0, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		log.Printf("Error adding raft node %s: %v", req.ID, err)
+		renderError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if _, err := s.raftApply(raftCommand{Op: opNode, Node: req.ID, API: req.API}); err != nil {
+		log.Printf("Error publishing address of raft node %s: %v", req.ID, err)
+		renderError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	log.Printf("Raft node %s joined from %s", req.ID, req.Addr)
+	_, err := fmt.Fprint(w, MsgHealthy)
+	if err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
+
+/*
+	method getRaft()
+	Return a JSON object describing this node's view of the raft cluster
+*/
+func (s *Server) getRaft(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	_, leader := s.raftNode.LeaderWithID()
+	status := RaftStatus{
+		ID:      s.nodeName(),
+		State:   s.raftNode.State().String(),
+		Leader:  string(leader),
+		Servers: []string{},
+	}
+	if f := s.raftNode.GetConfiguration(); f.Error() == nil {
+		for _, srv := range f.Configuration().Servers {
+			status.Servers = append(status.Servers, string(srv.ID))
+		}
+	}
+
+	jtext, _ := json.Marshal(status)
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning raft status: %v", err)
+	}
+}
+
+/* method stopRaft()
+Hand off leadership if we hold it and stop replicating
+*/
+func (s *Server) stopRaft() {
+	if s.raftNode == nil {
+		return
+	}
+	if s.raftNode.State() == raft.Leader {
+		if err := s.raftNode.LeadershipTransfer().Error(); err != nil {
+			log.Printf("Unable to transfer raft leadership: %v", err)
+		}
+	}
+	if err := s.raftNode.Shutdown().Error(); err != nil {
+		log.Printf("Error stopping raft: %v", err)
+	}
+	if err := s.raftStore.Close(); err != nil {
+		log.Printf("Error closing raft store: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+/*********************************************************
+File: raftstore.go
+Contents: bbolt-backed log and stable store for the raft library
+*********************************************************/
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// Bucket names
+	bucketRaftLogs   = []byte("logs")
+	bucketRaftStable = []byte("stable")
+
+	// The raft library checks for this exact message on missing keys
+	errRaftKeyNotFound = errors.New("not found")
+)
+
+// Implements raft.LogStore and raft.StableStore on a single bbolt file
+type boltRaftStore struct {
+	db *bbolt.DB
+}
+
+/* method newBoltRaftStore()
+Open (or create) the store at `path` and make sure both buckets exist
+*/
+func newBoltRaftStore(path string) (*boltRaftStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketRaftLogs); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketRaftStable)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltRaftStore{db: db}, nil
+}
+
+func (s *boltRaftStore) Close() error {
+	return s.db.Close()
+}
+
+// Log indexes are stored big endian so bbolt keeps them in order
+func raftIndexKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+func (s *boltRaftStore) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(bucketRaftLogs).Cursor().First(); k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *boltRaftStore) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(bucketRaftLogs).Cursor().Last(); k != nil {
+			index = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *boltRaftStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketRaftLogs).Get(raftIndexKey(index))
+		if v == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(v, log)
+	})
+}
+
+func (s *boltRaftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *boltRaftStore) StoreLogs(logs []*raft.Log) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketRaftLogs)
+		for _, log := range logs {
+			v, err := json.Marshal(log)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(raftIndexKey(log.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRaftStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketRaftLogs)
+		// Collect the keys first, deleting under a live cursor can skip entries
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(raftIndexKey(min)); k != nil && binary.BigEndian.Uint64(k) <= max; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRaftStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRaftStable).Put(key, val)
+	})
+}
+
+func (s *boltRaftStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketRaftStable).Get(key)
+		if v == nil {
+			return errRaftKeyNotFound
+		}
+		// bbolt values are only valid for the life of the transaction
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return val, err
+}
+
+func (s *boltRaftStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, raftIndexKey(val))
+}
+
+func (s *boltRaftStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
@@ -0,0 +1,650 @@
+/*********************************************************
+File: redisstore.go
+Contents: Redis-backed Store shared by instances behind a load balancer
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Key prefix used unless another is configured
+	DefaultRedisPrefix = "hash_pass:"
+
+	// Idle connections kept for reuse, and the time allowed to connect and
+	// for each command
+	redisIdleConns = 8
+	redisTimeout   = 5 * time.Second
+	// Keys asked for per SCAN
+	redisScanCount = 500
+
+	// Store a result and index it under its expiry, +inf for none, in one
+	// step, a held result never expiring.  KEYS: result, index, holds.
+	// ARGV: value, score, PX milliseconds or "", id.
+	redisPutScript = `if ARGV[3] == '' or redis.call('SISMEMBER', KEYS[3], ARGV[4]) == 1 then
+	redis.call('SET', KEYS[1], ARGV[1])
+	redis.call('ZADD', KEYS[2], '+inf', ARGV[4])
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+	redis.call('ZADD', KEYS[2], ARGV[2], ARGV[4])
+end
+return 1`
+	// Place or lift a legal hold, a held result never expiring and one
+	// released expiring a full TTL later.  KEYS: result, index, holds.
+	// ARGV: id, "1" to hold or "" to lift, PX milliseconds or "", now in
+	// Unix milliseconds.
+	redisHoldScript = `if ARGV[2] == '1' then
+	redis.call('SADD', KEYS[3], ARGV[1])
+	if redis.call('PERSIST', KEYS[1]) == 1 then
+		redis.call('ZADD', KEYS[2], '+inf', ARGV[1])
+	end
+else
+	redis.call('SREM', KEYS[3], ARGV[1])
+	if ARGV[3] ~= '' and redis.call('PEXPIRE', KEYS[1], ARGV[3]) == 1 then
+		redis.call('ZADD', KEYS[2], tonumber(ARGV[4]) + tonumber(ARGV[3]), ARGV[1])
+	end
+end
+return 1`
+	// Remove a result and its index entry.  KEYS: result, index.  ARGV: id.
+	redisDeleteScript = `redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1`
+	// Drop the index entries of expired results and count the rest.
+	// KEYS: index.  ARGV: now in Unix milliseconds.
+	redisCountScript = `redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+return redis.call('ZCARD', KEYS[1])`
+	// Append a dead letter and drop the oldest beyond the limit.  KEYS:
+	// list.  ARGV: letter, letters kept.
+	redisDeadLetterScript = `redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[2]), -1)
+return 1`
+	// Index results stored before there was an index, under their expiry.
+	// KEYS: index, then the result keys.  ARGV: now in Unix milliseconds,
+	// length of the result key prefix.
+	redisIndexScript = `for i = 2, #KEYS do
+	local ttl = redis.call('PTTL', KEYS[i])
+	if ttl ~= -2 then
+		local score = '+inf'
+		if ttl >= 0 then
+			score = tonumber(ARGV[1]) + ttl
+		end
+		redis.call('ZADD', KEYS[1], score, string.sub(KEYS[i], tonumber(ARGV[2]) + 1))
+	end
+end
+return 1`
+)
+
+// Error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errRedisProtocol = errors.New("redis: malformed reply")
+
+// A connection and its reader
+type redisConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// Implements SequenceStore, JobStateStore, DeadLetterStore and
+// RetentionStore on Redis, the request counter kept with INCR so every
+// instance sharing the server counts on it.  Results
+// are also indexed in a sorted set scored by their expiry, so they can be
+// counted without scanning.
+type RedisStore struct {
+	addr     string
+	user     string
+	password string
+	db       int
+	// Connection security for rediss:// URLs, nil for plain connections
+	tlsConfig *tls.Config
+	// Prepended to every key
+	prefix string
+	// Expiry of each result, 0 to keep them until deleted
+	ttl time.Duration
+	// Idle connections
+	idle chan *redisConn
+}
+
+/* method OpenRedisStore()
+Connect to the server at `rawURL`, redis://[user:password@]host[:port][/db]
+or rediss:// for TLS, check it answers and index any results stored before
+the index was kept
+*/
+func OpenRedisStore(rawURL string, prefix string, ttl time.Duration) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || len(u.Hostname()) == 0 {
+		return nil, errors.New("redis URL must look like redis[s]://[user:password@]host[:port][/db]")
+	}
+	r := &RedisStore{addr: u.Host, prefix: prefix, ttl: ttl, idle: make(chan *redisConn, redisIdleConns)}
+	if u.Scheme == "rediss" {
+		r.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	}
+	if len(u.Port()) == 0 {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if _, err := r.do("PING"); err != nil {
+		return nil, err
+	}
+	if err := r.buildIndex(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("indexing results: %w", err)
+	}
+	return r, nil
+}
+
+/* method buildIndex()
+Index the results already stored, when there is no index yet
+*/
+func (r *RedisStore) buildIndex() error {
+	reply, err := r.do("EXISTS", r.indexKey())
+	if err != nil || reply != int64(0) {
+		return err
+	}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return r.scan(func(keys []string) (bool, error) {
+		args := append([]string{"EVAL", redisIndexScript, strconv.Itoa(len(keys) + 1), r.indexKey()}, keys...)
+		_, err := r.do(append(args, now, strconv.Itoa(len(r.resultKey(""))))...)
+		return err == nil, err
+	})
+}
+
+/* method dial()
+Open a connection, authenticating and selecting the database
+*/
+func (r *RedisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if r.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.addr, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, br: bufio.NewReader(conn)}
+	var setup [][]string
+	if len(r.password) > 0 && len(r.user) > 0 {
+		setup = append(setup, []string{"AUTH", r.user, r.password})
+	} else if len(r.password) > 0 {
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.command(args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+/* method command()
+Send one command and read its reply
+*/
+func (c *redisConn) command(args []string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.br)
+}
+
+/* method readRedisReply()
+Read a RESP reply: a string, int64, nil, []interface{} or redisError
+*/
+func readRedisReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisProtocol
+	}
+	kind, text := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return redisError(text), nil
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < -1 {
+			return nil, errRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil || n < -1 {
+			return nil, errRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
+
+/* method do()
+Run a command on an idle connection, or a new one, returning error
+replies as errors.  Connections that fail are dropped rather than reused.
+*/
+func (r *RedisStore) do(args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-r.idle:
+	default:
+		var err error
+		if c, err = r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.command(args)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (r *RedisStore) resultKey(id string) string {
+	return r.prefix + "result:" + id
+}
+
+func (r *RedisStore) jobKey(id string) string {
+	return r.prefix + "job:" + id
+}
+
+// List of JSON dead letters, oldest first
+func (r *RedisStore) deadLettersKey() string {
+	return r.prefix + "dead_letters"
+}
+
+// Hash of JSON deleted results by Id
+func (r *RedisStore) deletedKey() string {
+	return r.prefix + "deleted"
+}
+
+// Set of the Ids held
+func (r *RedisStore) holdsKey() string {
+	return r.prefix + "holds"
+}
+
+// Sorted set of result Ids scored by expiry in Unix milliseconds
+func (r *RedisStore) indexKey() string {
+	return r.prefix + "results"
+}
+
+/* method redisGlobEscape()
+Escape the characters MATCH patterns treat specially, so `s` only matches
+itself
+*/
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\^-`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (r *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *RedisStore) Put(id string, result StoredResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	score, px := "+inf", ""
+	if r.ttl > 0 {
+		score = strconv.FormatInt(time.Now().Add(r.ttl).UnixMilli(), 10)
+		px = strconv.FormatInt(r.ttl.Milliseconds(), 10)
+	}
+	_, err = r.do("EVAL", redisPutScript, "3", r.resultKey(id), r.indexKey(), r.holdsKey(), string(data), score, px, id)
+	return err
+}
+
+func (r *RedisStore) Get(id string) (StoredResult, bool, error) {
+	var result StoredResult
+	reply, err := r.do("GET", r.resultKey(id))
+	if err != nil || reply == nil {
+		return result, false, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return result, false, errRedisProtocol
+	}
+	return result, true, json.Unmarshal([]byte(data), &result)
+}
+
+func (r *RedisStore) Delete(id string) error {
+	_, err := r.do("EVAL", redisDeleteScript, "2", r.resultKey(id), r.indexKey(), id)
+	return err
+}
+
+/* method scan()
+Call `fn` with each batch of result keys until it returns false
+*/
+func (r *RedisStore) scan(fn func(keys []string) (bool, error)) error {
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", redisGlobEscape(r.resultKey(""))+"*", "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return errRedisProtocol
+		}
+		next, ok := items[0].(string)
+		batch, ok2 := items[1].([]interface{})
+		if !ok || !ok2 {
+			return errRedisProtocol
+		}
+		keys := make([]string, 0, len(batch))
+		for _, k := range batch {
+			if key, ok := k.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			more, err := fn(keys)
+			if err != nil || !more {
+				return err
+			}
+		}
+		if cursor = next; cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (r *RedisStore) List(fn func(id string, result StoredResult) bool) error {
+	return r.scan(func(keys []string) (bool, error) {
+		reply, err := r.do(append([]string{"MGET"}, keys...)...)
+		if err != nil {
+			return false, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != len(keys) {
+			return false, errRedisProtocol
+		}
+		for i, v := range values {
+			data, ok := v.(string)
+			if !ok {
+				// Expired or deleted since the scan
+				continue
+			}
+			var result StoredResult
+			if err := json.Unmarshal([]byte(data), &result); err != nil {
+				return false, fmt.Errorf("result %s: %w", keys[i], err)
+			}
+			if !fn(strings.TrimPrefix(keys[i], r.resultKey("")), result) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+func (r *RedisStore) Count() (int, error) {
+	reply, err := r.do("EVAL", redisCountScript, "1", r.indexKey(), strconv.FormatInt(time.Now().UnixMilli(), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errRedisProtocol
+	}
+	return int(n), nil
+}
+
+func (r *RedisStore) PutJobState(id string, state JobState, ttl time.Duration) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("SET", r.jobKey(id), string(data), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (r *RedisStore) GetJobState(id string) (JobState, bool, error) {
+	var state JobState
+	reply, err := r.do("GET", r.jobKey(id))
+	if err != nil || reply == nil {
+		return state, false, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return state, false, errRedisProtocol
+	}
+	return state, true, json.Unmarshal([]byte(data), &state)
+}
+
+func (r *RedisStore) DeleteJobState(id string) error {
+	_, err := r.do("DEL", r.jobKey(id))
+	return err
+}
+
+/* method NextID()
+Count a request on the counter shared by every instance
+*/
+func (r *RedisStore) NextID() (int64, error) {
+	reply, err := r.do("INCR", r.prefix+"counter")
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errRedisProtocol
+	}
+	return n, nil
+}
+
+func (r *RedisStore) PutDeadLetter(d DeadLetter, keep int) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("EVAL", redisDeadLetterScript, "1", r.deadLettersKey(), string(data), strconv.Itoa(keep))
+	return err
+}
+
+func (r *RedisStore) ListDeadLetters() ([]DeadLetter, error) {
+	reply, err := r.do("LRANGE", r.deadLettersKey(), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, errRedisProtocol
+	}
+	letters := make([]DeadLetter, 0, len(items))
+	for i, item := range items {
+		data, ok := item.(string)
+		if !ok {
+			return nil, errRedisProtocol
+		}
+		var d DeadLetter
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return nil, fmt.Errorf("dead letter %d: %w", i, err)
+		}
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
+
+func (r *RedisStore) ClearDeadLetters() error {
+	_, err := r.do("DEL", r.deadLettersKey())
+	return err
+}
+
+func (r *RedisStore) PutDeleted(id string, result StoredResult, at int64) error {
+	data, err := json.Marshal(newDeletedResult(result, at))
+	if err != nil {
+		return err
+	}
+	_, err = r.do("HSET", r.deletedKey(), id, string(data))
+	return err
+}
+
+func (r *RedisStore) GetDeleted(id string) (StoredResult, int64, bool, error) {
+	var d deletedResult
+	reply, err := r.do("HGET", r.deletedKey(), id)
+	if err != nil || reply == nil {
+		return StoredResult{}, 0, false, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return StoredResult{}, 0, false, errRedisProtocol
+	}
+	err = json.Unmarshal([]byte(data), &d)
+	return d.result(), d.At, true, err
+}
+
+func (r *RedisStore) ForgetDeleted(id string) error {
+	_, err := r.do("HDEL", r.deletedKey(), id)
+	return err
+}
+
+func (r *RedisStore) ListDeleted(fn func(id string, result StoredResult, at int64) bool) error {
+	reply, err := r.do("HGETALL", r.deletedKey())
+	if err != nil {
+		return err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return errRedisProtocol
+	}
+	for i := 0; i < len(items); i += 2 {
+		id, ok := items[i].(string)
+		data, ok2 := items[i+1].(string)
+		if !ok || !ok2 {
+			return errRedisProtocol
+		}
+		var d deletedResult
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return fmt.Errorf("deleted result %s: %w", id, err)
+		}
+		if !fn(id, d.result(), d.At) {
+			break
+		}
+	}
+	return nil
+}
+
+/* method SetHold()
+Place or lift the hold on `id`, taking its result's expiry away while it
+is held
+*/
+func (r *RedisStore) SetHold(id string, held bool) error {
+	hold, px := "", ""
+	if held {
+		hold = "1"
+	}
+	if r.ttl > 0 {
+		px = strconv.FormatInt(r.ttl.Milliseconds(), 10)
+	}
+	_, err := r.do("EVAL", redisHoldScript, "3", r.resultKey(id), r.indexKey(), r.holdsKey(), id, hold, px, strconv.FormatInt(time.Now().UnixMilli(), 10))
+	return err
+}
+
+func (r *RedisStore) Held(id string) (bool, error) {
+	reply, err := r.do("SISMEMBER", r.holdsKey(), id)
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, errRedisProtocol
+	}
+	return n == 1, nil
+}
+
+func (r *RedisStore) ListHolds() ([]string, error) {
+	reply, err := r.do("SMEMBERS", r.holdsKey())
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, errRedisProtocol
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		id, ok := item.(string)
+		if !ok {
+			return nil, errRedisProtocol
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		want        interface{}
+		err         error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"error", "-ERR wrong type\r\n", redisError("ERR wrong type"), nil},
+		{"integer", ":-42\r\n", int64(-42), nil},
+		{"bulk string", "$5\r\nhello\r\n", "hello", nil},
+		{"empty bulk string", "$0\r\n\r\n", "", nil},
+		{"bulk string holding CRLF", "$4\r\na\r\nb\r\n", "a\r\nb", nil},
+		{"nil bulk string", "$-1\r\n", nil, nil},
+		{"nil array", "*-1\r\n", nil, nil},
+		{"empty array", "*0\r\n", []interface{}{}, nil},
+		{"array", "*3\r\n$1\r\na\r\n$-1\r\n:7\r\n", []interface{}{"a", nil, int64(7)}, nil},
+		{"nested array with an error", "*2\r\n*1\r\n+x\r\n-ERR e\r\n", []interface{}{[]interface{}{"x"}, redisError("ERR e")}, nil},
+		{"unknown type", "?x\r\n", nil, errRedisProtocol},
+		{"bare newline", "+OK\n", nil, errRedisProtocol},
+		{"empty simple string", "+\r\n", "", nil},
+		{"line without a type", "\r\n", nil, errRedisProtocol},
+		{"bad bulk length", "$-2\r\n", nil, errRedisProtocol},
+		{"bad array length", "*x\r\n", nil, errRedisProtocol},
+		{"truncated bulk string", "$5\r\nhel", nil, io.ErrUnexpectedEOF},
+		{"truncated array", "*2\r\n+a\r\n", nil, io.EOF},
+		{"no reply", "", nil, io.EOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tc.input)))
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("readRedisReply(%q) error %v, want %v", tc.input, err, tc.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readRedisReply(%q) = %#v, %v, want %#v", tc.input, got, err, tc.want)
+			}
+		})
+	}
+
+	if _, err := readRedisReply(bufio.NewReader(strings.NewReader(":abc\r\n"))); err == nil {
+		t.Error("readRedisReply of a malformed integer succeeded")
+	}
+}
+
+func TestReadRedisReplyPipelined(t *testing.T) {
+	// Replies arriving together are read one at a time, each leaving the
+	// next intact
+	br := bufio.NewReader(strings.NewReader("+OK\r\n$3\r\nfoo\r\n$-1\r\n*2\r\n:1\r\n:2\r\n-ERR last\r\n"))
+	for i, want := range []interface{}{"OK", "foo", nil, []interface{}{int64(1), int64(2)}, redisError("ERR last")} {
+		got, err := readRedisReply(br)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("reply %d = %#v, %v, want %#v", i, got, err, want)
+		}
+	}
+	if _, err := readRedisReply(br); err != io.EOF {
+		t.Errorf("read past the last reply returned %v, want EOF", err)
+	}
+}
+
+// fakeRedis answers the commands read from `conn` with `replies` in turn,
+// sending each command it reads to the returned channel, and closes `conn`
+// once it runs out
+func fakeRedis(t *testing.T, conn net.Conn, replies ...string) <-chan []string {
+	t.Helper()
+	commands := make(chan []string, len(replies))
+	go func() {
+		defer conn.Close()
+		defer close(commands)
+		br := bufio.NewReader(conn)
+		for _, reply := range replies {
+			cmd, err := readRedisReply(br)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range cmd.([]interface{}) {
+				args = append(args, arg.(string))
+			}
+			commands <- args
+			if _, err := io.WriteString(conn, reply); err != nil {
+				return
+			}
+		}
+	}()
+	return commands
+}
+
+// pipeRedisStore returns a store whose one idle connection is answered by
+// fakeRedis with `replies`
+func pipeRedisStore(t *testing.T, replies ...string) (*RedisStore, <-chan []string) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	r := &RedisStore{idle: make(chan *redisConn, 1)}
+	r.idle <- &redisConn{Conn: client, br: bufio.NewReader(client)}
+	return r, fakeRedis(t, server, replies...)
+}
+
+func TestRedisDo(t *testing.T) {
+	r, commands := pipeRedisStore(t, "$5\r\nvalue\r\n", "$-1\r\n", "-WRONGTYPE not a string\r\n", "*2\r\n$1\r\na\r\n$0\r\n\r\n")
+
+	// Arguments holding spaces, CRLF and nothing at all go through intact
+	for _, tc := range []struct {
+		args []string
+		want interface{}
+		err  error
+	}{
+		{[]string{"GET", "key with spaces"}, "value", nil},
+		{[]string{"GET", "missing"}, nil, nil},
+		{[]string{"GET", "line\r\nbreak"}, nil, redisError("WRONGTYPE not a string")},
+		{[]string{"MGET", "a", ""}, []interface{}{"a", ""}, nil},
+	} {
+		got, err := r.do(tc.args...)
+		if tc.err != nil {
+			if err != tc.err {
+				t.Errorf("do(%q) error %v, want %v", tc.args, err, tc.err)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("do(%q) = %#v, %v, want %#v", tc.args, got, err, tc.want)
+		}
+		if sent := <-commands; !reflect.DeepEqual(sent, tc.args) {
+			t.Errorf("server got %q, want %q", sent, tc.args)
+		}
+		// Error replies leave the connection usable
+		if len(r.idle) != 1 {
+			t.Fatalf("connection not returned to the pool after do(%q)", tc.args)
+		}
+	}
+}
+
+func TestRedisDoDropsBrokenConnection(t *testing.T) {
+	// A reply cut short fails the command and the connection isn't reused
+	r, _ := pipeRedisStore(t, "$10\r\nshort")
+	if _, err := r.do("GET", "key"); err == nil {
+		t.Fatal("do with a truncated reply succeeded")
+	}
+	if len(r.idle) != 0 {
+		t.Error("broken connection returned to the pool")
+	}
+}
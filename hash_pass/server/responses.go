@@ -0,0 +1,144 @@
+/*********************************************************
+File: responses.go
+Contents: JSON responses from the hash API for clients that ask for them
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Header selecting the API version, 2 for JSON responses
+	APIVersionHeader = "X-Api-Version"
+	APIVersionJSON   = "2"
+
+	// Status of a task waiting out its delay, being hashed, whose result
+	// is available, and that was cancelled before it was hashed
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusComplete   = "complete"
+	StatusCancelled  = "cancelled"
+)
+
+// A task Id, a JSON string, or a JSON number for the numbered Ids issued
+// before Ids were random
+type TaskID string
+
+// Body of the JSON responses of POST /hash and GET /hash/{id}
+type HashResult struct {
+	ID        TaskID `json:"id"`
+	Hash      string `json:"hash,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Salt      string `json:"salt,omitempty"`
+	PepperID  string `json:"pepper_id,omitempty"`
+	// When the job was submitted, a worker started hashing it and it
+	// completed, each omitted until it happens
+	Submitted time.Time `json:"submitted,omitzero"`
+	Started   time.Time `json:"started,omitzero"`
+	Completed time.Time `json:"completed,omitzero"`
+	// Processing delay the job waits out in microseconds, jitter included,
+	// omitted for jobs without one
+	Delay int64 `json:"delay,omitempty"`
+}
+
+func (id TaskID) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseInt(string(id), 10, 64); err == nil {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+func (id *TaskID) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		*id = TaskID(n)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	*id = TaskID(text)
+	return nil
+}
+
+/* method hashResult()
+Return the JSON body describing job `id` with `status`, and its result or
+the times recorded so far
+*/
+func hashResult(id string, status string, result StoredResult) HashResult {
+	return HashResult{
+		ID:        TaskID(id),
+		Hash:      result.Hash,
+		Status:    status,
+		Algorithm: result.Algorithm,
+		Salt:      result.Salt,
+		PepperID:  result.PepperID,
+		Submitted: unixTime(result.Submitted),
+		Started:   unixTime(result.Started),
+		Completed: unixTime(result.Completed),
+		Delay:     result.Delay / int64(time.Microsecond),
+	}
+}
+
+/* method writeAccepted()
+Answer a POST with the Id of the job it created and where its result will
+be, as JSON or plain text
+*/
+func writeAccepted(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Location", HashPath+"/"+url.PathEscape(id))
+	if wantsJSON(r) {
+		writeJSON(w, r, http.StatusAccepted, HashResult{ID: TaskID(id)})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if _, err := fmt.Fprint(w, id); err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
+
+/* method wantsJSON()
+Report whether the client asked for JSON, with an Accept header naming
+application/json or API version 2.  Other clients get the plain text
+responses they always have.
+*/
+func wantsJSON(r *http.Request) bool {
+	if r.Header.Get(APIVersionHeader) == APIVersionJSON {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+/* method writeJSON()
+Send `v` as a JSON response with `status`
+*/
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jtext, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		renderError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(jtext); err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
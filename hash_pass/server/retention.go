@@ -0,0 +1,417 @@
+/*********************************************************
+File: retention.go
+Contents: Soft deletion of results with a recovery window, and legal holds
+*********************************************************/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A deleted result kept until its recovery window ends
+type deletedResult struct {
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Salt      string `json:"salt,omitempty"`
+	PepperID  string `json:"pepper_id,omitempty"`
+	Submitted int64  `json:"submitted,omitempty"`
+	Started   int64  `json:"started,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Delay     int64  `json:"delay,omitempty"`
+	// Deletion time in Unix nanoseconds
+	At int64 `json:"at"`
+}
+
+var (
+	errNoResult   = errors.New("no such result")
+	errHeld       = errors.New("result is under legal hold")
+	errNotDeleted = errors.New("result is not deleted")
+	errRetention  = errors.New("retention state not stored")
+)
+
+/* method newDeletedResult()
+Keep `result`, deleted at `at` in Unix nanoseconds
+*/
+func newDeletedResult(result StoredResult, at int64) deletedResult {
+	return deletedResult{Hash: result.Hash, Algorithm: result.Algorithm, Salt: result.Salt, PepperID: result.PepperID, Submitted: result.Submitted, Started: result.Started, Completed: result.Completed, Delay: result.Delay, At: at}
+}
+
+/* method result()
+Return the result as it was stored before it was deleted
+*/
+func (d deletedResult) result() StoredResult {
+	return StoredResult{Hash: d.Hash, Algorithm: d.Algorithm, Salt: d.Salt, PepperID: d.PepperID, Submitted: d.Submitted, Started: d.Started, Completed: d.Completed, Delay: d.Delay}
+}
+
+/* method onHold()
+Report whether result `id` is under legal hold and must not be removed.
+Holds are read from the store when it keeps them, so one placed through
+another instance counts too, and a result whose hold can't be read is
+treated as held.  The caller must hold mtxMap.
+*/
+func (s *Server) onHold(id string) bool {
+	if s.retentionStore == nil {
+		return s.legalHolds[id]
+	}
+	held, err := s.retentionStore.Held(id)
+	if err != nil {
+		log.Printf("Error reading legal hold on request Id %s, keeping it: %v", id, err)
+		return true
+	}
+	return held
+}
+
+/* method lockedHolds()
+Return the Ids held, read from the store when it keeps them and otherwise
+from memory.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedHolds() map[string]bool {
+	if s.retentionStore == nil {
+		return maps.Clone(s.legalHolds)
+	}
+	held, err := s.retentionStore.ListHolds()
+	if err != nil {
+		log.Printf("Error listing legal holds in store: %v", err)
+		return maps.Clone(s.legalHolds)
+	}
+	holds := make(map[string]bool, len(held))
+	for _, id := range held {
+		holds[id] = true
+	}
+	return holds
+}
+
+/* method lockedGetDeleted()
+Return deleted result `id`, read from the store when it keeps them.  The
+caller must hold mtxMap.
+*/
+func (s *Server) lockedGetDeleted(id string) (deletedResult, bool, error) {
+	if s.retentionStore == nil {
+		d, ok := s.deletedResults[id]
+		return d, ok, nil
+	}
+	result, at, ok, err := s.retentionStore.GetDeleted(id)
+	if !ok || err != nil {
+		return deletedResult{}, false, err
+	}
+	if result, err = s.sealer.openResult(result); err != nil {
+		return deletedResult{}, false, err
+	}
+	return newDeletedResult(result, at), true, nil
+}
+
+/* method lockedPutDeleted()
+Keep deleted result `id` in the deleted set, the store when it keeps
+them and the write-ahead log.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedPutDeleted(id string, d deletedResult) error {
+	sealed := s.sealer.sealResult(d.result())
+	if s.retentionStore != nil {
+		if err := s.retentionStore.PutDeleted(id, sealed, d.At); err != nil {
+			return fmt.Errorf("%w: %w", errRetention, err)
+		}
+	}
+	s.deletedResults[id] = d
+	s.walAppend(walRecord{Op: walDeleted, ID: id, Result: &sealed, At: d.At})
+	return nil
+}
+
+/* method lockedForgetDeleted()
+Drop deleted result `id`, restored or purged, everywhere it is kept.  A
+store failure is logged, the result is then purged again after the next
+restart.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedForgetDeleted(id string) {
+	if s.retentionStore != nil {
+		if err := s.retentionStore.ForgetDeleted(id); err != nil {
+			log.Printf("Error removing deleted result %s from store: %v", id, err)
+		}
+	}
+	delete(s.deletedResults, id)
+	s.walAppend(walRecord{Op: walForget, ID: id})
+}
+
+/* method lockedPutHold()
+Place or lift the legal hold on `id` everywhere it is kept.  The caller
+must hold mtxMap.
+*/
+func (s *Server) lockedPutHold(id string, hold bool) error {
+	if s.retentionStore != nil {
+		if err := s.retentionStore.SetHold(id, hold); err != nil {
+			return fmt.Errorf("%w: %w", errRetention, err)
+		}
+	}
+	if hold {
+		s.legalHolds[id] = true
+	} else {
+		delete(s.legalHolds, id)
+	}
+	s.walAppend(walRecord{Op: walHold, ID: id, Hold: hold})
+	return nil
+}
+
+/* method loadRetention()
+Start from the deleted results and legal holds the store kept, when it
+keeps them, each deleted result to be purged when its recovery window ends
+*/
+func (s *Server) loadRetention() error {
+	if s.retentionStore == nil {
+		return nil
+	}
+	held, err := s.retentionStore.ListHolds()
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]deletedResult)
+	var openErr error
+	err = s.retentionStore.ListDeleted(func(id string, result StoredResult, at int64) bool {
+		if result, openErr = s.sealer.openResult(result); openErr != nil {
+			openErr = fmt.Errorf("deleted result %s: %w", id, openErr)
+			return false
+		}
+		deleted[id] = newDeletedResult(result, at)
+		return true
+	})
+	if err == nil {
+		err = openErr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mtxMap.Lock()
+	for _, id := range held {
+		s.legalHolds[id] = true
+	}
+	for id, d := range deleted {
+		s.deletedResults[id] = d
+	}
+	s.mtxMap.Unlock()
+	for id, d := range deleted {
+		s.schedulePurge(id, d.At)
+	}
+	if len(held) > 0 || len(deleted) > 0 {
+		log.Printf("Loaded %d legal holds and %d deleted results", len(held), len(deleted))
+	}
+	return nil
+}
+
+/* method deleteResult()
+Move a result out of the store into the deleted set, where it stays until
+its recovery window ends.  `at` is the deletion time in Unix nanoseconds.
+*/
+func (s *Server) deleteResult(id string, at int64) error {
+	s.mtxMap.Lock()
+	result, ok := s.getResult(id)
+	switch {
+	case !ok:
+		s.mtxMap.Unlock()
+		return errNoResult
+	case s.onHold(id):
+		s.mtxMap.Unlock()
+		return errHeld
+	}
+	// Kept as deleted before it is removed, so a failure loses nothing
+	if err := s.lockedPutDeleted(id, newDeletedResult(result, at)); err != nil {
+		s.mtxMap.Unlock()
+		return err
+	}
+	s.lockedDeleteResult(id)
+	s.mtxMap.Unlock()
+	s.schedulePurge(id, at)
+	return nil
+}
+
+/* method schedulePurge()
+Remove a deleted result for good once its recovery window has ended, unless
+it has been restored, deleted again, or put on hold in the meantime
+*/
+func (s *Server) schedulePurge(id string, at int64) {
+	s.clock.AfterFunc(time.Unix(0, at).Add(s.config.DeleteRecovery).Sub(s.clock.Now()), func() {
+		s.mtxMap.Lock()
+		d, ok, err := s.lockedGetDeleted(id)
+		purge := ok && d.At == at && !s.onHold(id)
+		if purge {
+			s.lockedForgetDeleted(id)
+		}
+		s.mtxMap.Unlock()
+		if err != nil {
+			log.Printf("Error reading deleted result %s, keeping it: %v", id, err)
+		}
+		if purge {
+			log.Printf("Deleted request Id %s purged", id)
+		}
+	})
+}
+
+/* method restoreResult()
+Put a deleted result back while it is still within its recovery window
+*/
+func (s *Server) restoreResult(id string) error {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	d, ok, err := s.lockedGetDeleted(id)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRetention, err)
+	} else if !ok {
+		return errNotDeleted
+	}
+	if err := s.lockedPutResult(id, d.result()); err != nil {
+		return fmt.Errorf("%w: %w", errRetention, err)
+	}
+	s.lockedForgetDeleted(id)
+	return nil
+}
+
+/* method setHold()
+Place or lift a legal hold on a result, deleted or not.  A deleted result
+whose window ended while it was held is purged once the hold is lifted.
+*/
+func (s *Server) setHold(id string, hold bool) error {
+	s.mtxMap.Lock()
+	_, stored := s.getResult(id)
+	d, deleted, err := s.lockedGetDeleted(id)
+	if err == nil && !stored && !deleted {
+		err = errNoResult
+	}
+	if err == nil {
+		err = s.lockedPutHold(id, hold)
+	}
+	s.mtxMap.Unlock()
+	if err != nil {
+		return err
+	}
+	if !hold && deleted {
+		s.schedulePurge(id, d.At)
+	}
+	return nil
+}
+
+/* method applyRetention()
+Perform a delete, restore or hold.  With raft replication it must go
+through the log so every node makes the same change.
+*/
+func (s *Server) applyRetention(cmd raftCommand) error {
+	if s.raftNode != nil {
+		resp, err := s.raftApply(cmd)
+		if err != nil {
+			return err
+		}
+		err, _ = resp.(error)
+		return err
+	}
+	return s.retentionCommand(cmd)
+}
+
+/* method retentionCommand()
+Apply a delete, restore or hold command to this node's state
+*/
+func (s *Server) retentionCommand(cmd raftCommand) error {
+	switch cmd.Op {
+	case opDelete:
+		return s.deleteResult(cmd.ID, cmd.At)
+	case opRestore:
+		return s.restoreResult(cmd.ID)
+	case opHold:
+		return s.setHold(cmd.ID, cmd.Hold)
+	}
+	return nil
+}
+
+/* method retentionRequest()
+Route a retention request to the node that can apply it, apply it, and
+report the outcome.  Returns true when the change was made.
+*/
+func (s *Server) retentionRequest(w http.ResponseWriter, r *http.Request, cmd raftCommand) bool {
+	if s.raftIsFollower() {
+		s.proxyToLeader(w, r)
+		return false
+	}
+	if s.raftNode == nil && s.forwardToOwner(w, r, cmd.ID) {
+		return false
+	}
+	err := s.applyRetention(cmd)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case errors.Is(err, errNoResult):
+		renderError(w, r, http.StatusBadRequest, ErrInvalidId)
+	case errors.Is(err, errHeld):
+		renderError(w, r, http.StatusConflict, ErrLegalHold)
+	case errors.Is(err, errNotDeleted):
+		renderError(w, r, http.StatusNotFound, ErrNotDeleted)
+	case errors.Is(err, errRetention):
+		log.Printf("Error storing %s of request Id %s: %v", cmd.Op, cmd.ID, err)
+		renderError(w, r, http.StatusServiceUnavailable, ErrStorage)
+	default:
+		log.Printf("Error replicating %s of request Id %s: %v", cmd.Op, cmd.ID, err)
+		renderError(w, r, http.StatusServiceUnavailable, ErrReplication)
+	}
+	return false
+}
+
+/*
+	method deleteHash()
+	Handle DELETE request for URL path `/hash/{id}`
+*/
+func (s *Server) deleteHash(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	id := r.PathValue("id")
+	cmd := raftCommand{Op: opDelete, ID: id, At: s.clock.Now().UnixNano()}
+	if s.retentionRequest(w, r, cmd) {
+		log.Printf("AUDIT: Request Id %s deleted by %s, recoverable for %v", id, s.clientLabel(r), s.config.DeleteRecovery)
+	}
+}
+
+/*
+	method restoreHash()
+	Handle POST request for URL path `/admin/hash/{id}/restore`
+*/
+func (s *Server) restoreHash(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	id := r.PathValue("id")
+	if s.retentionRequest(w, r, raftCommand{Op: opRestore, ID: id}) {
+		log.Printf("AUDIT: Request Id %s restored by %s", id, s.clientLabel(r))
+	}
+}
+
+/*
+	method holdHash()
+	Handle PUT request for URL path `/admin/hash/{id}/hold`
+*/
+func (s *Server) holdHash(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	hold, err := strconv.ParseBool(r.FormValue(HoldKey))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, ErrHoldValue)
+		return
+	}
+	id := r.PathValue("id")
+	if s.retentionRequest(w, r, raftCommand{Op: opHold, ID: id, Hold: hold}) {
+		if hold {
+			log.Printf("AUDIT: Legal hold placed on request Id %s by %s", id, s.clientLabel(r))
+		} else {
+			log.Printf("AUDIT: Legal hold lifted from request Id %s by %s", id, s.clientLabel(r))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Server {
+		t.Helper()
+		s, err := NewServer(Config{Workers: 1, DataDir: dir, MaxResults: 2, DeleteRecovery: time.Hour})
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		return s
+	}
+	s := open()
+	putResults(t, s, "held", "deleted")
+	if err := s.setHold("held", true); err != nil {
+		t.Fatalf("holding: %v", err)
+	}
+	if err := s.deleteResult("deleted", s.clock.Now().UnixNano()); err != nil {
+		t.Fatalf("deleting: %v", err)
+	}
+	if err := s.closeBackends(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+
+	// The hold still protects its result from eviction, and the deleted
+	// result can still be restored
+	s = open()
+	defer s.closeBackends()
+	putResults(t, s, "new", "newer")
+	if ids := storedIDs(t, s); !ids["held"] {
+		t.Errorf("held result evicted after reopen, results %v", ids)
+	}
+	if err := s.deleteResult("held", s.clock.Now().UnixNano()); err != errHeld {
+		t.Errorf("deleting the held result after reopen returned %v, want errHeld", err)
+	}
+	if err := s.restoreResult("deleted"); err != nil {
+		t.Fatalf("restoring after reopen: %v", err)
+	}
+	if _, ok := s.getResult("deleted"); !ok {
+		t.Error("restored result not stored")
+	}
+}
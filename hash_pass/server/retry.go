@@ -0,0 +1,187 @@
+/*********************************************************
+File: retry.go
+Contents: Retries of failed jobs and the dead-letter list of those that ran out
+*********************************************************/
+
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Failed jobs are retried 3 times, over about 7 seconds
+	DefaultJobRetries = 3
+
+	// Kinds of failure recorded in the dead-letter list, a job that
+	// couldn't be hashed or stored and a callback that couldn't be delivered
+	DeadLetterJob      = "job"
+	DeadLetterCallback = "callback"
+
+	// Wait before a failed job's first retry, doubling for each one after
+	// up to maxJobBackoff
+	jobBackoff    = time.Second
+	maxJobBackoff = time.Minute
+	// Dead letters kept, the oldest are dropped beyond this
+	maxDeadLetters = 1000
+)
+
+// A job or callback that failed every attempt
+type DeadLetter struct {
+	ID       TaskID    `json:"id"`
+	Kind     string    `json:"kind"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Failed   time.Time `json:"failed"`
+	// Identifiers of the request that submitted the job
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+/* method jobRetries()
+Return the times a failed job is retried
+*/
+func (s *Server) jobRetries() int {
+	if s.config.JobRetries < 0 {
+		return 0
+	}
+	return s.config.JobRetries
+}
+
+/* method retryJob()
+Queue a job that failed for another attempt after a backoff, false once it
+has used up its retries
+*/
+func (s *Server) retryJob(job *queuedJob, err error) bool {
+	if job.attempts >= s.jobRetries() {
+		return false
+	}
+	job.attempts++
+	backoff := min(jobBackoff<<(job.attempts-1), maxJobBackoff)
+	log.Printf("Request Id %s failed, retrying in %v: %v%s", job.id, backoff, err, requestCorrelation(job.ctx).logSuffix())
+	s.setJobState(job.id, StatusPending)
+
+	p := &s.workers
+	p.mtx.Lock()
+	p.byID[job.id] = job
+	job.readyAt = 0
+	job.timer = s.clock.AfterFunc(backoff, func() { s.queueJob(job) })
+	p.mtx.Unlock()
+	return true
+}
+
+/* method failJob()
+Give up on a job that failed every attempt, so it stays unknown rather
+than pending for ever, and add it to the dead-letter list
+*/
+func (s *Server) failJob(requestId string, err error, attempts int, c correlation) {
+	s.setJobState(requestId, "")
+	s.releaseJob(requestId)
+	s.countOutcome(OutcomeFailed)
+	s.recordDeadLetter(requestId, DeadLetterJob, err, attempts, c)
+	log.Printf("Request Id %s failed after %d attempts: %v%s", requestId, attempts, err, c.logSuffix())
+}
+
+/* method recordDeadLetter()
+Add a failure to the dead-letter list, dropping the oldest beyond
+maxDeadLetters, and to the store when it keeps the list.  A store failure
+is logged, the failure is then only listed until the server stops.
+*/
+func (s *Server) recordDeadLetter(requestId string, kind string, err error, attempts int, c correlation) {
+	d := DeadLetter{
+		ID:        TaskID(requestId),
+		Kind:      kind,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		Failed:    s.clock.Now().UTC(),
+		RequestID: c.RequestID,
+		TraceID:   c.TraceID,
+	}
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	if len(s.deadLetters) >= maxDeadLetters {
+		s.deadLetters = append(s.deadLetters[:0], s.deadLetters[len(s.deadLetters)-maxDeadLetters+1:]...)
+	}
+	s.deadLetters = append(s.deadLetters, d)
+	if s.deadLetterStore != nil {
+		if err := s.deadLetterStore.PutDeadLetter(d, maxDeadLetters); err != nil {
+			log.Printf("Error storing dead letter for request Id %s: %v", requestId, err)
+		}
+	}
+}
+
+/* method loadDeadLetters()
+Start from the dead-letter list the store kept, when it keeps one
+*/
+func (s *Server) loadDeadLetters() error {
+	if s.deadLetterStore == nil {
+		return nil
+	}
+	letters, err := s.deadLetterStore.ListDeadLetters()
+	if err != nil {
+		return err
+	}
+	s.mtxMap.Lock()
+	s.deadLetters = letters
+	s.mtxMap.Unlock()
+	if len(letters) > 0 {
+		log.Printf("Loaded %d dead letters", len(letters))
+	}
+	return nil
+}
+
+/*
+	method getDeadLetters()
+	Handle GET request for URL path `/admin/dead-letters`, listing the
+	failures oldest first, only those of one kind with `kind`
+*/
+func (s *Server) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	kind := r.URL.Query().Get(KindKey)
+	if kind != "" && kind != DeadLetterJob && kind != DeadLetterCallback {
+		renderError(w, r, http.StatusBadRequest, ErrDeadLetterKind)
+		return
+	}
+
+	letters := []DeadLetter{}
+	s.mtxMap.Lock()
+	for _, d := range s.deadLetters {
+		if kind == "" || d.Kind == kind {
+			letters = append(letters, d)
+		}
+	}
+	s.mtxMap.Unlock()
+	writeJSON(w, r, http.StatusOK, letters)
+}
+
+/*
+	method clearDeadLetters()
+	Handle DELETE request for URL path `/admin/dead-letters`, emptying the
+	list once its failures have been dealt with
+*/
+func (s *Server) clearDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	s.mtxMap.Lock()
+	n := len(s.deadLetters)
+	s.deadLetters = nil
+	var err error
+	if s.deadLetterStore != nil {
+		err = s.deadLetterStore.ClearDeadLetters()
+	}
+	s.mtxMap.Unlock()
+	if err != nil {
+		log.Printf("Error clearing stored dead letters: %v", err)
+		renderError(w, r, http.StatusServiceUnavailable, ErrStorage)
+		return
+	}
+	log.Printf("AUDIT: %d dead letters cleared by %s", n, s.clientLabel(r))
+	w.WriteHeader(http.StatusNoContent)
+}
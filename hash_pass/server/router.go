@@ -0,0 +1,75 @@
+/*********************************************************
+File: router.go
+Contents: Method- and path-aware routing of requests to handlers
+*********************************************************/
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	// Methods checked when working out the Allow header for a 405
+	knownMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+)
+
+/* method route()
+Register `h` for requests with `method` whose path matches `pattern`.
+Patterns use the standard library syntax, so `{id}` captures a segment.
+*/
+func (s *Server) route(method string, pattern string, h http.Handler) {
+	s.router.Handle(method+" "+pattern, h)
+}
+
+/* method adminRoute()
+Register an operational endpoint as route does, on the admin listener when
+AdminAddr configures one so it isn't exposed with the public API
+*/
+func (s *Server) adminRoute(method string, pattern string, h http.Handler) {
+	if s.adminRouter == nil {
+		s.route(method, pattern, h)
+		return
+	}
+	s.adminRouter.Handle(method+" "+pattern, h)
+}
+
+/* method allowedMethods()
+Return the methods that have a route in `mux` for the request's path
+*/
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	for _, m := range knownMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = m
+		if _, pattern := mux.Handler(probe); len(pattern) > 0 {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+/* method dispatch()
+Return a handler serving requests from their route in `mux`, or responding
+with 405 and an Allow header when the path exists under other methods, or
+404 when it doesn't exist at all
+*/
+func dispatch(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); len(pattern) > 0 {
+			// Let the mux serve it so path parameters are filled in
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if allowed := allowedMethods(mux, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			methodNotAllowed(w, r)
+			return
+		}
+		notFound(w, r)
+	})
+}
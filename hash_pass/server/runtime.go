@@ -0,0 +1,121 @@
+/*********************************************************
+File: runtime.go
+Contents: Runtime tuning of the garbage collector and scheduler
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// Current Go runtime tuning
+type RuntimeSettings struct {
+	// GC target percentage, -1 when the collector is off
+	GOGC int `json:"gogc"`
+	// Soft memory limit in bytes, math.MaxInt64 when there is none
+	GOMemLimit int64 `json:"gomemlimit"`
+	// Number of OS threads executing Go code simultaneously
+	GOMAXPROCS int `json:"gomaxprocs"`
+	// Logical CPUs available, for reference when setting GOMAXPROCS
+	NumCPU int `json:"numcpu"`
+}
+
+/* method runtimeSettings()
+Read the current settings.  There is no getter for GOGC, so it is read by
+setting it and immediately restoring it.
+*/
+func runtimeSettings() RuntimeSettings {
+	gogc := debug.SetGCPercent(-1)
+	debug.SetGCPercent(gogc)
+	return RuntimeSettings{
+		GOGC:       gogc,
+		GOMemLimit: debug.SetMemoryLimit(-1),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+	}
+}
+
+/* method writeRuntime()
+Return the current settings as a JSON object
+*/
+func (s *Server) writeRuntime(w http.ResponseWriter) {
+	s.mtxRuntime.Lock()
+	settings := runtimeSettings()
+	s.mtxRuntime.Unlock()
+	jtext, _ := json.Marshal(settings)
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning runtime settings: %v", err)
+	}
+}
+
+/*
+	method getRuntime()
+	Return a JSON object with the current GC and scheduler settings
+*/
+func (s *Server) getRuntime(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	s.writeRuntime(w)
+}
+
+/*
+	method setRuntime()
+	Change any of GOGC, GOMEMLIMIT and GOMAXPROCS from the `gogc`,
+	`gomemlimit` and `gomaxprocs` form fields and return the new settings
+*/
+func (s *Server) setRuntime(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	// Validate everything before changing anything
+	var gogc, maxProcs int
+	var memLimit int64
+	var err error
+	setGOGC, setMemLimit, setMaxProcs := r.FormValue(GOGCKey), r.FormValue(MemLimitKey), r.FormValue(MaxProcsKey)
+	if len(setGOGC) > 0 {
+		if gogc, err = strconv.Atoi(setGOGC); err != nil || gogc < -1 {
+			renderError(w, r, http.StatusBadRequest, ErrRuntimeValue)
+			return
+		}
+	}
+	if len(setMemLimit) > 0 {
+		if memLimit, err = strconv.ParseInt(setMemLimit, 10, 64); err != nil || memLimit < 0 {
+			renderError(w, r, http.StatusBadRequest, ErrRuntimeValue)
+			return
+		}
+	}
+	if len(setMaxProcs) > 0 {
+		if maxProcs, err = strconv.Atoi(setMaxProcs); err != nil || maxProcs < 1 {
+			renderError(w, r, http.StatusBadRequest, ErrRuntimeValue)
+			return
+		}
+	}
+
+	s.mtxRuntime.Lock()
+	if len(setGOGC) > 0 {
+		debug.SetGCPercent(gogc)
+		log.Printf("AUDIT: GOGC set to %d by %s", gogc, s.clientLabel(r))
+	}
+	if len(setMemLimit) > 0 {
+		debug.SetMemoryLimit(memLimit)
+		log.Printf("AUDIT: GOMEMLIMIT set to %d by %s", memLimit, s.clientLabel(r))
+	}
+	if len(setMaxProcs) > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+		log.Printf("AUDIT: GOMAXPROCS set to %d by %s", maxProcs, s.clientLabel(r))
+	}
+	s.mtxRuntime.Unlock()
+
+	s.writeRuntime(w)
+}
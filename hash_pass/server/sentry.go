@@ -0,0 +1,152 @@
+/*********************************************************
+File: sentry.go
+Contents: Optional reporting of panics and server errors to Sentry
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const (
+	// Maximum time to wait for queued events to be delivered on shutdown
+	sentryFlushTimeout = 2 * time.Second
+)
+
+/* method initSentry()
+Initialize the Sentry client if a DSN has been configured
+*/
+func (s *Server) initSentry() {
+	if len(s.config.SentryDSN) == 0 {
+		return
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              s.config.SentryDSN,
+		Environment:      s.config.SentryEnvironment,
+		EnableTracing:    s.config.SentryTraceRate > 0,
+		TracesSampleRate: s.config.SentryTraceRate,
+	})
+	if err != nil {
+		log.Printf("Error initializing Sentry, error reporting disabled: %v", err)
+		return
+	}
+	s.bSentry = true
+	s.bTracing = s.config.SentryTraceRate > 0
+	log.Printf("Reporting errors to Sentry")
+}
+
+/* method flushSentry()
+Wait for any buffered events to be delivered before the process exits
+*/
+func (s *Server) flushSentry() {
+	if s.bSentry && !sentry.Flush(sentryFlushTimeout) {
+		log.Printf("Timed out delivering events to Sentry")
+	}
+}
+
+/* method reportErrors()
+Wrap `next` so that panics and 5xx responses are captured to Sentry with
+the originating request and its request and trace Ids attached.  A panic
+is turned into a 500 response.  Service Unavailable is not reported since
+it is expected during shutdown.  When tracing is enabled each request gets
+a transaction continuing the caller's trace.
+*/
+func (s *Server) reportErrors(next http.Handler) http.Handler {
+	if !s.bSentry {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(r)
+		hub.Scope().SetUser(sentry.User{IPAddress: s.clientIP(r)})
+		c := requestCorrelation(r.Context())
+		hub.Scope().SetTag("request_id", c.RequestID)
+		hub.Scope().SetTag("trace_id", c.TraceID)
+		sr := &statusRecorder{ResponseWriter: w}
+
+		ctx := sentry.SetHubOnContext(r.Context(), hub)
+		if s.bTracing {
+			name := r.Method + " " + r.URL.Path
+			if _, pattern := s.router.Handler(r); len(pattern) > 0 {
+				// Name by route so /hash/{id} is one transaction, not one per Id
+				name = pattern
+			}
+			tx := sentry.StartTransaction(ctx, name,
+				sentry.WithOpName("http.server"),
+				sentry.ContinueFromTrace(c.TraceID+"-"+c.SpanID))
+			tx.SetTag("request_id", c.RequestID)
+			defer func() {
+				tx.Status = sentry.HTTPtoSpanStatus(sr.status)
+				tx.Finish()
+			}()
+			ctx = tx.Context()
+		}
+		r = r.WithContext(ctx)
+
+		defer func() {
+			if err := recover(); err != nil {
+				hub.Recover(err)
+				log.Printf("Panic serving %s %s: %v", r.Method, r.URL.Path, err)
+				if sr.status == 0 {
+					renderError(sr, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				}
+			}
+		}()
+
+		next.ServeHTTP(sr, r)
+
+		if sr.status >= http.StatusInternalServerError && sr.status != http.StatusServiceUnavailable {
+			hub.CaptureMessage(fmt.Sprintf("%s %s returned %d", r.Method, r.URL.Path, sr.status))
+		}
+	})
+}
+
+/* method startJobSpan()
+Start a transaction for job `id` in the trace of the request that submitted
+it.  The job outlives the request's transaction so it can't be a child span
+of it.  Returns nil when the request isn't being traced.
+*/
+func startJobSpan(ctx context.Context, id string) *sentry.Span {
+	parent := sentry.TransactionFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	span := sentry.StartTransaction(sentry.SetHubOnContext(context.Background(), hub), "hash job",
+		sentry.WithOpName("hash.job"),
+		sentry.ContinueFromTrace(parent.ToSentryTrace()))
+	span.SetTag("request_id", requestCorrelation(ctx).RequestID)
+	span.SetTag("job_id", id)
+	return span
+}
+
+/* method finishJobSpan()
+Record how the job ended and send its transaction
+*/
+func finishJobSpan(span *sentry.Span, err error) {
+	if span == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		span.Status = sentry.SpanStatusOK
+	case errors.Is(err, context.DeadlineExceeded):
+		span.Status = sentry.SpanStatusDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		span.Status = sentry.SpanStatusCanceled
+	default:
+		span.Status = sentry.SpanStatusInternalError
+	}
+	span.Finish()
+}
@@ -6,180 +6,1552 @@ Contents: This file contains the API endpoint implementations and related data
 package server
 
 import (
-	"crypto/sha512"
+	"container/list"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash_pass/hasher"
+	"io"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/raft"
+	"github.com/oschwald/maxminddb-golang/v2"
 )
 
 type RequestStat struct {
-	Total   int64 `json:"total"`
-	Average int64 `json:"average"`
+	// Unit of every time below, ns, us or ms
+	Unit    string           `json:"unit"`
+	Total   int64            `json:"total"`
+	Average float64          `json:"average"`
+	Min     float64          `json:"min"`
+	Max     float64          `json:"max"`
+	StdDev  float64          `json:"stddev"`
+	Latency LatencyHistogram `json:"latency"`
+	// POST requests and jobs by how they ended
+	Outcomes map[string]int64 `json:"outcomes"`
+	// Jobs that ran past their deadline without completing
+	Timeouts int64 `json:"timeouts"`
+	// Results evicted to stay within the configured maximum
+	Evictions int64 `json:"evictions"`
+	// Requests per client country, only when GeoIP is enabled
+	Countries map[string]int64 `json:"countries,omitempty"`
+	// Requests on the request counter, which carries on across restarts
+	// when the store keeps it; for this node's scope only
+	Requests int64 `json:"requests,omitempty"`
+	// The worker pool, summed across the cluster
+	Workers *WorkerStat `json:"workers,omitempty"`
+	// Jobs waiting to complete, and POSTs refused because there were
+	// MaxQueueDepth of them
+	QueueDepth      int64 `json:"queue_depth"`
+	QueueRejections int64 `json:"queue_rejections"`
+	// When the node answering started and how long it has been up since,
+	// in seconds whatever the unit of the other times
+	Started time.Time `json:"started,omitzero"`
+	Uptime  float64   `json:"uptime,omitempty"`
+	// Goroutines running, summed across the cluster
+	Goroutines int `json:"goroutines,omitempty"`
+}
+
+// Distribution of POST processing times.  Counts[i] is the number of
+// requests that took at most Bounds[i], the final entry of Counts holds the
+// requests slower than every bound.
+type LatencyHistogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+}
+
+// Runtime settings supplied by the caller of NewServer
+type Config struct {
+	// Port the HTTP server listens on
+	Port int
+	// Address the HTTP server listens on, e.g. 127.0.0.1:8080, overrides Port when set
+	ListenAddr string
+	// PEM certificate and key files to serve HTTPS with, plain HTTP when empty
+	TLSCert, TLSKey string
+	// PEM file of the CAs that issue the cluster nodes' certificates, the
+	// system roots when empty
+	ClusterCA string
+	// Time each job waits before its result is available
+	Delay time.Duration
+	// Fraction of POST requests that must be good, e.g. 0.99
+	SLOObjective float64
+	// Maximum enqueue time for a POST to count as good
+	SLOLatency time.Duration
+	// Sentry DSN, error reporting is disabled when empty
+	SentryDSN string
+	// Environment name attached to Sentry events
+	SentryEnvironment string
+	// Fraction of requests and jobs traced to Sentry, tracing is disabled when 0
+	SentryTraceRate float64
+	// URL pinged while the server is healthy, disabled when empty
+	HeartbeatURL string
+	// Time between heartbeat pings
+	HeartbeatInterval time.Duration
+	// Consul agent address, e.g. http://127.0.0.1:8500, registration is disabled when empty
+	ConsulAddr string
+	// ACL token for the Consul agent
+	ConsulToken string
+	// Service name registered with Consul
+	ConsulService string
+	// Address advertised to Consul, defaults to the agent's address
+	ConsulServiceAddr string
+	// host:port to gossip on, clustering is disabled when empty
+	ClusterBind string
+	// Address advertised to other cluster nodes
+	ClusterAdvertise string
+	// Gossip addresses of existing nodes to join
+	ClusterJoin []string
+	// Key of 16, 24 or 32 bytes shared by the cluster nodes, encrypting
+	// their gossip and signing the requests they send each other
+	ClusterKey []byte
+	// Unique name of this node, defaults to hostname-port
+	NodeName string
+	// host:port for raft replication traffic, replication is disabled when empty
+	RaftBind string
+	// Address advertised to other raft nodes, defaults to RaftBind
+	RaftAdvertise string
+	// Directory holding the raft log and snapshots
+	RaftDir string
+	// Directory holding results and the request counter across restarts,
+	// results are kept in memory only when empty
+	DataDir string
+	// redis://[user:password@]host[:port][/db] of a Redis server to keep
+	// results and the request counter in, shared with other instances
+	RedisURL string
+	// Prefix of the Redis keys, DefaultRedisPrefix when empty
+	RedisPrefix string
+	// Expiry of results kept in Redis, kept until deleted when 0
+	RedisTTL time.Duration
+	// File logging accepted jobs and completed results, replayed on start
+	// so acknowledged jobs survive a crash; not kept when empty
+	WALPath string
+	// Allow the log without encryption keys, keeping the passwords of
+	// pending jobs in it in the clear
+	WALPlaintext bool
+	// Records appended to the log between compactions,
+	// DefaultWALCompactRecords when 0
+	WALCompactRecords int
+	// File the results and counters are snapshotted to and loaded from on
+	// start; not kept when empty
+	SnapshotPath string
+	// Time between snapshots, DefaultSnapshotInterval when 0
+	SnapshotInterval time.Duration
+	// http[s]://host[:port]/bucket[/prefix] of an S3-compatible bucket old
+	// results are moved to; results are never archived when empty
+	ArchiveURL string
+	// Region the archive requests are signed for, DefaultArchiveRegion
+	// when empty
+	ArchiveRegion string
+	// Credentials of the archive bucket
+	ArchiveCredentials ArchiveCredentials
+	// Age after completion at which results are archived,
+	// DefaultArchiveAfter when 0
+	ArchiveAfter time.Duration
+	// Data source name of a PostgreSQL database to keep results and the
+	// request counter in, shared with other instances
+	PostgresDSN string
+	// database/sql driver opening PostgresDSN, DefaultPostgresDriver when
+	// empty
+	PostgresDriver string
+	// Open connections to PostgreSQL, DefaultPostgresMaxConns when 0
+	PostgresMaxConns int
+	// Start a new raft cluster with this node as its only member
+	RaftBootstrap bool
+	// HTTP API address of an existing node to join through
+	RaftJoin string
+	// Prefix request Ids with the node name and forward GETs to the owning node
+	Sharded bool
+	// Spread jobs across cluster nodes by consistent hashing of their Id
+	Distributed bool
+	// Reverse proxies whose Forwarded/X-Forwarded-For headers are believed
+	TrustedProxies []*net.IPNet
+	// MaxMind-format database for client country lookup, GeoIP is disabled when empty
+	GeoIPDB string
+	// ISO country codes allowed to use the hash API, all when empty
+	GeoAllow []string
+	// ISO country codes refused access to the hash API
+	GeoDeny []string
+	// Origins, as scheme://host[:port], whose pages may open a WebSocket
+	// besides those served by the host the socket is opened on, "*" for any
+	WSAllowedOrigins []string
+	// Period over which client activity is counted for abuse detection
+	AbuseWindow time.Duration
+	// How long an abusive client is refused service
+	AbuseThrottle time.Duration
+	// POSTs per client per window before it is throttled, 0 disables
+	AbusePostLimit int
+	// GETs of unknown task Ids per client per window before it is throttled, 0 disables
+	AbuseMissLimit int
+	// Authorization failures per client per window before it is throttled, 0 disables
+	AbuseAuthLimit int
+	// Jobs a single client may have in flight at once, 0 for no limit
+	MaxInFlightPerClient int
+	// Workers hashing jobs once their delay has passed, one per CPU when 0
+	Workers int
+	// Largest pool /admin/workers may resize to, DefaultMaxWorkers when 0
+	MaxWorkers int
+	// Time waiting for a worker that raises a job's priority by a level,
+	// DefaultPriorityAging when 0
+	PriorityAging time.Duration
+	// Bounds the autoscaler keeps the worker pool within, off when
+	// AutoscaleMax is 0, and the queue wait it aims for,
+	// DefaultAutoscaleWait when 0
+	AutoscaleMin  int
+	AutoscaleMax  int
+	AutoscaleWait time.Duration
+	// Jobs this node may have waiting to complete before POSTs are
+	// refused, 0 for no limit
+	MaxQueueDepth int
+	// Deadline for a job to complete, 0 for none
+	JobTimeout time.Duration
+	// Longest a shutdown waits for pending jobs before abandoning them and
+	// stopping anyway, 0 to wait however long they take
+	DrainTimeout time.Duration
+	// Time an Idempotency-Key is remembered for, DefaultIdempotencyWindow
+	// when 0
+	IdempotencyWindow time.Duration
+	// Give a client repeating a submission, with the same password and
+	// options, the job it already created instead of a new one
+	Dedup bool
+	// Algorithm for sha512 format results when a request names none
+	Algorithm string
+	// Cost of the bcrypt algorithm, its default when 0
+	BcryptCost int
+	// Memory in KiB, passes and lanes of the argon2id algorithm, their
+	// defaults when 0
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+	// CPU/memory cost, block size and parallelism of the scrypt algorithm,
+	// their defaults when 0
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	// Time between fetches of the pepper to pick up rotations, 0 to fetch
+	// it at startup only
+	PepperRefresh time.Duration
+	// Key of the hmac-sha512 algorithm, which is unavailable when empty
+	HMACSecret []byte
+	// Key signing the results POSTed to callback URLs, unsigned when empty
+	CallbackSecret []byte
+	// Times a failed callback delivery is retried
+	CallbackRetries int
+	// Deliver callbacks to loopback, private and link-local addresses too,
+	// for callback receivers on an internal network
+	CallbackAllowPrivate bool
+	// Times a job that couldn't be hashed or stored is retried
+	JobRetries int
+	// Iterations of the pbkdf2 algorithms, their defaults when 0
+	PBKDF2Iterations int
+	// Pick the pbkdf2 iterations at startup so a hash takes this long,
+	// overriding PBKDF2Iterations, disabled when 0
+	PBKDF2Calibrate time.Duration
+	// Time between lines of statistics written to the log, 0 for none
+	StatsInterval time.Duration
+	// Base URL of an OpenTelemetry collector taking OTLP over HTTP, such as
+	// http://localhost:4318, the statistics being pushed to its /v1/metrics
+	// every OTLPInterval; not pushed when empty
+	OTLPEndpoint string
+	// Headers sent with each push, such as the collector's API key
+	OTLPHeaders map[string]string
+	// Time between pushes, DefaultOTLPInterval when 0
+	OTLPInterval time.Duration
+	// Time a result is kept after its job completes, 0 to keep it until
+	// it is deleted
+	ResultTTL time.Duration
+	// Most results kept, evicting the least recently stored or fetched
+	// beyond it, 0 for no limit
+	MaxResults int
+	// Time a deleted result can still be restored, 0 removes it at once
+	DeleteRecovery time.Duration
+	// Time allowed to read a request's headers
+	ReadHeaderTimeout time.Duration
+	// Time allowed to read an entire request including its body
+	ReadTimeout time.Duration
+	// Validate API keys against the JumpCloud directory
+	JumpCloudAuth bool
+	// Base URL of the JumpCloud API
+	JumpCloudURL string
+	// JumpCloud organization keys must belong to, any when empty
+	JumpCloudOrgID string
+	// How long a key validation is cached
+	AuthCacheTTL time.Duration
+	// Bearer token required by the admin endpoints, open when empty
+	AdminToken string
+	// Address of a second listener serving the admin endpoints, /shutdown,
+	// /stats and pprof, such as localhost:9090, so they aren't exposed with
+	// the public API.  All but pprof are served with it when empty.
+	AdminAddr string
+	// Initial state of feature flags by name, overriding their defaults
+	Features map[string]bool
+	// Fraction the processing delay varies by either way, e.g. 0.2 for ±20%
+	DelayJitter float64
+	// Time the processing delay varies by either way, e.g. 1s for 5s ±1s,
+	// used in place of DelayJitter when set
+	DelayJitterRange time.Duration
+	// Longest delay a POST may ask for in place of Delay, longer ones being
+	// cut to it, DefaultMaxDelay when 0
+	MaxDelay time.Duration
+	// Calibration hashes run at startup before the server reports ready
+	WarmupHashes int
+	// Number of results to size the result map for up front, 0 to grow on demand
+	PreallocResults int
+	// Largest payload accepted by the digest endpoint in bytes, 0 for no limit
+	MaxDigestBytes int64
+	// How each setting was resolved, reported by the admin config endpoint
+	Settings []Setting
 }
 
 const (
 	// URL paths
-	HashPath     = "/hash"
-	StatsPath    = "/stats"
-	ShutdownPath = "/shutdown"
+	HashPath        = "/hash"
+	DigestPath      = "/digest"
+	StatsPath       = "/stats"
+	QueuePath       = "/queue"
+	SLOPath         = "/slo"
+	HealthPath      = "/healthz"
+	ReadyPath       = "/readyz"
+	ClusterPath     = "/cluster"
+	RaftPath        = "/raft"
+	RaftJoinPath    = "/raft/join"
+	HandoffPath     = "/cluster/results"
+	AdminConfigPath = "/admin/config"
+	FeaturesPath    = "/admin/features"
+	RuntimePath     = "/admin/runtime"
+	WorkersPath     = "/admin/workers"
+	AdminHashPath   = "/admin/hash"
+	DeadLettersPath = "/admin/dead-letters"
+	BackupPath      = "/admin/backup"
+	RestorePath     = "/admin/restore"
+	ExportPath      = "/admin/export"
+	ImportPath      = "/admin/import"
+	ShutdownPath    = "/shutdown"
+	WebSocketPath   = "/ws"
+	ProfilePath     = "/debug/pprof"
+	VersionPath     = "/version"
 
 	// Form fields
 	PasswordKey = "password"
+	EnabledKey  = "enabled"
+	StoreKey    = "store"
+	FormatKey   = "format"
+	UserKey     = "user"
+	RoundsKey   = "rounds"
+	GOGCKey     = "gogc"
+	MemLimitKey = "gomemlimit"
+	MaxProcsKey = "gomaxprocs"
+	HoldKey     = "hold"
+	ScryptNKey  = "scrypt-n"
+	ScryptRKey  = "scrypt-r"
+	ScryptPKey  = "scrypt-p"
+	CallbackKey = "callback_url"
+	PriorityKey = "priority"
+	DelayKey    = "delay"
+	SizeKey     = "size"
+
+	// Response headers
+	AlgorithmHeader = "X-Hash-Algorithm"
+	SaltHeader      = "X-Hash-Salt"
+	PepperHeader    = "X-Hash-Pepper-Id"
+
+	// Query parameters and values
+	ScopeKey     = "scope"
+	UnitKey      = "unit"
+	AlgorithmKey = "algorithm"
+	WaitKey      = "wait"
+	StatusKey    = "status"
+	LimitKey     = "limit"
+	CursorKey    = "cursor"
+	ConflictKey  = "on_conflict"
+	KindKey      = "kind"
+	ScopeLocal   = "local"
+	ScopeCluster = "cluster"
 
 	// Error messages
-	ErrInvalidId     = "Error: Invalid task Id"
-	ErrPassword      = "Error: Missing or invalid password"
-	ErrShutdown      = "Service is shutting down, request rejected"
-	ErrShutdownError = "Server encountered an error while shutting down: %v"
+	ErrInvalidId       = "Error: Invalid task Id"
+	ErrPassword        = "Error: Missing or invalid password"
+	ErrShutdown        = "Service is shutting down, request rejected"
+	ErrShutdownError   = "Server encountered an error while shutting down: %v"
+	ErrReplication     = "Error: Unable to replicate request"
+	ErrStorage         = "Error: Unable to record request"
+	ErrArchive         = "Error: Unable to fetch archived result"
+	ErrBackup          = "Error: Invalid backup or checksum mismatch"
+	ErrRestore         = "Error: Restore requires an empty instance without raft or a shared store"
+	ErrExportFormat    = "Error: Invalid export format"
+	ErrImport          = "Error: Invalid import file"
+	ErrImportConflict  = "Error: Imported task Ids are already in use"
+	ErrConflictMode    = "Error: Invalid conflict resolution"
+	ErrImportRaft      = "Error: Import is unavailable with raft replication"
+	ErrIdempotencyKey  = "Error: Invalid Idempotency-Key header"
+	ErrIdempotentReuse = "Error: Idempotency-Key was already used for a different request"
+	ErrIdempotentBusy  = "Error: A request with this Idempotency-Key is still in progress"
+	ErrRaftJoin        = "Error: Missing or invalid join request"
+	ErrScope           = "Error: Invalid stats scope"
+	ErrUnit            = "Error: Invalid time unit"
+	ErrNodeUnavailable = "Error: Node owning this task Id is unavailable"
+	ErrHandoff         = "Error: Invalid result handoff"
+	ErrGeoDenied       = "Error: Service is not available in your region"
+	ErrThrottled       = "Error: Too many requests, try again later"
+	ErrConcurrency     = "Error: Too many requests in progress for this client"
+	ErrPriority        = "Error: Invalid priority"
+	ErrDelay           = "Error: Invalid delay"
+	ErrQueueFull       = "Error: Too many jobs waiting, try again later"
+	ErrFeature         = "Error: Unknown feature"
+	ErrFeatureValue    = "Error: Missing or invalid feature value"
+	ErrAdminToken      = "Error: Missing or invalid admin token"
+	ErrAdminClosed     = "Error: Admin endpoints need an admin token or a loopback admin address"
+	ErrRuntimeValue    = "Error: Invalid runtime setting"
+	ErrWorkers         = "Error: Missing or invalid worker pool size"
+	ErrWorkersMax      = "Error: Worker pool size above the maximum"
+	ErrNotReady        = "Service is warming up, request rejected"
+	ErrStore           = "Error: Invalid store option"
+	ErrFormat          = "Error: Unsupported output format"
+	ErrUser            = "Error: Missing or invalid user for htpasswd format"
+	ErrRounds          = "Error: Invalid number of rounds"
+	ErrUnauthorized    = "Error: Missing or invalid API key"
+	ErrAuthBackend     = "Error: Unable to validate credentials, try again later"
+	ErrAlgorithm       = "Error: Unsupported digest algorithm"
+	ErrHashAlgorithm   = "Error: Unsupported hash algorithm for output format"
+	ErrAlgorithmOff    = "Error: Hash algorithm is disabled"
+	ErrPayload         = "Error: Unable to read payload"
+	ErrPayloadSize     = "Error: Payload too large"
+	ErrLegalHold       = "Error: Task is under legal hold"
+	ErrNotDeleted      = "Error: Task is not deleted or can no longer be restored"
+	ErrHoldValue       = "Error: Missing or invalid hold value"
+	ErrScrypt          = "Error: Invalid scrypt parameters"
+	ErrSalt            = "Error: Unable to generate salt, try again later"
+	ErrContentType     = "Error: Unsupported content type, use form encoding or application/json"
+	ErrJSON            = "Error: Malformed JSON request body"
+	ErrWait            = "Error: Invalid wait time"
+	ErrWebSocket       = "Error: Invalid WebSocket handshake"
+	ErrWSOrigin        = "Error: WebSocket origin not allowed"
+	ErrSubscribe       = "Error: Invalid subscribe message"
+	ErrCallback        = "Error: Invalid callback URL"
+	ErrCallbacksOff    = "Error: Callbacks are disabled"
+	ErrStatusFilter    = "Error: Invalid status filter"
+	ErrLimit           = "Error: Invalid limit"
+	ErrCursor          = "Error: Invalid cursor"
+	ErrExpired         = "Error: Result has expired"
+	ErrDeadLetterKind  = "Error: Invalid dead letter kind"
+	ErrCancelled       = "Error: Task was cancelled"
+	ErrNotPending      = "Error: Task is no longer pending"
 
 	// Farewell message
-	MsgFarewell = "All requests have been processed, terminating service."
-	MsgShutdown = "Initiating service shutdown"
+	MsgFarewell  = "All requests have been processed, terminating service."
+	MsgAbandoned = "Stopped waiting for pending requests, terminating service."
+	MsgShutdown  = "Initiating service shutdown"
+	MsgHealthy   = "OK"
+	MsgPaused    = "OK, job processing paused"
 	
-	// Runtime constants
-	ListenPort = 8080
-	DelayTime  = 5 * time.Second
+	// Defaults for the listen port, the time each job waits before completing
+	// and the longest a POST may ask it to wait
+	DefaultPort     = 8080
+	DefaultDelay    = 5 * time.Second
+	DefaultMaxDelay = 30 * time.Second
+
+	// SLO defaults, 99% of POSTs enqueued in under 50ms
+	DefaultSLOObjective = 0.99
+	DefaultSLOLatency   = 50 * time.Millisecond
+
+	// Heartbeat default, one ping per minute
+	DefaultHeartbeatInterval = time.Minute
+
+	// Metrics are pushed to an OpenTelemetry collector once a minute
+	DefaultOTLPInterval = time.Minute
+
+	// Service name used for Consul registration
+	DefaultConsulService = "hash_pass"
+
+	// Abuse detection defaults, count per minute and throttle for 5 minutes
+	DefaultAbuseWindow   = time.Minute
+	DefaultAbuseThrottle = 5 * time.Minute
+
+	// Request read timeouts
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+
+	// Longest the service waits for pending jobs when shutting down
+	DefaultDrainTimeout = 2 * time.Minute
+	// Longest the HTTP server waits for requests still being served once
+	// the jobs have drained
+	stopTimeout = 10 * time.Second
+	// Shared job states outlive their delay by this much without a job
+	// timeout, so a job lost with its instance is forgotten eventually
+	sharedJobGrace = time.Hour
+
+	// JumpCloud authentication defaults
+	DefaultJumpCloudURL = "https://console.jumpcloud.com"
+	DefaultAuthCacheTTL = 5 * time.Minute
+
+	// Deleted results can be restored for a day
+	DefaultDeleteRecovery = 24 * time.Hour
+
+	// Digest defaults, SHA-256 of payloads up to 16GiB, so multi-gigabyte
+	// files stream through while a client can't keep one request going
+	// forever
+	DefaultDigestAlgorithm = "sha256"
+	DefaultMaxDigestBytes  = 16 << 30
+
+	// Callback deliveries are retried 5 times, over about 30 seconds
+	DefaultCallbackRetries = 5
+
+	// Bytes of random salt mixed into each sha512 format result
+	saltSize = 16
 )
 
 var (
-	// Request counter, incremented for each request, used as request Id
-	requestID int64 = 0
-	// Results are stored here
-	resultMap = make(map[string]string)
-	// Mutexes to protect requestId and resultMap
-	mtxId, mtxMap sync.Mutex
-	// Total time spent processing POST requests
-	elapsedTime int64 = 0
+	// Histogram bucket bounds for POST processing time, in microseconds
+	latencyBounds = []int64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000}
+)
+
+// An instance of the service.  Every instance has its own results,
+// statistics and cluster membership, so several can run in one process.
+type Server struct {
+	// Settings the server was started with
+	config Config
+	// Routes registered by the server, matched on method and path
+	router *http.ServeMux
 	// Server object
 	httpServer http.Server
 	// Shutdown flag
-	bShutdown = false
-)
+	bShutdown atomic.Bool
+	// Set once warm-up has completed and the server should receive traffic
+	bReady atomic.Bool
+	// Handler built from the routes and middleware
+	handler http.Handler
+	// Routes, handler and server of the admin listener, nil and unused
+	// without AdminAddr
+	adminRouter  *http.ServeMux
+	adminHandler http.Handler
+	adminServer  http.Server
+	// Set when the admin listener is bound to a loopback address, which lets
+	// the admin endpoints be used without AdminToken
+	adminLoopback bool
+	// Address the public listener is bound to, nil until Start listens
+	boundAddr *net.TCPAddr
+	// Starts warm-up the first time the handler is asked for
+	warmUpOnce sync.Once
+	// When the server was created, reported in the stats with its uptime
+	startTime time.Time
+
+	// Request counter, incremented for each request and reported in the stats
+	requestID int64
+	// Results are stored here, used under mtxMap so a job's status and
+	// result change together
+	store Store
+	// Log of accepted jobs and results replayed on start, if kept
+	wal *writeAheadLog
+	// Jobs recovered from it, held until the worker pool starts
+	walResumed []walResumed
+	// Bucket old results are moved to, if configured
+	archive *objectArchive
+	// Result Ids most recently used first, and each one's element, when
+	// MaxResults is set, protected by mtxMap
+	resultOrder *list.List
+	resultElems map[string]*list.Element
+	// Results evicted by MaxResults, protected by mtxMap
+	evictionCount int64
+	// Jobs running on this node that have not stored a result yet, protected by mtxMap
+	jobsPending int64
+	// Closed once the jobs waiting to complete, local or replicated, run
+	// out, while a drain waits for that, protected by mtxMap
+	jobsDrained chan struct{}
+	// State of each of those jobs, protected by mtxMap
+	jobStates map[string]JobState
+	// Where the state of those jobs is shared with other instances, nil
+	// when the store doesn't keep job states
+	sharedJobs JobStateStore
+	// Where the dead-letter list is kept across restarts, nil when the
+	// store doesn't keep it
+	deadLetterStore DeadLetterStore
+	// Where deleted results and legal holds are kept across restarts and
+	// shared with other instances, nil when the store doesn't keep them
+	retentionStore RetentionStore
+	// Workers hashing those jobs
+	workers workerPool
+	// Channels closed on the next change of state of a job, protected by mtxMap
+	jobWatchers map[string]chan struct{}
+	// Open WebSocket connections, protected by mtxMap
+	webSockets map[*wsConn]bool
+	// Mutexes to protect requestId and the use of store
+	mtxId, mtxMap sync.Mutex
+	// Deleted results that can still be restored, protected by mtxMap, a
+	// copy of those this instance knows of when retentionStore keeps them
+	deletedResults map[string]deletedResult
+	// Expiry time in Unix nanoseconds of each result removed by the TTL,
+	// protected by mtxMap
+	expiredResults map[string]int64
+	// Time in Unix nanoseconds each job was cancelled, protected by mtxMap
+	cancelledJobs map[string]int64
+	// Jobs and callbacks that failed every attempt, oldest first,
+	// protected by mtxMap
+	deadLetters []DeadLetter
+	// Ids of results under legal hold, protected by mtxMap, a copy of those
+	// this instance knows of when retentionStore keeps them
+	legalHolds map[string]bool
+	// POSTs sent with an Idempotency-Key, by client and key, protected by
+	// mtxMap
+	idempotencyKeys map[string]idempotentRequest
+	// With Config.Dedup, the job created for each submission by its
+	// digest, protected by mtxMap, and the key of the digests
+	dedupJobs   map[string]string
+	dedupSecret []byte
+
+	// Number of POST requests processed by this node
+	postCount int64
+	// Total time spent processing POST requests, in nanoseconds
+	elapsedTime int64
+	// Number of jobs abandoned at their deadline
+	timeoutCount int64
+	// Number of POSTs refused because the queue was full
+	queueRejections int64
+	// POST processing time histogram, one more entry than latencyBounds
+	latencyCounts []int64
+	// POST requests per client country
+	countryCounts map[string]int64
+	// Counts per outcome, protected by mtxId
+	outcomeCounts map[string]int64
+	// Fastest and slowest POST processing times and the sum of their squares
+	// in nanoseconds, protected by mtxId
+	minTime, maxTime int64
+	sumSquares       float64
+	// Ring of per-minute SLO buckets indexed by minute modulo sloBuckets
+	sloRing [sloBuckets]sloBucket
+	// Mutex to protect sloRing
+	mtxSLO sync.Mutex
+
+	// Default state of each feature declared with WithFeature by name
+	featureDefaults map[string]bool
+	// Current state of each known feature by name
+	features map[string]bool
+	// Mutex to protect features
+	mtxFeatures sync.Mutex
+	// Authenticator for the hash API, nil when the API is open
+	authenticator Authenticator
+	// Caller supplied middleware, outermost first
+	middlewares []Middleware
+	// Renders every error response, nil for problem details
+	errorRenderer ErrorRenderer
+	// Handlers for unknown paths and unsupported methods, nil for the defaults
+	notFoundHandler, methodNotAllowedHandler http.Handler
+	// Registered hooks for each lifecycle stage
+	startHooks, readyHooks, drainHooks, shutdownHooks []func()
+	// Mutex to protect the hook lists
+	mtxHooks sync.Mutex
+	// Set once initSentry has initialized the Sentry client, and when
+	// performance traces are sent as well as errors.  Neither changes once
+	// NewServer returns.
+	bSentry, bTracing bool
+	// Mutex to serialize reading and changing the runtime settings
+	mtxRuntime sync.Mutex
+	// Hash algorithms for this server only, taking precedence over those
+	// registered with hasher.Register
+	hashers map[string]hasher.Hasher
+	// Source of the pepper, nil when results aren't peppered
+	pepperSource PepperSource
+	// Pepper new jobs are hashed with
+	pepper Pepper
+	// Mutex to protect pepper
+	mtxPepper sync.Mutex
+	// Source of the keys results are encrypted at rest with, nil when they
+	// aren't
+	keySource KeySource
+	// Encrypts results written to durable backends, nil when they aren't
+	sealer *sealer
+	// Stops the maintenance loop, nil when it isn't running, and closed
+	// once it has stopped
+	stopMaintenance context.CancelFunc
+	maintenanceDone chan struct{}
+	// GeoIP database, nil when GeoIP is disabled
+	geoDB *maxminddb.Reader
+
+	// Activity per client IP
+	clientActivities map[string]*clientActivity
+	// Last time idle entries were removed from clientActivities
+	lastAbuseSweep time.Time
+	// Mutex to protect clientActivities and lastAbuseSweep
+	mtxAbuse sync.Mutex
+	// Jobs accepted but not yet completed, per client
+	inFlight map[string]int
+	// Client that submitted each in-flight job, by request Id
+	jobClients map[string]string
+	// Mutex to protect inFlight and jobClients
+	mtxInFlight sync.Mutex
+
+	// Gossip membership, nil when clustering is disabled
+	memberList *memberlist.Memberlist
+	// Key signing the requests sent to other cluster nodes, derived from
+	// ClusterKey
+	peerKey []byte
+	// Client delivering callbacks, refusing internal addresses
+	callbackClient *http.Client
+	// Export and backup downloads kept to resume, by URL and format
+	downloads map[string]*download
+	// Mutex to protect downloads
+	mtxDownloads sync.Mutex
+	// Certificate the listener serves, nil for plain HTTP
+	tlsCert *tls.Certificate
+	// Transport for requests to other cluster nodes, trusting ClusterCA,
+	// nil for the default
+	peerTransport *http.Transport
+	// Current ring, nil until the cluster has started
+	ring *hashRing
+	// Mutex to protect ring
+	mtxRing sync.Mutex
+	// Base URL of each node on the ring, protected by mtxRing
+	ringAddrs map[string]string
+	// Service Id we registered with Consul under, empty if not registered
+	consulServiceID string
+
+	// Raft node, nil when replication is disabled
+	raftNode *raft.Raft
+	// Log and stable store backing raftNode
+	raftStore *boltRaftStore
+	// HTTP API address we publish to the other nodes
+	raftAPI string
+	// Jobs accepted but not yet due, replicated or recovered from the
+	// write-ahead log, protected by mtxMap
+	pendingJobs map[string]pendingJob
+	// HTTP API address of each raft server, protected by mtxMap
+	raftAPIs map[string]string
+	// Time source of the job lifecycle, the wall clock but for tests
+	clock Clock
+	// Closed once stop has run, which it does only once, and what went
+	// wrong when it did
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+}
 
-/* method delayAndUpdate()
-- Sleep for the required amount of time
-- Calculate SHA512 of `pword`
-- Put result in resultMap using requestId as key
+/* method setJobState()
+Record the status of a job that has no result yet, "" once it has none
 */
-func delayAndUpdate(requestId string, pword string) {
-	// Pause before processing
-	time.Sleep(DelayTime)
-	
-	// Hash the password
-	sum := sha512.Sum512([]byte(pword))
-	
-	// Convert to Base64
-	sha := base64.URLEncoding.EncodeToString(sum[:])
-	
-	// Add to resultMap
-	mtxMap.Lock()
-	resultMap[requestId] = sha
-	mtxMap.Unlock()
-	
-	log.Printf("Deferred processing completed for request Id %s", requestId)
+func (s *Server) setJobState(requestId string, status string) {
+	s.mtxMap.Lock()
+	if len(status) == 0 {
+		delete(s.jobStates, requestId)
+		s.lockedUnshareJobState(requestId)
+	} else {
+		state := s.jobStates[requestId]
+		state.Status = status
+		s.jobStates[requestId] = state
+		s.lockedShareJobState(requestId, state)
+	}
+	s.jobChanged(requestId)
+	s.mtxMap.Unlock()
+}
+
+/* method lockedShareJobState()
+Record the state of job `requestId` where other instances can see it, if
+the store shares job states.  A failure is logged, other instances then
+just can't see the job until it completes.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedShareJobState(requestId string, state JobState) {
+	if s.sharedJobs == nil {
+		return
+	}
+	// Long enough for the job to be hashed once its delay has passed
+	ttl := time.Duration(state.Delay) + sharedJobGrace
+	if s.config.JobTimeout > 0 {
+		ttl = time.Duration(state.Delay) + s.config.JobTimeout
+	}
+	if err := s.sharedJobs.PutJobState(requestId, state, ttl); err != nil {
+		log.Printf("Error sharing state of request Id %s: %v", requestId, err)
+	}
+}
+
+/* method lockedUnshareJobState()
+Remove the shared state of job `requestId`, if the store shares job
+states.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedUnshareJobState(requestId string) {
+	if s.sharedJobs == nil {
+		return
+	}
+	if err := s.sharedJobs.DeleteJobState(requestId); err != nil {
+		log.Printf("Error removing shared state of request Id %s: %v", requestId, err)
+	}
+}
+
+/* method markProcessing()
+Record that a worker started hashing job `requestId` at `started`
+*/
+func (s *Server) markProcessing(requestId string, started int64) {
+	s.mtxMap.Lock()
+	state := s.jobStates[requestId]
+	state.Status, state.Started = StatusProcessing, started
+	s.jobStates[requestId] = state
+	s.lockedShareJobState(requestId, state)
+	s.jobChanged(requestId)
+	s.mtxMap.Unlock()
+}
+
+/* method jobStatus()
+Return the result of job `requestId` and its status: StatusComplete once
+it has a result, StatusPending or StatusProcessing before that, and "" for
+a job this node doesn't know.  Fetching a result this way counts as a use
+for eviction.
+*/
+func (s *Server) jobStatus(requestId string) (StoredResult, string) {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	result, status := s.lockedJobStatus(requestId)
+	if status == StatusComplete {
+		s.lockedTouch(requestId)
+	}
+	return result, status
+}
+
+/* method lockedJobStatus()
+jobStatus for callers that hold mtxMap.  A job without a result yet gets
+one holding only its submission and start times and delay.
+*/
+func (s *Server) lockedJobStatus(requestId string) (StoredResult, string) {
+	if result, ok := s.getResult(requestId); ok {
+		return result, StatusComplete
+	}
+	if state, ok := s.jobStates[requestId]; ok {
+		return StoredResult{Submitted: state.Submitted, Started: state.Started, Delay: state.Delay}, state.Status
+	}
+	if job, ok := s.pendingJobs[requestId]; ok {
+		// Replicated jobs are hashed when accepted, they only wait
+		return StoredResult{Submitted: job.Submitted, Delay: job.Delay}, StatusPending
+	}
+	if s.sharedJobs != nil {
+		// Accepted by another instance sharing the store
+		state, ok, err := s.sharedJobs.GetJobState(requestId)
+		if err != nil {
+			log.Printf("Error reading shared state of request Id %s: %v", requestId, err)
+		} else if ok {
+			return StoredResult{Submitted: state.Submitted, Started: state.Started, Delay: state.Delay}, state.Status
+		}
+	}
+	return StoredResult{}, ""
+}
+
+/* method storeResult()
+Put result in the store using requestId as key, unless the caller asked
+for it not to be kept.  The completion is logged with the identifiers of
+the request that submitted the job.  If the store fails the job is left
+as it was, for the caller to retry or give up on.
+*/
+func (s *Server) storeResult(requestId string, result StoredResult, store bool, c correlation) error {
+	if result.Completed == 0 {
+		result.Completed = s.clock.Now().UnixNano()
+	}
+	s.mtxMap.Lock()
+	if store {
+		if err := s.lockedPutResult(requestId, result); err != nil {
+			s.mtxMap.Unlock()
+			return err
+		}
+	} else {
+		s.walAppend(walRecord{Op: walDone, ID: requestId})
+	}
+	delete(s.jobStates, requestId)
+	s.lockedUnshareJobState(requestId)
+	s.jobChanged(requestId)
+	s.mtxMap.Unlock()
+	s.releaseJob(requestId)
+
+	if store {
+		log.Printf("Deferred processing completed for request Id %s%s", requestId, c.logSuffix())
+	} else {
+		log.Printf("Deferred processing completed for request Id %s, result not stored%s", requestId, c.logSuffix())
+	}
+	return nil
+}
+
+/* method jobContext()
+Context for a job submitted by `r`.  The job outlives the request, so it
+keeps the request's values but not its cancellation, and gets its own
+deadline if one is configured.
+*/
+func (s *Server) jobContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := context.WithoutCancel(r.Context())
+	if s.config.JobTimeout > 0 {
+		return context.WithTimeout(ctx, s.config.JobTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Status of a job that has no result yet
+type JobState struct {
+	Status string `json:"status"`
+	// Submission and start of hashing times in Unix nanoseconds, Started
+	// being 0 until a worker takes the job
+	Submitted int64 `json:"submitted"`
+	Started   int64 `json:"started,omitempty"`
+	// Processing delay the job waits out in nanoseconds
+	Delay int64 `json:"delay"`
+}
+
+
+// How a job's result is produced and kept
+type jobOptions struct {
+	// Keep the result so it can be fetched, false for fire-and-forget
+	store bool
+	// Format the password is hashed in
+	hasher.Options
+	// scrypt parameters the request overrides, 0 for those it doesn't
+	scrypt hasher.ScryptHasher
+	// Id of the pepper in Options.Pepper
+	pepperID string
+	// URL the result is POSTed to once the job completes, if any
+	callbackURL string
+	// Submission and start of hashing times in Unix nanoseconds
+	submitted int64
+	started   int64
+	// Level in priorities the job is queued for a worker at
+	priority int
+	// Delay the request asked for in place of the configured one, or the
+	// one picked once the job is accepted, used when delaySet
+	delay    time.Duration
+	delaySet bool
+}
+
+/* method result()
+Record `hash` with the algorithm, or format, that produced it and the salt
+mixed into it, if there is one
+*/
+func (o jobOptions) result(hash string) StoredResult {
+	if o.Format != hasher.FormatSHA512 {
+		return StoredResult{Hash: hash, Algorithm: o.Format, Submitted: o.submitted, Started: o.started, Delay: int64(o.delay)}
+	}
+	r := StoredResult{Hash: hash, Algorithm: o.Algorithm, Salt: base64.StdEncoding.EncodeToString(o.Salt), PepperID: o.pepperID, Submitted: o.submitted, Started: o.started, Delay: int64(o.delay)}
+	if len(r.Algorithm) == 0 {
+		r.Algorithm = hasher.AlgorithmSHA512
+	}
+	return r
+}
+
+/* method optionsError()
+Return the error message for a job that can't be hashed as requested, ""
+if it can
+*/
+func optionsError(pword string, opts jobOptions) string {
+	err := hasher.Check(pword, opts.Options)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, hasher.ErrUser):
+		return ErrUser
+	case errors.Is(err, hasher.ErrRounds):
+		return ErrRounds
+	case errors.Is(err, hasher.ErrPassword):
+		return ErrPassword
+	case errors.Is(err, hasher.ErrAlgorithm):
+		return ErrHashAlgorithm
+	}
+	return ErrFormat
+}
+
+/* method configureHashers()
+Tune the built-in algorithms to the configured costs, unless they were
+replaced with WithHasher, and check the default algorithm exists
+*/
+func (s *Server) configureHashers() error {
+	tuned := map[string]hasher.Hasher{
+		hasher.AlgorithmBcrypt: hasher.BcryptHasher{Cost: s.config.BcryptCost},
+		hasher.AlgorithmArgon2id: hasher.Argon2idHasher{
+			Memory:      uint32(s.config.Argon2Memory),
+			Iterations:  uint32(s.config.Argon2Iterations),
+			Parallelism: uint8(s.config.Argon2Parallelism),
+		},
+		hasher.AlgorithmScrypt:       hasher.ScryptHasher{N: s.config.ScryptN, R: s.config.ScryptR, P: s.config.ScryptP},
+		hasher.AlgorithmPBKDF2SHA256: hasher.PBKDF2Hasher{Digest: "sha256", Iterations: s.config.PBKDF2Iterations},
+		hasher.AlgorithmPBKDF2SHA512: hasher.PBKDF2Hasher{Digest: "sha512", Iterations: s.config.PBKDF2Iterations},
+	}
+	for name, h := range tuned {
+		if _, ok := s.hashers[name]; ok {
+			continue
+		}
+		if p, ok := h.(hasher.PBKDF2Hasher); ok && s.config.PBKDF2Calibrate > 0 {
+			p.Iterations = hasher.CalibratePBKDF2(p.Digest, s.config.PBKDF2Calibrate)
+			log.Printf("Calibrated %s to %d iterations for %v per hash", name, p.Iterations, s.config.PBKDF2Calibrate)
+			h = p
+		}
+		s.hashers[name] = h
+	}
+	if a := tuned[hasher.AlgorithmArgon2id].(hasher.Argon2idHasher); !a.Valid() {
+		return errors.New("argon2id parameters out of range")
+	}
+	if sc := tuned[hasher.AlgorithmScrypt].(hasher.ScryptHasher); !sc.Valid() {
+		return errors.New("scrypt parameters out of range")
+	}
+	if p := tuned[hasher.AlgorithmPBKDF2SHA256].(hasher.PBKDF2Hasher); !p.Valid() {
+		return errors.New("pbkdf2 iterations out of range")
+	}
+	if _, ok := s.hashers[hasher.AlgorithmHMACSHA512]; !ok && len(s.config.HMACSecret) > 0 {
+		if len(s.config.HMACSecret) < hasher.MinHMACKeySize {
+			return hasher.ErrHMACKey
+		}
+		s.hashers[hasher.AlgorithmHMACSHA512] = hasher.HMACHasher{Key: s.config.HMACSecret}
+	}
+	if _, ok := s.hashers[s.config.Algorithm]; !ok {
+		if _, ok := hasher.Lookup(s.config.Algorithm); !ok {
+			if s.config.Algorithm == hasher.AlgorithmHMACSHA512 {
+				return errors.New("hmac-sha512 requires a secret")
+			}
+			return errors.New("unknown algorithm " + s.config.Algorithm)
+		}
+	}
+	return nil
+}
+
+/* method selectAlgorithm()
+Fill in the configured algorithm for sha512 format jobs that don't name one,
+and use this server's own implementation of it when it has one, with any
+scrypt parameters the request overrides.  htpasswd-bcrypt jobs get the
+configured bcrypt cost.  Returns the error message for overrides that can't
+be applied, "" if there is none.
+*/
+func (s *Server) selectAlgorithm(opts *jobOptions) string {
+	overrides := opts.scrypt != hasher.ScryptHasher{}
+	opts.BcryptCost = s.config.BcryptCost
+	if opts.Format != hasher.FormatSHA512 {
+		if overrides {
+			return ErrScrypt
+		}
+		return ""
+	}
+	if len(opts.Algorithm) == 0 {
+		opts.Algorithm = s.config.Algorithm
+	}
+	opts.Hasher = s.hashers[opts.Algorithm]
+	if !overrides {
+		return ""
+	}
+
+	sc, ok := opts.Hasher.(hasher.ScryptHasher)
+	if !ok || opts.Algorithm != hasher.AlgorithmScrypt {
+		return ErrScrypt
+	}
+	if opts.scrypt.N != 0 {
+		sc.N = opts.scrypt.N
+	}
+	if opts.scrypt.R != 0 {
+		sc.R = opts.scrypt.R
+	}
+	if opts.scrypt.P != 0 {
+		sc.P = opts.scrypt.P
+	}
+	if !sc.Valid() {
+		return ErrScrypt
+	}
+	opts.Hasher = sc
+	return ""
+}
+
+/* method maxDelay()
+Return the longest delay a POST may ask for
+*/
+func (s *Server) maxDelay() time.Duration {
+	if s.config.MaxDelay > 0 {
+		return s.config.MaxDelay
+	}
+	return DefaultMaxDelay
+}
+
+/* method jobDelay()
+Return the processing delay for a job, the one its request asked for if
+any, else spread uniformly over Delay ± the configured jitter so
+completions, and the GETs polling for them, don't all land at the same
+moment.  A jitter range wider than Delay never makes it negative.
+*/
+func (s *Server) jobDelay(opts jobOptions) time.Duration {
+	if opts.delaySet {
+		return opts.delay
+	}
+	spread := s.config.DelayJitter * float64(s.config.Delay)
+	if s.config.DelayJitterRange > 0 {
+		spread = float64(s.config.DelayJitterRange)
+	}
+	if spread <= 0 {
+		return s.config.Delay
+	}
+	return max(s.config.Delay+time.Duration((2*rand.Float64()-1)*spread), 0)
+}
+
+/* method abandonJob()
+Give up on a job whose context ended before it completed
+*/
+func (s *Server) abandonJob(requestId string, err error, c correlation) {
+	s.setJobState(requestId, "")
+	s.releaseJob(requestId)
+	if errors.Is(err, errJobCancelled) {
+		s.countOutcome(OutcomeCancelled)
+		log.Printf("Request Id %s cancelled%s", requestId, c.logSuffix())
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.mtxId.Lock()
+		s.timeoutCount++
+		s.outcomeCounts[OutcomeTimedOut]++
+		s.mtxId.Unlock()
+		log.Printf("Request Id %s timed out after %v%s", requestId, s.config.JobTimeout, c.logSuffix())
+		return
+	}
+	s.countOutcome(OutcomeAbandoned)
+	log.Printf("Request Id %s abandoned: %v%s", requestId, err, c.logSuffix())
 }
 
 /*
-	method doHash()
-	Handle POST and GET request for URL path `/hash`
+	method getHash()
+	Handle GET request for URL path `/hash/{id}`
 */
-func doHash(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getHash(w http.ResponseWriter, r *http.Request) {
 	// Sorry, not taking any more requests
-	if bShutdown {
-		http.Error(w, ErrShutdown, http.StatusServiceUnavailable)
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
 		return
 	}
-	// Keep track of start time
-	startTime := time.Now()
-
-	// handle GET and POST requests
-	switch r.Method {
-	case http.MethodGet:
-		// parse out the request Id
-		id := strings.TrimPrefix(r.URL.Path, HashPath+"/")
-		result := resultMap[id]
-		if len(result) > 0 {
-			// Output the result
-			_, err := fmt.Fprintf(w, result)
-			if err != nil {
-				log.Printf("Error sending HTTP response: %v", err)
-			}
-		} else {
-			// No entry found for specified key
-			http.Error(w, ErrInvalidId, http.StatusBadRequest)
-		}
-	case http.MethodPost:
-		// Get the password from the form
-		pw := r.FormValue(PasswordKey)
-		if len(pw) == 0 {
-			// Password missing
-			http.Error(w, ErrPassword, http.StatusBadRequest)
+
+	id := r.PathValue("id")
+	if s.forwardToOwner(w, r, id) {
+		return
+	}
+	if v := r.URL.Query().Get(WaitKey); len(v) > 0 {
+		wait, ok := parseWait(v)
+		if !ok {
+			renderError(w, r, http.StatusBadRequest, ErrWait)
 			return
 		}
-		// Increment request Id
-		mtxId.Lock()
-		requestID++
-		num := strconv.FormatInt(requestID, 10)
-		mtxId.Unlock()
-		
-		// Fire off goroutine to do the work
-		go delayAndUpdate(num, pw)
-		
-		// return the requestId
-		_, err := fmt.Fprintf(w, num)
+		s.awaitJob(r.Context(), id, wait)
+	}
+	if s.resultExpired(id) {
+		renderError(w, r, http.StatusGone, ErrExpired)
+		return
+	}
+	if s.jobCancelled(id) {
+		renderError(w, r, http.StatusGone, ErrCancelled)
+		return
+	}
+	result, status := s.jobStatus(id)
+	if len(status) == 0 {
+		archived, ok, err := s.archivedResult(id)
 		if err != nil {
+			log.Printf("Error fetching result %s from archive: %v", id, err)
+			renderError(w, r, http.StatusServiceUnavailable, ErrArchive)
+			return
+		}
+		if ok {
+			result, status = archived, StatusComplete
+		}
+	}
+	switch {
+	case len(status) == 0:
+		// No job with this Id
+		renderError(w, r, http.StatusNotFound, ErrInvalidId)
+	case wantsJSON(r):
+		writeJSON(w, r, http.StatusOK, hashResult(id, status, result))
+	case status != StatusComplete:
+		// Plain text clients get the status in place of the hash
+		if _, err := fmt.Fprint(w, status); err != nil {
 			log.Printf("Error sending HTTP response: %v", err)
 		}
-
-		// Update statistics
-		mtxId.Lock()
-		elapsedTime += time.Since(startTime).Microseconds()
-		mtxId.Unlock()
-
-		log.Printf("Request %s posted for deferred processing", num)
-
 	default:
-		// We only support GET and POST methods here
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		// Output the result
+		if len(result.Algorithm) > 0 {
+			w.Header().Set(AlgorithmHeader, result.Algorithm)
+		}
+		if len(result.Salt) > 0 {
+			w.Header().Set(SaltHeader, result.Salt)
+		}
+		if len(result.PepperID) > 0 {
+			w.Header().Set(PepperHeader, result.PepperID)
+		}
+		_, err := fmt.Fprint(w, result.Hash)
+		if err != nil {
+			log.Printf("Error sending HTTP response: %v", err)
+		}
 	}
 }
 
 /*
-	method getStats()
-	Return a JSON object with the current statistics
+	method postHash()
+	Handle POST request for URL path `/hash`
 */
-func getStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		// Only GET method is supported
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *Server) postHash(w http.ResponseWriter, r *http.Request) {
+	// Keep track of start time
+	startTime := s.clock.Now()
+
+	// Sorry, not taking any more requests
+	if s.bShutdown.Load() {
+		s.recordSLO(s.clock.Now().Sub(startTime), false)
+		s.rejectPost(w, r, http.StatusServiceUnavailable, ErrShutdown)
 		return
 	}
-	// If we're shutting down we will not accept requests
-	if bShutdown {
-		http.Error(w, "Service is shutting down, request rejected", http.StatusServiceUnavailable)
+
+	if s.raftIsFollower() {
+		// Only the raft leader can assign request Ids
+		s.proxyToLeader(w, r)
+		return
+	}
+	if status, msg := readHashRequest(w, r); status != 0 {
+		s.rejectPost(w, r, status, msg)
+		return
+	}
+	// Get the password from the form
+	pw := r.FormValue(PasswordKey)
+	if len(pw) == 0 {
+		// Password missing
+		s.rejectPost(w, r, http.StatusBadRequest, ErrPassword)
+		return
+	}
+	// Fire-and-forget callers don't want the result kept
+	opts := jobOptions{store: true, submitted: s.clock.Now().UnixNano()}
+	opts.Format = hasher.FormatSHA512
+	opts.User = r.FormValue(UserKey)
+	opts.Algorithm = r.FormValue(AlgorithmKey)
+	if v := r.FormValue(StoreKey); len(v) > 0 {
+		var err error
+		if opts.store, err = strconv.ParseBool(v); err != nil {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrStore)
+			return
+		}
+	}
+	if v := r.FormValue(FormatKey); len(v) > 0 {
+		opts.Format = v
+	}
+	if v := r.FormValue(CallbackKey); len(v) > 0 {
+		if !s.FeatureEnabled(FeatureCallbacks) {
+			s.rejectPost(w, r, http.StatusForbidden, ErrCallbacksOff)
+			return
+		}
+		if !validCallback(v) {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrCallback)
+			return
+		}
+		opts.callbackURL = v
+	}
+	if level, ok := priorityLevel(r.FormValue(PriorityKey)); ok {
+		opts.priority = level
+	} else {
+		s.rejectPost(w, r, http.StatusBadRequest, ErrPriority)
+		return
+	}
+	if v := r.FormValue(DelayKey); len(v) > 0 {
+		delay, ok := parseDuration(v)
+		if !ok {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrDelay)
+			return
+		}
+		opts.delay, opts.delaySet = min(delay, s.maxDelay()), true
+	}
+	if v := r.FormValue(RoundsKey); len(v) > 0 {
+		var err error
+		if opts.Rounds, err = strconv.Atoi(v); err != nil {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrRounds)
+			return
+		}
+	}
+	for key, v := range map[string]*int{ScryptNKey: &opts.scrypt.N, ScryptRKey: &opts.scrypt.R, ScryptPKey: &opts.scrypt.P} {
+		if len(r.FormValue(key)) == 0 {
+			continue
+		}
+		var err error
+		if *v, err = strconv.Atoi(r.FormValue(key)); err != nil || *v <= 0 {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrScrypt)
+			return
+		}
+	}
+	if msg := s.selectAlgorithm(&opts); len(msg) > 0 {
+		s.rejectPost(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	if !s.algorithmEnabled(opts.Algorithm) {
+		s.rejectPost(w, r, http.StatusForbidden, ErrAlgorithmOff)
+		return
+	}
+	if msg := optionsError(pw, opts); len(msg) > 0 {
+		s.rejectPost(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	// A fresh salt for every job, so equal passwords don't give equal
+	// hashes.  bcrypt makes its own, so one of ours would only be stored
+	// and returned unused.
+	if opts.Format == hasher.FormatSHA512 {
+		if opts.Algorithm != hasher.AlgorithmBcrypt {
+			var err error
+			if opts.Salt, err = hasher.RandomSalt(saltSize); err != nil {
+				log.Printf("Error generating salt: %v", err)
+				s.rejectPost(w, r, http.StatusServiceUnavailable, ErrSalt)
+				return
+			}
+		}
+		p := s.currentPepper()
+		opts.Pepper, opts.pepperID = p.Secret, p.ID
+	}
+
+	// A peer handing us a job counted and capped it where it arrived, we
+	// only give it an Id
+	num := ""
+	handedOver := s.raftNode == nil && s.handedOver(r)
+	if handedOver {
+		num = s.ownedID()
+	}
+
+	// A retry of a POST that already created a job gets that job back.
+	// The key is released again if this request is rejected.
+	claimedKey := ""
+	if !handedOver {
+		key, ok := s.idempotencyKey(r)
+		if !ok {
+			s.rejectPost(w, r, http.StatusBadRequest, ErrIdempotencyKey)
+			return
+		}
+		if len(key) > 0 {
+			id, status, msg := s.claimIdempotencyKey(key, requestFingerprint(r), startTime)
+			if len(msg) > 0 {
+				s.rejectPost(w, r, status, msg)
+				return
+			}
+			if len(id) > 0 {
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				writeAccepted(w, r, id)
+				return
+			}
+			claimedKey = key
+			defer func() {
+				if len(claimedKey) > 0 {
+					s.settleIdempotencyKey(claimedKey, "")
+				}
+			}()
+		}
+	}
+
+	// A client repeating a submission gets the job it already created
+	client := s.clientKey(r)
+	dedupKey := ""
+	if s.config.Dedup && !handedOver {
+		dedupKey = s.dedupKey(client, pw, opts)
+	}
+	if id, ok := s.dedupedJob(dedupKey); ok {
+		if len(claimedKey) > 0 {
+			s.settleIdempotencyKey(claimedKey, id)
+			claimedKey = ""
+		}
+		s.countOutcome(OutcomeDeduplicated)
+		s.recordSLO(s.clock.Now().Sub(startTime), true)
+		writeAccepted(w, r, id)
+		log.Printf("Request from %s shares job %s%s", s.clientLabel(r), id, requestCorrelation(r.Context()).logSuffix())
+		return
+	}
+
+	if !handedOver && s.queueFull() {
+		// This node already has as much work waiting as it may
+		s.mtxId.Lock()
+		s.queueRejections++
+		s.mtxId.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.config.Delay/time.Second))))
+		s.rejectPost(w, r, http.StatusTooManyRequests, ErrQueueFull)
+		return
+	}
+	if !handedOver && !s.acquireSlot(client) {
+		// Client already has as many jobs in flight as it may
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.config.Delay/time.Second))))
+		s.rejectPost(w, r, http.StatusTooManyRequests, ErrConcurrency)
+		return
+	}
+
+	if s.raftNode != nil {
+		// Replicate the job so any node can serve the result
+		id, err := s.submitRaft(requestCorrelation(r.Context()), pw, opts)
+		if err != nil {
+			s.releaseSlot(client)
+			log.Printf("Error replicating request: %v", err)
+			s.recordSLO(s.clock.Now().Sub(startTime), false)
+			s.rejectPost(w, r, http.StatusServiceUnavailable, ErrReplication)
+			return
+		}
+		num = id
+		s.bindSlot(num, client)
+	} else {
+		if !handedOver {
+			// Count the request and give it a random Id
+			if err := s.countRequest(); err != nil {
+				s.releaseSlot(client)
+				log.Printf("Error counting request: %v", err)
+				s.recordSLO(s.clock.Now().Sub(startTime), false)
+				s.rejectPost(w, r, http.StatusServiceUnavailable, ErrStorage)
+				return
+			}
+			num = s.shardID(newTaskID())
+		}
+
+		// In distributed mode the job may belong to another node
+		if id, ok := s.dispatchJob(r, num, pw, opts); ok {
+			num = id
+			s.releaseSlot(client)
+		} else {
+			if !handedOver {
+				s.bindSlot(num, client)
+			}
+			// Pick the delay now so the job can report it
+			opts.delay, opts.delaySet = s.jobDelay(opts), true
+			if s.wal != nil {
+				// Log the job before acknowledging it, so a crash can't lose it
+				task := s.newWALTask(requestCorrelation(r.Context()), pw, opts)
+				if err := s.wal.append(walRecord{Op: walQueue, ID: num, Task: &task}); err != nil {
+					s.releaseJob(num)
+					log.Printf("Error logging request: %v", err)
+					s.recordSLO(s.clock.Now().Sub(startTime), false)
+					s.rejectPost(w, r, http.StatusServiceUnavailable, ErrStorage)
+					return
+				}
+			}
+			s.mtxMap.Lock()
+			s.jobsPending++
+			s.jobStates[num] = JobState{Status: StatusPending, Submitted: opts.submitted, Delay: int64(opts.delay)}
+			s.lockedShareJobState(num, s.jobStates[num])
+			s.mtxMap.Unlock()
+
+			// Hand the job to the worker pool once its delay has passed
+			ctx, cancel := s.jobContext(r)
+			s.submitJob(ctx, cancel, client, num, pw, opts, opts.delay)
+		}
+	}
+	
+	if len(claimedKey) > 0 {
+		s.settleIdempotencyKey(claimedKey, num)
+		claimedKey = ""
+	}
+	if len(dedupKey) > 0 {
+		s.recordDedup(dedupKey, num)
+	}
+	writeAccepted(w, r, num)
+
+	if handedOver {
 		return
 	}
 
-	// get current counts
+	// Update statistics
+	elapsed := s.clock.Now().Sub(startTime)
+	s.mtxId.Lock()
+	s.recordPost(elapsed)
+	if country := requestCountry(r); len(country) > 0 {
+		s.countryCounts[country]++
+	}
+	s.mtxId.Unlock()
+	s.recordSLO(elapsed, true)
+
+	log.Printf("Request %s from %s posted for deferred processing%s", num, s.clientLabel(r), requestCorrelation(r.Context()).logSuffix())
+}
+
+/* method latencyBucket()
+Return the index in latencyCounts for a request that took `us` microseconds
+*/
+func latencyBucket(us int64) int {
+	for i, bound := range latencyBounds {
+		if us <= bound {
+			return i
+		}
+	}
+	return len(latencyBounds)
+}
+
+/* method localStats()
+Snapshot the statistics for requests processed by this node
+*/
+func (s *Server) localStats() RequestStat {
+	// get current counts, times in nanoseconds
 	stats := RequestStat{
+		Unit:    UnitNanoseconds,
 		Total:   0,
 		Average: 0,
+		Latency: LatencyHistogram{
+			Bounds: make([]float64, len(latencyBounds)),
+			Counts: make([]int64, len(s.latencyCounts)),
+		},
+		Outcomes: make(map[string]int64),
+	}
+	for i, b := range latencyBounds {
+		stats.Latency.Bounds[i] = float64(b * int64(time.Microsecond))
 	}
 
-	mtxId.Lock()
-	stats.Total = requestID
-	et := elapsedTime
-	mtxId.Unlock()
+	s.mtxId.Lock()
+	stats.Total = s.postCount
+	stats.Requests = s.requestID
+	stats.Timeouts = s.timeoutCount
+	stats.QueueRejections = s.queueRejections
+	et := s.elapsedTime
+	squares := s.sumSquares
+	stats.Min = float64(s.minTime)
+	stats.Max = float64(s.maxTime)
+	copy(stats.Latency.Counts, s.latencyCounts)
+	for o, n := range s.outcomeCounts {
+		stats.Outcomes[o] = n
+	}
+	if s.geoDB != nil {
+		stats.Countries = make(map[string]int64, len(s.countryCounts))
+		for c, n := range s.countryCounts {
+			stats.Countries[c] = n
+		}
+	}
+	s.mtxId.Unlock()
+	s.mtxMap.Lock()
+	stats.Evictions = s.evictionCount
+	stats.QueueDepth = s.lockedQueueDepth()
+	s.mtxMap.Unlock()
+	stats.Workers = s.workerStats()
+	stats.Started = s.startTime.UTC()
+	stats.Uptime = s.clock.Now().Sub(s.startTime).Seconds()
+	stats.Goroutines = runtime.NumGoroutine()
 
 	// calculate average if count != 0
 	if stats.Total != 0 {
-		stats.Average = et / stats.Total
+		stats.Average = float64(et) / float64(stats.Total)
+	}
+	stats.StdDev = stdDev(stats.Total, float64(et), squares)
+	return stats
+}
+
+/*
+	method getStats()
+	Return a JSON object with the current statistics, for this node or
+	aggregated across the cluster depending on the `scope` parameter, with
+	times in the unit given by the `unit` parameter, microseconds by default
+*/
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	// If we're shutting down we will not accept requests
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, "Service is shutting down, request rejected")
+		return
+	}
+
+	unit := r.URL.Query().Get(UnitKey)
+	if len(unit) == 0 {
+		unit = UnitMicroseconds
+	}
+	if _, ok := unitScale(unit); !ok {
+		renderError(w, r, http.StatusBadRequest, ErrUnit)
+		return
+	}
+
+	var stats interface{}
+	switch r.URL.Query().Get(ScopeKey) {
+	case "", ScopeLocal:
+		stats = s.localStats().inUnit(unit)
+	case ScopeCluster:
+		agg := s.clusterStats()
+		agg.RequestStat = agg.RequestStat.inUnit(unit)
+		stats = agg
+	default:
+		renderError(w, r, http.StatusBadRequest, ErrScope)
+		return
 	}
 
 	// Serialize and return the stats
@@ -191,63 +1563,463 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-	method doShutdown
-	- Set the shutdown flag to stop accepting new requests
-	- Wait for any pending requests to complete
-	- Shut down the HTTP server
+	method doHealth()
+	Report whether the service is accepting requests, and whether it is
+	processing them
 */
-func doShutdown(w http.ResponseWriter, r *http.Request) {
-
-	if r.Method != http.MethodGet {
-		// Only GET method is supported
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+func (s *Server) doHealth(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
 		return
 	}
+	msg := MsgHealthy
+	if s.workersPaused() {
+		msg = MsgPaused
+	}
+	_, err := fmt.Fprint(w, msg)
+	if err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
 
-	log.Printf(MsgShutdown)
-	bShutdown = true
-
-	/* 	Wait for all requests to complete.  This is done by comparing the
-	number of requests accepted to the number of entries in resultMap.
-	When they match all requests have been processed
-	*/
-	for {
-		mtxMap.Lock()
-		count := len(resultMap)
-		mtxMap.Unlock()
-		if int64(count) == requestID {
-			break
-		}
-		// Wait a short time before checking again
-		time.Sleep(100 * time.Millisecond)
+/*
+	method doShutdown
+	Handle POST or DELETE request for URL path `/shutdown`
+	- Stop accepting new requests and wait for any pending requests to complete
+	- Shut down the HTTP server once the farewell message has been sent
+*/
+func (s *Server) doShutdown(w http.ResponseWriter, r *http.Request) {
+	log.Printf("AUDIT: Shutdown requested by %s", s.clientLabel(r))
+	// Not the request's context, a client hanging up mustn't cut the wait short
+	msg := MsgFarewell
+	if s.drain(context.Background()) != nil {
+		msg = MsgAbandoned
 	}
 
 	// Respond with a farewell message
-	_, err := fmt.Fprintf(w, MsgFarewell)
+	_, err := fmt.Fprint(w, msg)
 	if err != nil {
 		log.Printf("Failed to send farewell message: %v", err)
 	}
 
-	log.Printf("Shutdown: All tasks completed")
 	// Give the server some time to send the request, then terminate it
 	go func() {
-		time.Sleep(1 * time.Second)
-		err := httpServer.Shutdown(nil)
-		if err != http.ErrServerClosed {
+		s.clock.Sleep(1 * time.Second)
+		if err := s.stop(context.Background()); err != nil {
 			log.Printf(ErrShutdownError, err)
 		}
 	}()
 }
 
+/* method drain()
+- Set the shutdown flag to stop accepting new requests
+- Leave the cluster and service discovery
+- Wait for any pending requests to complete, or until `ctx` ends or
+  DrainTimeout passes, then abandon those left
+*/
+func (s *Server) drain(ctx context.Context) error {
+	log.Printf(MsgShutdown)
+	s.bShutdown.Store(true)
+	s.runHooks(&s.drainHooks)
+	s.deregisterConsul()
+	s.leaveCluster()
+	s.stopRaft()
+	// Paused jobs would never complete
+	if s.pauseWorkers(false) {
+		log.Printf("Shutdown: Job processing resumed")
+	}
+
+	if s.config.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.DrainTimeout)
+		defer cancel()
+	}
+	if err := s.waitForJobs(ctx); err != nil {
+		log.Printf("Shutdown: Stopped waiting for tasks to complete: %v", err)
+		s.abandonRemaining()
+		return err
+	}
+	log.Printf("Shutdown: All tasks completed")
+	return nil
+}
+
+/* method stop()
+Run the shutdown hooks, flush error reports and stop the HTTP server, once
+however many shutdowns were asked for.  Requests still being served are
+waited for until `ctx` ends or stopTimeout passes, then cut off.  Returns
+what went wrong stopping the server, the store or the write-ahead log.
+*/
+func (s *Server) stop(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		defer close(s.stopped)
+		s.runHooks(&s.shutdownHooks)
+		s.endMaintenance()
+		if len(s.config.OTLPEndpoint) > 0 {
+			// The last statistics, jobs completed during the drain included
+			s.exportMetrics(s.clock.Now())
+		}
+		if len(s.config.SnapshotPath) > 0 {
+			s.takeSnapshot(s.clock.Now())
+		}
+		s.closeWebSockets()
+		s.removeDownloads()
+		s.flushSentry()
+
+		ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+		defer cancel()
+		var errs []error
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			s.httpServer.Close()
+			errs = append(errs, fmt.Errorf("stopping HTTP server: %w", err))
+		}
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			s.adminServer.Close()
+			errs = append(errs, fmt.Errorf("stopping admin listener: %w", err))
+		}
+		errs = append(errs, s.closeBackends())
+		s.stopErr = errors.Join(errs...)
+	})
+	return s.stopErr
+}
+
+/* method closeBackends()
+Close the store and write-ahead log, returning what went wrong
+*/
+func (s *Server) closeBackends() error {
+	var errs []error
+	if c, ok := s.store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing store: %w", err))
+		}
+	}
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing write-ahead log: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/* method abort()
+Close what NewServer had opened before `err` stopped it, and return `err`
+*/
+func (s *Server) abort(err error) error {
+	if closeErr := s.closeBackends(); closeErr != nil {
+		log.Printf("Error cleaning up: %v", closeErr)
+	}
+	return err
+}
+
+/* method NewServer()
+Create a server with the given settings, adjusted by any options, and set
+up its handlers.  Nothing is started until Start is called, or Handler is
+mounted in another server.  Returns why the server can't be created, with
+any backends it had opened closed again.
+*/
+func NewServer(cfg Config, opts ...Option) (*Server, error) {
+	s := &Server{
+		config:           cfg,
+		router:           http.NewServeMux(),
+		resultOrder:      list.New(),
+		resultElems:      make(map[string]*list.Element),
+		jobStates:        make(map[string]JobState),
+		jobWatchers:      make(map[string]chan struct{}),
+		webSockets:       make(map[*wsConn]bool),
+		deletedResults:   make(map[string]deletedResult),
+		expiredResults:   make(map[string]int64),
+		cancelledJobs:    make(map[string]int64),
+		legalHolds:       make(map[string]bool),
+		idempotencyKeys:  make(map[string]idempotentRequest),
+		dedupJobs:        make(map[string]string),
+		dedupSecret:      newDedupSecret(),
+		latencyCounts:    make([]int64, len(latencyBounds)+1),
+		countryCounts:    make(map[string]int64),
+		outcomeCounts:    make(map[string]int64),
+		featureDefaults:  builtinFeatures(),
+		downloads:        make(map[string]*download),
+		features:         make(map[string]bool),
+		hashers:          make(map[string]hasher.Hasher),
+		clientActivities: make(map[string]*clientActivity),
+		inFlight:         make(map[string]int),
+		jobClients:       make(map[string]string),
+		ringAddrs:        make(map[string]string),
+		pendingJobs:      make(map[string]pendingJob),
+		raftAPIs:         make(map[string]string),
+		clock:            realClock{},
+		stopped:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	cfg = s.config
+	s.startTime = s.clock.Now()
+	if len(cfg.AdminAddr) > 0 {
+		s.adminRouter = http.NewServeMux()
+	}
+	s.applyFeatures(cfg.Features)
+	s.callbackClient = s.newCallbackClient()
+	if err := s.loadTLS(); err != nil {
+		return nil, s.abort(fmt.Errorf("loading TLS certificates: %w", err))
+	}
+	if cfg.JumpCloudAuth && s.authenticator == nil {
+		s.authenticator = NewJumpCloudAuthenticator(cfg.JumpCloudURL, cfg.JumpCloudOrgID, cfg.AuthCacheTTL)
+	}
+	if err := s.configureHashers(); err != nil {
+		return nil, s.abort(fmt.Errorf("configuring hash algorithms: %w", err))
+	}
+	if s.pepperSource != nil {
+		if err := s.loadPepper(); err != nil {
+			return nil, s.abort(fmt.Errorf("loading pepper: %w", err))
+		}
+	}
+	if s.keySource != nil {
+		if err := s.loadKeys(); err != nil {
+			return nil, s.abort(fmt.Errorf("loading encryption keys: %w", err))
+		}
+	}
+	if s.store == nil && len(cfg.DataDir) > 0 {
+		if err := s.openDataDir(); err != nil {
+			return nil, s.abort(fmt.Errorf("opening data directory: %w", err))
+		}
+	}
+	if s.store == nil && len(cfg.RedisURL) > 0 {
+		if err := s.openRedis(); err != nil {
+			return nil, s.abort(fmt.Errorf("connecting to Redis: %w", err))
+		}
+	}
+	if s.store == nil && len(cfg.PostgresDSN) > 0 {
+		if err := s.openPostgres(); err != nil {
+			return nil, s.abort(fmt.Errorf("opening PostgreSQL store: %w", err))
+		}
+	}
+	if _, inMemory := s.store.(*MemoryStore); s.sealer != nil && s.store != nil && !inMemory {
+		s.store = encryptStore(s.store, s.sealer)
+	}
+	s.sharedJobs, _ = unwrapStore(s.store).(JobStateStore)
+	s.deadLetterStore, _ = unwrapStore(s.store).(DeadLetterStore)
+	s.retentionStore, _ = unwrapStore(s.store).(RetentionStore)
+	s.preallocate()
+	if err := s.loadCounter(); err != nil {
+		return nil, s.abort(fmt.Errorf("loading request counter: %w", err))
+	}
+	if err := s.loadDeadLetters(); err != nil {
+		return nil, s.abort(fmt.Errorf("loading dead letters: %w", err))
+	}
+	if err := s.loadRetention(); err != nil {
+		return nil, s.abort(fmt.Errorf("loading deleted results and legal holds: %w", err))
+	}
+	if len(cfg.ArchiveURL) > 0 {
+		if err := s.openArchive(); err != nil {
+			return nil, s.abort(fmt.Errorf("configuring archive: %w", err))
+		}
+	}
+	if len(cfg.SnapshotPath) > 0 {
+		if err := s.loadSnapshot(); err != nil {
+			return nil, s.abort(fmt.Errorf("loading snapshot: %w", err))
+		}
+	}
+	if len(cfg.WALPath) > 0 {
+		if err := s.openWAL(); err != nil {
+			return nil, s.abort(fmt.Errorf("recovering write-ahead log: %w", err))
+		}
+	}
+	if cfg.MaxResults > 0 {
+		// Results kept from before the restart are evicted like new ones
+		s.mtxMap.Lock()
+		s.lockedResetOrder()
+		s.mtxMap.Unlock()
+	}
+	if len(cfg.GeoIPDB) > 0 {
+		if err := s.openGeoIP(); err != nil {
+			return nil, s.abort(fmt.Errorf("opening GeoIP database: %w", err))
+		}
+	}
+	s.initSentry()
+	s.startWorkers()
+	s.resumeTasks()
+	s.route(http.MethodPost, HashPath, s.geoPolicy(s.authenticate(http.HandlerFunc(s.postHash))))
+	s.route(http.MethodGet, HashPath+"/{id}", s.geoPolicy(s.authenticate(http.HandlerFunc(s.getHash))))
+	s.route(http.MethodGet, HashPath+"/{id}/events", s.geoPolicy(s.authenticate(http.HandlerFunc(s.jobEvents))))
+	s.route(http.MethodGet, WebSocketPath, s.geoPolicy(s.authenticate(http.HandlerFunc(s.webSocket))))
+	s.route(http.MethodDelete, HashPath+"/{id}", s.geoPolicy(s.authenticate(http.HandlerFunc(s.deleteHash))))
+	s.route(http.MethodPost, HashPath+"/{id}/cancel", s.geoPolicy(s.authenticate(http.HandlerFunc(s.cancelHash))))
+	s.route(http.MethodPost, DigestPath, s.authenticate(http.HandlerFunc(s.doDigest)))
+	s.adminRoute(http.MethodGet, StatsPath, http.HandlerFunc(s.getStats))
+	if s.adminRouter != nil && len(cfg.ClusterBind) > 0 {
+		// Cluster statistics are gathered from the peers' public listeners
+		s.route(http.MethodGet, StatsPath, s.peersOnly(http.HandlerFunc(s.getStats)))
+	}
+	s.route(http.MethodGet, QueuePath, http.HandlerFunc(s.getQueue))
+	s.route(http.MethodGet, SLOPath, http.HandlerFunc(s.getSLO))
+	s.route(http.MethodGet, HealthPath, http.HandlerFunc(s.doHealth))
+	s.route(http.MethodGet, ReadyPath, http.HandlerFunc(s.doReady))
+	s.route(http.MethodGet, VersionPath, http.HandlerFunc(s.getVersion))
+	s.route(http.MethodGet, ClusterPath, http.HandlerFunc(s.getCluster))
+	s.route(http.MethodPost, HandoffPath, http.HandlerFunc(s.doHandoff))
+	s.adminRoute(http.MethodGet, HashPath, s.adminOnly(http.HandlerFunc(s.listHashes)))
+	s.adminRoute(http.MethodGet, AdminConfigPath, s.adminOnly(http.HandlerFunc(s.getConfig)))
+	s.adminRoute(http.MethodGet, FeaturesPath, s.adminOnly(http.HandlerFunc(s.getFeatures)))
+	s.adminRoute(http.MethodPut, FeaturesPath+"/{name}", s.adminOnly(http.HandlerFunc(s.setFeature)))
+	s.adminRoute(http.MethodGet, RuntimePath, s.adminOnly(http.HandlerFunc(s.getRuntime)))
+	s.adminRoute(http.MethodPut, RuntimePath, s.adminOnly(http.HandlerFunc(s.setRuntime)))
+	s.adminRoute(http.MethodGet, WorkersPath, s.adminOnly(http.HandlerFunc(s.getWorkers)))
+	s.adminRoute(http.MethodPut, WorkersPath, s.adminOnly(http.HandlerFunc(s.setWorkers)))
+	s.adminRoute(http.MethodPost, WorkersPath+"/pause", s.adminOnly(http.HandlerFunc(s.pauseProcessing)))
+	s.adminRoute(http.MethodPost, WorkersPath+"/resume", s.adminOnly(http.HandlerFunc(s.resumeProcessing)))
+	s.adminRoute(http.MethodPost, AdminHashPath+"/{id}/restore", s.adminOnly(http.HandlerFunc(s.restoreHash)))
+	s.adminRoute(http.MethodPut, AdminHashPath+"/{id}/hold", s.adminOnly(http.HandlerFunc(s.holdHash)))
+	s.adminRoute(http.MethodGet, DeadLettersPath, s.adminOnly(http.HandlerFunc(s.getDeadLetters)))
+	s.adminRoute(http.MethodDelete, DeadLettersPath, s.adminOnly(http.HandlerFunc(s.clearDeadLetters)))
+	s.adminRoute(http.MethodGet, BackupPath, s.adminOnly(http.HandlerFunc(s.getBackup)))
+	s.adminRoute(http.MethodPost, RestorePath, s.adminOnly(http.HandlerFunc(s.postRestore)))
+	s.adminRoute(http.MethodGet, ExportPath, s.adminOnly(http.HandlerFunc(s.getExport)))
+	s.adminRoute(http.MethodPost, ImportPath, s.adminOnly(http.HandlerFunc(s.postImport)))
+	s.adminRoute(http.MethodPost, ShutdownPath, s.adminOnly(http.HandlerFunc(s.doShutdown)))
+	s.adminRoute(http.MethodDelete, ShutdownPath, s.adminOnly(http.HandlerFunc(s.doShutdown)))
+	if s.adminRouter != nil {
+		s.routeProfiling()
+	}
+	if len(cfg.RaftBind) > 0 {
+		s.route(http.MethodGet, RaftPath, http.HandlerFunc(s.getRaft))
+		s.route(http.MethodPost, RaftJoinPath, http.HandlerFunc(s.doRaftJoin))
+	}
+	s.buildHandlers()
+	return s, nil
+}
+
+/* method Handler()
+Return the handler serving the API, for mounting in another HTTP server.
+Warm-up starts the first time this is called.
+*/
+func (s *Server) Handler() http.Handler {
+	s.warmUpOnce.Do(func() {
+		// Serve health checks while warming up, readiness flips when it's done
+		go s.warmUp()
+	})
+	return s.handler
+}
+
+/* method Start()
+Run the start hooks, listen on the configured port, join the cluster and
+service discovery if configured, and serve requests until the server is
+shut down.  Returns nil
+once it has shut down cleanly, what went wrong stopping it otherwise, or at
+once why it couldn't start or serve, after stopping what it had started.
+*/
+func (s *Server) Start() error {
+	s.runHooks(&s.startHooks)
+	cfg := s.config
+	addr := cfg.ListenAddr
+	if len(addr) == 0 {
+		addr = ":" + strconv.Itoa(cfg.Port)
+	}
+	s.httpServer = http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+	}
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	s.boundAddr, _ = ln.Addr().(*net.TCPAddr)
+	if s.adminHandler != nil {
+		if err := s.startAdmin(); err != nil {
+			ln.Close()
+			return fmt.Errorf("starting admin listener: %w", err)
+		}
+	}
+	if err := s.startBackground(); err != nil {
+		ln.Close()
+		s.adminServer.Close()
+		return err
+	}
+	if len(cfg.HeartbeatURL) > 0 {
+		go s.sendHeartbeats()
+	}
+	s.httpServer.Handler = s.Handler()
+	if s.tlsCert != nil {
+		s.httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*s.tlsCert}}
+		ln = tls.NewListener(ln, s.httpServer.TLSConfig)
+	}
+	if err := s.httpServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		s.stopBackground()
+		s.adminServer.Close()
+		return err
+	}
+	// Serving ends as the shutdown begins, let it close the store and log
+	<-s.stopped
+	return s.stopErr
+}
+
+/* method listenPort()
+Return the port the listener is bound to, the configured one before Start
+listens
+*/
+func (s *Server) listenPort() int {
+	if s.boundAddr != nil {
+		return s.boundAddr.Port
+	}
+	return s.config.Port
+}
+
+/* method startBackground()
+Join the cluster and raft, register with Consul and start the maintenance
+loop, stopping what was already started if a step fails
+*/
+func (s *Server) startBackground() error {
+	cfg := s.config
+	if len(cfg.ClusterBind) > 0 {
+		if err := s.startCluster(); err != nil {
+			return fmt.Errorf("starting cluster: %w", err)
+		}
+	}
+	if len(cfg.RaftBind) > 0 {
+		if err := s.startRaft(); err != nil {
+			s.leaveCluster()
+			return fmt.Errorf("starting raft: %w", err)
+		}
+	}
+	if len(cfg.ConsulAddr) > 0 {
+		s.registerConsul()
+	}
+	s.startMaintenance()
+	return nil
+}
+
+/* method stopBackground()
+Undo startBackground when the server fails to serve
+*/
+func (s *Server) stopBackground() {
+	s.endMaintenance()
+	s.deregisterConsul()
+	s.stopRaft()
+	s.leaveCluster()
+}
+
+/* method Shutdown()
+Stop accepting requests, wait for pending jobs to complete and stop the
+HTTP server, as the shutdown endpoint does.  Once `ctx` ends the jobs still
+pending are abandoned and requests still being served cut off.  Returns
+why jobs were abandoned and what went wrong stopping the server.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	drainErr := s.drain(ctx)
+	if drainErr != nil {
+		drainErr = fmt.Errorf("waiting for pending jobs: %w", drainErr)
+	}
+	return errors.Join(drainErr, s.stop(ctx))
+}
+
 /*
-	method HandleRequests()
-	Server's only export.  This sets up the handlers and deploys a listening server.
-*/
-func StartServer(port int) {
-	http.HandleFunc(HashPath, doHash)
-	http.HandleFunc(HashPath+"/", doHash)
-	http.HandleFunc(StatsPath, getStats)
-	http.HandleFunc(ShutdownPath, doShutdown)
-	httpServer = http.Server{Addr: ":" + strconv.Itoa(port)}
-	log.Fatal(httpServer.ListenAndServe())
+	method StartServer()
+	Create a server with `cfg` and run it.  This sets up the handlers and deploys a listening server.
+	Returns what NewServer or Start does.
+*/
+func StartServer(cfg Config, opts ...Option) error {
+	s, err := NewServer(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	return s.Start()
 }
@@ -0,0 +1,66 @@
+/*********************************************************
+File: settings.go
+Contents: Reporting of the effective configuration and where it came from
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const (
+	// Sources a setting can be resolved from
+	SourceDefault = "default"
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+
+	// Shown in place of secret values
+	redactedValue = "[redacted]"
+)
+
+// A single resolved setting
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	// Secret values such as tokens are never reported
+	Secret bool `json:"-"`
+}
+
+/* method ReportedSettings()
+Return the settings in `cfg` as they may be shown to an operator, with
+secrets redacted
+*/
+func ReportedSettings(cfg Config) []Setting {
+	settings := make([]Setting, 0, len(cfg.Settings))
+	for _, s := range cfg.Settings {
+		if s.Secret && len(s.Value) > 0 {
+			s.Value = redactedValue
+		}
+		settings = append(settings, s)
+	}
+	return settings
+}
+
+/*
+	method getConfig()
+	Return a JSON list of the settings this instance is running with,
+	with secrets redacted
+*/
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	// If we're shutting down we will not accept requests
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	jtext, _ := json.Marshal(ReportedSettings(s.config))
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning configuration: %v", err)
+	}
+}
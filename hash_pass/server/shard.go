@@ -0,0 +1,170 @@
+/*********************************************************
+File: shard.go
+Contents: Random, optionally node-prefixed, task Ids and forwarding to the owning node
+*********************************************************/
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Separates the node name from the random part of a sharded Id
+	shardSeparator = "-"
+	// Length of a UUID in its canonical form
+	uuidLen = 36
+	// Set on requests we forward so the receiving node never forwards them again
+	forwardedHeader = "X-Hash-Pass-Forwarded"
+)
+
+/* method newTaskID()
+Return a random version 4 UUID to identify a new job.  Ids used to be the
+request number, which let anyone fetch other clients' results by counting.
+*/
+func newTaskID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+/* method isUUID()
+Report whether `id` is a UUID in its canonical form
+*/
+func isUUID(id string) bool {
+	if len(id) != uuidLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !('0' <= c && c <= '9' || 'a' <= c && c <= 'f'):
+			return false
+		}
+	}
+	return true
+}
+
+/* method shardID()
+Build the public Id for a job from its random `token`.  Only the node that
+processed a request holds its result, so the Id records which node that is.
+*/
+func (s *Server) shardID(token string) string {
+	if !s.config.Sharded && !s.config.Distributed {
+		return token
+	}
+	return s.nodeName() + shardSeparator + token
+}
+
+/* method idSequence()
+Return the request number of an Id issued before Ids were random, a bare
+number or one prefixed with a node name
+*/
+func idSequence(id string) (int64, bool) {
+	if len(id) >= uuidLen && isUUID(id[len(id)-uuidLen:]) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(id[strings.LastIndex(id, shardSeparator)+1:], 10, 64)
+	return n, err == nil
+}
+
+/* method shardOwner()
+Return the name of the node that owns `id`.  Node names and UUIDs may both
+contain the separator, so split just before the UUID, or at the last
+separator of an older numbered Id.
+*/
+func shardOwner(id string) (string, bool) {
+	if isUUID(id) {
+		return "", false
+	}
+	if n := len(id) - uuidLen - len(shardSeparator); n > 0 && isUUID(id[n+len(shardSeparator):]) {
+		return id[:n], id[n:n+len(shardSeparator)] == shardSeparator
+	}
+	i := strings.LastIndex(id, shardSeparator)
+	if i <= 0 {
+		return "", false
+	}
+	return id[:i], true
+}
+
+/* method proxyRequest()
+Hand the request over to the node whose API lives at `addr`, signed so it
+knows the request comes from a cluster member
+*/
+func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, addr string) {
+	target, err := url.Parse(addr)
+	if len(addr) == 0 || err != nil {
+		renderError(w, r, http.StatusServiceUnavailable, ErrNodeUnavailable)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeerBody))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Set(forwardedHeader, s.nodeName())
+	// The other node echoes the request Id it was sent, don't send it twice
+	w.Header().Del(RequestIDHeader)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if s.peerTransport != nil {
+		proxy.Transport = s.peerTransport
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		s.signPeerRequest(req, body)
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+/* method forwardToOwner()
+If `id` belongs to another node, proxy the request there and return true.
+Requests that were already forwarded are always answered locally.  In
+distributed mode the owner is found on the hash ring, but a result that
+has not been handed off yet is still served from here.
+*/
+func (s *Server) forwardToOwner(w http.ResponseWriter, r *http.Request, id string) bool {
+	if len(r.Header.Get(forwardedHeader)) > 0 {
+		return false
+	}
+	if s.config.Distributed {
+		s.mtxMap.Lock()
+		_, local := s.getResult(id)
+		s.mtxMap.Unlock()
+		owner, addr := s.ringOwner(id)
+		if local || len(owner) == 0 || owner == s.nodeName() {
+			return false
+		}
+		s.proxyRequest(w, r, addr)
+		return true
+	}
+	if !s.config.Sharded {
+		return false
+	}
+	owner, ok := shardOwner(id)
+	if !ok || owner == s.nodeName() {
+		return false
+	}
+	for _, p := range s.clusterPeers() {
+		if p.Name == owner {
+			s.proxyRequest(w, r, p.Addr)
+			return true
+		}
+	}
+	renderError(w, r, http.StatusServiceUnavailable, ErrNodeUnavailable)
+	return true
+}
@@ -0,0 +1,133 @@
+/*********************************************************
+File: slo.go
+Contents: Service level objective tracking and error-budget burn rates
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Burn rates for a single alerting window
+type SLOWindow struct {
+	Window    string  `json:"window"`
+	Total     int64   `json:"total"`
+	Bad       int64   `json:"bad"`
+	ErrorRate float64 `json:"error_rate"`
+	BurnRate  float64 `json:"burn_rate"`
+}
+
+// Payload returned by the SLO endpoint
+type SLOStatus struct {
+	Objective float64     `json:"objective"`
+	Latency   int64       `json:"latency"`
+	Windows   []SLOWindow `json:"windows"`
+}
+
+// One minute's worth of SLO events
+type sloBucket struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+const (
+	// Oldest window we report on is 3 days, keep one bucket per minute for it
+	sloBuckets = 3 * 24 * 60
+)
+
+var (
+	// Windows reported by the SLO endpoint.  These pair up for the usual
+	// multi-window burn-rate alerts (5m/1h, 30m/6h, 2h/1d, 6h/3d)
+	sloWindows = []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"5m", 5 * time.Minute},
+		{"30m", 30 * time.Minute},
+		{"1h", time.Hour},
+		{"2h", 2 * time.Hour},
+		{"6h", 6 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"3d", 72 * time.Hour},
+	}
+)
+
+/* method recordSLO()
+- Classify a POST as good or bad against the configured objective
+- Add it to the bucket for the current minute
+*/
+func (s *Server) recordSLO(latency time.Duration, ok bool) {
+	minute := s.clock.Now().Unix() / 60
+	bad := !ok || latency > s.config.SLOLatency
+
+	s.mtxSLO.Lock()
+	b := &s.sloRing[minute%sloBuckets]
+	if b.minute != minute {
+		// Bucket holds data from a previous lap of the ring, start over
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+	s.mtxSLO.Unlock()
+}
+
+/* method sloWindow()
+Sum up the buckets covering `d` and compute the error and burn rates
+*/
+func (s *Server) sloWindow(name string, d time.Duration, now int64) SLOWindow {
+	w := SLOWindow{Window: name}
+	minutes := int64(d / time.Minute)
+	for m := now - minutes + 1; m <= now; m++ {
+		b := s.sloRing[m%sloBuckets]
+		if b.minute == m {
+			w.Total += b.total
+			w.Bad += b.bad
+		}
+	}
+	if w.Total != 0 {
+		w.ErrorRate = float64(w.Bad) / float64(w.Total)
+		// Burn rate of 1 means the error budget is consumed exactly over the SLO period
+		if budget := 1 - s.config.SLOObjective; budget > 0 {
+			w.BurnRate = w.ErrorRate / budget
+		}
+	}
+	return w
+}
+
+/*
+	method getSLO()
+	Return a JSON object with the burn rate for each alerting window
+*/
+func (s *Server) getSLO(w http.ResponseWriter, r *http.Request) {
+	// If we're shutting down we will not accept requests
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	status := SLOStatus{
+		Objective: s.config.SLOObjective,
+		Latency:   s.config.SLOLatency.Microseconds(),
+	}
+
+	now := s.clock.Now().Unix() / 60
+	s.mtxSLO.Lock()
+	for _, win := range sloWindows {
+		status.Windows = append(status.Windows, s.sloWindow(win.name, win.duration, now))
+	}
+	s.mtxSLO.Unlock()
+
+	// Serialize and return the status
+	jtext, _ := json.Marshal(status)
+	_, err := w.Write(jtext)
+	if err != nil {
+		log.Printf("Error returning SLO status: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+/*********************************************************
+File: snapshot.go
+Contents: Periodic snapshots of results and counters, loaded on start
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Time between snapshots unless another is configured
+	DefaultSnapshotInterval = time.Minute
+
+	// Format of the snapshots written by this version
+	snapshotVersion = 1
+)
+
+// Statistics carried across restarts in a snapshot
+type snapshotCounters struct {
+	RequestID  int64            `json:"request_id"`
+	Posts      int64            `json:"posts"`
+	Timeouts   int64            `json:"timeouts"`
+	Elapsed    int64            `json:"elapsed"`
+	SumSquares float64          `json:"sum_squares"`
+	MinTime    int64            `json:"min_time"`
+	MaxTime    int64            `json:"max_time"`
+	Latency    []int64          `json:"latency"`
+	Outcomes   map[string]int64 `json:"outcomes,omitempty"`
+	Evictions  int64            `json:"evictions"`
+	// POSTs refused because the queue was full
+	QueueRejections int64 `json:"queue_rejections,omitempty"`
+}
+
+// Contents of a snapshot file
+type snapshotState struct {
+	Version  int                     `json:"version"`
+	Taken    time.Time               `json:"taken"`
+	Counters snapshotCounters        `json:"counters"`
+	Results  map[string]StoredResult `json:"results"`
+	Pending  map[string]pendingJob   `json:"pending,omitempty"`
+	Holds    map[string]bool         `json:"holds,omitempty"`
+	// Jobs that failed or were abandoned by a shutdown, oldest first
+	DeadLetters []DeadLetter `json:"dead_letters,omitempty"`
+}
+
+/* method writeFileAtomic()
+Write a file with `write`, beside `path` and then renamed over it, so a
+crash leaves either the old file or the complete new one
+*/
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err = write(bw); err == nil {
+		if err = bw.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+/* method snapshotInterval()
+Return the time between snapshots
+*/
+func (s *Server) snapshotInterval() time.Duration {
+	if s.config.SnapshotInterval > 0 {
+		return s.config.SnapshotInterval
+	}
+	return DefaultSnapshotInterval
+}
+
+/* method takeSnapshot()
+Write the results, pending jobs, legal holds, dead letters and counters to
+the configured snapshot file
+*/
+func (s *Server) takeSnapshot(now time.Time) {
+	state := snapshotState{
+		Version: snapshotVersion,
+		Taken:   now.UTC(),
+		Pending: make(map[string]pendingJob),
+	}
+	s.mtxId.Lock()
+	state.Counters = snapshotCounters{
+		RequestID:  s.requestID,
+		Posts:      s.postCount,
+		Timeouts:   s.timeoutCount,
+		Elapsed:    s.elapsedTime,
+		SumSquares: s.sumSquares,
+		MinTime:    s.minTime,
+		MaxTime:    s.maxTime,
+		Latency:    append([]int64(nil), s.latencyCounts...),
+		Outcomes:   make(map[string]int64),
+	}
+	for o, n := range s.outcomeCounts {
+		state.Counters.Outcomes[o] = n
+	}
+	state.Counters.QueueRejections = s.queueRejections
+	s.mtxId.Unlock()
+
+	s.mtxMap.Lock()
+	state.Counters.Evictions = s.evictionCount
+	state.Results = s.allResults()
+	for id, result := range state.Results {
+		state.Results[id] = s.sealer.sealResult(result)
+	}
+	for k, v := range s.pendingJobs {
+		state.Pending[k] = v
+	}
+	state.Holds = s.lockedHolds()
+	if s.deadLetterStore == nil {
+		// Otherwise the store keeps them
+		state.DeadLetters = append(state.DeadLetters, s.deadLetters...)
+	}
+	s.mtxMap.Unlock()
+
+	err := writeFileAtomic(s.config.SnapshotPath, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(state)
+	})
+	if err != nil {
+		log.Printf("Error writing snapshot %s: %v", s.config.SnapshotPath, err)
+	}
+}
+
+/* method loadSnapshot()
+Restore the state in the configured snapshot file, if there is one yet.
+Results go back in the store, pending jobs are rescheduled and counters
+carry on from where they were.
+*/
+func (s *Server) loadSnapshot() error {
+	data, err := os.ReadFile(s.config.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version > snapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than this build supports", state.Version)
+	}
+
+	c := state.Counters
+	s.mtxId.Lock()
+	s.requestID = max(s.requestID, c.RequestID)
+	s.postCount += c.Posts
+	s.timeoutCount += c.Timeouts
+	s.queueRejections += c.QueueRejections
+	s.elapsedTime += c.Elapsed
+	s.sumSquares += c.SumSquares
+	if c.Posts > 0 {
+		s.minTime, s.maxTime = c.MinTime, c.MaxTime
+	}
+	if len(c.Latency) == len(s.latencyCounts) {
+		for i, n := range c.Latency {
+			s.latencyCounts[i] += n
+		}
+	}
+	for o, n := range c.Outcomes {
+		s.outcomeCounts[o] += n
+	}
+	s.mtxId.Unlock()
+
+	s.mtxMap.Lock()
+	s.evictionCount += c.Evictions
+	for id, result := range state.Results {
+		result, err := s.sealer.openResult(result)
+		if err != nil {
+			s.mtxMap.Unlock()
+			return fmt.Errorf("result %s: %w", id, err)
+		}
+		if err := s.store.Put(id, result); err != nil {
+			s.mtxMap.Unlock()
+			return err
+		}
+		s.lockedTouch(id)
+	}
+	for k, v := range state.Holds {
+		if err := s.lockedPutHold(k, v); err != nil {
+			s.mtxMap.Unlock()
+			return err
+		}
+	}
+	s.deadLetters = append(state.DeadLetters, s.deadLetters...)
+	if len(s.deadLetters) > maxDeadLetters {
+		s.deadLetters = s.deadLetters[len(s.deadLetters)-maxDeadLetters:]
+	}
+	s.lockedEvict()
+	for id, job := range state.Pending {
+		s.pendingJobs[id] = job
+	}
+	s.mtxMap.Unlock()
+	for id, job := range state.Pending {
+		s.schedulePending(id, job)
+	}
+	log.Printf("Loaded %d results and %d pending jobs from snapshot %s taken %s", len(state.Results), len(state.Pending), s.config.SnapshotPath, state.Taken.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,142 @@
+/*********************************************************
+File: stats.go
+Contents: Time units and outcome counts for the reported statistics
+*********************************************************/
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// Time units the statistics can be reported in
+	UnitNanoseconds  = "ns"
+	UnitMicroseconds = "us"
+	UnitMilliseconds = "ms"
+
+	// How a POST request or the job it submitted ended
+	OutcomeAccepted     = "accepted"
+	OutcomeInvalid      = "invalid"
+	OutcomeThrottled    = "throttled"
+	OutcomeUnavailable  = "unavailable"
+	OutcomeCompleted    = "completed"
+	OutcomeTimedOut     = "timed_out"
+	OutcomeAbandoned    = "abandoned"
+	OutcomeCancelled    = "cancelled"
+	OutcomeFailed       = "failed"
+	OutcomeDeduplicated = "deduplicated"
+)
+
+/* method unitScale()
+Return the length of `unit`, false if it isn't one we report in
+*/
+func unitScale(unit string) (time.Duration, bool) {
+	switch unit {
+	case UnitNanoseconds:
+		return time.Nanosecond, true
+	case UnitMicroseconds, "µs":
+		return time.Microsecond, true
+	case UnitMilliseconds:
+		return time.Millisecond, true
+	}
+	return 0, false
+}
+
+/* method inUnit()
+Return a copy of the statistics with every time but the uptime, which is
+in seconds, converted to `unit`, which must be valid.  Statistics from nodes that predate units are in
+microseconds.
+*/
+func (s RequestStat) inUnit(unit string) RequestStat {
+	if unit == "µs" {
+		unit = UnitMicroseconds
+	}
+	from, ok := unitScale(s.Unit)
+	if !ok {
+		from = time.Microsecond
+	}
+	to, _ := unitScale(unit)
+	// Scale up before dividing so e.g. 50us comes out as exactly 0.05ms
+	convert := func(v float64) float64 {
+		return v * float64(from) / float64(to)
+	}
+
+	s.Unit = unit
+	s.Average = convert(s.Average)
+	s.Min = convert(s.Min)
+	s.Max = convert(s.Max)
+	s.StdDev = convert(s.StdDev)
+	bounds := make([]float64, len(s.Latency.Bounds))
+	for i, b := range s.Latency.Bounds {
+		bounds[i] = convert(b)
+	}
+	s.Latency.Bounds = bounds
+	if s.Workers != nil {
+		workers := *s.Workers
+		workers.QueueWait = convert(workers.QueueWait)
+		workers.Priorities = make(map[string]PriorityStat, len(s.Workers.Priorities))
+		for name, ps := range s.Workers.Priorities {
+			ps.QueueWait = convert(ps.QueueWait)
+			workers.Priorities[name] = ps
+		}
+		s.Workers = &workers
+	}
+	return s
+}
+
+/* method recordPost()
+Add an accepted POST that took `elapsed` to the processing time statistics.
+The caller must hold mtxId.
+*/
+func (s *Server) recordPost(elapsed time.Duration) {
+	ns := elapsed.Nanoseconds()
+	if s.postCount == 0 || ns < s.minTime {
+		s.minTime = ns
+	}
+	if ns > s.maxTime {
+		s.maxTime = ns
+	}
+	s.postCount++
+	s.elapsedTime += ns
+	s.sumSquares += float64(ns) * float64(ns)
+	s.latencyCounts[latencyBucket(elapsed.Microseconds())]++
+	s.outcomeCounts[OutcomeAccepted]++
+}
+
+/* method stdDev()
+Population standard deviation from a count, sum and sum of squares
+*/
+func stdDev(n int64, sum float64, squares float64) float64 {
+	if n == 0 {
+		return 0
+	}
+	mean := sum / float64(n)
+	return math.Sqrt(math.Max(0, squares/float64(n)-mean*mean))
+}
+
+/* method countOutcome()
+Count a POST or job that ended with `outcome`
+*/
+func (s *Server) countOutcome(outcome string) {
+	s.mtxId.Lock()
+	s.outcomeCounts[outcome]++
+	s.mtxId.Unlock()
+}
+
+/* method rejectPost()
+Count a POST that couldn't be accepted by its status and send the error
+*/
+func (s *Server) rejectPost(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	switch status {
+	case http.StatusTooManyRequests:
+		s.countOutcome(OutcomeThrottled)
+	case http.StatusServiceUnavailable:
+		s.countOutcome(OutcomeUnavailable)
+	default:
+		s.countOutcome(OutcomeInvalid)
+	}
+	renderError(w, r, status, msg)
+}
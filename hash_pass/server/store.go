@@ -0,0 +1,344 @@
+/*********************************************************
+File: store.go
+Contents: Storage of completed results, in memory unless a Store is given
+*********************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// File in Config.DataDir holding the results
+	dataFile = "results.db"
+)
+
+// Keeps completed results by task Id.  Implementations must be safe for
+// concurrent use; the server serializes the changes it makes itself, so a
+// Store needn't make sequences of calls atomic.
+type Store interface {
+	// Store `result` as `id`, replacing any result already stored there
+	Put(id string, result StoredResult) error
+	// Return the result stored as `id`, false if there is none
+	Get(id string) (StoredResult, bool, error)
+	// Remove the result stored as `id`, if any
+	Delete(id string) error
+	// Call `fn` with every result in no particular order until it returns
+	// false.  `fn` must not call back into the Store.
+	List(fn func(id string, result StoredResult) bool) error
+	// Return the number of results stored
+	Count() (int, error)
+}
+
+// Implemented by stores that also keep the request counter, so the count
+// carries on after a restart
+type CounterStore interface {
+	Store
+	// Record that `n` requests have been counted
+	SaveCounter(n int64) error
+	// Return the requests counted, 0 for none
+	LoadCounter() (int64, error)
+}
+
+// Implemented by stores shared between instances that keep one request
+// counter for all of them
+type SequenceStore interface {
+	Store
+	// Count a request and return the new count
+	NextID() (int64, error)
+}
+
+// Implemented by stores shared between instances that also share the
+// state of jobs still pending, so any instance can report a job accepted by
+// another before its result is stored
+type JobStateStore interface {
+	Store
+	// Record the state of job `id`, forgetting it after `ttl` in case the
+	// instance running it stops before it completes
+	PutJobState(id string, state JobState, ttl time.Duration) error
+	// Return the state of job `id`, false if none is recorded
+	GetJobState(id string) (JobState, bool, error)
+	// Forget the state of job `id`, once it has a result or is dropped
+	DeleteJobState(id string) error
+}
+
+// Implemented by stores that keep the dead-letter list, so the jobs and
+// callbacks that failed, those a shutdown abandoned included, survive a
+// restart
+type DeadLetterStore interface {
+	Store
+	// Add `d` to the end of the list, dropping the oldest beyond `keep`
+	PutDeadLetter(d DeadLetter, keep int) error
+	// Return the list, oldest first
+	ListDeadLetters() ([]DeadLetter, error)
+	// Empty the list
+	ClearDeadLetters() error
+}
+
+// Implemented by stores that keep deleted results through their recovery
+// window and the legal holds, so neither is lost in a restart and every
+// instance sharing the store sees the same ones
+type RetentionStore interface {
+	Store
+	// Keep `result`, deleted at `at` in Unix nanoseconds, as deleted
+	// result `id`
+	PutDeleted(id string, result StoredResult, at int64) error
+	// Return deleted result `id` and when it was deleted, false if there
+	// is none
+	GetDeleted(id string) (StoredResult, int64, bool, error)
+	// Forget deleted result `id`, once it is restored or purged
+	ForgetDeleted(id string) error
+	// Call `fn` with every deleted result until it returns false
+	ListDeleted(fn func(id string, result StoredResult, at int64) bool) error
+	// Place or lift the legal hold on `id`.  A held result must not
+	// expire in a store that expires results itself.
+	SetHold(id string, held bool) error
+	// Report whether `id` is held
+	Held(id string) (bool, error)
+	// Return the Ids held
+	ListHolds() ([]string, error)
+}
+
+/* method unwrapStore()
+Return the store `st` wraps, such as the one an encrypting store encrypts
+for, so the extensions it implements for data other than results can be
+found.  Returns `st` itself when it wraps none.
+*/
+func unwrapStore(st Store) Store {
+	for {
+		u, ok := st.(interface{ Unwrap() Store })
+		if !ok {
+			return st
+		}
+		st = u.Unwrap()
+	}
+}
+
+// A completed job's result, as kept by a Store
+type StoredResult struct {
+	Hash string `json:"hash"`
+	// Algorithm that produced a sha512 format Hash, or the format itself
+	// for formats with an algorithm of their own
+	Algorithm string `json:"algorithm,omitempty"`
+	// Base64 salt mixed into a sha512 format Hash, the other formats carry
+	// their salt in the hash
+	Salt string `json:"salt,omitempty"`
+	// Id of the pepper mixed into a sha512 format Hash, "" for none
+	PepperID string `json:"pepper_id,omitempty"`
+	// Submission, start of hashing and completion times in Unix
+	// nanoseconds, 0 for results from nodes that predate recording them
+	Submitted int64 `json:"submitted,omitempty"`
+	Started   int64 `json:"started,omitempty"`
+	Completed int64 `json:"completed,omitempty"`
+	// Processing delay the job waited out in nanoseconds, jitter included
+	Delay int64 `json:"delay,omitempty"`
+}
+
+/* method UnmarshalJSON()
+Also accept a bare hash, as snapshots and handoffs from nodes that predate
+recording the algorithm hold them
+*/
+func (r *StoredResult) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*r = StoredResult{}
+		return json.Unmarshal(data, &r.Hash)
+	}
+	type plain StoredResult
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// The default Store, holding results in a map
+type MemoryStore struct {
+	results map[string]StoredResult
+	mtx     sync.RWMutex
+}
+
+/* method NewMemoryStore()
+Create an empty in-memory store with room for `size` results up front
+*/
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{results: make(map[string]StoredResult, size)}
+}
+
+func (m *MemoryStore) Put(id string, result StoredResult) error {
+	m.mtx.Lock()
+	m.results[id] = result
+	m.mtx.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) Get(id string) (StoredResult, bool, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	result, ok := m.results[id]
+	return result, ok, nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mtx.Lock()
+	delete(m.results, id)
+	m.mtx.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) List(fn func(id string, result StoredResult) bool) error {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for id, result := range m.results {
+		if !fn(id, result) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Count() (int, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return len(m.results), nil
+}
+
+/* method getResult()
+Return result `id` from the store, logging a store failure and treating
+it as no result
+*/
+func (s *Server) getResult(id string) (StoredResult, bool) {
+	result, ok, err := s.store.Get(id)
+	if err != nil {
+		log.Printf("Error reading result %s from store: %v", id, err)
+		return StoredResult{}, false
+	}
+	return result, ok
+}
+
+/* method allResults()
+Return every stored result by Id, logging a store failure and returning
+what was read before it
+*/
+func (s *Server) allResults() map[string]StoredResult {
+	results := make(map[string]StoredResult)
+	err := s.store.List(func(id string, result StoredResult) bool {
+		results[id] = result
+		return true
+	})
+	if err != nil {
+		log.Printf("Error listing results in store: %v", err)
+	}
+	return results
+}
+
+/* method countResults()
+Return the number of stored results, 0 if the store fails
+*/
+func (s *Server) countResults() int {
+	n, err := s.store.Count()
+	if err != nil {
+		log.Printf("Error counting results in store: %v", err)
+	}
+	return n
+}
+
+/* method openDataDir()
+Keep results in a bbolt store in the configured data directory, creating
+the directory if need be
+*/
+func (s *Server) openDataDir() error {
+	if err := os.MkdirAll(s.config.DataDir, 0700); err != nil {
+		return err
+	}
+	st, err := OpenBoltStore(filepath.Join(s.config.DataDir, dataFile))
+	if err != nil {
+		return err
+	}
+	s.store = st
+	log.Printf("Keeping results in %s", filepath.Join(s.config.DataDir, dataFile))
+	return nil
+}
+
+/* method openRedis()
+Keep results in the configured Redis server, shared with other instances
+*/
+func (s *Server) openRedis() error {
+	prefix := s.config.RedisPrefix
+	if len(prefix) == 0 {
+		prefix = DefaultRedisPrefix
+	}
+	st, err := OpenRedisStore(s.config.RedisURL, prefix, s.config.RedisTTL)
+	if err != nil {
+		return err
+	}
+	s.store = st
+	log.Printf("Keeping results in Redis at %s under %q", st.addr, st.prefix)
+	return nil
+}
+
+/* method openPostgres()
+Keep results in the configured PostgreSQL database, shared with other
+instances
+*/
+func (s *Server) openPostgres() error {
+	driver, maxConns := s.config.PostgresDriver, s.config.PostgresMaxConns
+	if len(driver) == 0 {
+		driver = DefaultPostgresDriver
+	}
+	if maxConns <= 0 {
+		maxConns = DefaultPostgresMaxConns
+	}
+	st, err := OpenPostgresStore(driver, s.config.PostgresDSN, maxConns)
+	if err != nil {
+		return err
+	}
+	s.store = st
+	log.Printf("Keeping results in PostgreSQL with up to %d connections", maxConns)
+	return nil
+}
+
+/* method loadCounter()
+Carry on from the request counter a CounterStore kept
+*/
+func (s *Server) loadCounter() error {
+	cs, ok := s.store.(CounterStore)
+	if !ok {
+		return nil
+	}
+	n, err := cs.LoadCounter()
+	if err != nil {
+		return err
+	}
+	s.mtxId.Lock()
+	s.requestID = max(s.requestID, n)
+	s.mtxId.Unlock()
+	return nil
+}
+
+/* method countRequest()
+Count a request on the request counter, the store's if it is shared and
+otherwise the local one, saved if the store keeps it.  Task Ids are random,
+so the counter only feeds the statistics.
+*/
+func (s *Server) countRequest() error {
+	if ss, ok := s.store.(SequenceStore); ok {
+		n, err := ss.NextID()
+		if err != nil {
+			return err
+		}
+		s.mtxId.Lock()
+		s.requestID = max(s.requestID, n)
+		s.mtxId.Unlock()
+		return nil
+	}
+	s.mtxId.Lock()
+	s.requestID++
+	n := s.requestID
+	s.mtxId.Unlock()
+	if cs, ok := s.store.(CounterStore); ok {
+		return cs.SaveCounter(n)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*********************************************************
+File: ttl.go
+Contents: Expiry of results once they have been kept for the result TTL
+*********************************************************/
+
+package server
+
+import (
+	"log"
+	"time"
+)
+
+/* method reapInterval()
+Time between sweeps for expired results, a tenth of the TTL between 1s
+and 1m, so results outlive it by no more than that
+*/
+func (s *Server) reapInterval() time.Duration {
+	return min(max(s.config.ResultTTL/10, time.Second), time.Minute)
+}
+
+/* method lockedExpire()
+Remove `result`, stored as `id`, if it completed more than the TTL before
+`now` and isn't under legal hold, leaving a tombstone so fetching it gets
+Gone rather than Not Found.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedExpire(id string, result StoredResult, now time.Time) bool {
+	if s.config.ResultTTL <= 0 || result.Completed == 0 || s.onHold(id) {
+		return false
+	}
+	if now.Before(time.Unix(0, result.Completed).Add(s.config.ResultTTL)) {
+		return false
+	}
+	s.lockedDeleteResult(id)
+	s.expiredResults[id] = now.UnixNano()
+	return true
+}
+
+/* method resultExpired()
+Report whether result `id` has expired, expiring it now if the reaper
+hasn't got to it yet
+*/
+func (s *Server) resultExpired(id string) bool {
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	if result, ok := s.getResult(id); ok {
+		return s.lockedExpire(id, result, s.clock.Now())
+	}
+	_, ok := s.expiredResults[id]
+	return ok
+}
+
+/* method expireResults()
+Sweep out expired results.  The store is scanned without holding mtxMap,
+so requests aren't held up behind the scan, and only the results found due
+are read again and expired under it.  Tombstones are kept for one more TTL,
+after which an expired Id is simply unknown.  Results from nodes that
+predate completion times start their TTL when first swept.
+*/
+func (s *Server) expireResults(now time.Time) {
+	var due []string
+	err := s.store.List(func(id string, result StoredResult) bool {
+		if result.Completed == 0 || !now.Before(time.Unix(0, result.Completed).Add(s.config.ResultTTL)) {
+			due = append(due, id)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Error listing results in store: %v", err)
+	}
+
+	expired := 0
+	s.mtxMap.Lock()
+	for _, id := range due {
+		// Deleted, replaced or expired on a fetch since the scan
+		result, ok := s.getResult(id)
+		if !ok {
+			continue
+		}
+		if result.Completed == 0 {
+			result.Completed = now.UnixNano()
+			if err := s.store.Put(id, result); err != nil {
+				log.Printf("Error starting the TTL of result %s: %v", id, err)
+			}
+		} else if s.lockedExpire(id, result, now) {
+			expired++
+		}
+	}
+	for id, at := range s.expiredResults {
+		if now.Sub(time.Unix(0, at)) > s.config.ResultTTL {
+			delete(s.expiredResults, id)
+		}
+	}
+	s.mtxMap.Unlock()
+	if expired > 0 {
+		log.Printf("Expired %d results older than %v", expired, s.config.ResultTTL)
+	}
+}
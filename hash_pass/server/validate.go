@@ -0,0 +1,66 @@
+/*********************************************************
+File: validate.go
+Contents: Checking a configuration reaches its backends
+*********************************************************/
+
+package server
+
+import (
+	"fmt"
+	"log"
+)
+
+// Key the archive is probed with, never written
+const archiveProbeKey = ".hash_pass-validate"
+
+/* method CheckBackends()
+Load what the configuration and options name, the TLS certificates, pepper
+and encryption keys, then open and close again the store NewServer would
+use, the data directory, Redis or PostgreSQL, and read from the archive
+bucket, so a configuration can be checked before it is deployed.  Returns
+a problem for each one that fails.
+*/
+func CheckBackends(cfg Config, opts ...Option) []string {
+	s := &Server{config: cfg}
+	for _, opt := range opts {
+		opt(s)
+	}
+	cfg = s.config
+
+	var problems []string
+	check := func(what string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Error %s: %v", what, err))
+		}
+	}
+	check("loading TLS certificates", s.loadTLS())
+	if s.pepperSource != nil {
+		check("loading pepper", s.loadPepper())
+	}
+	if s.keySource != nil {
+		check("loading encryption keys", s.loadKeys())
+	}
+	switch {
+	case s.store != nil:
+	case len(cfg.DataDir) > 0:
+		check("opening data directory", s.openDataDir())
+	case len(cfg.RedisURL) > 0:
+		check("connecting to Redis", s.openRedis())
+	case len(cfg.PostgresDSN) > 0:
+		check("opening PostgreSQL store", s.openPostgres())
+	}
+	if s.store != nil {
+		check("loading request counter", s.loadCounter())
+	}
+	if len(cfg.ArchiveURL) > 0 {
+		err := s.openArchive()
+		if err == nil {
+			_, _, err = s.archive.get(archiveProbeKey)
+		}
+		check("reading archive", err)
+	}
+	if err := s.closeBackends(); err != nil {
+		log.Printf("Error cleaning up: %v", err)
+	}
+	return problems
+}
@@ -0,0 +1,89 @@
+/*********************************************************
+File: version.go
+Contents: Version and build details identifying a deployed instance
+*********************************************************/
+
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	// Version reported by builds given none
+	devVersion = "dev"
+)
+
+var (
+	// Build details, set with -ldflags, e.g.
+	//   -X hash_pass/server.Version=1.4.0 -X hash_pass/server.Commit=$(git rev-parse HEAD)
+	//   -X hash_pass/server.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+	// Those left unset are read from the build info Go embeds where it has them
+	Version   string
+	Commit    string
+	BuildDate string
+)
+
+// Payload returned by the version endpoint.  BuildDate falls back to the
+// time of the commit built when the binary wasn't given one.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+/* method versionInfo()
+Return the version and build details of this binary
+*/
+func versionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if len(info.Version) == 0 && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		modified := false
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if len(info.Commit) == 0 {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if len(info.BuildDate) == 0 {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		// Built from a working tree with changes on top of the commit
+		if modified && len(Commit) == 0 && len(info.Commit) > 0 {
+			info.Commit += "-dirty"
+		}
+	}
+	if len(info.Version) == 0 {
+		info.Version = devVersion
+	}
+	return info
+}
+
+/*
+	method getVersion()
+	Handle GET request for URL path `/version`, returning a JSON object with
+	the version, commit, build date and Go version of this instance
+*/
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, versionInfo())
+}
@@ -0,0 +1,511 @@
+/*********************************************************
+File: wal.go
+Contents: Write-ahead log of accepted jobs and results, replayed on start
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"hash_pass/hasher"
+)
+
+const (
+	// Records appended between compactions unless another number is
+	// configured
+	DefaultWALCompactRecords = 10000
+
+	// Record operations: a job accepted for the worker pool, a job hashed
+	// when accepted, a result stored, a result removed, a job that ended
+	// without its result being kept, a result kept as deleted, a deleted
+	// result restored or purged, and a legal hold placed or lifted
+	walQueue   = "queue"
+	walAccept  = "accept"
+	walPut     = "put"
+	walDelete  = "delete"
+	walDone    = "done"
+	walDeleted = "deleted"
+	walForget  = "forget"
+	walHold    = "hold"
+)
+
+var errWALPlaintext = errors.New("encryption keys are needed to keep the passwords of pending jobs, unless keeping them in the clear is allowed")
+
+// One line of the log
+type walRecord struct {
+	Op     string        `json:"op"`
+	ID     string        `json:"id"`
+	Task   *walTask      `json:"task,omitempty"`
+	Job    *pendingJob   `json:"job,omitempty"`
+	Result *StoredResult `json:"result,omitempty"`
+	// Deletion time of a deleted result in Unix nanoseconds, and whether a
+	// hold is placed rather than lifted
+	At   int64 `json:"at,omitempty"`
+	Hold bool  `json:"hold,omitempty"`
+}
+
+// A job accepted but not yet hashed, with what a worker needs to hash it.
+// The password and salt are sealed when encryption keys are configured.
+type walTask struct {
+	Password  string `json:"password"`
+	Discard   bool   `json:"discard,omitempty"`
+	Format    string `json:"format,omitempty"`
+	User      string `json:"user,omitempty"`
+	Rounds    int    `json:"rounds,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	// Base64 salt and pepper Id of sha512 format jobs
+	Salt     string `json:"salt,omitempty"`
+	PepperID string `json:"pepper_id,omitempty"`
+	// scrypt parameters the request overrides
+	ScryptN     int    `json:"scrypt_n,omitempty"`
+	ScryptR     int    `json:"scrypt_r,omitempty"`
+	ScryptP     int    `json:"scrypt_p,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	Priority    int    `json:"priority,omitempty"`
+	// Submission and due times in Unix nanoseconds, and the delay picked
+	Submitted int64 `json:"submitted"`
+	Due       int64 `json:"due"`
+	Delay     int64 `json:"delay,omitempty"`
+	// Identifiers of the submitting request
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+// Append-only file of walRecords, one JSON object per line.  Each record is
+// synced to disk before append returns, and the file is compacted every
+// compactAfter records.
+type writeAheadLog struct {
+	file *os.File
+	path string
+	// Records appended since the file was last compacted, and the number
+	// that triggers the next compaction
+	records, compactAfter int
+	mtx                   sync.Mutex
+}
+
+/* method append()
+Write `rec` to the log and sync it, compacting the log once enough records
+have been appended.  A failed compaction is logged and the log carries on
+growing until the next one.
+*/
+func (l *writeAheadLog) append(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if l.records++; l.records >= l.compactAfter {
+		if err := l.lockedCompact(); err != nil {
+			log.Printf("Error compacting write-ahead log %s: %v", l.path, err)
+		}
+	}
+	return nil
+}
+
+/* method lockedCompact()
+Replace the log with one holding just the state it records, swapping the
+file appended to.  The caller must hold mtx, so no record lands in the
+file being replaced.
+*/
+func (l *writeAheadLog) lockedCompact() error {
+	st, err := replayWAL(l.path)
+	if err != nil {
+		return err
+	}
+	if err := writeWAL(l.path, st); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file, l.records = f, 0
+	return nil
+}
+
+func (l *writeAheadLog) Close() error {
+	return l.file.Close()
+}
+
+// State recovered from a log
+type walState struct {
+	// Jobs waiting for a worker, and jobs already hashed waiting out their
+	// delay
+	tasks map[string]walTask
+	jobs  map[string]pendingJob
+	// Results still stored
+	results map[string]StoredResult
+	// Deleted results still restorable, and the Ids held
+	deleted map[string]deletedResult
+	holds   map[string]bool
+}
+
+/* method replayWAL()
+Read the log at `path`, returning the jobs still pending and the results
+still stored when it was last written.  A final record cut short by a
+crash is ignored; any other unreadable record is an error.
+*/
+func replayWAL(path string) (walState, error) {
+	st := walState{
+		tasks:   make(map[string]walTask),
+		jobs:    make(map[string]pendingJob),
+		results: make(map[string]StoredResult),
+		deleted: make(map[string]deletedResult),
+		holds:   make(map[string]bool),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return walState{}, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Ignoring incomplete final record %d of %s", n, path)
+			}
+			break
+		} else if err != nil {
+			return walState{}, err
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return walState{}, fmt.Errorf("record %d: %w", n, err)
+		}
+		switch rec.Op {
+		case walQueue:
+			if rec.Task != nil {
+				st.tasks[rec.ID] = *rec.Task
+			}
+		case walAccept:
+			if rec.Job != nil {
+				st.jobs[rec.ID] = *rec.Job
+			}
+		case walPut:
+			delete(st.tasks, rec.ID)
+			delete(st.jobs, rec.ID)
+			if rec.Result != nil {
+				st.results[rec.ID] = *rec.Result
+			}
+		case walDelete:
+			delete(st.results, rec.ID)
+		case walDone:
+			delete(st.tasks, rec.ID)
+			delete(st.jobs, rec.ID)
+		case walDeleted:
+			if rec.Result != nil {
+				st.deleted[rec.ID] = newDeletedResult(*rec.Result, rec.At)
+			}
+		case walForget:
+			delete(st.deleted, rec.ID)
+		case walHold:
+			if rec.Hold {
+				st.holds[rec.ID] = true
+			} else {
+				delete(st.holds, rec.ID)
+			}
+		default:
+			return walState{}, fmt.Errorf("record %d: unknown operation %q", n, rec.Op)
+		}
+	}
+	return st, nil
+}
+
+/* method writeWAL()
+Replace the log at `path` with one holding just the state in `st`,
+written beside it and renamed into place so a crash leaves one or the
+other
+*/
+func writeWAL(path string, st walState) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for id, result := range st.results {
+			if err := enc.Encode(walRecord{Op: walPut, ID: id, Result: &result}); err != nil {
+				return err
+			}
+		}
+		for id, task := range st.tasks {
+			if err := enc.Encode(walRecord{Op: walQueue, ID: id, Task: &task}); err != nil {
+				return err
+			}
+		}
+		for id, job := range st.jobs {
+			if err := enc.Encode(walRecord{Op: walAccept, ID: id, Job: &job}); err != nil {
+				return err
+			}
+		}
+		for id, d := range st.deleted {
+			result := d.result()
+			if err := enc.Encode(walRecord{Op: walDeleted, ID: id, Result: &result, At: d.At}); err != nil {
+				return err
+			}
+		}
+		for id := range st.holds {
+			if err := enc.Encode(walRecord{Op: walHold, ID: id, Hold: true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* method compactWAL()
+Replace the log at `path` with one holding just the state in `st` and open
+it for appending, to be compacted again every `compactAfter` records
+*/
+func compactWAL(path string, st walState, compactAfter int) (*writeAheadLog, error) {
+	if err := writeWAL(path, st); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: f, path: path, compactAfter: compactAfter}, nil
+}
+
+/* method openWAL()
+Recover the state in the configured log: results go back in the store,
+after the legal holds so eviction passes over the held ones, deleted
+results go back in the deleted set until their recovery window ends, jobs
+acknowledged before a crash go back to the worker pool, or are rescheduled
+if they were hashed already, and the request counter carries on past every
+Id seen.  The log is then compacted and new records appended
+to it.  Without encryption keys the log is refused unless
+Config.WALPlaintext accepts keeping passwords in the clear.
+*/
+func (s *Server) openWAL() error {
+	path := s.config.WALPath
+	if s.sealer == nil && !s.config.WALPlaintext {
+		return errWALPlaintext
+	}
+	st, err := replayWAL(path)
+	if err != nil {
+		return err
+	}
+	compactAfter := s.config.WALCompactRecords
+	if compactAfter <= 0 {
+		compactAfter = DefaultWALCompactRecords
+	}
+	if s.wal, err = compactWAL(path, st, compactAfter); err != nil {
+		return err
+	}
+	if s.sealer == nil {
+		log.Printf("Warning: %s keeps the passwords of pending jobs in the clear without encryption keys", path)
+	}
+	results, jobs := st.results, st.jobs
+
+	var highest int64
+	noteID := func(id string) {
+		if n, ok := idSequence(id); ok {
+			highest = max(highest, n)
+		}
+	}
+	for id := range results {
+		noteID(id)
+	}
+	for id := range jobs {
+		noteID(id)
+	}
+	for id := range st.tasks {
+		noteID(id)
+	}
+	s.mtxId.Lock()
+	s.requestID = max(s.requestID, highest)
+	s.mtxId.Unlock()
+
+	s.mtxMap.Lock()
+	for id := range st.holds {
+		if s.retentionStore != nil {
+			if err := s.retentionStore.SetHold(id, true); err != nil {
+				s.mtxMap.Unlock()
+				return err
+			}
+		}
+		s.legalHolds[id] = true
+	}
+	for id, d := range st.deleted {
+		result, err := s.sealer.openResult(d.result())
+		if err != nil {
+			s.mtxMap.Unlock()
+			return fmt.Errorf("deleted result %s: %w", id, err)
+		}
+		if s.retentionStore != nil {
+			if err := s.retentionStore.PutDeleted(id, d.result(), d.At); err != nil {
+				s.mtxMap.Unlock()
+				return err
+			}
+		}
+		s.deletedResults[id] = newDeletedResult(result, d.At)
+	}
+	for id, result := range results {
+		result, err := s.sealer.openResult(result)
+		if err != nil {
+			s.mtxMap.Unlock()
+			return fmt.Errorf("result %s: %w", id, err)
+		}
+		if err := s.store.Put(id, result); err != nil {
+			s.mtxMap.Unlock()
+			return err
+		}
+		s.lockedTouch(id)
+	}
+	s.lockedEvict()
+	for id, job := range jobs {
+		s.pendingJobs[id] = job
+	}
+	s.mtxMap.Unlock()
+	for id, job := range jobs {
+		s.schedulePending(id, job)
+	}
+	for id, d := range st.deleted {
+		s.schedulePurge(id, d.At)
+	}
+	for id, task := range st.tasks {
+		if err := s.recoverTask(id, task); err != nil {
+			return fmt.Errorf("job %s: %w", id, err)
+		}
+	}
+	log.Printf("Recovered %d results and %d pending jobs from %s", len(results), len(jobs)+len(st.tasks), path)
+	return nil
+}
+
+/* method newWALTask()
+Record a job for the log before it goes to the worker pool
+*/
+func (s *Server) newWALTask(c correlation, pword string, opts jobOptions) walTask {
+	t := walTask{
+		Password:    s.sealer.seal(pword),
+		Discard:     !opts.store,
+		Format:      opts.Format,
+		User:        opts.User,
+		Rounds:      opts.Rounds,
+		Algorithm:   opts.Algorithm,
+		PepperID:    opts.pepperID,
+		ScryptN:     opts.scrypt.N,
+		ScryptR:     opts.scrypt.R,
+		ScryptP:     opts.scrypt.P,
+		CallbackURL: opts.callbackURL,
+		Priority:    opts.priority,
+		Submitted:   opts.submitted,
+		Due:         s.clock.Now().Add(opts.delay).UnixNano(),
+		Delay:       int64(opts.delay),
+		RequestID:   c.RequestID,
+		TraceID:     c.TraceID,
+	}
+	if len(opts.Salt) > 0 {
+		t.Salt = s.sealer.seal(base64.StdEncoding.EncodeToString(opts.Salt))
+	}
+	return t
+}
+
+// A job recovered from the log, waiting for the worker pool to start
+type walResumed struct {
+	id   string
+	pw   string
+	opts jobOptions
+	c    correlation
+	due  int64
+}
+
+/* method recoverTask()
+Rebuild job `id`, logged before a crash but not hashed, and count it as
+pending until resumeTasks puts it back in the worker pool.  A job peppered
+with a pepper since replaced is hashed with the current one.
+*/
+func (s *Server) recoverTask(id string, t walTask) error {
+	pw, err := s.sealer.open(t.Password)
+	if err != nil {
+		return err
+	}
+	opts := jobOptions{
+		store:       !t.Discard,
+		Options:     hasher.Options{Format: t.Format, User: t.User, Rounds: t.Rounds, Algorithm: t.Algorithm},
+		scrypt:      hasher.ScryptHasher{N: t.ScryptN, R: t.ScryptR, P: t.ScryptP},
+		callbackURL: t.CallbackURL,
+		submitted:   t.Submitted,
+		priority:    t.Priority,
+		delay:       time.Duration(t.Delay),
+		delaySet:    true,
+	}
+	if msg := s.selectAlgorithm(&opts); len(msg) > 0 {
+		return errors.New(msg)
+	}
+	if opts.Format == hasher.FormatSHA512 {
+		salt, err := s.sealer.open(t.Salt)
+		if err != nil {
+			return err
+		}
+		if opts.Salt, err = base64.StdEncoding.DecodeString(salt); err != nil {
+			return err
+		}
+		p := s.currentPepper()
+		if len(t.PepperID) > 0 && t.PepperID != p.ID {
+			log.Printf("Request Id %s was peppered with %s, hashing it with %s", id, t.PepperID, p.ID)
+		}
+		opts.Pepper, opts.pepperID = p.Secret, p.ID
+	}
+
+	s.mtxMap.Lock()
+	s.jobsPending++
+	s.jobStates[id] = JobState{Status: StatusPending, Submitted: opts.submitted, Delay: int64(opts.delay)}
+	s.lockedShareJobState(id, s.jobStates[id])
+	s.mtxMap.Unlock()
+	s.walResumed = append(s.walResumed, walResumed{id: id, pw: pw, opts: opts, c: correlation{RequestID: t.RequestID, TraceID: t.TraceID}, due: t.Due})
+	return nil
+}
+
+/* method resumeTasks()
+Hand the jobs recovered from the log to the worker pool, each to run at its
+original due time
+*/
+func (s *Server) resumeTasks() {
+	for _, job := range s.walResumed {
+		ctx := context.WithValue(context.Background(), correlationKey{}, job.c)
+		var cancel context.CancelFunc
+		if s.config.JobTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, s.config.JobTimeout)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+		s.submitJob(ctx, cancel, "", job.id, job.pw, job.opts, time.Unix(0, job.due).Sub(s.clock.Now()))
+	}
+	s.walResumed = nil
+}
+
+/* method walAppend()
+Log `rec` if a write-ahead log is kept.  Failures are logged, as the
+change has already been made.
+*/
+func (s *Server) walAppend(rec walRecord) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.append(rec); err != nil {
+		log.Printf("Error writing %s record for %s to write-ahead log: %v", rec.Op, rec.ID, err)
+	}
+}
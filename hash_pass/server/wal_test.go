@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRecords writes `recs` to a new log in a temporary directory,
+// followed by `tail` as it is, and returns the log's path
+func writeRecords(t *testing.T, tail string, recs ...walRecord) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			t.Fatalf("encoding %+v: %v", rec, err)
+		}
+	}
+	buf.WriteString(tail)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("writing log: %v", err)
+	}
+	return path
+}
+
+// walHistory is a log touching every kind of state, and walHistoryState
+// what it leaves
+var walHistory = []walRecord{
+	{Op: walQueue, ID: "queued", Task: &walTask{Password: "pw1", Submitted: 1, Due: 2}},
+	{Op: walAccept, ID: "accepted", Job: &pendingJob{Hash: "hash1", Submitted: 1, Due: 3}},
+	{Op: walQueue, ID: "hashed", Task: &walTask{Password: "pw2"}},
+	{Op: walPut, ID: "hashed", Result: &StoredResult{Hash: "hash2"}},
+	{Op: walAccept, ID: "dropped", Job: &pendingJob{Hash: "hash3"}},
+	{Op: walDone, ID: "dropped"},
+	{Op: walPut, ID: "removed", Result: &StoredResult{Hash: "hash4"}},
+	{Op: walDelete, ID: "removed"},
+	{Op: walDeleted, ID: "removed", Result: &StoredResult{Hash: "hash4"}, At: 5},
+	{Op: walDeleted, ID: "restored", Result: &StoredResult{Hash: "hash5"}, At: 6},
+	{Op: walForget, ID: "restored"},
+	{Op: walHold, ID: "hashed", Hold: true},
+	{Op: walHold, ID: "released", Hold: true},
+	{Op: walHold, ID: "released"},
+}
+
+var walHistoryState = walState{
+	tasks:   map[string]walTask{"queued": {Password: "pw1", Submitted: 1, Due: 2}},
+	jobs:    map[string]pendingJob{"accepted": {Hash: "hash1", Submitted: 1, Due: 3}},
+	results: map[string]StoredResult{"hashed": {Hash: "hash2"}},
+	deleted: map[string]deletedResult{"removed": newDeletedResult(StoredResult{Hash: "hash4"}, 5)},
+	holds:   map[string]bool{"hashed": true},
+}
+
+func checkWALState(t *testing.T, got, want walState) {
+	t.Helper()
+	if !reflect.DeepEqual(got.tasks, want.tasks) {
+		t.Errorf("tasks = %+v, want %+v", got.tasks, want.tasks)
+	}
+	if !reflect.DeepEqual(got.jobs, want.jobs) {
+		t.Errorf("jobs = %+v, want %+v", got.jobs, want.jobs)
+	}
+	if !reflect.DeepEqual(got.results, want.results) {
+		t.Errorf("results = %+v, want %+v", got.results, want.results)
+	}
+	if !reflect.DeepEqual(got.deleted, want.deleted) {
+		t.Errorf("deleted = %+v, want %+v", got.deleted, want.deleted)
+	}
+	if !reflect.DeepEqual(got.holds, want.holds) {
+		t.Errorf("holds = %v, want %v", got.holds, want.holds)
+	}
+}
+
+func TestReplayWAL(t *testing.T) {
+	// Jobs waiting for a worker come back as tasks and jobs already hashed
+	// as accepted jobs, until a result or the end of the job is recorded
+	st, err := replayWAL(writeRecords(t, "", walHistory...))
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+	checkWALState(t, st, walHistoryState)
+
+	st, err = replayWAL(filepath.Join(t.TempDir(), "missing.log"))
+	if err != nil || len(st.tasks)+len(st.jobs)+len(st.results)+len(st.deleted)+len(st.holds) != 0 {
+		t.Errorf("replay of a missing log = %+v, %v, want an empty state", st, err)
+	}
+}
+
+func TestReplayWALTruncated(t *testing.T) {
+	// A crash part way through the last record loses only that record
+	for _, tail := range []string{`{"op":"put","id":"late","res`, `{"op":"put","id":"late"}`, "   "} {
+		st, err := replayWAL(writeRecords(t, tail, walHistory...))
+		if err != nil {
+			t.Fatalf("replayWAL with final record %q: %v", tail, err)
+		}
+		checkWALState(t, st, walHistoryState)
+	}
+
+	// Damage before the end isn't mistaken for a crash
+	path := writeRecords(t, "", walHistory[:1]...)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append(append(data, `{"op":"put","id":"torn"`+"\n"...), data...), 0600)
+	if _, err := replayWAL(path); err == nil || !strings.HasPrefix(err.Error(), "record 2:") {
+		t.Errorf("replay of a log with a damaged record returned %v, want an error at record 2", err)
+	}
+	if _, err := replayWAL(writeRecords(t, "", walRecord{Op: "rename", ID: "a"})); err == nil || !strings.Contains(err.Error(), `"rename"`) {
+		t.Errorf("replay of an unknown operation returned %v", err)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading log: %v", err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestCompactWAL(t *testing.T) {
+	path := writeRecords(t, "", walHistory...)
+	st, err := replayWAL(path)
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	// Compacting keeps one record for each thing still recorded
+	l, err := compactWAL(path, st, 3)
+	if err != nil {
+		t.Fatalf("compactWAL: %v", err)
+	}
+	defer func() { l.Close() }()
+	if n := countLines(t, path); n != 5 {
+		t.Errorf("compacted log holds %d records, want 5", n)
+	}
+	compacted, err := replayWAL(path)
+	if err != nil {
+		t.Fatalf("replay of the compacted log: %v", err)
+	}
+	checkWALState(t, compacted, walHistoryState)
+
+	// The log is compacted again as the third record is appended, and
+	// carries on being appended to after
+	for _, rec := range []walRecord{
+		{Op: walPut, ID: "queued", Result: &StoredResult{Hash: "hash1"}},
+		{Op: walDone, ID: "accepted"},
+		{Op: walForget, ID: "removed"},
+		{Op: walHold, ID: "queued", Hold: true},
+	} {
+		if err := l.append(rec); err != nil {
+			t.Fatalf("append(%+v): %v", rec, err)
+		}
+	}
+	if n := countLines(t, path); n != 4 {
+		t.Errorf("log holds %d records after compacting and one more, want 4", n)
+	}
+	st, err = replayWAL(path)
+	if err != nil {
+		t.Fatalf("replay after appending: %v", err)
+	}
+	checkWALState(t, st, walState{
+		tasks:   map[string]walTask{},
+		jobs:    map[string]pendingJob{},
+		results: map[string]StoredResult{"hashed": {Hash: "hash2"}, "queued": {Hash: "hash1"}},
+		deleted: map[string]deletedResult{},
+		holds:   map[string]bool{"hashed": true, "queued": true},
+	})
+}
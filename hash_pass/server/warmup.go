@@ -0,0 +1,75 @@
+/*********************************************************
+File: warmup.go
+Contents: Warm-up at startup and the readiness endpoint
+*********************************************************/
+
+package server
+
+import (
+	"fmt"
+	"hash_pass/hasher"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* method preallocate()
+Create the in-memory store, unless another Store was given, sized up front
+so it doesn't have to grow under load
+*/
+func (s *Server) preallocate() {
+	if s.store == nil {
+		s.store = NewMemoryStore(s.config.PreallocResults)
+	}
+}
+
+/* method warmUp()
+Run the configured number of calibration hashes with the configured
+algorithm, salted like real jobs, so the first burst of them doesn't pay
+for cold caches, then mark the server ready
+*/
+func (s *Server) warmUp() {
+	if s.config.WarmupHashes > 0 {
+		opts := jobOptions{Options: hasher.Options{Format: hasher.FormatSHA512}}
+		s.selectAlgorithm(&opts)
+		salt, err := hasher.RandomSalt(saltSize)
+		if err != nil {
+			log.Printf("Error generating salt: %v", err)
+		}
+		opts.Salt = salt
+		opts.Pepper = s.currentPepper().Secret
+		start, n := time.Now(), 0
+		for ; n < s.config.WarmupHashes; n++ {
+			if _, err := hasher.Hash(strconv.Itoa(n), opts.Options); err != nil {
+				log.Printf("Warm-up: Error hashing with %s: %v", opts.Algorithm, err)
+				break
+			}
+		}
+		if n > 0 {
+			elapsed := time.Since(start)
+			log.Printf("Warm-up: %d calibration %s hashes, %v average", n, opts.Algorithm, elapsed/time.Duration(n))
+		}
+	}
+	s.bReady.Store(true)
+	s.runHooks(&s.readyHooks)
+}
+
+/*
+	method doReady()
+	Report whether the service has warmed up and should receive traffic
+*/
+func (s *Server) doReady(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	if !s.bReady.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrNotReady)
+		return
+	}
+	_, err := fmt.Fprint(w, MsgHealthy)
+	if err != nil {
+		log.Printf("Error sending HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,452 @@
+/*********************************************************
+File: websocket.go
+Contents: WebSocket subscriptions pushing results as jobs complete
+*********************************************************/
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Appended to the client's key to prove the server speaks RFC 6455
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Frame opcodes
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// Close status codes
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+
+	// Largest message a client may send, and most jobs it may follow at once
+	wsMaxMessage       = 4096
+	wsMaxSubscriptions = 100
+
+	// Time between pings, how long a client may stay silent before it is
+	// considered gone, and how long to wait for a write or for the client
+	// to answer our close
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 2 * wsPingInterval
+	wsWriteWait    = 10 * time.Second
+	wsCloseWait    = time.Second
+)
+
+var (
+	errWSProtocol = errors.New("websocket protocol error")
+	errWSTooBig   = errors.New("websocket message too big")
+	errWSBinary   = errors.New("websocket binary message")
+	errWSClosed   = errors.New("websocket closed")
+)
+
+// Message a client sends to follow jobs
+type wsSubscribe struct {
+	Subscribe []TaskID `json:"subscribe"`
+}
+
+// Message pushed to a client: the job's final state, or the code of the
+// error that stopped it being followed, without an Id for a bad message
+type wsNotice struct {
+	*HashResult
+	Error string `json:"error,omitempty"`
+}
+
+// A client connection, taken over from the HTTP server
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// Closed once the close handshake has started
+	done      chan struct{}
+	closeOnce sync.Once
+	// Jobs followed, protected by mtxSubs
+	subs    map[TaskID]bool
+	mtxSubs sync.Mutex
+	// Set once our close frame is sent, protected by mtxWrite
+	closed   bool
+	mtxWrite sync.Mutex
+}
+
+/* method wsAccept()
+Return the Sec-WebSocket-Accept value answering `key`
+*/
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+/* method headerHasToken()
+Report whether a comma separated header such as Connection lists `token`
+*/
+func headerHasToken(r *http.Request, name, token string) bool {
+	for _, v := range r.Header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* method wsOriginAllowed()
+Report whether the page that opened the socket may, so another site can't
+have its visitors' browsers follow jobs on their behalf.  Requests without
+an Origin don't come from a browser page and are allowed.
+*/
+func (s *Server) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.config.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+/* method writeFrame()
+Send one unfragmented frame.  Nothing more is sent after a close frame.
+*/
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mtxWrite.Lock()
+	defer c.mtxWrite.Unlock()
+	if c.closed {
+		return errWSClosed
+	}
+	c.closed = opcode == wsClose
+
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+/* method readFrame()
+Read one frame from the client, which must be masked, and unmask it
+*/
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		return fin, opcode, nil, errWSProtocol
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (!fin || n > 125) {
+		return fin, opcode, nil, errWSProtocol
+	}
+	if n > wsMaxMessage {
+		return fin, opcode, nil, errWSTooBig
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+/* method readMessage()
+Return the next text message, answering pings and reassembling fragments
+on the way.  Returns io.EOF once the client has sent a close frame.
+*/
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		select {
+		case <-c.done:
+		default:
+			c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.closeWith(code, "")
+			return nil, io.EOF
+		case wsBinary:
+			return nil, errWSBinary
+		case wsText:
+			if message != nil {
+				return nil, errWSProtocol
+			}
+			message = []byte{}
+		case wsContinuation:
+			if message == nil {
+				return nil, errWSProtocol
+			}
+		default:
+			return nil, errWSProtocol
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return nil, errWSTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+/* method closeWith()
+Start the close handshake, giving the client a moment to answer before the
+connection is dropped
+*/
+func (c *wsConn) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.writeFrame(wsClose, append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...))
+		c.conn.SetReadDeadline(time.Now().Add(wsCloseWait))
+	})
+}
+
+/* method send()
+Push a notice to the client as a text message
+*/
+func (c *wsConn) send(notice wsNotice) error {
+	jtext, _ := json.Marshal(notice)
+	return c.writeFrame(wsText, jtext)
+}
+
+/* method keepAlive()
+Ping the client until the connection closes, so dead peers and idle
+proxies are noticed
+*/
+func (c *wsConn) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.writeFrame(wsPing, nil) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+/* method subscribe()
+Follow job `id` for the client, pushing its result once it completes
+*/
+func (s *Server) subscribe(c *wsConn, id TaskID) {
+	c.mtxSubs.Lock()
+	if c.subs[id] {
+		c.mtxSubs.Unlock()
+		return
+	}
+	if len(c.subs) >= wsMaxSubscriptions {
+		c.mtxSubs.Unlock()
+		c.send(wsNotice{HashResult: &HashResult{ID: id}, Error: "too_many_subscriptions"})
+		return
+	}
+	c.subs[id] = true
+	c.mtxSubs.Unlock()
+
+	result, status, changed := s.watchJob(string(id))
+	if len(status) == 0 {
+		c.mtxSubs.Lock()
+		delete(c.subs, id)
+		c.mtxSubs.Unlock()
+		c.send(wsNotice{HashResult: &HashResult{ID: id}, Error: errorCodes[ErrInvalidId]})
+		return
+	}
+	go func() {
+		defer func() {
+			c.mtxSubs.Lock()
+			delete(c.subs, id)
+			c.mtxSubs.Unlock()
+		}()
+		for changed != nil {
+			select {
+			case <-changed:
+			case <-c.done:
+				return
+			}
+			result, status, changed = s.watchJob(string(id))
+		}
+		notice := wsNotice{HashResult: &HashResult{ID: id, Status: StatusGone}}
+		if status == StatusComplete {
+			*notice.HashResult = hashResult(string(id), status, result)
+		}
+		c.send(notice)
+	}()
+}
+
+/* method closeWebSockets()
+Close every WebSocket connection as the server goes away
+*/
+func (s *Server) closeWebSockets() {
+	s.mtxMap.Lock()
+	conns := make([]*wsConn, 0, len(s.webSockets))
+	for c := range s.webSockets {
+		conns = append(conns, c)
+	}
+	s.mtxMap.Unlock()
+	for _, c := range conns {
+		c.closeWith(wsCloseGoingAway, "server shutting down")
+	}
+}
+
+/*
+	method webSocket()
+	Handle GET request for URL path `/ws`, upgrading to a WebSocket on
+	which the client subscribes to jobs with `{"subscribe": [ids]}` messages
+	or `id` query parameters, and is pushed each job's result when it
+	completes
+*/
+func (s *Server) webSocket(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 ||
+		!headerHasToken(r, "Connection", "upgrade") || !headerHasToken(r, "Upgrade", "websocket") {
+		renderError(w, r, http.StatusBadRequest, ErrWebSocket)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		renderError(w, r, http.StatusUpgradeRequired, ErrWebSocket)
+		return
+	}
+	if !s.wsOriginAllowed(r) {
+		log.Printf("WebSocket from %s refused for origin %q", s.clientLabel(r), r.Header.Get("Origin"))
+		renderError(w, r, http.StatusForbidden, ErrWSOrigin)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Error taking over connection for WebSocket: %v", err)
+		renderError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err != nil {
+		return
+	}
+
+	c := &wsConn{conn: conn, br: brw.Reader, done: make(chan struct{}), subs: make(map[TaskID]bool)}
+	s.mtxMap.Lock()
+	s.webSockets[c] = true
+	s.mtxMap.Unlock()
+	defer func() {
+		s.mtxMap.Lock()
+		delete(s.webSockets, c)
+		s.mtxMap.Unlock()
+	}()
+	log.Printf("WebSocket opened by %s", s.clientLabel(r))
+
+	go c.keepAlive()
+	for _, id := range r.URL.Query()["id"] {
+		s.subscribe(c, TaskID(id))
+	}
+	for {
+		message, err := c.readMessage()
+		switch {
+		case err == nil:
+		case errors.Is(err, errWSProtocol):
+			c.closeWith(wsCloseProtocol, "")
+			return
+		case errors.Is(err, errWSTooBig):
+			c.closeWith(wsCloseTooBig, "")
+			return
+		case errors.Is(err, errWSBinary):
+			c.closeWith(wsCloseUnsupported, "text messages only")
+			return
+		default:
+			c.closeWith(wsCloseNormal, "")
+			return
+		}
+
+		var sub wsSubscribe
+		if err := json.Unmarshal(message, &sub); err != nil || len(sub.Subscribe) == 0 {
+			c.send(wsNotice{Error: errorCodes[ErrSubscribe]})
+			continue
+		}
+		for _, id := range sub.Subscribe {
+			s.subscribe(c, id)
+		}
+	}
+}
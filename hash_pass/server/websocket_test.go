@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufConn is a connection reading from `in` and writing to `out`
+type bufConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *bufConn) SetReadDeadline(time.Time) error    { return nil }
+func (c *bufConn) SetWriteDeadline(time.Time) error   { return nil }
+func (c *bufConn) SetDeadline(t time.Time) error      { return nil }
+func (c *bufConn) Close() error                       { return nil }
+func (c *bufConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *bufConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *bufConn) withInput(frames ...[]byte) *wsConn { return newTestWSConn(c, frames...) }
+
+func newTestWSConn(c *bufConn, frames ...[]byte) *wsConn {
+	c.in = bytes.NewReader(bytes.Join(frames, nil))
+	return &wsConn{conn: c, br: bufio.NewReader(c), done: make(chan struct{}), subs: make(map[TaskID]bool)}
+}
+
+// clientFrame encodes a frame as a client sends it, masked with `mask`
+// unless it is nil
+func clientFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	b := opcode
+	if fin {
+		b |= 0x80
+	}
+	frame := []byte{b}
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, maskBit|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, maskBit|127), uint64(n))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+var testMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+func TestWSAccept(t *testing.T) {
+	// From RFC 6455 section 1.3
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wsAccept() = %s", got)
+	}
+}
+
+func TestWSWriteFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		head []byte
+	}{
+		{"short", 5, []byte{0x81, 5}},
+		{"largest short", 125, []byte{0x81, 125}},
+		{"16 bit length", 126, []byte{0x81, 126, 0, 126}},
+		{"largest 16 bit length", 0xffff, []byte{0x81, 126, 0xff, 0xff}},
+		{"64 bit length", 0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &bufConn{}
+			c := newTestWSConn(conn)
+			payload := bytes.Repeat([]byte("x"), tc.size)
+			if err := c.writeFrame(wsText, payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			// Server frames are never masked
+			want := append(append([]byte{}, tc.head...), payload...)
+			if got := conn.out.Bytes(); !bytes.Equal(got, want) {
+				t.Errorf("frame starts % x, want % x", got[:min(len(got), 10)], tc.head)
+			}
+		})
+	}
+
+	conn := &bufConn{}
+	c := newTestWSConn(conn)
+	if err := c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal)); err != nil {
+		t.Fatalf("writing close frame: %v", err)
+	}
+	if err := c.writeFrame(wsText, []byte("late")); err != errWSClosed {
+		t.Errorf("write after close frame returned %v, want errWSClosed", err)
+	}
+	if got, want := conn.out.Bytes(), []byte{0x88, 2, 0x03, 0xe8}; !bytes.Equal(got, want) {
+		t.Errorf("sent % x, want only the close frame % x", got, want)
+	}
+}
+
+func TestWSReadFrame(t *testing.T) {
+	long := bytes.Repeat([]byte("y"), 300)
+	for _, tc := range []struct {
+		name    string
+		frame   []byte
+		fin     bool
+		opcode  byte
+		payload []byte
+		err     error
+	}{
+		{"masked text", clientFrame(true, wsText, []byte("hello"), testMask), true, wsText, []byte("hello"), nil},
+		{"empty", clientFrame(true, wsText, nil, testMask), true, wsText, []byte{}, nil},
+		{"16 bit length", clientFrame(true, wsText, long, testMask), true, wsText, long, nil},
+		{"fragment", clientFrame(false, wsText, []byte("hel"), testMask), false, wsText, []byte("hel"), nil},
+		{"unmasked", clientFrame(true, wsText, []byte("hello"), nil), true, wsText, nil, errWSProtocol},
+		{"reserved bit", append([]byte{0xc1}, clientFrame(true, wsText, []byte("x"), testMask)[1:]...), true, wsText, nil, errWSProtocol},
+		{"fragmented control", clientFrame(false, wsPing, nil, testMask), false, wsPing, nil, errWSProtocol},
+		{"long control", clientFrame(true, wsPing, bytes.Repeat([]byte("p"), 126), testMask), true, wsPing, nil, errWSProtocol},
+		{"too big", clientFrame(true, wsText, bytes.Repeat([]byte("z"), wsMaxMessage+1), testMask), true, wsText, nil, errWSTooBig},
+		{"64 bit length too big", []byte{0x81, 0x80 | 127, 0, 0, 0, 1, 0, 0, 0, 0}, true, wsText, nil, errWSTooBig},
+		{"truncated", clientFrame(true, wsText, []byte("hello"), testMask)[:8], true, wsText, nil, io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := (&bufConn{}).withInput(tc.frame)
+			fin, opcode, payload, err := c.readFrame()
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("readFrame error %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil || fin != tc.fin || opcode != tc.opcode || !bytes.Equal(payload, tc.payload) {
+				t.Errorf("readFrame() = %v, %#x, %q, %v, want %v, %#x, %q", fin, opcode, payload, err, tc.fin, tc.opcode, tc.payload)
+			}
+		})
+	}
+}
+
+func TestWSReadMessage(t *testing.T) {
+	half := bytes.Repeat([]byte("h"), wsMaxMessage/2+1)
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		want   string
+		err    error
+	}{
+		{"single frame", [][]byte{clientFrame(true, wsText, []byte("hello"), testMask)}, "hello", nil},
+		{"fragmented", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), testMask),
+			clientFrame(false, wsContinuation, []byte("l"), testMask),
+			clientFrame(true, wsContinuation, []byte("o"), testMask),
+		}, "hello", nil},
+		{"ping between fragments", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), testMask),
+			clientFrame(true, wsPing, []byte("are you there"), testMask),
+			clientFrame(true, wsPong, nil, testMask),
+			clientFrame(true, wsContinuation, []byte("lo"), testMask),
+		}, "hello", nil},
+		{"continuation first", [][]byte{clientFrame(true, wsContinuation, []byte("lo"), testMask)}, "", errWSProtocol},
+		{"text inside a fragmented message", [][]byte{
+			clientFrame(false, wsText, []byte("hel"), testMask),
+			clientFrame(true, wsText, []byte("lo"), testMask),
+		}, "", errWSProtocol},
+		{"binary", [][]byte{clientFrame(true, wsBinary, []byte{1, 2}, testMask)}, "", errWSBinary},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil, testMask)}, "", errWSProtocol},
+		{"fragments too big together", [][]byte{
+			clientFrame(false, wsText, half, testMask),
+			clientFrame(true, wsContinuation, half, testMask),
+		}, "", errWSTooBig},
+		{"close", [][]byte{clientFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), testMask)}, "", io.EOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := (&bufConn{}).withInput(tc.frames...)
+			message, err := c.readMessage()
+			if tc.err != nil {
+				if err != tc.err {
+					t.Fatalf("readMessage error %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil || string(message) != tc.want {
+				t.Errorf("readMessage() = %q, %v, want %q", message, err, tc.want)
+			}
+		})
+	}
+
+	// Pings are answered with a pong carrying the same payload, and a
+	// client's close is answered with its code
+	conn := &bufConn{}
+	c := conn.withInput(
+		clientFrame(true, wsPing, []byte("ping"), testMask),
+		clientFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), testMask))
+	if _, err := c.readMessage(); err != io.EOF {
+		t.Fatalf("readMessage error %v, want EOF", err)
+	}
+	want := append([]byte{0x8a, 4}, "ping"...)
+	want = append(want, 0x88, 2, 0x03, 0xe9)
+	if got := conn.out.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("sent % x, want % x", got, want)
+	}
+}
+
+func TestWSOriginAllowed(t *testing.T) {
+	s := &Server{config: Config{WSAllowedOrigins: []string{"https://app.example.com"}}}
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://hash.example.com", true},
+		{"http://HASH.example.com", true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://evil.example.net", false},
+		{"https://hash.example.com.evil.example.net", false},
+		{"null", false},
+		{"://bad", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://hash.example.com"+WebSocketPath, nil)
+		if len(tc.origin) > 0 {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := s.wsOriginAllowed(r); got != tc.want {
+			t.Errorf("wsOriginAllowed(%q) = %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
+
+// upgradeRequest returns a WebSocket upgrade of `url` sent from a page of
+// `origin`
+func upgradeRequest(url, origin string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Origin", origin)
+	return r
+}
+
+func TestWebSocketCrossOrigin(t *testing.T) {
+	s, err := NewServer(Config{Workers: 1, WSAllowedOrigins: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, upgradeRequest("http://hash.example.com"+WebSocketPath, "https://evil.example.net"))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin upgrade got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if len(rec.Header().Get("Sec-WebSocket-Accept")) > 0 {
+		t.Error("refused upgrade was accepted")
+	}
+
+	// An allowed origin is switched over
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := upgradeRequest(ts.URL+WebSocketPath, "https://app.example.com").Write(conn); err != nil {
+		t.Fatalf("sending upgrade: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("allowed upgrade got %s with accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("Upgrade header %q", resp.Header.Get("Upgrade"))
+	}
+}
@@ -0,0 +1,554 @@
+/*********************************************************
+File: workers.go
+Contents: Bounded pool of workers hashing the jobs whose delay has passed
+*********************************************************/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"hash_pass/hasher"
+	"log"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const (
+	// Largest pool /admin/workers resizes to unless another is configured
+	DefaultMaxWorkers = 1024
+)
+
+var (
+	// Reason given for the jobs still pending when a shutdown stops
+	// waiting for them
+	errDrainTimeout = errors.New("shutdown drain timed out")
+)
+
+// A job accepted on this node, waiting out its delay or for a worker
+type queuedJob struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	id     string
+	pw     string
+	opts   jobOptions
+	span   *sentry.Span
+	// Client that submitted the job, which takes turns with the others
+	client string
+	// Fires when the delay has passed, putting the job in the queue
+	timer Timer
+	// When the job was queued, in Unix nanoseconds
+	readyAt int64
+	// Set by a cancel that raced with the timer firing
+	cancelled bool
+	// Retries made after the job failed
+	attempts int
+}
+
+// Workers taking jobs from a queue once their delay has passed
+type workerPool struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// Jobs whose delay has passed
+	ready readyQueue
+	// Jobs waiting out their delay or queued, by Id, until a worker takes them
+	byID map[string]*queuedJob
+	// Workers wanted, running and hashing a job.  Running exceeds size
+	// while workers let go by a resize finish their job.
+	size    int
+	running int
+	busy    int
+	// Set while an operator has paused processing, so jobs are accepted
+	// and queued but no worker takes them
+	paused bool
+	// Jobs taken from the queue and the nanoseconds they spent in it, in
+	// total and by priority
+	started      int64
+	waited       int64
+	levelStarted []int64
+	levelWaited  []int64
+	// The same at the autoscaler's last decision, and its decisions
+	scaledStarted int64
+	scaledWaited  int64
+	scaleUps      int64
+	scaleDowns    int64
+}
+
+// Jobs of a priority queued for a worker, taken from the queue and their
+// average wait in it
+type PriorityStat struct {
+	Queued    int     `json:"queued"`
+	Started   int64   `json:"started"`
+	QueueWait float64 `json:"queue_wait"`
+}
+
+// Size of the worker pool, and how many are busy and queued for one.
+// Running exceeds Size until the workers let go by a resize stop.
+type WorkerStat struct {
+	Size    int  `json:"size"`
+	Running int  `json:"running"`
+	Busy    int  `json:"busy"`
+	Queued  int  `json:"queued"`
+	Paused  bool `json:"paused"`
+	// Clients with jobs queued, which take turns
+	Clients int `json:"clients"`
+	// Jobs workers have taken from the queue and their average wait in it
+	Started   int64   `json:"started"`
+	QueueWait float64 `json:"queue_wait"`
+	// The same by priority
+	Priorities map[string]PriorityStat `json:"priorities"`
+	// The autoscaler, when it is on
+	Autoscale *AutoscaleStat `json:"autoscale,omitempty"`
+}
+
+/* method workerCount()
+Return the initial size of the worker pool, one worker per CPU unless
+configured, within the autoscaler's bounds when it is on
+*/
+func (s *Server) workerCount() int {
+	n := runtime.NumCPU()
+	if s.config.Workers > 0 {
+		n = s.config.Workers
+	}
+	if lo, hi, ok := s.autoscaleBounds(); ok {
+		n = min(max(n, lo), hi)
+	}
+	return n
+}
+
+/* method startWorkers()
+Start the worker pool.  Jobs sleep on a timer rather than a goroutine of
+their own, so a burst of requests costs no more goroutines than there are
+workers.
+*/
+func (s *Server) startWorkers() {
+	p := &s.workers
+	p.cond = sync.NewCond(&p.mtx)
+	p.ready = newReadyQueue(s.priorityAging())
+	p.byID = make(map[string]*queuedJob)
+	p.levelStarted = make([]int64, len(priorities))
+	p.levelWaited = make([]int64, len(priorities))
+	s.resizeWorkers(s.workerCount())
+}
+
+/* method resizeWorkers()
+Change the size of the pool.  New workers start at once, and workers beyond
+the new size stop when they next look for a job, so a job in progress is
+never cut short.
+*/
+func (s *Server) resizeWorkers(n int) {
+	p := &s.workers
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.size = n
+	for p.running < p.size {
+		p.running++
+		go s.work()
+	}
+	p.cond.Broadcast()
+}
+
+/* method pauseWorkers()
+Stop workers taking jobs from the queue, or let them again, reporting
+whether that changed anything.  Jobs being hashed when the pool is paused
+carry on to completion.
+*/
+func (s *Server) pauseWorkers(paused bool) bool {
+	p := &s.workers
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	p.cond.Broadcast()
+	return true
+}
+
+/* method workersPaused()
+Report whether processing is paused
+*/
+func (s *Server) workersPaused() bool {
+	p := &s.workers
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.paused
+}
+
+/* method work()
+Hash jobs from the queue as they become ready, until the pool shrinks
+*/
+func (s *Server) work() {
+	p := &s.workers
+	for {
+		p.mtx.Lock()
+		for (p.ready.len() == 0 || p.paused) && p.running <= p.size {
+			p.cond.Wait()
+		}
+		if p.running > p.size {
+			p.running--
+			p.mtx.Unlock()
+			return
+		}
+		now := s.clock.Now()
+		job := p.ready.pop(now)
+		delete(p.byID, job.id)
+		wait := now.UnixNano() - job.readyAt
+		p.busy++
+		p.started++
+		p.waited += wait
+		p.levelStarted[job.opts.priority]++
+		p.levelWaited[job.opts.priority] += wait
+		p.mtx.Unlock()
+
+		s.runJob(job)
+
+		p.mtx.Lock()
+		p.busy--
+		p.mtx.Unlock()
+	}
+}
+
+/* method submitJob()
+Queue the job for a worker once `wait` has passed, or abandon it if its
+context ends first
+*/
+func (s *Server) submitJob(ctx context.Context, cancel context.CancelFunc, client string, id string, pw string, opts jobOptions, wait time.Duration) {
+	p := &s.workers
+	job := &queuedJob{ctx: ctx, cancel: cancel, id: id, pw: pw, opts: opts, span: startJobSpan(ctx, id), client: client}
+	p.mtx.Lock()
+	p.byID[id] = job
+	job.timer = s.clock.AfterFunc(wait, func() { s.queueJob(job) })
+	p.mtx.Unlock()
+	context.AfterFunc(ctx, func() {
+		// Once queued, the worker taking the job sees its context ended
+		p.mtx.Lock()
+		_, waiting := p.byID[id]
+		stopped := waiting && job.timer.Stop()
+		if stopped {
+			delete(p.byID, id)
+		}
+		p.mtx.Unlock()
+		if stopped {
+			s.endJob(job, ctx.Err())
+		}
+	})
+}
+
+/* method queueJob()
+Put a job whose delay or retry backoff has passed in the queue, unless it
+was cancelled while the timer fired
+*/
+func (s *Server) queueJob(job *queuedJob) {
+	p := &s.workers
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !job.cancelled {
+		job.readyAt = s.clock.Now().UnixNano()
+		p.ready.push(job)
+		p.cond.Signal()
+	}
+}
+
+/* method runJob()
+- Abandon the job if its context ended while it was queued
+- Hash the password in the requested format and store the result using
+  the job's Id as key, unless the options say not to keep it
+- Retry the job if either fails, or give up on it once it is out of retries
+*/
+func (s *Server) runJob(job *queuedJob) {
+	if err := job.ctx.Err(); err != nil {
+		s.endJob(job, err)
+		return
+	}
+	job.opts.started = s.clock.Now().UnixNano()
+	s.markProcessing(job.id, job.opts.started)
+
+	c := requestCorrelation(job.ctx)
+	result, err := hasher.Hash(job.pw, job.opts.Options)
+	if err == nil {
+		err = s.storeResult(job.id, job.opts.result(result), job.opts.store, c)
+	}
+	if err != nil {
+		if !s.retryJob(job, err) {
+			s.failJob(job.id, err, job.attempts+1, c)
+			s.finishJob(job, err)
+		}
+		return
+	}
+	if len(job.opts.callbackURL) > 0 {
+		s.sendCallback(job.opts.callbackURL, job.id, job.opts.result(result), c)
+	}
+	s.countOutcome(OutcomeCompleted)
+	s.endJob(job, nil)
+}
+
+/* method endJob()
+Account for a job that completed, or abandon it on `err`
+*/
+func (s *Server) endJob(job *queuedJob, err error) {
+	if err != nil {
+		s.abandonJob(job.id, err, requestCorrelation(job.ctx))
+	}
+	s.finishJob(job, err)
+}
+
+/* method finishJob()
+Close the trace span and context of a job that has ended and stop counting
+it as pending
+*/
+func (s *Server) finishJob(job *queuedJob, err error) {
+	if err != nil && !errors.Is(err, errDrainTimeout) {
+		// Don't resume it on restart
+		s.walAppend(walRecord{Op: walDone, ID: job.id})
+	}
+	finishJobSpan(job.span, err)
+	job.cancel()
+	s.mtxMap.Lock()
+	s.jobsPending--
+	s.lockedCheckDrained()
+	s.mtxMap.Unlock()
+}
+
+/* method lockedQueueDepth()
+Return the number of jobs on this node waiting to complete, local or
+replicated.  The caller must hold mtxMap.
+*/
+func (s *Server) lockedQueueDepth() int64 {
+	return s.jobsPending + int64(len(s.pendingJobs))
+}
+
+/* method lockedCheckDrained()
+Release a drain waiting for the jobs on this node once none are left.  The
+caller must hold mtxMap.
+*/
+func (s *Server) lockedCheckDrained() {
+	if s.jobsDrained != nil && s.lockedQueueDepth() == 0 {
+		close(s.jobsDrained)
+		s.jobsDrained = nil
+	}
+}
+
+/* method waitForJobs()
+Wait until no job on this node is waiting out its delay or being hashed,
+whether local or replicated, or until `ctx` ends.  Jobs are counted as
+they are accepted and complete rather than derived from the results
+stored, which are expired, deleted and handed between nodes.
+*/
+func (s *Server) waitForJobs(ctx context.Context) error {
+	for {
+		s.mtxMap.Lock()
+		if s.lockedQueueDepth() == 0 {
+			s.mtxMap.Unlock()
+			return nil
+		}
+		if s.jobsDrained == nil {
+			s.jobsDrained = make(chan struct{})
+		}
+		drained := s.jobsDrained
+		s.mtxMap.Unlock()
+
+		select {
+		case <-drained:
+			// Check again, a job may have been handed over since
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/* method abandonRemaining()
+Give up on the jobs left on this node once a shutdown stops waiting for
+them.  Jobs no worker has taken are abandoned and added to the dead-letter
+list, which the snapshot keeps when one is configured.  Replicated jobs are
+left to resume on restart from the write-ahead log, raft log or snapshot,
+and are dead letters too when there's none of those.
+*/
+func (s *Server) abandonRemaining() {
+	p := &s.workers
+	p.mtx.Lock()
+	queued := make([]*queuedJob, 0, len(p.byID))
+	for id, job := range p.byID {
+		delete(p.byID, id)
+		job.cancelled = true
+		if !job.timer.Stop() && job.readyAt > 0 {
+			p.ready.remove(job)
+		}
+		queued = append(queued, job)
+	}
+	p.mtx.Unlock()
+
+	var abandoned, hashing, replicated []string
+	for _, job := range queued {
+		// The write-ahead log resumes them on restart
+		if s.wal != nil {
+			replicated = append(replicated, job.id)
+		} else {
+			abandoned = append(abandoned, job.id)
+			s.recordDeadLetter(job.id, DeadLetterJob, errDrainTimeout, job.attempts, requestCorrelation(job.ctx))
+		}
+		s.endJob(job, errDrainTimeout)
+	}
+	resumable := s.wal != nil || s.raftNode != nil || len(s.config.SnapshotPath) > 0
+	s.mtxMap.Lock()
+	for id, state := range s.jobStates {
+		if state.Status == StatusProcessing {
+			hashing = append(hashing, id)
+		}
+	}
+	jobs := make(map[string]pendingJob, len(s.pendingJobs))
+	for id, job := range s.pendingJobs {
+		replicated = append(replicated, id)
+		jobs[id] = job
+	}
+	s.mtxMap.Unlock()
+	if !resumable {
+		for id, job := range jobs {
+			s.recordDeadLetter(id, DeadLetterJob, errDrainTimeout, 0, correlation{RequestID: job.RequestID, TraceID: job.TraceID})
+		}
+	}
+
+	logIds := func(msg string, ids []string) {
+		if len(ids) > 0 {
+			slices.SortFunc(ids, compareIDs)
+			log.Printf("Shutdown: %s %d jobs: %s", msg, len(ids), strings.Join(ids, ", "))
+		}
+	}
+	logIds("Abandoned", abandoned)
+	logIds("Abandoned while hashing", hashing)
+	if resumable {
+		logIds("Left to resume on restart", replicated)
+	} else {
+		logIds("Abandoned replicated", replicated)
+	}
+}
+
+/* method queueFull()
+Report whether this node has MaxQueueDepth jobs waiting, so a POST must be
+refused until some complete
+*/
+func (s *Server) queueFull() bool {
+	if s.config.MaxQueueDepth <= 0 {
+		return false
+	}
+	s.mtxMap.Lock()
+	defer s.mtxMap.Unlock()
+	return s.lockedQueueDepth() >= int64(s.config.MaxQueueDepth)
+}
+
+/* method workerStats()
+Return the size of the pool and how busy it is
+*/
+func (s *Server) workerStats() *WorkerStat {
+	p := &s.workers
+	p.mtx.Lock()
+	stat := &WorkerStat{Size: p.size, Running: p.running, Busy: p.busy, Queued: p.ready.len(), Paused: p.paused, Clients: p.ready.clients(), Started: p.started,
+		Priorities: make(map[string]PriorityStat, len(priorities))}
+	if p.started > 0 {
+		stat.QueueWait = float64(p.waited) / float64(p.started)
+	}
+	for level, name := range priorities {
+		ps := PriorityStat{Queued: p.ready.lanes[level].n, Started: p.levelStarted[level]}
+		if ps.Started > 0 {
+			ps.QueueWait = float64(p.levelWaited[level]) / float64(ps.Started)
+		}
+		stat.Priorities[name] = ps
+	}
+	p.mtx.Unlock()
+	stat.Autoscale = s.autoscaleStats()
+	return stat
+}
+
+/* method workerReport()
+Return the state of the pool with its queue wait in microseconds, as /stats
+reports it unless asked otherwise
+*/
+func (s *Server) workerReport() *WorkerStat {
+	return RequestStat{Unit: UnitNanoseconds, Workers: s.workerStats()}.inUnit(UnitMicroseconds).Workers
+}
+
+/*
+	method getWorkers()
+	Return a JSON object with the size of the worker pool and how busy it is
+*/
+func (s *Server) getWorkers(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.workerReport())
+}
+
+/* method maxWorkers()
+Return the largest pool /admin/workers may resize to
+*/
+func (s *Server) maxWorkers() int {
+	if s.config.MaxWorkers > 0 {
+		return s.config.MaxWorkers
+	}
+	return DefaultMaxWorkers
+}
+
+/*
+	method setWorkers()
+	Resize the worker pool to the `size` form field, at most the
+	configured maximum, so operators can respond to load without a
+	restart, and return its new state
+*/
+func (s *Server) setWorkers(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	n, err := strconv.Atoi(r.FormValue(SizeKey))
+	if err != nil || n < 1 {
+		renderError(w, r, http.StatusBadRequest, ErrWorkers)
+		return
+	} else if n > s.maxWorkers() {
+		renderError(w, r, http.StatusBadRequest, ErrWorkersMax)
+		return
+	}
+	s.resizeWorkers(n)
+	log.Printf("AUDIT: Worker pool resized to %d by %s", n, s.clientLabel(r))
+	writeJSON(w, r, http.StatusOK, s.workerReport())
+}
+
+/*
+	method pauseProcessing()
+	Handle POST request for URL path `/admin/workers/pause`, holding the
+	queued jobs during backend maintenance while still accepting new ones,
+	and return the state of the pool
+*/
+func (s *Server) pauseProcessing(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	if s.pauseWorkers(true) {
+		log.Printf("AUDIT: Job processing paused by %s", s.clientLabel(r))
+	}
+	writeJSON(w, r, http.StatusOK, s.workerReport())
+}
+
+/*
+	method resumeProcessing()
+	Handle POST request for URL path `/admin/workers/resume`, letting the
+	workers take the queued jobs again, and return the state of the pool
+*/
+func (s *Server) resumeProcessing(w http.ResponseWriter, r *http.Request) {
+	if s.bShutdown.Load() {
+		renderError(w, r, http.StatusServiceUnavailable, ErrShutdown)
+		return
+	}
+	if s.pauseWorkers(false) {
+		log.Printf("AUDIT: Job processing resumed by %s", s.clientLabel(r))
+	}
+	writeJSON(w, r, http.StatusOK, s.workerReport())
+}